@@ -0,0 +1,132 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Audited actions.
+const (
+	AuditWriteNode      = "write-node"
+	AuditWriteNodeData  = "write-node-data"
+	AuditRemoveNodeData = "remove-node-data"
+	AuditRemoveNode     = "remove-node"
+	AuditRenameNode     = "rename-node"
+	AuditLogin          = "login"
+	AuditLogout         = "logout"
+	AuditChangePassword = "change-password"
+	AuditWriteUser      = "write-user"
+)
+
+// AuditActor identifies who is making changes.
+type AuditActor struct {
+	// User is the login of the user or empty for changes not made on
+	// behalf of a user.
+	User string
+	// IP is the client's IP address.
+	IP string
+}
+
+// AuditEntry records a change of content or accounts.
+type AuditEntry struct {
+	Time time.Time
+	Site string
+	AuditActor
+	// Action is one of the Audit* constants.
+	Action string
+	// Path of the affected node, if any.
+	Path string
+	// Details about the change, e.g. the changed file or the target of
+	// a rename.
+	Details string
+}
+
+// AuditFilter selects audit entries.
+type AuditFilter struct {
+	// User selects entries of the given user.
+	User string
+	// Path selects entries of the given node and its descendants.
+	Path string
+	// Since and Until select entries in the given time span. Zero
+	// values are ignored.
+	Since, Until time.Time
+	// Limit is the maximum number of entries to return, keeping the
+	// most recent ones. Zero means no limit.
+	Limit int
+}
+
+// Match checks if the filter selects the given entry.
+func (f *AuditFilter) Match(entry *AuditEntry) bool {
+	if len(f.User) > 0 && entry.User != f.User {
+		return false
+	}
+	if path := strings.TrimSuffix(f.Path, "/"); len(path) > 0 &&
+		entry.Path != path && !strings.HasPrefix(entry.Path, path+"/") {
+		return false
+	}
+	if !f.Since.IsZero() && entry.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && entry.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// WriteAuditEntry appends the given entry to the site's audit log.
+//
+// If the entry has no time, the current time will be used. If it has
+// no user nor IP, the client's Actor will be used.
+func (s *MonstiClient) WriteAuditEntry(site string, entry *AuditEntry) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := *entry
+	args.Site = site
+	if args.Time.IsZero() {
+		args.Time = time.Now().UTC()
+	}
+	if args.AuditActor == (AuditActor{}) {
+		args.AuditActor = s.Actor
+	}
+	if err := s.RPCClient.Call("Monsti.WriteAuditEntry", &args, new(int)); err != nil {
+		return fmt.Errorf("service: WriteAuditEntry error: %v", err)
+	}
+	return nil
+}
+
+// GetAuditEntries returns the site's audit entries selected by the
+// given filter, oldest first.
+func (s *MonstiClient) GetAuditEntries(site string, filter *AuditFilter) (
+	[]*AuditEntry, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct {
+		Site   string
+		Filter AuditFilter
+	}{site, *filter}
+	var reply []*AuditEntry
+	err := s.RPCClient.Call("Monsti.GetAuditEntries", &args, &reply)
+	if err != nil {
+		return nil, fmt.Errorf("service: GetAuditEntries error: %v", err)
+	}
+	return reply, nil
+}
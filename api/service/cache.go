@@ -0,0 +1,114 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"fmt"
+	"time"
+)
+
+// CacheEntry describes data cached for a node.
+type CacheEntry struct {
+	// Node is the path of the node and Id the id of the cached data.
+	Node, Id string
+	// Size is the size of the cache file in bytes.
+	Size int64
+	// Modified is the time the data has been cached.
+	Modified time.Time
+	// Expire is the expiration time of the data, if any.
+	Expire time.Time
+	// Deps are the dependencies of the data, i.e. the data will be
+	// removed if one of them gets marked.
+	Deps []CacheDep
+}
+
+// Age returns the time since the data has been cached.
+func (e CacheEntry) Age() time.Duration {
+	return time.Since(e.Modified)
+}
+
+// Expired returns true if the data has expired.
+func (e CacheEntry) Expired() bool {
+	return !e.Expire.IsZero() && e.Expire.Before(time.Now())
+}
+
+// CacheFilter selects cache entries of a site.
+//
+// The zero value selects the entries of the root node. To select all
+// entries of a site, set Descend.
+type CacheFilter struct {
+	// Node is the path of the node whose entries are selected.
+	Node string
+	// Descend selects the entries of all nodes below Node, too.
+	Descend bool
+	// Pattern selects the entries whose ids match the given shell
+	// pattern (see path.Match), e.g. "core.page.*".
+	Pattern string
+}
+
+// GetCacheEntries returns the cache entries of the given site matching
+// the filter, ordered by node and id.
+func (s *MonstiClient) GetCacheEntries(site string, filter *CacheFilter) (
+	[]CacheEntry, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct {
+		Site   string
+		Filter CacheFilter
+	}{site, *filter}
+	var reply []CacheEntry
+	if err := s.RPCClient.Call("Monsti.GetCacheEntries", &args, &reply); err != nil {
+		return nil, fmt.Errorf("service: GetCacheEntries error: %v", err)
+	}
+	return reply, nil
+}
+
+// PurgeCache removes the cache entries of the given site matching the
+// filter.
+//
+// Returns the number of removed entries.
+func (s *MonstiClient) PurgeCache(site string, filter *CacheFilter) (
+	int, error) {
+	if s.Error != nil {
+		return 0, s.Error
+	}
+	args := struct {
+		Site   string
+		Filter CacheFilter
+	}{site, *filter}
+	var reply int
+	if err := s.RPCClient.Call("Monsti.PurgeCache", &args, &reply); err != nil {
+		return 0, fmt.Errorf("service: PurgeCache error: %v", err)
+	}
+	return reply, nil
+}
+
+// WarmCache fills the cache of the given site by requesting all
+// published nodes.
+//
+// Returns the number of successfully requested pages.
+func (s *MonstiClient) WarmCache(site string) (int, error) {
+	if s.Error != nil {
+		return 0, s.Error
+	}
+	var reply int
+	if err := s.RPCClient.Call("Monsti.WarmCache", site, &reply); err != nil {
+		return 0, fmt.Errorf("service: WarmCache error: %v", err)
+	}
+	return reply, nil
+}
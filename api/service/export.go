@@ -0,0 +1,36 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import "fmt"
+
+// ExportSite renders all published nodes of the given site along with
+// files, images, and static files into the given directory on the
+// host running Monsti. The directory must be absolute.
+//
+// Returns the number of exported files.
+func (s *MonstiClient) ExportSite(site, dir string) (int, error) {
+	if s.Error != nil {
+		return 0, s.Error
+	}
+	args := struct{ Site, Dir string }{site, dir}
+	var reply int
+	if err := s.RPCClient.Call("Monsti.ExportSite", &args, &reply); err != nil {
+		return 0, fmt.Errorf("service: ExportSite error: %v", err)
+	}
+	return reply, nil
+}
@@ -0,0 +1,621 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"fmt"
+	"html/template"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// ValidatingField is implemented by fields which validate their
+// values after being loaded from the edit form.
+type ValidatingField interface {
+	Field
+	// Validate returns an error message in the given locale if the
+	// value is not valid for the given field. Otherwise, it returns
+	// the empty string.
+	Validate(field *NodeField, locale string) string
+}
+
+// FieldOption is an option of Select and MultiSelect fields.
+type FieldOption struct {
+	// Value is the stored value of the option. It must not contain
+	// dots.
+	Value string
+	// The name of the option as shown in the web interface,
+	// specified as a translation map (language -> msg).
+	Name map[string]string
+}
+
+// GetLocalName returns the name of the option in the given language.
+//
+// Falls back to the "en" locale or the value of the option.
+func (o FieldOption) GetLocalName(locale string) string {
+	name, ok := o.Name[locale]
+	if !ok {
+		name, ok = o.Name["en"]
+	}
+	if !ok {
+		name = o.Value
+	}
+	return name
+}
+
+// checkRange checks if the value is in the range of the given
+// field.
+func checkRange(value float64, field *NodeField, locale string) string {
+	if field.Min == field.Max {
+		return ""
+	}
+	if value < field.Min || value > field.Max {
+		G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+		return fmt.Sprintf(G("Please enter a value between %v and %v."),
+			field.Min, field.Max)
+	}
+	return ""
+}
+
+// IntegerField is an integer number.
+type IntegerField int
+
+func (t IntegerField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t IntegerField) String() string {
+	return strconv.Itoa(int(t))
+}
+
+func (t IntegerField) RenderHTML() interface{} {
+	return t.String()
+}
+
+func (t *IntegerField) Load(f func(interface{}) error) error {
+	return f(t)
+}
+
+func (t IntegerField) Dump() interface{} {
+	return int(t)
+}
+
+func (t IntegerField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	data.Set(field.Id, int(t))
+	form.AddWidget(new(htmlwidgets.IntegerWidget), "Fields."+field.Id,
+		field.Name[locale], "")
+}
+
+func (t *IntegerField) FromFormField(data util.NestedMap, field *NodeField) {
+	*t = IntegerField(data.Get(field.Id).(int))
+}
+
+func (t IntegerField) Validate(field *NodeField, locale string) string {
+	return checkRange(float64(t), field, locale)
+}
+
+// DecimalField is a decimal number.
+type DecimalField float64
+
+func (t DecimalField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t DecimalField) String() string {
+	return strconv.FormatFloat(float64(t), 'f', -1, 64)
+}
+
+func (t DecimalField) RenderHTML() interface{} {
+	return t.String()
+}
+
+func (t *DecimalField) Load(f func(interface{}) error) error {
+	return f(t)
+}
+
+func (t DecimalField) Dump() interface{} {
+	return float64(t)
+}
+
+func (t DecimalField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+	data.Set(field.Id, t.String())
+	form.AddWidget(&htmlwidgets.TextWidget{
+		MinLength:       1,
+		Regexp:          `^-?[0-9]+(\.[0-9]+)?$`,
+		ValidationError: G("Please enter a number.")},
+		"Fields."+field.Id, field.Name[locale], "")
+}
+
+func (t *DecimalField) FromFormField(data util.NestedMap, field *NodeField) {
+	value, _ := strconv.ParseFloat(data.Get(field.Id).(string), 64)
+	*t = DecimalField(value)
+}
+
+func (t DecimalField) Validate(field *NodeField, locale string) string {
+	return checkRange(float64(t), field, locale)
+}
+
+// BooleanField is either true or false.
+type BooleanField bool
+
+func (t BooleanField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t BooleanField) String() string {
+	return strconv.FormatBool(bool(t))
+}
+
+func (t BooleanField) RenderHTML() interface{} {
+	return t.String()
+}
+
+func (t *BooleanField) Load(f func(interface{}) error) error {
+	return f(t)
+}
+
+func (t BooleanField) Dump() interface{} {
+	return bool(t)
+}
+
+func (t BooleanField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	data.Set(field.Id, bool(t))
+	form.AddWidget(new(htmlwidgets.BoolWidget), "Fields."+field.Id,
+		field.Name[locale], "")
+}
+
+func (t *BooleanField) FromFormField(data util.NestedMap, field *NodeField) {
+	*t = BooleanField(data.Get(field.Id).(bool))
+}
+
+// SelectField holds one of the options of the field.
+type SelectField string
+
+func (t SelectField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t SelectField) String() string {
+	return string(t)
+}
+
+func (t SelectField) RenderHTML() interface{} {
+	return t.String()
+}
+
+func (t *SelectField) Load(f func(interface{}) error) error {
+	return f(t)
+}
+
+func (t SelectField) Dump() interface{} {
+	return string(t)
+}
+
+func (t SelectField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	data.Set(field.Id, string(t))
+	options := make([]htmlwidgets.SelectOption, 0, len(field.Options)+1)
+	if !field.Required {
+		options = append(options, htmlwidgets.SelectOption{Value: "", Text: "-"})
+	}
+	for _, option := range field.Options {
+		options = append(options, htmlwidgets.SelectOption{
+			Value: option.Value, Text: option.GetLocalName(locale)})
+	}
+	form.AddWidget(&htmlwidgets.SelectWidget{Options: options},
+		"Fields."+field.Id, field.Name[locale], "")
+}
+
+func (t *SelectField) FromFormField(data util.NestedMap, field *NodeField) {
+	*t = SelectField(data.Get(field.Id).(string))
+}
+
+// isOption checks if the value is an option of the given field.
+func isOption(value string, field *NodeField) bool {
+	for _, option := range field.Options {
+		if option.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (t SelectField) Validate(field *NodeField, locale string) string {
+	G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+	if len(t) == 0 {
+		if field.Required {
+			return G("Required.")
+		}
+		return ""
+	}
+	if !isOption(string(t), field) {
+		return G("Please choose one of the options.")
+	}
+	return ""
+}
+
+// MultiSelectField holds any number of the options of the field.
+type MultiSelectField []string
+
+func (t MultiSelectField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t MultiSelectField) String() string {
+	return strings.Join(t, ", ")
+}
+
+func (t MultiSelectField) RenderHTML() interface{} {
+	return t.String()
+}
+
+func (t *MultiSelectField) Load(f func(interface{}) error) error {
+	return f(t)
+}
+
+func (t MultiSelectField) Dump() interface{} {
+	if t == nil {
+		return []string{}
+	}
+	return []string(t)
+}
+
+// Has checks if the given option is selected.
+func (t MultiSelectField) Has(value string) bool {
+	for _, selected := range t {
+		if selected == value {
+			return true
+		}
+	}
+	return false
+}
+
+// The options are shown as a group of checkboxes, one for each
+// option.
+func (t MultiSelectField) ToFormField(form *htmlwidgets.Form,
+	data util.NestedMap, field *NodeField, locale string) {
+	for _, option := range field.Options {
+		data.Set(field.Id+"."+option.Value, t.Has(option.Value))
+		form.AddWidget(new(htmlwidgets.BoolWidget),
+			"Fields."+field.Id+"."+option.Value,
+			field.Name[locale]+": "+option.GetLocalName(locale), "")
+	}
+}
+
+func (t *MultiSelectField) FromFormField(data util.NestedMap,
+	field *NodeField) {
+	*t = MultiSelectField{}
+	for _, option := range field.Options {
+		if selected, _ := data.Get(field.Id + "." + option.Value).(bool); selected {
+			*t = append(*t, option.Value)
+		}
+	}
+}
+
+func (t MultiSelectField) Validate(field *NodeField, locale string) string {
+	G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+	if field.Required && len(t) == 0 {
+		return G("Please choose at least one option.")
+	}
+	for _, value := range t {
+		if !isOption(value, field) {
+			return G("Please choose one of the options.")
+		}
+	}
+	return ""
+}
+
+var emailRegexp = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+// EmailField is an email address.
+type EmailField string
+
+func (t EmailField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t EmailField) String() string {
+	return string(t)
+}
+
+func (t EmailField) RenderHTML() interface{} {
+	if len(t) == 0 {
+		return ""
+	}
+	escaped := template.HTMLEscapeString(string(t))
+	return template.HTML(fmt.Sprintf(`<a href="mailto:%v">%v</a>`, escaped,
+		escaped))
+}
+
+func (t *EmailField) Load(f func(interface{}) error) error {
+	return f(t)
+}
+
+func (t EmailField) Dump() interface{} {
+	return string(t)
+}
+
+func (t EmailField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	data.Set(field.Id, string(t))
+	form.AddWidget(new(htmlwidgets.TextWidget), "Fields."+field.Id,
+		field.Name[locale], "")
+}
+
+func (t *EmailField) FromFormField(data util.NestedMap, field *NodeField) {
+	*t = EmailField(strings.TrimSpace(data.Get(field.Id).(string)))
+}
+
+func (t EmailField) Validate(field *NodeField, locale string) string {
+	G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+	if len(t) == 0 {
+		if field.Required {
+			return G("Required.")
+		}
+		return ""
+	}
+	if !emailRegexp.MatchString(string(t)) {
+		return G("Please enter a valid email address.")
+	}
+	return ""
+}
+
+// URLField is an absolute HTTP(S) URL or an absolute path on the
+// site.
+type URLField string
+
+func (t URLField) Init(*MonstiClient, string) error {
+	return nil
+}
+
+func (t URLField) String() string {
+	return string(t)
+}
+
+func (t URLField) RenderHTML() interface{} {
+	if len(t) == 0 {
+		return ""
+	}
+	escaped := template.HTMLEscapeString(string(t))
+	return template.HTML(fmt.Sprintf(`<a href="%v">%v</a>`, escaped, escaped))
+}
+
+func (t *URLField) Load(f func(interface{}) error) error {
+	return f(t)
+}
+
+func (t URLField) Dump() interface{} {
+	return string(t)
+}
+
+func (t URLField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	data.Set(field.Id, string(t))
+	form.AddWidget(new(htmlwidgets.TextWidget), "Fields."+field.Id,
+		field.Name[locale], "")
+}
+
+func (t *URLField) FromFormField(data util.NestedMap, field *NodeField) {
+	*t = URLField(strings.TrimSpace(data.Get(field.Id).(string)))
+}
+
+func (t URLField) Validate(field *NodeField, locale string) string {
+	G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+	if len(t) == 0 {
+		if field.Required {
+			return G("Required.")
+		}
+		return ""
+	}
+	parsed, err := url.Parse(string(t))
+	valid := err == nil && ((parsed.Scheme == "http" ||
+		parsed.Scheme == "https") && len(parsed.Host) > 0 ||
+		len(parsed.Scheme) == 0 && len(parsed.Host) == 0 &&
+			strings.HasPrefix(parsed.Path, "/"))
+	if !valid {
+		return G("Please enter a valid URL, e.g. http://example.com/.")
+	}
+	return ""
+}
+
+// ReferenceField references another node of the site by its path.
+type ReferenceField struct {
+	Path   string
+	monsti *MonstiClient
+	site   string
+}
+
+func (t *ReferenceField) Init(m *MonstiClient, site string) error {
+	t.monsti = m
+	t.site = site
+	return nil
+}
+
+func (t ReferenceField) String() string {
+	return t.Path
+}
+
+// RenderHTML returns a link to the referenced node using its title.
+func (t ReferenceField) RenderHTML() interface{} {
+	if len(t.Path) == 0 {
+		return ""
+	}
+	title := t.Path
+	if node, err := t.Node(); err == nil && node != nil &&
+		node.Fields["core.Title"] != nil {
+		title = node.Fields["core.Title"].String()
+	}
+	href := path.Clean(t.Path)
+	if href != "/" {
+		href += "/"
+	}
+	return template.HTML(fmt.Sprintf(`<a href="%v">%v</a>`,
+		template.HTMLEscapeString(href), template.HTMLEscapeString(title)))
+}
+
+// Node returns the referenced node or nil.
+func (t ReferenceField) Node() (*Node, error) {
+	if len(t.Path) == 0 || t.monsti == nil {
+		return nil, nil
+	}
+	return t.monsti.GetNode(t.site, t.Path)
+}
+
+func (t *ReferenceField) Load(f func(interface{}) error) error {
+	return f(&t.Path)
+}
+
+func (t ReferenceField) Dump() interface{} {
+	return t.Path
+}
+
+// maxReferenceNodes is the maximum number of nodes visited to find the
+// nodes which may be referenced by a field.
+const maxReferenceNodes = 1000
+
+// referenceRoot returns the path of the subtree containing the nodes
+// which may be referenced by the given field.
+func referenceRoot(field *NodeField) string {
+	return path.Clean("/" + field.Root)
+}
+
+// referenceCandidates returns the paths and titles of the nodes that
+// may be referenced by the given field.
+//
+// At most maxReferenceNodes nodes below the field's root are visited.
+func (t ReferenceField) referenceCandidates(field *NodeField) (
+	[][2]string, error) {
+	var candidates [][2]string
+	visited := 0
+	var walk func(nodePath string) error
+	walk = func(nodePath string) error {
+		children, err := t.monsti.GetChildren(t.site, nodePath)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if visited >= maxReferenceNodes {
+				return nil
+			}
+			visited++
+			if len(field.NodeTypes) == 0 || isNodeTypeOf(child.Type.Id,
+				field.NodeTypes) {
+				title := child.Path
+				if child.Fields["core.Title"] != nil {
+					title = child.Fields["core.Title"].String()
+				}
+				candidates = append(candidates, [2]string{child.Path, title})
+			}
+			if err := walk(child.Path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := walk(referenceRoot(field))
+	return candidates, err
+}
+
+// isNodeTypeOf checks if the given node type id matches one of the
+// given ids or namespaces (e.g. "core.").
+func isNodeTypeOf(id string, types []string) bool {
+	for _, nodeType := range types {
+		if nodeType == id || nodeType == "." ||
+			strings.HasSuffix(nodeType, ".") && strings.HasPrefix(id, nodeType) {
+			return true
+		}
+	}
+	return false
+}
+
+// The picker lists the nodes which may be referenced, see
+// referenceCandidates. The currently referenced node is always listed.
+func (t ReferenceField) ToFormField(form *htmlwidgets.Form,
+	data util.NestedMap, field *NodeField, locale string) {
+	data.Set(field.Id, t.Path)
+	options := []htmlwidgets.SelectOption{}
+	if !field.Required {
+		options = append(options, htmlwidgets.SelectOption{Value: "", Text: "-"})
+	}
+	if t.monsti != nil {
+		candidates, err := t.referenceCandidates(field)
+		if err != nil {
+			candidates = nil
+		}
+		listed := len(t.Path) == 0
+		for _, candidate := range candidates {
+			listed = listed || candidate[0] == t.Path
+		}
+		if !listed {
+			candidates = append(candidates, [2]string{t.Path, t.Path})
+		}
+		sort.Sort(referenceCandidates(candidates))
+		for _, candidate := range candidates {
+			options = append(options, htmlwidgets.SelectOption{
+				Value: candidate[0],
+				Text:  fmt.Sprintf("%v (%v)", candidate[1], candidate[0])})
+		}
+	}
+	form.AddWidget(&htmlwidgets.SelectWidget{Options: options},
+		"Fields."+field.Id, field.Name[locale], "")
+}
+
+type referenceCandidates [][2]string
+
+func (r referenceCandidates) Len() int           { return len(r) }
+func (r referenceCandidates) Less(i, j int) bool { return r[i][0] < r[j][0] }
+func (r referenceCandidates) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+func (t *ReferenceField) FromFormField(data util.NestedMap, field *NodeField) {
+	t.Path = data.Get(field.Id).(string)
+}
+
+func (t ReferenceField) Validate(field *NodeField, locale string) string {
+	G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+	if len(t.Path) == 0 {
+		if field.Required {
+			return G("Required.")
+		}
+		return ""
+	}
+	root := referenceRoot(field)
+	if target := path.Clean(t.Path); root != "/" && target != root &&
+		!strings.HasPrefix(target, root+"/") {
+		return G("This node may not be referenced here.")
+	}
+	node, err := t.Node()
+	if err != nil || t.monsti != nil && node == nil {
+		return G("The referenced node does not exist.")
+	}
+	if node != nil && len(field.NodeTypes) > 0 &&
+		!isNodeTypeOf(node.Type.Id, field.NodeTypes) {
+		return G("This node may not be referenced here.")
+	}
+	return ""
+}
@@ -0,0 +1,189 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"html/template"
+	"reflect"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestFieldsJSON(t *testing.T) {
+	nodeType := NodeType{
+		Id: "foo.Bar",
+		Fields: []*NodeField{
+			{Id: "foo.Integer", Type: "Integer"},
+			{Id: "foo.Decimal", Type: "Decimal"},
+			{Id: "foo.Boolean", Type: "Boolean"},
+			{Id: "foo.Select", Type: "Select"},
+			{Id: "foo.MultiSelect", Type: "MultiSelect"},
+			{Id: "foo.Email", Type: "Email"},
+			{Id: "foo.URL", Type: "URL"},
+			{Id: "foo.Reference", Type: "Reference"},
+		}}
+	data := []byte(`{"Type": "foo.Bar", "Fields": {"foo": {
+    "Integer": 42, "Decimal": 1.5, "Boolean": true, "Select": "a",
+    "MultiSelect": ["a", "c"], "Email": "foo@example.com",
+    "URL": "http://example.com/", "Reference": "/foo/bar"}}}`)
+	node, err := dataToNode(data,
+		func(string) (*NodeType, error) { return &nodeType, nil }, nil, "")
+	if err != nil {
+		t.Fatalf("Could not convert data to node: %v", err)
+	}
+	expected := map[string]interface{}{
+		"foo.Integer":     42,
+		"foo.Decimal":     1.5,
+		"foo.Boolean":     true,
+		"foo.Select":      "a",
+		"foo.MultiSelect": []string{"a", "c"},
+		"foo.Email":       "foo@example.com",
+		"foo.URL":         "http://example.com/",
+		"foo.Reference":   "/foo/bar",
+	}
+	for id, value := range expected {
+		if dumped := node.Fields[id].Dump(); !reflect.DeepEqual(dumped, value) {
+			t.Errorf("Field %v should be %v, got %v", id, value, dumped)
+		}
+	}
+	ret, err := nodeToData(node, false)
+	if err != nil {
+		t.Fatalf("Could not convert node to data: %v", err)
+	}
+	node2, err := dataToNode(ret,
+		func(string) (*NodeType, error) { return &nodeType, nil }, nil, "")
+	if err != nil {
+		t.Fatalf("Could not convert data to node: %v", err)
+	}
+	for id := range expected {
+		if !reflect.DeepEqual(node.Fields[id].Dump(), node2.Fields[id].Dump()) {
+			t.Errorf("Field %v changed after round trip: %v != %v", id,
+				node.Fields[id].Dump(), node2.Fields[id].Dump())
+		}
+	}
+}
+
+func TestFieldsFromFormField(t *testing.T) {
+	options := []FieldOption{{Value: "a"}, {Value: "b"}, {Value: "c"}}
+	tests := []struct {
+		Field     Field
+		NodeField NodeField
+		Data      util.NestedMap
+		Expected  interface{}
+	}{
+		{new(IntegerField), NodeField{Id: "foo.Bar"},
+			util.NestedMap{"foo": map[string]interface{}{"Bar": 7}}, 7},
+		{new(DecimalField), NodeField{Id: "foo.Bar"},
+			util.NestedMap{"foo": map[string]interface{}{"Bar": "-2.25"}}, -2.25},
+		{new(BooleanField), NodeField{Id: "foo.Bar"},
+			util.NestedMap{"foo": map[string]interface{}{"Bar": true}}, true},
+		{new(MultiSelectField), NodeField{Id: "foo.Bar", Options: options},
+			util.NestedMap{"foo": map[string]interface{}{"Bar": map[string]interface{}{
+				"a": false, "b": true, "c": true}}}, []string{"b", "c"}},
+		{new(EmailField), NodeField{Id: "foo.Bar"},
+			util.NestedMap{"foo": map[string]interface{}{"Bar": " foo@example.com "}},
+			"foo@example.com"},
+	}
+	for i, test := range tests {
+		test.Field.FromFormField(test.Data, &test.NodeField)
+		if ret := test.Field.Dump(); !reflect.DeepEqual(ret, test.Expected) {
+			t.Errorf("%v: FromFormField should set %v, got %v", i, test.Expected,
+				ret)
+		}
+	}
+}
+
+func TestFieldsValidate(t *testing.T) {
+	options := []FieldOption{{Value: "a"}, {Value: "b"}}
+	integer := func(v int) *IntegerField { f := IntegerField(v); return &f }
+	decimal := func(v float64) *DecimalField { f := DecimalField(v); return &f }
+	sel := func(v string) *SelectField { f := SelectField(v); return &f }
+	email := func(v string) *EmailField { f := EmailField(v); return &f }
+	url := func(v string) *URLField { f := URLField(v); return &f }
+	tests := []struct {
+		Field     ValidatingField
+		NodeField NodeField
+		Valid     bool
+	}{
+		{integer(5), NodeField{}, true},
+		{integer(5), NodeField{Min: 1, Max: 5}, true},
+		{integer(6), NodeField{Min: 1, Max: 5}, false},
+		{decimal(0.5), NodeField{Min: 1, Max: 5}, false},
+		{decimal(1.5), NodeField{Min: 1, Max: 5}, true},
+		{sel(""), NodeField{Options: options}, true},
+		{sel(""), NodeField{Options: options, Required: true}, false},
+		{sel("b"), NodeField{Options: options}, true},
+		{sel("x"), NodeField{Options: options}, false},
+		{&MultiSelectField{}, NodeField{Options: options}, true},
+		{&MultiSelectField{}, NodeField{Options: options, Required: true}, false},
+		{&MultiSelectField{"a", "x"}, NodeField{Options: options}, false},
+		{email(""), NodeField{}, true},
+		{email("foo@example.com"), NodeField{}, true},
+		{email("foo@example"), NodeField{}, false},
+		{email("foo bar@example.com"), NodeField{}, false},
+		{url(""), NodeField{Required: true}, false},
+		{url("https://example.com/foo?bar"), NodeField{}, true},
+		{url("/foo/bar"), NodeField{}, true},
+		{url("javascript:alert(1)"), NodeField{}, false},
+		{url("example.com"), NodeField{}, false},
+		{&ReferenceField{}, NodeField{}, true},
+		{&ReferenceField{}, NodeField{Required: true}, false},
+		{&ReferenceField{Path: "/foo/bar"}, NodeField{Root: "/foo"}, true},
+		{&ReferenceField{Path: "/foo"}, NodeField{Root: "/foo/"}, true},
+		{&ReferenceField{Path: "/foobar"}, NodeField{Root: "/foo"}, false},
+	}
+	for i, test := range tests {
+		msg := test.Field.Validate(&test.NodeField, "en")
+		if test.Valid && msg != "" {
+			t.Errorf("%v: %v should be valid, got %q", i, test.Field, msg)
+		}
+		if !test.Valid && msg == "" {
+			t.Errorf("%v: %v should be invalid", i, test.Field)
+		}
+	}
+}
+
+func TestFieldsRenderHTML(t *testing.T) {
+	integer, decimal, boolean := IntegerField(3), DecimalField(0.25),
+		BooleanField(true)
+	email, url, emptyURL := EmailField(`a"b@example.com`),
+		URLField("/foo?a=1&b=2"), URLField("")
+	tests := []struct {
+		Field    Field
+		Expected interface{}
+	}{
+		{&integer, "3"},
+		{&decimal, "0.25"},
+		{&boolean, "true"},
+		{&MultiSelectField{"a", "b"}, "a, b"},
+		{&email, template.HTML(
+			`<a href="mailto:a&#34;b@example.com">a&#34;b@example.com</a>`)},
+		{&url, template.HTML(
+			`<a href="/foo?a=1&amp;b=2">/foo?a=1&amp;b=2</a>`)},
+		{&emptyURL, ""},
+		{&ReferenceField{Path: "/foo/bar"}, template.HTML(
+			`<a href="/foo/bar/">/foo/bar</a>`)},
+		{&ReferenceField{Path: "/"}, template.HTML(`<a href="/">/</a>`)},
+	}
+	for i, test := range tests {
+		if ret := test.Field.RenderHTML(); ret != test.Expected {
+			t.Errorf("%v: RenderHTML should return %q, got %q", i, test.Expected,
+				ret)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"sort"
+	"sync"
+
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// FieldFactory returns a new, uninitialized field.
+type FieldFactory func() Field
+
+// fieldTypes maps field type names to factories. Field types provided
+// by modules are listed in remote.
+var fieldTypes = struct {
+	sync.RWMutex
+	factories map[string]FieldFactory
+	remote    map[string]bool
+}{remote: make(map[string]bool), factories: map[string]FieldFactory{
+	"DateTime":    func() Field { return new(DateTimeField) },
+	"File":        func() Field { return new(FileField) },
+	"Text":        func() Field { return new(TextField) },
+	"HTMLArea":    func() Field { return new(HTMLField) },
+	"Integer":     func() Field { return new(IntegerField) },
+	"Decimal":     func() Field { return new(DecimalField) },
+	"Boolean":     func() Field { return new(BooleanField) },
+	"Select":      func() Field { return new(SelectField) },
+	"MultiSelect": func() Field { return new(MultiSelectField) },
+	"Email":       func() Field { return new(EmailField) },
+	"URL":         func() Field { return new(URLField) },
+	"Reference":   func() Field { return new(ReferenceField) },
+	"List":        func() Field { return new(ListField) },
+	"Compound":    func() Field { return new(CompoundField) },
+}}
+
+// RegisterFieldType registers a factory for fields of the given type.
+//
+// The core field types are registered by default. Returns an error
+// if the type has already been registered.
+func RegisterFieldType(name string, factory FieldFactory) error {
+	fieldTypes.Lock()
+	defer fieldTypes.Unlock()
+	if _, ok := fieldTypes.factories[name]; ok {
+		return fmt.Errorf("Field type %q has already been registered", name)
+	}
+	fieldTypes.factories[name] = factory
+	return nil
+}
+
+// RegisterRemoteFieldType registers a field type provided by some
+// module, see RemoteFieldFactory.
+//
+// Registering the same remote field type again, e.g. if the module has
+// been restarted, does nothing. Returns an error if a local field type
+// of the given name has been registered.
+func RegisterRemoteFieldType(name string) error {
+	fieldTypes.Lock()
+	defer fieldTypes.Unlock()
+	if fieldTypes.remote[name] {
+		return nil
+	}
+	if _, ok := fieldTypes.factories[name]; ok {
+		return fmt.Errorf("Field type %q has already been registered", name)
+	}
+	fieldTypes.factories[name] = RemoteFieldFactory(name)
+	fieldTypes.remote[name] = true
+	return nil
+}
+
+// RemoteFieldTypes returns the names of the registered remote field
+// types.
+func RemoteFieldTypes() []string {
+	fieldTypes.RLock()
+	defer fieldTypes.RUnlock()
+	names := make([]string, 0, len(fieldTypes.remote))
+	for name := range fieldTypes.remote {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewField returns a new, uninitialized field of the given type.
+//
+// Returns nil if the type is unknown.
+func NewField(fieldType string) Field {
+	fieldTypes.RLock()
+	factory, ok := fieldTypes.factories[fieldType]
+	fieldTypes.RUnlock()
+	if !ok {
+		return nil
+	}
+	return factory()
+}
+
+// ModuleField is a field type provided by a module.
+//
+// Modules can't add widgets to the daemon's edit form directly.
+// Instead, the field is edited using a text input holding the value
+// returned by FormValue.
+type ModuleField interface {
+	// RenderHTML returns a string or template.HTML to be used in a html
+	// template.
+	RenderHTML() interface{}
+	// Load loads the field value using the given function.
+	Load(func(interface{}) error) error
+	// Dump returns the raw value of the field.
+	Dump() interface{}
+	// FormValue returns the value to be edited and wether the input
+	// should span multiple lines.
+	FormValue(field *NodeField, locale string) (value string, multiline bool)
+	// SetFormValue sets the field to the edited value. Returns an
+	// error message in the given locale if the value is not valid.
+	SetFormValue(value string, field *NodeField, locale string) string
+}
+
+// Actions of field type signals.
+const (
+	FieldTypeRender   = "render"
+	FieldTypeToForm   = "toform"
+	FieldTypeFromForm = "fromform"
+)
+
+// FieldTypeArgs are the arguments of the monsti.FieldType signal.
+type FieldTypeArgs struct {
+	// Type is the name of the field type.
+	Type string
+	// Action is one of the FieldType* constants.
+	Action string
+	Field  NodeField
+	Locale string
+	// Value is the JSON encoded value of the field.
+	Value []byte
+	// FormValue is the edited value for the fromform action.
+	FormValue string
+}
+
+// FieldTypeRet is the return value of the monsti.FieldType signal.
+type FieldTypeRet struct {
+	// Handled is true if the receiver provides the field type.
+	Handled bool
+	// Value is the JSON encoded value after the fromform action.
+	Value []byte
+	// FormValue and Multiline are set by the toform action.
+	FormValue string
+	Multiline bool
+	// HTML is set by the render action.
+	HTML string
+	// Error is the error message of the fromform action.
+	Error string
+}
+
+func init() {
+	gob.RegisterName("monsti.FieldTypeArgs", FieldTypeArgs{})
+	gob.RegisterName("monsti.FieldTypeRet", FieldTypeRet{})
+}
+
+type fieldTypeHandler struct {
+	types map[string]func() ModuleField
+}
+
+func (r *fieldTypeHandler) Name() string {
+	return "monsti.FieldType"
+}
+
+func (r *fieldTypeHandler) Handle(args interface{}) (interface{}, error) {
+	args_ := args.(FieldTypeArgs)
+	factory, ok := r.types[args_.Type]
+	if !ok {
+		return FieldTypeRet{}, nil
+	}
+	field := factory()
+	if len(args_.Value) > 0 {
+		err := field.Load(func(in interface{}) error {
+			return json.Unmarshal(args_.Value, in)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Could not load field value: %v", err)
+		}
+	}
+	ret := FieldTypeRet{Handled: true}
+	switch args_.Action {
+	case FieldTypeRender:
+		ret.HTML = renderedHTML(field.RenderHTML())
+	case FieldTypeToForm:
+		ret.FormValue, ret.Multiline = field.FormValue(&args_.Field,
+			args_.Locale)
+	case FieldTypeFromForm:
+		ret.Error = field.SetFormValue(args_.FormValue, &args_.Field,
+			args_.Locale)
+		value, err := json.Marshal(field.Dump())
+		if err != nil {
+			return nil, fmt.Errorf("Could not dump field value: %v", err)
+		}
+		ret.Value = value
+	default:
+		return nil, fmt.Errorf("Unknown field type action %q", args_.Action)
+	}
+	return ret, nil
+}
+
+// NewFieldTypeHandler constructs a signal handler that provides the
+// given field types to the daemon.
+//
+// The types must also be registered using
+// MonstiClient.RegisterFieldType.
+func NewFieldTypeHandler(types map[string]func() ModuleField) SignalHandler {
+	return &fieldTypeHandler{types}
+}
+
+// RegisterFieldType tells Monsti that the module provides the given
+// field type.
+//
+// The field type is registered locally, too, so that the module can
+// read and write nodes having such fields. Rendering and editing the
+// field is delegated using the monsti.FieldType signal, see
+// NewFieldTypeHandler.
+func (s *MonstiClient) RegisterFieldType(name string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	err := s.RPCClient.Call("Monsti.RegisterFieldType", name, new(int))
+	if err != nil {
+		return fmt.Errorf("service: Error calling RegisterFieldType: %v", err)
+	}
+	if err := RegisterRemoteFieldType(name); err != nil {
+		return fmt.Errorf("service: Could not register field type: %v", err)
+	}
+	return nil
+}
+
+// LoadRemoteFieldTypes registers the field types provided by modules
+// which have been registered at Monsti.
+//
+// Fields of unknown types get initialized after loading the remote
+// field types, so modules can read nodes having fields of types
+// provided by other modules.
+func (s *MonstiClient) LoadRemoteFieldTypes() error {
+	if s.Error != nil {
+		return s.Error
+	}
+	var names []string
+	err := s.RPCClient.Call("Monsti.GetRemoteFieldTypes", 0, &names)
+	if err != nil {
+		return fmt.Errorf("service: Error calling GetRemoteFieldTypes: %v", err)
+	}
+	for _, name := range names {
+		if err := RegisterRemoteFieldType(name); err != nil {
+			return fmt.Errorf("service: Could not register field type: %v", err)
+		}
+	}
+	return nil
+}
+
+// RemoteFieldFactory returns a factory for fields of the given type
+// provided by some module.
+func RemoteFieldFactory(fieldType string) FieldFactory {
+	return func() Field {
+		return &remoteField{fieldType: fieldType}
+	}
+}
+
+// remoteField delegates rendering and editing to the module providing
+// the field type.
+type remoteField struct {
+	fieldType string
+	value     interface{}
+	monsti    *MonstiClient
+	// formValue and formError hold the edited value and the error
+	// message of the last FromFormField call.
+	formValue, formError string
+}
+
+func (t *remoteField) Init(m *MonstiClient, site string) error {
+	t.monsti = m
+	return nil
+}
+
+// emit emits the monsti.FieldType signal with the given action and
+// returns the answer of the module providing the field type.
+func (t *remoteField) emit(args FieldTypeArgs) (*FieldTypeRet, error) {
+	if t.monsti == nil {
+		return nil, fmt.Errorf("Field has not been initialized")
+	}
+	value, err := json.Marshal(t.value)
+	if err != nil {
+		return nil, fmt.Errorf("Could not dump field value: %v", err)
+	}
+	args.Type = t.fieldType
+	args.Value = value
+	var ret []FieldTypeRet
+	if err := t.monsti.EmitSignal("monsti.FieldType", args, &ret); err != nil {
+		return nil, fmt.Errorf("Could not emit signal: %v", err)
+	}
+	for _, answer := range ret {
+		if answer.Handled {
+			return &answer, nil
+		}
+	}
+	return nil, fmt.Errorf("No module provides field type %q", t.fieldType)
+}
+
+func (t remoteField) String() string {
+	if t.value == nil {
+		return ""
+	}
+	return fmt.Sprint(t.value)
+}
+
+func (t *remoteField) RenderHTML() interface{} {
+	ret, err := t.emit(FieldTypeArgs{Action: FieldTypeRender})
+	if err != nil {
+		return t.String()
+	}
+	return template.HTML(ret.HTML)
+}
+
+func (t *remoteField) Load(f func(interface{}) error) error {
+	return f(&t.value)
+}
+
+func (t *remoteField) Dump() interface{} {
+	return t.value
+}
+
+func (t *remoteField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	ret, err := t.emit(FieldTypeArgs{Action: FieldTypeToForm, Field: *field,
+		Locale: locale})
+	if err != nil {
+		ret = &FieldTypeRet{FormValue: t.String()}
+	}
+	data.Set(field.Id, ret.FormValue)
+	var widget htmlwidgets.Widget = new(htmlwidgets.TextWidget)
+	if ret.Multiline {
+		widget = new(htmlwidgets.TextAreaWidget)
+	}
+	form.AddWidget(widget, "Fields."+field.Id, field.Name[locale], "")
+}
+
+// FromFormField can't return errors. They are remembered and returned
+// by Validate.
+func (t *remoteField) FromFormField(data util.NestedMap, field *NodeField) {
+	t.formValue, _ = data.Get(field.Id).(string)
+	t.formError = t.fromFormValue(field, "")
+}
+
+// fromFormValue sets the field to the edited value. Returns an error
+// message in the given locale if the value could not be set.
+func (t *remoteField) fromFormValue(field *NodeField, locale string) string {
+	ret, err := t.emit(FieldTypeArgs{Action: FieldTypeFromForm, Field: *field,
+		Locale: locale, FormValue: t.formValue})
+	if err != nil {
+		return err.Error()
+	}
+	if len(ret.Error) > 0 {
+		return ret.Error
+	}
+	var value interface{}
+	if err := json.Unmarshal(ret.Value, &value); err != nil {
+		return err.Error()
+	}
+	t.value = value
+	return ""
+}
+
+// Validate asks the module again for a localized error message if
+// FromFormField failed.
+func (t *remoteField) Validate(field *NodeField, locale string) string {
+	if len(t.formError) > 0 && len(locale) > 0 {
+		t.formError = t.fromFormValue(field, locale)
+	}
+	return t.formError
+}
@@ -0,0 +1,159 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+)
+
+func TestRegisterFieldType(t *testing.T) {
+	if _, ok := NewField("Text").(*TextField); !ok {
+		t.Errorf(`NewField("Text") should return a *TextField`)
+	}
+	if NewField("test.Unknown") != nil {
+		t.Errorf("NewField should return nil for unknown field types")
+	}
+	if err := RegisterFieldType("Text", RemoteFieldFactory("Text")); err == nil {
+		t.Errorf("Registering a core field type again should fail")
+	}
+	if err := RegisterRemoteFieldType("Text"); err == nil {
+		t.Errorf("Registering a core field type as remote one should fail")
+	}
+	for i := 0; i < 2; i++ {
+		if err := RegisterRemoteFieldType("test.Color"); err != nil {
+			t.Fatalf("Could not register field type: %v", err)
+		}
+	}
+	if _, ok := NewField("test.Color").(*remoteField); !ok {
+		t.Errorf(`NewField("test.Color") should return a *remoteField`)
+	}
+	node := Node{Type: &NodeType{Fields: []*NodeField{
+		{Id: "test.Color", Type: "test.Color"}}}}
+	if err := node.InitFields(nil, ""); err != nil {
+		t.Errorf("InitFields should know registered field types, got %v", err)
+	}
+}
+
+// fieldTypeService provides the field types of a fake Monsti daemon.
+type fieldTypeService struct{ types []string }
+
+func (s *fieldTypeService) GetRemoteFieldTypes(args int,
+	reply *[]string) error {
+	*reply = s.types
+	return nil
+}
+
+func TestLoadRemoteFieldTypes(t *testing.T) {
+	server := rpc.NewServer()
+	err := server.RegisterName("Monsti",
+		&fieldTypeService{[]string{"test.Provided"}})
+	if err != nil {
+		t.Fatalf("Could not register service: %v", err)
+	}
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	client := new(MonstiClient)
+	client.RPCClient = rpc.NewClient(clientConn)
+	defer client.RPCClient.Close()
+	// Fields of types provided by other modules get loaded from Monsti.
+	node := Node{Type: &NodeType{Fields: []*NodeField{
+		{Id: "test.Provided", Type: "test.Provided"}}}}
+	if err := node.InitFields(client, ""); err != nil {
+		t.Fatalf("InitFields should load remote field types, got %v", err)
+	}
+	if _, ok := node.Fields["test.Provided"].(*remoteField); !ok {
+		t.Errorf("Field should be a *remoteField, got %T",
+			node.Fields["test.Provided"])
+	}
+	node = Node{Type: &NodeType{Fields: []*NodeField{
+		{Id: "test.Missing", Type: "test.Missing"}}}}
+	if err := node.InitFields(client, ""); err == nil {
+		t.Errorf("InitFields should fail for unknown field types")
+	}
+}
+
+// colorField is a module field holding a color like "#ff0000".
+type colorField string
+
+func (t colorField) RenderHTML() interface{} {
+	return "<" + string(t) + ">"
+}
+
+func (t *colorField) Load(f func(interface{}) error) error {
+	return f(t)
+}
+
+func (t colorField) Dump() interface{} {
+	return string(t)
+}
+
+func (t colorField) FormValue(field *NodeField, locale string) (string, bool) {
+	return strings.TrimPrefix(string(t), "#"), false
+}
+
+func (t *colorField) SetFormValue(value string, field *NodeField,
+	locale string) string {
+	if len(value) != 6 {
+		return "invalid color (" + locale + ")"
+	}
+	*t = colorField("#" + value)
+	return ""
+}
+
+func TestFieldTypeHandler(t *testing.T) {
+	handler := NewFieldTypeHandler(map[string]func() ModuleField{
+		"test.Color": func() ModuleField { return new(colorField) },
+	})
+	tests := []struct {
+		Args     FieldTypeArgs
+		Expected FieldTypeRet
+	}{
+		{FieldTypeArgs{Type: "test.Other", Action: FieldTypeRender},
+			FieldTypeRet{}},
+		{FieldTypeArgs{Type: "test.Color", Action: FieldTypeRender,
+			Value: []byte(`"#ff0000"`)},
+			FieldTypeRet{Handled: true, HTML: "&lt;#ff0000&gt;"}},
+		{FieldTypeArgs{Type: "test.Color", Action: FieldTypeToForm,
+			Value: []byte(`"#ff0000"`)},
+			FieldTypeRet{Handled: true, FormValue: "ff0000"}},
+		{FieldTypeArgs{Type: "test.Color", Action: FieldTypeFromForm,
+			Value: []byte(`"#ff0000"`), FormValue: "00ff00"},
+			FieldTypeRet{Handled: true, Value: []byte(`"#00ff00"`)}},
+		{FieldTypeArgs{Type: "test.Color", Action: FieldTypeFromForm,
+			Value: []byte(`"#ff0000"`), FormValue: "foo", Locale: "de"},
+			FieldTypeRet{Handled: true, Value: []byte(`"#ff0000"`),
+				Error: "invalid color (de)"}},
+	}
+	for i, test := range tests {
+		ret, err := handler.Handle(test.Args)
+		if err != nil {
+			t.Errorf("%v: Handle returned error: %v", i, err)
+			continue
+		}
+		ret_ := ret.(FieldTypeRet)
+		if ret_.Handled != test.Expected.Handled ||
+			string(ret_.Value) != string(test.Expected.Value) ||
+			ret_.FormValue != test.Expected.FormValue ||
+			ret_.HTML != test.Expected.HTML || ret_.Error != test.Expected.Error {
+			t.Errorf("%v: Handle returned %v, should be %v", i, ret_,
+				test.Expected)
+		}
+	}
+}
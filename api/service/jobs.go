@@ -0,0 +1,159 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Job is a task run by Monsti's scheduler.
+type Job struct {
+	// Id identifies the job. Scheduling a job replaces any job with the
+	// same id.
+	Id string
+	// Type decides who runs the job. Jobs having a type starting with
+	// "monsti." are run by Monsti itself. Other jobs are sent to the
+	// modules using the monsti.Job signal, see NewJobHandler.
+	Type string
+	// Site is the site the job is for, if any.
+	Site string
+	// Schedule repeats the job. It's either a cron expression
+	// ("<minute> <hour> <day of month> <month> <day of week>", e.g. "30
+	// 4 * * 1-5"), one of @yearly, @monthly, @weekly, @daily, and
+	// @hourly, or "@every <duration>", e.g. "@every 15m". Times are
+	// local to the Monsti daemon.
+	Schedule string
+	// At is the time to run a one-shot job, i.e. a job without
+	// Schedule. One-shot jobs are removed when they have been run.
+	At time.Time
+	// Data holds arbitrary arguments of the job.
+	Data []byte
+	// Next is the time of the next run. It's set by the scheduler.
+	Next time.Time
+	// LastRun is the time of the last run and LastError its error
+	// message, if any. They are set by the scheduler.
+	LastRun   time.Time
+	LastError string
+}
+
+// JobArgs are the arguments of the monsti.Job signal.
+type JobArgs struct {
+	Job Job
+}
+
+// JobRet is the return value of the monsti.Job signal.
+type JobRet struct {
+	// Handled is true if the receiver runs jobs of the given type.
+	Handled bool
+	// Error is the error message of a failed job.
+	Error string
+}
+
+func init() {
+	gob.RegisterName("monsti.JobArgs", JobArgs{})
+	gob.RegisterName("monsti.JobRet", JobRet{})
+}
+
+type jobHandler struct {
+	types map[string]func(*Job) error
+}
+
+func (r *jobHandler) Name() string {
+	return "monsti.Job"
+}
+
+func (r *jobHandler) Handle(args interface{}) (interface{}, error) {
+	args_ := args.(JobArgs)
+	run, ok := r.types[args_.Job.Type]
+	if !ok {
+		return JobRet{}, nil
+	}
+	ret := JobRet{Handled: true}
+	if err := run(&args_.Job); err != nil {
+		ret.Error = err.Error()
+	}
+	return ret, nil
+}
+
+// NewJobHandler constructs a signal handler that runs scheduled jobs
+// of the given types.
+func NewJobHandler(types map[string]func(*Job) error) SignalHandler {
+	return &jobHandler{types}
+}
+
+// ScheduleJob adds the given job to the scheduler or replaces the job
+// having the same id.
+func (s *MonstiClient) ScheduleJob(job *Job) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	if err := s.RPCClient.Call("Monsti.ScheduleJob", job, new(int)); err != nil {
+		return fmt.Errorf("service: ScheduleJob error: %v", err)
+	}
+	return nil
+}
+
+// UnscheduleJob removes the job with the given id from the scheduler.
+//
+// Removing a job which does not exist is not an error.
+func (s *MonstiClient) UnscheduleJob(id string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	if err := s.RPCClient.Call("Monsti.UnscheduleJob", id, new(int)); err != nil {
+		return fmt.Errorf("service: UnscheduleJob error: %v", err)
+	}
+	return nil
+}
+
+// GetJobs returns all scheduled jobs ordered by the time of their next
+// run.
+func (s *MonstiClient) GetJobs() ([]Job, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	var reply []Job
+	if err := s.RPCClient.Call("Monsti.GetJobs", 0, &reply); err != nil {
+		return nil, fmt.Errorf("service: GetJobs error: %v", err)
+	}
+	return reply, nil
+}
+
+// RunJob sends the job to the modules using the monsti.Job signal.
+//
+// It's used by Monsti's scheduler to run jobs provided by modules.
+func (s *MonstiClient) RunJob(job *Job) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	var ret []JobRet
+	if err := s.EmitSignal("monsti.Job", JobArgs{*job}, &ret); err != nil {
+		return fmt.Errorf("service: Could not emit signal: %v", err)
+	}
+	for _, answer := range ret {
+		if answer.Handled {
+			if answer.Error != "" {
+				return errors.New(answer.Error)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("service: No module runs jobs of type %q", job.Type)
+}
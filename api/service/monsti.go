@@ -34,6 +34,9 @@ import (
 type MonstiClient struct {
 	Client
 	SignalHandlers map[string]func(interface{}) (interface{}, error)
+	// Actor is recorded in the audit log for changes made using this
+	// client.
+	Actor AuditActor
 }
 
 // NewMonstiConnection establishes a new RPC connection to a Monsti service.
@@ -80,17 +83,39 @@ func nodeToData(node *Node, indent bool) ([]byte, error) {
 	outNode.Fields = make(map[string]map[string]*json.RawMessage)
 
 	nodeFields := append(node.Type.Fields, node.LocalFields...)
-	for _, field := range nodeFields {
-		parts := strings.SplitN(field.Id, ".", 2)
-		dump, err := json.Marshal(node.Fields[field.Id].Dump())
-		if err != nil {
-			return nil, fmt.Errorf("Could not marshal field: %v", err)
+	dumpFields := func(fields map[string]Field,
+		out map[string]map[string]*json.RawMessage) error {
+		for _, field := range nodeFields {
+			value, ok := fields[field.Id]
+			if !ok {
+				continue
+			}
+			parts := strings.SplitN(field.Id, ".", 2)
+			dump, err := json.Marshal(value.Dump())
+			if err != nil {
+				return fmt.Errorf("Could not marshal field: %v", err)
+			}
+			if out[parts[0]] == nil {
+				out[parts[0]] = make(map[string]*json.RawMessage)
+			}
+			msg := json.RawMessage(dump)
+			out[parts[0]][parts[1]] = &msg
 		}
-		if outNode.Fields[parts[0]] == nil {
-			outNode.Fields[parts[0]] = make(map[string]*json.RawMessage)
+		return nil
+	}
+	if err := dumpFields(node.Fields, outNode.Fields); err != nil {
+		return nil, err
+	}
+	if len(node.Translations) > 0 {
+		outNode.Translations = make(
+			map[string]map[string]map[string]*json.RawMessage)
+		for locale, fields := range node.Translations {
+			out := make(map[string]map[string]*json.RawMessage)
+			if err := dumpFields(fields, out); err != nil {
+				return nil, err
+			}
+			outNode.Translations[locale] = out
 		}
-		msg := json.RawMessage(dump)
-		outNode.Fields[parts[0]][parts[1]] = &msg
 	}
 
 	if indent {
@@ -106,10 +131,16 @@ func nodeToData(node *Node, indent bool) ([]byte, error) {
 }
 
 // WriteNode writes the given node.
+//
+// If some fields of the node are not valid, the node won't be written
+// and a *ValidationError will be returned.
 func (s *MonstiClient) WriteNode(site, path string, node *Node) error {
 	if s.Error != nil {
 		return nil
 	}
+	if err := node.Validate(""); err != nil {
+		return err
+	}
 	node.Changed = time.Now().UTC()
 	data, err := nodeToData(node, true)
 	if err != nil {
@@ -127,6 +158,8 @@ type nodeJSON struct {
 	Node
 	Type   string
 	Fields map[string]map[string]*json.RawMessage
+	// Translations holds the translated fields by locale.
+	Translations map[string]map[string]map[string]*json.RawMessage `json:",omitempty"`
 }
 
 // dataToNode unmarshals given data
@@ -163,6 +196,28 @@ func dataToNode(data []byte,
 			ret.Fields[field.Id].Load(f)
 		}
 	}
+	for locale, fields := range node.Translations {
+		if ret.Translations == nil {
+			ret.Translations = make(map[string]map[string]Field)
+		}
+		ret.Translations[locale] = make(map[string]Field)
+		for _, field := range nodeFields {
+			parts := strings.SplitN(field.Id, ".", 2)
+			value := fields[parts[0]][parts[1]]
+			if value == nil || !field.Translatable() {
+				continue
+			}
+			translated := copyField(ret.Fields[field.Id])
+			f := func(in interface{}) error {
+				return json.Unmarshal(*value, in)
+			}
+			if err := translated.Load(f); err != nil {
+				return nil, fmt.Errorf("Could not load translated field %q: %v",
+					field.Id, err)
+			}
+			ret.Translations[locale][field.Id] = translated
+		}
+	}
 	return &ret, nil
 }
 
@@ -229,22 +284,68 @@ func (s *MonstiClient) GetNodeData(site, path, file string) ([]byte, error) {
 }
 
 // WriteNodeData writes data for some node.
+//
+// Files of File fields (i.e. "__file_<field id>") are validated, see
+// ValidateFile. If the file is not valid, a *ValidationError will be
+// returned.
 func (s *MonstiClient) WriteNodeData(site, path, file string,
 	content []byte) error {
 	if s.Error != nil {
 		return nil
 	}
+	if strings.HasPrefix(file, "__file_") {
+		err := s.validateFileData(site, path, strings.TrimPrefix(file, "__file_"),
+			content)
+		if err != nil {
+			return err
+		}
+	}
 	args := struct {
 		Site, Path, File string
 		Content          []byte
+		Actor            AuditActor
 	}{
-		site, path, file, content}
+		site, path, file, content, s.Actor}
 	if err := s.RPCClient.Call("Monsti.WriteNodeData", &args, new(int)); err != nil {
 		return fmt.Errorf("service: WriteNodeData error: %v", err)
 	}
 	return nil
 }
 
+// fileField returns the File field of the node with the given id.
+//
+// Returns nil if the node or the field does not exist.
+func (s *MonstiClient) fileField(site, path, fieldId string) (*NodeField,
+	error) {
+	node, err := s.GetNode(site, path)
+	if err != nil {
+		return nil, fmt.Errorf("service: Could not get node: %v", err)
+	}
+	if node == nil {
+		return nil, nil
+	}
+	for _, field := range append(node.Type.Fields, node.LocalFields...) {
+		if field.Id == fieldId {
+			return field, nil
+		}
+	}
+	return nil, nil
+}
+
+// validateFileData validates the content of the given File field of
+// the node.
+func (s *MonstiClient) validateFileData(site, path, fieldId string,
+	content []byte) error {
+	field, err := s.fileField(site, path, fieldId)
+	if err != nil || field == nil {
+		return err
+	}
+	if msg := ValidateFile(field, content, ""); msg != "" {
+		return &ValidationError{map[string]string{fieldId: msg}}
+	}
+	return nil
+}
+
 // RemoveNodeData removes data of some node.
 func (s *MonstiClient) RemoveNodeData(site, path, file string) error {
 	if s.Error != nil {
@@ -252,7 +353,8 @@ func (s *MonstiClient) RemoveNodeData(site, path, file string) error {
 	}
 	args := struct {
 		Site, Path, File string
-	}{site, path, file}
+		Actor            AuditActor
+	}{site, path, file, s.Actor}
 	if err := s.RPCClient.Call("Monsti.RemoveNodeData", &args, new(int)); err != nil {
 		return fmt.Errorf("service: RemoveNodeData error: %v", err)
 	}
@@ -268,7 +370,8 @@ func (s *MonstiClient) RemoveNode(site string, node string) error {
 	}
 	args := struct {
 		Site, Node string
-	}{site, node}
+		Actor      AuditActor
+	}{site, node, s.Actor}
 	if err := s.RPCClient.Call("Monsti.RemoveNode", args, new(int)); err != nil {
 		return fmt.Errorf("service: RemoveNode error: %v", err)
 	}
@@ -285,7 +388,8 @@ func (s *MonstiClient) RenameNode(site, source, target string) error {
 	}
 	args := struct {
 		Site, Source, Target string
-	}{site, source, target}
+		Actor                AuditActor
+	}{site, source, target, s.Actor}
 	if err := s.RPCClient.Call("Monsti.RenameNode", args, new(int)); err != nil {
 		return fmt.Errorf("service: RenameNode error: %v", err)
 	}
@@ -424,6 +528,10 @@ const (
 	RemoveAction
 	RequestPasswordTokenAction
 	ChangePasswordAction
+	AuditAction
+	ProfileAction
+	MediaAction
+	CacheAction
 )
 
 // A request to be processed by a nodes service.
@@ -526,6 +634,9 @@ type User struct {
 	Password string
 	// PasswordChanged keeps the time of the last password change.
 	PasswordChanged time.Time
+	// Locale is the preferred language of the web interface. If empty,
+	// the site's locale will be used.
+	Locale string `json:",omitempty"`
 }
 
 // UserSession is a session of an authenticated or anonymous user.
@@ -722,6 +833,22 @@ func (c *CacheMods) Join(right *CacheMods) {
 	}
 }
 
+// ExpireOnPublish lets the cache expire when the first of the given
+// nodes gets published.
+//
+// Caches of content listing nodes (e.g. navigations) should call it
+// with all listed nodes, including those which have been skipped
+// because they are not published yet.
+func (c *CacheMods) ExpireOnPublish(nodes ...*Node) {
+	now := time.Now()
+	for _, node := range nodes {
+		if node.PublishTime.After(now) &&
+			(c.Expire.IsZero() || node.PublishTime.Before(c.Expire)) {
+			c.Expire = node.PublishTime
+		}
+	}
+}
+
 // CacheDep identifies something a cache may depend on and which can
 // be marked.
 type CacheDep struct {
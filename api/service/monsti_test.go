@@ -19,6 +19,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetConfig(t *testing.T) {
@@ -48,7 +49,7 @@ func TestDataToNode(t *testing.T) {
 		Id:   "foo.Bar",
 		Name: map[string]string{"en": "A Bar"},
 		Fields: []*NodeField{
-			{"foo.FooField", map[string]string{"en": "A FooField"}, false, "Text"},
+			{Id: "foo.FooField", Name: map[string]string{"en": "A FooField"}, Type: "Text"},
 		},
 		Embed: nil}
 	data := []byte(`
@@ -89,12 +90,12 @@ func TestNodeToData(t *testing.T) {
 		Type: &NodeType{
 			Id: "foo.Bar",
 			Fields: []*NodeField{
-				{"foo.FooField", nil, false, "Text"},
+				{Id: "foo.FooField", Type: "Text"},
 			},
 			Embed: nil,
 		},
 		LocalFields: []*NodeField{
-			{"foo.BarField", nil, false, "Text"},
+			{Id: "foo.BarField", Type: "Text"},
 		},
 	}
 	node.InitFields(nil, "")
@@ -153,3 +154,100 @@ func TestNodeToData(t *testing.T) {
 			trim(string(ret)), trim(expected))
 	}
 }
+
+func TestNodeTranslations(t *testing.T) {
+	nodeType := NodeType{
+		Id: "foo.Bar",
+		Fields: []*NodeField{
+			{Id: "foo.Title", Type: "Text"},
+			{Id: "foo.Body", Type: "Text"},
+			{Id: "foo.File", Type: "File"},
+		}}
+	data := []byte(`
+{ "Type": "foo.Bar",
+  "Fields": {"foo": {"Title": "Title", "Body": "Body"}},
+  "Translations": {
+    "de": {"foo": {"Title": "Titel", "File": "ignored"}}
+  }
+}`)
+	getNodeType := func(id string) (*NodeType, error) { return &nodeType, nil }
+	node, err := dataToNode(data, getNodeType, nil, "")
+	if err != nil {
+		t.Fatalf("dataToNode returns error: %v", err)
+	}
+	if _, ok := node.Translations["de"]["foo.File"]; ok {
+		t.Errorf("File fields should not be translated")
+	}
+
+	tests := []struct {
+		Locale      string
+		Fallback    bool
+		Title, Body string
+	}{
+		{"de", false, "Titel", "Body"},
+		{"de", true, "Titel", "Body"},
+		{"fr", true, "Title", "Body"},
+		{"fr", false, "", ""},
+	}
+	for _, v := range tests {
+		translated := node.Translated(v.Locale, v.Fallback)
+		if translated == nil {
+			if len(v.Title) > 0 {
+				t.Errorf("Translated(%q, %v) = nil", v.Locale, v.Fallback)
+			}
+			continue
+		}
+		title := translated.GetField("foo.Title").String()
+		body := translated.GetField("foo.Body").String()
+		if title != v.Title || body != v.Body {
+			t.Errorf("Translated(%q, %v) has fields %q, %q, should be %q, %q",
+				v.Locale, v.Fallback, title, body, v.Title, v.Body)
+		}
+	}
+	if node.GetField("foo.Title").String() != "Title" {
+		t.Errorf("Translated altered node")
+	}
+
+	node.InitTranslation("fr")
+	*(node.Translations["fr"]["foo.Body"].(*TextField)) = "Corps"
+	if node.GetField("foo.Body").String() != "Body" {
+		t.Errorf("Changing the translation altered the untranslated field")
+	}
+	if title := node.Translations["fr"]["foo.Title"].String(); title != "Title" {
+		t.Errorf("InitTranslation should copy untranslated value, got %q", title)
+	}
+
+	out, err := nodeToData(node, false)
+	if err != nil {
+		t.Fatalf("nodeToData returns error: %v", err)
+	}
+	node, err = dataToNode(out, getNodeType, nil, "")
+	if err != nil {
+		t.Fatalf("dataToNode returns error: %v", err)
+	}
+	if body := node.Translated("fr", false).GetField("foo.Body").String(); body != "Corps" {
+		t.Errorf("Translation has not been written, got %q", body)
+	}
+}
+
+func TestExpireOnPublish(t *testing.T) {
+	now := time.Now()
+	soon, later := now.Add(time.Hour), now.Add(2*time.Hour)
+	nodes := []*Node{
+		{Public: true, PublishTime: now.Add(-time.Hour)},
+		{Public: true, PublishTime: later},
+		{Public: true, PublishTime: soon}}
+	mods := new(CacheMods)
+	mods.ExpireOnPublish(nodes...)
+	if !mods.Expire.Equal(soon) {
+		t.Errorf("Expire should be %v, got %v", soon, mods.Expire)
+	}
+	if nodes[0].Published() != true || nodes[1].Published() != false {
+		t.Errorf("Only past nodes should be published")
+	}
+	mods = &CacheMods{Expire: now.Add(time.Minute)}
+	mods.ExpireOnPublish(nodes...)
+	if !mods.Expire.Equal(now.Add(time.Minute)) {
+		t.Errorf("Earlier Expire should be kept, got %v", mods.Expire)
+	}
+}
@@ -0,0 +1,482 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// ConfigurableField is implemented by fields which depend on their
+// configuration, e.g. the fields of a compound field.
+type ConfigurableField interface {
+	Field
+	// Configure is called with the field's configuration before Init.
+	Configure(field *NodeField) error
+}
+
+// FormControlField is implemented by fields with form controls that
+// change the structure of the field, e.g. adding list items.
+type FormControlField interface {
+	Field
+	// PrepareForm is called with the submitted edit form values before
+	// ToFormField, so that the field's widgets match the submitted
+	// form.
+	PrepareForm(values url.Values, field *NodeField)
+	// FormChanged returns true if the last call to FromFormField
+	// changed the structure of the field. The edit form will be shown
+	// again instead of saving the node.
+	FormChanged() bool
+}
+
+// fieldCopier is implemented by fields which can't be copied
+// shallowly.
+type fieldCopier interface {
+	copyField() Field
+}
+
+// initField returns a new, initialized field for the given
+// configuration.
+//
+// Field types provided by modules which are not yet known get loaded
+// from Monsti.
+func initField(field *NodeField, m *MonstiClient, site string) (Field, error) {
+	val := NewField(field.Type)
+	if val == nil && m != nil && m.RPCClient != nil {
+		if err := m.LoadRemoteFieldTypes(); err != nil {
+			return nil, err
+		}
+		val = NewField(field.Type)
+	}
+	if val == nil {
+		return nil, fmt.Errorf("Unknown field type %q", field.Type)
+	}
+	if val, ok := val.(ConfigurableField); ok {
+		if err := val.Configure(field); err != nil {
+			return nil, fmt.Errorf("Could not configure field: %v", err)
+		}
+	}
+	if err := val.Init(m, site); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// renderedHTML converts the return value of a RenderHTML method to
+// HTML.
+func renderedHTML(rendered interface{}) string {
+	switch html := rendered.(type) {
+	case template.HTML:
+		return string(html)
+	default:
+		return template.HTMLEscapeString(fmt.Sprint(html))
+	}
+}
+
+// loadRaw loads the given JSON value into the field.
+func loadRaw(field Field, value json.RawMessage) error {
+	return field.Load(func(in interface{}) error {
+		return json.Unmarshal(value, in)
+	})
+}
+
+// subField returns the configuration of a field nested into the given
+// field using the given id and label suffix.
+func subField(field, sub *NodeField, id, label string) *NodeField {
+	ret := *sub
+	ret.Id = field.Id + "." + id
+	ret.Name = make(map[string]string, len(field.Name))
+	for locale, name := range field.Name {
+		ret.Name[locale] = name + label
+		if len(sub.Name[locale]) > 0 {
+			ret.Name[locale] += ": " + sub.Name[locale]
+		}
+	}
+	return &ret
+}
+
+// nestedError returns the given validation error message prefixed by
+// the field's name.
+//
+// Names of nested fields include the names of the fields they are
+// nested into, so only the innermost field's name is used.
+func nestedError(field *NodeField, locale, msg string) string {
+	if name := field.Name[locale]; len(name) > 0 {
+		return name + ": " + msg
+	}
+	return msg
+}
+
+// ListField holds any number of values of the configured item field
+// (see NodeField.Item).
+type ListField struct {
+	Items   []Field
+	item    *NodeField
+	monsti  *MonstiClient
+	site    string
+	changed bool
+}
+
+func (t *ListField) Configure(field *NodeField) error {
+	if field.Item == nil {
+		return fmt.Errorf("List field %q misses item configuration", field.Id)
+	}
+	if NewField(field.Item.Type) == nil {
+		return fmt.Errorf("Unknown item field type %q", field.Item.Type)
+	}
+	t.item = field.Item
+	return nil
+}
+
+func (t *ListField) Init(m *MonstiClient, site string) error {
+	t.monsti = m
+	t.site = site
+	return nil
+}
+
+func (t *ListField) newItem() (Field, error) {
+	return initField(t.item, t.monsti, t.site)
+}
+
+func (t *ListField) copyField() Field {
+	ret := *t
+	ret.Items = make([]Field, len(t.Items))
+	for i, item := range t.Items {
+		ret.Items[i] = copyField(item)
+	}
+	return &ret
+}
+
+func (t ListField) String() string {
+	items := make([]string, len(t.Items))
+	for i, item := range t.Items {
+		items[i] = item.String()
+	}
+	return strings.Join(items, ", ")
+}
+
+func (t ListField) RenderHTML() interface{} {
+	if len(t.Items) == 0 {
+		return ""
+	}
+	var out bytes.Buffer
+	out.WriteString(`<ul class="list-field">`)
+	for _, item := range t.Items {
+		out.WriteString("<li>" + renderedHTML(item.RenderHTML()) + "</li>")
+	}
+	out.WriteString("</ul>")
+	return template.HTML(out.String())
+}
+
+func (t *ListField) Load(f func(interface{}) error) error {
+	var values []json.RawMessage
+	if err := f(&values); err != nil {
+		return err
+	}
+	t.Items = make([]Field, 0, len(values))
+	for i, value := range values {
+		item, err := t.newItem()
+		if err != nil {
+			return fmt.Errorf("Could not init item: %v", err)
+		}
+		if err := loadRaw(item, value); err != nil {
+			return fmt.Errorf("Could not load item %v: %v", i, err)
+		}
+		t.Items = append(t.Items, item)
+	}
+	return nil
+}
+
+func (t ListField) Dump() interface{} {
+	ret := make([]interface{}, len(t.Items))
+	for i, item := range t.Items {
+		ret[i] = item.Dump()
+	}
+	return ret
+}
+
+// itemField returns the configuration of the i-th item.
+func (t ListField) itemField(field *NodeField, i int) *NodeField {
+	return subField(field, t.item, fmt.Sprintf("Items.%v", i),
+		fmt.Sprintf(" #%v", i+1))
+}
+
+// Each item gets controls to change its position and to remove
+// it. The list gets a control to add an item.
+func (t ListField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+	for i, item := range t.Items {
+		item.ToFormField(form, data, t.itemField(field, i), locale)
+		label := fmt.Sprintf("%v #%v", field.Name[locale], i+1)
+		id := fmt.Sprintf("%v.Position.%v", field.Id, i)
+		data.Set(id, i+1)
+		form.AddWidget(new(htmlwidgets.IntegerWidget), "Fields."+id,
+			fmt.Sprintf(G("%v: Position"), label), "")
+		id = fmt.Sprintf("%v.Remove.%v", field.Id, i)
+		data.Set(id, false)
+		form.AddWidget(new(htmlwidgets.BoolWidget), "Fields."+id,
+			fmt.Sprintf(G("%v: Remove"), label), "")
+	}
+	data.Set(field.Id+".Count", strconv.Itoa(len(t.Items)))
+	form.AddWidget(new(htmlwidgets.HiddenWidget), "Fields."+field.Id+".Count",
+		"", "")
+	data.Set(field.Id+".Add", false)
+	form.AddWidget(new(htmlwidgets.BoolWidget), "Fields."+field.Id+".Add",
+		fmt.Sprintf(G("%v: Add item"), field.Name[locale]),
+		G("Shows the form again with a new item."))
+}
+
+// maxUnsavedItems is the maximum number of list items that may be
+// added to a form before saving it.
+const maxUnsavedItems = 100
+
+// PrepareForm adds items which have been added to the submitted form
+// but not yet been saved.
+func (t *ListField) PrepareForm(values url.Values, field *NodeField) {
+	count, err := strconv.Atoi(values.Get("Fields." + field.Id + ".Count"))
+	if err != nil || count < 0 {
+		return
+	}
+	if count > len(t.Items)+maxUnsavedItems {
+		count = len(t.Items) + maxUnsavedItems
+	}
+	for len(t.Items) < count {
+		item, err := t.newItem()
+		if err != nil {
+			return
+		}
+		t.Items = append(t.Items, item)
+	}
+	for i, item := range t.Items {
+		if item, ok := item.(FormControlField); ok {
+			item.PrepareForm(values, t.itemField(field, i))
+		}
+	}
+}
+
+type positionedField struct {
+	Position int
+	Field    Field
+}
+
+type byPosition []positionedField
+
+func (p byPosition) Len() int           { return len(p) }
+func (p byPosition) Less(i, j int) bool { return p[i].Position < p[j].Position }
+func (p byPosition) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+func (t *ListField) FromFormField(data util.NestedMap, field *NodeField) {
+	t.changed = false
+	items := make([]positionedField, 0, len(t.Items))
+	for i, item := range t.Items {
+		item.FromFormField(data, t.itemField(field, i))
+		if control, ok := item.(FormControlField); ok && control.FormChanged() {
+			t.changed = true
+		}
+		remove, _ := data.Get(fmt.Sprintf("%v.Remove.%v", field.Id, i)).(bool)
+		if remove {
+			continue
+		}
+		position, ok := data.Get(fmt.Sprintf("%v.Position.%v", field.Id, i)).(int)
+		if !ok {
+			position = i + 1
+		}
+		items = append(items, positionedField{position, item})
+	}
+	sort.Stable(byPosition(items))
+	t.Items = make([]Field, len(items))
+	for i, item := range items {
+		t.Items[i] = item.Field
+	}
+	if add, _ := data.Get(field.Id + ".Add").(bool); add {
+		if item, err := t.newItem(); err == nil {
+			t.Items = append(t.Items, item)
+			t.changed = true
+		}
+	}
+}
+
+func (t ListField) FormChanged() bool {
+	return t.changed
+}
+
+func (t ListField) Validate(field *NodeField, locale string) string {
+	if field.Required && len(t.Items) == 0 {
+		G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+		return nestedError(field, locale, G("Please add at least one item."))
+	}
+	for i, item := range t.Items {
+		if item, ok := item.(ValidatingField); ok {
+			itemField := t.itemField(field, i)
+			if msg := item.Validate(itemField, locale); msg != "" {
+				if _, nested := item.(FormControlField); nested {
+					return msg
+				}
+				return nestedError(itemField, locale, msg)
+			}
+		}
+	}
+	return ""
+}
+
+// CompoundField holds the values of the configured fields (see
+// NodeField.Fields).
+type CompoundField struct {
+	// Fields maps the ids of the configured fields to their values.
+	Fields  map[string]Field
+	configs []*NodeField
+}
+
+func (t *CompoundField) Configure(field *NodeField) error {
+	if len(field.Fields) == 0 {
+		return fmt.Errorf("Compound field %q misses fields", field.Id)
+	}
+	for _, sub := range field.Fields {
+		if len(sub.Id) == 0 || strings.Contains(sub.Id, ".") {
+			return fmt.Errorf("Invalid id %q of field in compound field %q",
+				sub.Id, field.Id)
+		}
+		if NewField(sub.Type) == nil {
+			return fmt.Errorf("Unknown field type %q of field %q", sub.Type,
+				sub.Id)
+		}
+	}
+	t.configs = field.Fields
+	return nil
+}
+
+func (t *CompoundField) Init(m *MonstiClient, site string) error {
+	t.Fields = make(map[string]Field, len(t.configs))
+	for _, sub := range t.configs {
+		val, err := initField(sub, m, site)
+		if err != nil {
+			return fmt.Errorf("Could not init field %q: %v", sub.Id, err)
+		}
+		t.Fields[sub.Id] = val
+	}
+	return nil
+}
+
+func (t *CompoundField) copyField() Field {
+	ret := *t
+	ret.Fields = make(map[string]Field, len(t.Fields))
+	for id, sub := range t.Fields {
+		ret.Fields[id] = copyField(sub)
+	}
+	return &ret
+}
+
+func (t CompoundField) String() string {
+	values := make([]string, 0, len(t.configs))
+	for _, sub := range t.configs {
+		values = append(values, t.Fields[sub.Id].String())
+	}
+	return strings.Join(values, ", ")
+}
+
+func (t CompoundField) RenderHTML() interface{} {
+	var out bytes.Buffer
+	out.WriteString(`<div class="compound-field">`)
+	for _, sub := range t.configs {
+		fmt.Fprintf(&out, `<div class="%v">%v</div>`,
+			template.HTMLEscapeString(sub.Id),
+			renderedHTML(t.Fields[sub.Id].RenderHTML()))
+	}
+	out.WriteString("</div>")
+	return template.HTML(out.String())
+}
+
+func (t *CompoundField) Load(f func(interface{}) error) error {
+	var values map[string]json.RawMessage
+	if err := f(&values); err != nil {
+		return err
+	}
+	for _, sub := range t.configs {
+		if value, ok := values[sub.Id]; ok {
+			if err := loadRaw(t.Fields[sub.Id], value); err != nil {
+				return fmt.Errorf("Could not load field %q: %v", sub.Id, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (t CompoundField) Dump() interface{} {
+	ret := make(map[string]interface{}, len(t.configs))
+	for _, sub := range t.configs {
+		ret[sub.Id] = t.Fields[sub.Id].Dump()
+	}
+	return ret
+}
+
+func (t CompoundField) ToFormField(form *htmlwidgets.Form, data util.NestedMap,
+	field *NodeField, locale string) {
+	for _, sub := range t.configs {
+		t.Fields[sub.Id].ToFormField(form, data, subField(field, sub, sub.Id, ""),
+			locale)
+	}
+}
+
+func (t *CompoundField) FromFormField(data util.NestedMap, field *NodeField) {
+	for _, sub := range t.configs {
+		t.Fields[sub.Id].FromFormField(data, subField(field, sub, sub.Id, ""))
+	}
+}
+
+func (t *CompoundField) PrepareForm(values url.Values, field *NodeField) {
+	for _, sub := range t.configs {
+		if val, ok := t.Fields[sub.Id].(FormControlField); ok {
+			val.PrepareForm(values, subField(field, sub, sub.Id, ""))
+		}
+	}
+}
+
+func (t CompoundField) FormChanged() bool {
+	for _, sub := range t.configs {
+		if control, ok := t.Fields[sub.Id].(FormControlField); ok &&
+			control.FormChanged() {
+			return true
+		}
+	}
+	return false
+}
+
+func (t CompoundField) Validate(field *NodeField, locale string) string {
+	for _, sub := range t.configs {
+		if val, ok := t.Fields[sub.Id].(ValidatingField); ok {
+			config := subField(field, sub, sub.Id, "")
+			if msg := val.Validate(config, locale); msg != "" {
+				if _, nested := val.(FormControlField); nested {
+					return msg
+				}
+				return nestedError(config, locale, msg)
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,188 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// teamNodeType returns a node type with a list of team members.
+func teamNodeType() *NodeType {
+	return &NodeType{
+		Id: "foo.Team",
+		Fields: []*NodeField{
+			{Id: "foo.Members", Type: "List",
+				Name: map[string]string{"en": "Members"},
+				Item: &NodeField{Type: "Compound", Fields: []*NodeField{
+					{Id: "Name", Type: "Text", Name: map[string]string{"en": "Name"}},
+					{Id: "Email", Type: "Email",
+						Name: map[string]string{"en": "Email"}},
+				}}},
+			{Id: "foo.Tags", Type: "List", Item: &NodeField{Type: "Text"}},
+		}}
+}
+
+func TestNestedFieldsJSON(t *testing.T) {
+	nodeType := teamNodeType()
+	data := []byte(`{"Type": "foo.Team", "Fields": {"foo": {
+    "Members": [{"Name": "Alice", "Email": "alice@example.com"},
+                {"Name": "Bob", "Email": ""}],
+    "Tags": ["a", "b"]}}}`)
+	getNodeType := func(string) (*NodeType, error) { return nodeType, nil }
+	node, err := dataToNode(data, getNodeType, nil, "")
+	if err != nil {
+		t.Fatalf("Could not convert data to node: %v", err)
+	}
+	members := node.Fields["foo.Members"].(*ListField)
+	if len(members.Items) != 2 {
+		t.Fatalf("Members should have two items, got %v", len(members.Items))
+	}
+	bob := members.Items[1].(*CompoundField)
+	if bob.Fields["Name"].String() != "Bob" {
+		t.Errorf(`Second member should be "Bob", got %q`, bob.Fields["Name"])
+	}
+	if ret := node.Fields["foo.Tags"].String(); ret != "a, b" {
+		t.Errorf(`Tags should be "a, b", got %q`, ret)
+	}
+	out, err := nodeToData(node, false)
+	if err != nil {
+		t.Fatalf("Could not convert node to data: %v", err)
+	}
+	var expected, ret struct{ Fields interface{} }
+	if err := json.Unmarshal(data, &expected); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(out, &ret); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, ret) {
+		t.Errorf("nodeToData returned %v, should be %v", ret, expected)
+	}
+
+	// Translations must not share items with the original.
+	node.InitTranslation("de")
+	translated := node.Translations["de"]["foo.Members"].(*ListField)
+	translated.Items[0].(*CompoundField).Fields["Name"].Load(
+		func(in interface{}) error {
+			*(in.(*TextField)) = "Alicia"
+			return nil
+		})
+	if ret := members.Items[0].(*CompoundField).Fields["Name"].String(); ret !=
+		"Alice" {
+		t.Errorf("Changing the translation changed the original: %q", ret)
+	}
+}
+
+func TestListFieldForm(t *testing.T) {
+	field := &NodeField{Id: "foo.Tags", Type: "List",
+		Item: &NodeField{Type: "Text"}}
+	list, err := initField(field, nil, "")
+	if err != nil {
+		t.Fatalf("Could not init field: %v", err)
+	}
+	if err := loadRaw(list, json.RawMessage(`["a", "b", "c"]`)); err != nil {
+		t.Fatalf("Could not load field: %v", err)
+	}
+	data := util.NestedMap{"foo": map[string]interface{}{"Tags": map[string]interface{}{
+		"Items":    map[string]interface{}{"0": "A", "1": "B", "2": "C"},
+		"Position": map[string]interface{}{"0": 3, "1": 1, "2": 2},
+		"Remove":   map[string]interface{}{"0": false, "1": false, "2": true},
+		"Add":      false,
+	}}}
+	list.FromFormField(data, field)
+	if ret := list.Dump(); !reflect.DeepEqual(ret, []interface{}{"B", "A"}) {
+		t.Errorf("FromFormField should reorder and remove items, got %v", ret)
+	}
+	if list.(FormControlField).FormChanged() {
+		t.Errorf("FormChanged should be false")
+	}
+
+	// Add an item and submit it.
+	data.Set("foo.Tags.Add", true)
+	data.Set("foo.Tags.Remove.2", false)
+	list.FromFormField(data, field)
+	if !list.(FormControlField).FormChanged() {
+		t.Errorf("FormChanged should be true after adding an item")
+	}
+	if ret := list.Dump(); !reflect.DeepEqual(ret,
+		[]interface{}{"B", "A", ""}) {
+		t.Errorf("FromFormField should add an item, got %v", ret)
+	}
+	list, _ = initField(field, nil, "")
+	list.(FormControlField).PrepareForm(url.Values{
+		"Fields.foo.Tags.Count": {"3"}}, field)
+	if ret := len(list.(*ListField).Items); ret != 3 {
+		t.Errorf("PrepareForm should add items to match the form, got %v", ret)
+	}
+	list, _ = initField(field, nil, "")
+	list.(FormControlField).PrepareForm(url.Values{
+		"Fields.foo.Tags.Count": {"1000000000"}}, field)
+	if ret := len(list.(*ListField).Items); ret != maxUnsavedItems {
+		t.Errorf("PrepareForm should limit added items, got %v", ret)
+	}
+	list, _ = initField(field, nil, "")
+	list.(FormControlField).PrepareForm(url.Values{
+		"Fields.foo.Tags.Count": {"-1"}}, field)
+	if ret := len(list.(*ListField).Items); ret != 0 {
+		t.Errorf("PrepareForm should ignore negative counts, got %v", ret)
+	}
+}
+
+func TestNestedFieldsValidate(t *testing.T) {
+	nodeType := teamNodeType()
+	nodeType.Fields[0].Required = true
+	node := Node{Type: nodeType}
+	if err := node.InitFields(nil, ""); err != nil {
+		t.Fatalf("Could not init fields: %v", err)
+	}
+	members := node.Fields["foo.Members"].(*ListField)
+	if msg := members.Validate(nodeType.Fields[0], "en"); msg !=
+		"Members: Please add at least one item." {
+		t.Errorf("Empty required list should be invalid, got %q", msg)
+	}
+	err := loadRaw(members, json.RawMessage(
+		`[{"Name": "Alice", "Email": "alice@example.com"},
+      {"Name": "Bob", "Email": "bob"}]`))
+	if err != nil {
+		t.Fatalf("Could not load field: %v", err)
+	}
+	if msg := members.Validate(nodeType.Fields[0], "en"); msg !=
+		"Members #2: Email: Please enter a valid email address." {
+		t.Errorf("Invalid email of second member should be reported, got %q",
+			msg)
+	}
+}
+
+func TestNestedFieldsConfigure(t *testing.T) {
+	tests := []*NodeField{
+		{Id: "foo.List", Type: "List"},
+		{Id: "foo.List", Type: "List", Item: &NodeField{Type: "Unknown"}},
+		{Id: "foo.Compound", Type: "Compound"},
+		{Id: "foo.Compound", Type: "Compound",
+			Fields: []*NodeField{{Id: "foo.Bar", Type: "Text"}}},
+	}
+	for i, test := range tests {
+		if _, err := initField(test, nil, ""); err == nil {
+			t.Errorf("%v: initField should fail for %v", i, test)
+		}
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"html/template"
 	"path"
+	"reflect"
 	"strings"
 	"time"
 
@@ -227,6 +228,9 @@ type Node struct {
 	TemplateOverwrites map[string]TemplateOverwrite
 	Embed              []EmbedNode
 	LocalFields        []*NodeField
+	// Translations holds the translated fields by locale and field
+	// id.
+	Translations map[string]map[string]Field `json:"-"`
 	// Public controls wether the node or its content may be viewed by
 	// unauthenticated users.
 	Public bool
@@ -238,32 +242,87 @@ type Node struct {
 	Changed time.Time
 }
 
+// Published returns true if unauthenticated users may view the node,
+// i.e. if it's public and its publish time has come.
+func (n Node) Published() bool {
+	return n.Public && !n.PublishTime.After(time.Now())
+}
+
 func (n *Node) InitFields(m *MonstiClient, site string) error {
 	n.Fields = make(map[string]Field)
 	nodeFields := append(n.Type.Fields, n.LocalFields...)
 	for _, field := range nodeFields {
-		var val Field
-		switch field.Type {
-		case "DateTime":
-			val = new(DateTimeField)
-		case "File":
-			val = new(FileField)
-		case "Text":
-			val = new(TextField)
-		case "HTMLArea":
-			val = new(HTMLField)
-		default:
-			return fmt.Errorf("Unknown field type %q for node %q", field.Type, n.Path)
-		}
-		err := val.Init(m, site)
+		val, err := initField(field, m, site)
 		if err != nil {
-			return fmt.Errorf("Could not init field %q: %v", field.Id, err)
+			return fmt.Errorf("Could not init field %q of node %q: %v", field.Id,
+				n.Path, err)
 		}
 		n.Fields[field.Id] = val
 	}
 	return nil
 }
 
+// copyField returns a copy of the given field.
+func copyField(field Field) Field {
+	if copier, ok := field.(fieldCopier); ok {
+		return copier.copyField()
+	}
+	value := reflect.ValueOf(field)
+	if value.Kind() != reflect.Ptr {
+		return field
+	}
+	ret := reflect.New(value.Elem().Type())
+	ret.Elem().Set(value.Elem())
+	return ret.Interface().(Field)
+}
+
+// InitTranslation prepares the node to be translated to the given
+// locale.
+//
+// Translatable fields without translation are initialized with the
+// untranslated values. InitFields must have been called before.
+func (n *Node) InitTranslation(locale string) {
+	if n.Translations == nil {
+		n.Translations = make(map[string]map[string]Field)
+	}
+	if n.Translations[locale] == nil {
+		n.Translations[locale] = make(map[string]Field)
+	}
+	nodeFields := append(n.Type.Fields, n.LocalFields...)
+	for _, field := range nodeFields {
+		if !field.Translatable() {
+			continue
+		}
+		if _, ok := n.Translations[locale][field.Id]; !ok {
+			n.Translations[locale][field.Id] = copyField(n.Fields[field.Id])
+		}
+	}
+}
+
+// Translated returns a copy of the node with the fields translated
+// to the given locale.
+//
+// If the node has not been translated to the locale, returns nil or,
+// if fallback is true, the untranslated node.
+func (n *Node) Translated(locale string, fallback bool) *Node {
+	translation, ok := n.Translations[locale]
+	if !ok {
+		if fallback {
+			return n
+		}
+		return nil
+	}
+	ret := *n
+	ret.Fields = make(map[string]Field, len(n.Fields))
+	for id, field := range n.Fields {
+		if translated, ok := translation[id]; ok {
+			field = translated
+		}
+		ret.Fields[id] = field
+	}
+	return &ret
+}
+
 func (n Node) GetField(id string) Field {
 	return n.Fields[id]
 }
@@ -337,6 +396,47 @@ type NodeField struct {
 	Name     map[string]string
 	Required bool
 	Type     string
+	// MinLength and MaxLength restrict the number of characters of the
+	// value. Zero means no restriction.
+	MinLength int `json:",omitempty"`
+	MaxLength int `json:",omitempty"`
+	// Regexp must match the value if set.
+	Regexp string `json:",omitempty"`
+	// MimeTypes restricts the allowed types of File fields. Entries may
+	// be types like "image/png" or wildcards like "image/*".
+	MimeTypes []string `json:",omitempty"`
+	// MaxSize is the maximum size of File fields in bytes.
+	MaxSize int64 `json:",omitempty"`
+	// ValidationError replaces the error messages if the value is not
+	// valid, specified as a translation map (language -> msg).
+	ValidationError map[string]string `json:",omitempty"`
+	// Min and Max restrict the values of Integer and Decimal fields.
+	// The range is not checked if both are equal.
+	Min float64 `json:",omitempty"`
+	Max float64 `json:",omitempty"`
+	// Options of Select and MultiSelect fields.
+	Options []FieldOption `json:",omitempty"`
+	// NodeTypes restricts the nodes which may be referenced by
+	// Reference fields. Like AddableTo of node types, it may contain
+	// node type ids, namespaces and the single dot for all types. If
+	// empty, all nodes may be referenced.
+	NodeTypes []string `json:",omitempty"`
+	// Root restricts the nodes which may be referenced by Reference
+	// fields to the subtree below the given path. If empty, nodes of
+	// the whole site may be referenced.
+	Root string `json:",omitempty"`
+	// Item configures the items of List fields.
+	Item *NodeField `json:",omitempty"`
+	// Fields configures the fields of Compound fields. Their ids must
+	// not contain dots.
+	Fields []*NodeField `json:",omitempty"`
+}
+
+// Translatable returns true if values of the field may be translated.
+//
+// Files are shared by all translations.
+func (f NodeField) Translatable() bool {
+	return f.Type != "File"
 }
 
 type EmbedNode struct {
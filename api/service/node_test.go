@@ -44,6 +44,13 @@ func TestFields(t *testing.T) {
 		new(TextField),
 		new(HTMLField),
 		new(FileField),
+		new(IntegerField),
+		new(DecimalField),
+		new(BooleanField),
+		new(SelectField),
+		new(EmailField),
+		new(URLField),
+		new(ReferenceField),
 	}
 	for _, field := range fields {
 		out := field.Dump()
@@ -0,0 +1,210 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// nodeDataChunkSize is the size of the chunks used to transfer node
+// data.
+const nodeDataChunkSize = 256 * 1024
+
+// NodeDataInfo describes a data file of a node.
+type NodeDataInfo struct {
+	// Exists is false if the node has no such data.
+	Exists  bool
+	Size    int64
+	ModTime time.Time
+}
+
+// StatNodeData returns information about some node data.
+func (s *MonstiClient) StatNodeData(site, path, file string) (
+	*NodeDataInfo, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct{ Site, Path, File string }{site, path, file}
+	var reply NodeDataInfo
+	if err := s.RPCClient.Call("Monsti.StatNodeData", &args, &reply); err != nil {
+		return nil, fmt.Errorf("service: StatNodeData error: %v", err)
+	}
+	return &reply, nil
+}
+
+// NodeDataReader reads node data chunk by chunk.
+//
+// It implements io.ReadSeeker, e.g. to be used with http.ServeContent.
+type NodeDataReader struct {
+	NodeDataInfo
+	client           *MonstiClient
+	site, path, file string
+	offset           int64
+	// buf contains the last read chunk, starting at bufOffset.
+	buf       []byte
+	bufOffset int64
+}
+
+// OpenNodeData returns a reader for some node data.
+//
+// Returns nil and a nil error if the data does not exist.
+func (s *MonstiClient) OpenNodeData(site, path, file string) (
+	*NodeDataReader, error) {
+	info, err := s.StatNodeData(site, path, file)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Exists {
+		return nil, nil
+	}
+	return &NodeDataReader{NodeDataInfo: *info, client: s, site: site,
+		path: path, file: file}, nil
+}
+
+// Read reads up to len(p) bytes, but at most one chunk.
+//
+// Whole chunks are fetched from Monsti and buffered, so small reads
+// don't need a request each.
+func (r *NodeDataReader) Read(p []byte) (int, error) {
+	if r.offset >= r.Size {
+		return 0, io.EOF
+	}
+	if r.offset < r.bufOffset || r.offset >= r.bufOffset+int64(len(r.buf)) {
+		args := struct {
+			Site, Path, File string
+			Offset           int64
+			Length           int
+		}{r.site, r.path, r.file, r.offset, nodeDataChunkSize}
+		var reply []byte
+		err := r.client.RPCClient.Call("Monsti.ReadNodeData", &args, &reply)
+		if err != nil {
+			return 0, fmt.Errorf("service: ReadNodeData error: %v", err)
+		}
+		if len(reply) == 0 {
+			// The data has been truncated in the meantime.
+			return 0, io.ErrUnexpectedEOF
+		}
+		r.buf, r.bufOffset = reply, r.offset
+	}
+	n := copy(p, r.buf[r.offset-r.bufOffset:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+// Seek sets the offset for the next Read.
+func (r *NodeDataReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_SET:
+	case os.SEEK_CUR:
+		offset += r.offset
+	case os.SEEK_END:
+		offset += r.Size
+	default:
+		return 0, fmt.Errorf("service: Invalid whence %v", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("service: Negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// WriteNodeDataFrom writes node data read from in.
+//
+// Unlike WriteNodeData, the data is transferred chunk by chunk. It
+// replaces existing data only after it has been transferred
+// completely. Files of File fields (i.e. "__file_<field id>") are
+// validated, see ValidateFileHead. If the file is not valid, a
+// *ValidationError will be returned.
+func (s *MonstiClient) WriteNodeDataFrom(site, path, file string,
+	in io.Reader) error {
+	if s.Error != nil {
+		return nil
+	}
+	var field *NodeField
+	fieldId := strings.TrimPrefix(file, "__file_")
+	if fieldId != file {
+		var err error
+		if field, err = s.fileField(site, path, fieldId); err != nil {
+			return err
+		}
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Errorf("service: Could not generate upload id: %v", err)
+	}
+	send := func(content []byte, done, abort bool) error {
+		args := struct {
+			Site, Path, File, Upload string
+			Content                  []byte
+			Done, Abort              bool
+			Actor                    AuditActor
+		}{site, path, file, hex.EncodeToString(id), content, done, abort,
+			s.Actor}
+		err := s.RPCClient.Call("Monsti.WriteNodeDataChunk", &args, new(int))
+		if err != nil {
+			return fmt.Errorf("service: WriteNodeDataChunk error: %v", err)
+		}
+		return nil
+	}
+	// abort discards the transferred data and returns the given error.
+	abort := func(err error) error {
+		if abortErr := send(nil, false, true); abortErr != nil {
+			return abortErr
+		}
+		return err
+	}
+	var head []byte
+	var size int64
+	buf := make([]byte, nodeDataChunkSize)
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			size += int64(n)
+			if head == nil {
+				head = append([]byte(nil), buf[:n]...)
+			}
+			if field != nil {
+				if msg := ValidateFileHead(field, head, size, ""); msg != "" {
+					return abort(&ValidationError{map[string]string{fieldId: msg}})
+				}
+			}
+			if err := send(buf[:n], false, false); err != nil {
+				return abort(err)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return abort(fmt.Errorf("service: Could not read node data: %v", err))
+		}
+	}
+	if field != nil && head == nil {
+		if msg := ValidateFileHead(field, nil, 0, ""); msg != "" {
+			return abort(&ValidationError{map[string]string{fieldId: msg}})
+		}
+	}
+	return send(nil, true, false)
+}
@@ -59,6 +59,7 @@ func (s *SessionPool) New() (*Session, error) {
 // Free puts a session back to the pool.
 func (s *SessionPool) Free(session *Session) {
 	if session.monsti != nil {
+		session.monsti.Actor = AuditActor{}
 		select {
 		case s.monsti <- session.monsti:
 		default:
@@ -0,0 +1,60 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import "fmt"
+
+// NewSite describes a site to be created as a copy of a template site.
+type NewSite struct {
+	// Name is the name of the new site and Template the name of the
+	// site to be copied.
+	Name, Template string
+	// Hosts serving the new site. At least one host is required.
+	Hosts []string
+	// Title of the new site. Defaults to the template's title.
+	Title string
+	// BaseURL of the new site. Defaults to http:// and the first host.
+	BaseURL string
+	// User is the initial user of the new site. Its password must be
+	// hashed. If nil, the new site has no users.
+	User *User
+}
+
+// CreateSite creates a new site as a copy of a template site,
+// including its nodes, users, templates, and site-static files, and
+// starts to serve it.
+func (s *MonstiClient) CreateSite(site *NewSite) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	if err := s.RPCClient.Call("Monsti.CreateSite", site, new(int)); err != nil {
+		return fmt.Errorf("service: CreateSite error: %v", err)
+	}
+	return nil
+}
+
+// ReloadSites reloads the site settings. New sites get served, removed
+// ones not anymore.
+func (s *MonstiClient) ReloadSites() error {
+	if s.Error != nil {
+		return s.Error
+	}
+	if err := s.RPCClient.Call("Monsti.ReloadSites", 0, new(int)); err != nil {
+		return fmt.Errorf("service: ReloadSites error: %v", err)
+	}
+	return nil
+}
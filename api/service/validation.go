@@ -0,0 +1,185 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"pkg.monsti.org/gettext"
+)
+
+// ValidationError is returned when writing nodes with invalid fields.
+type ValidationError struct {
+	// Fields maps the ids of the invalid fields to error messages.
+	Fields map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	ids := make([]string, 0, len(e.Fields))
+	for id := range e.Fields {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	msgs := make([]string, len(ids))
+	for i, id := range ids {
+		msgs[i] = fmt.Sprintf("%v: %v", id, e.Fields[id])
+	}
+	return "Invalid fields: " + strings.Join(msgs, "; ")
+}
+
+// validationError returns the field's custom error message in the
+// given locale or the given default message.
+func (f *NodeField) validationError(locale, msg string) string {
+	if custom, ok := f.ValidationError[locale]; ok {
+		return custom
+	}
+	if custom, ok := f.ValidationError["en"]; ok {
+		return custom
+	}
+	return msg
+}
+
+// isEmpty checks if the given value has not been filled in.
+func isEmpty(value Field) bool {
+	if value, ok := value.(*BooleanField); ok {
+		return !bool(*value)
+	}
+	return len(value.String()) == 0
+}
+
+// ValidateField checks the value of the given field.
+//
+// Besides the rules declared on the field, the value's own validation
+// is used if it implements ValidatingField. Returns an error message
+// in the given locale or the empty string if the value is valid.
+//
+// Files are not stored in the field's value and must be validated
+// using ValidateFile.
+func ValidateField(field *NodeField, value Field, locale string) string {
+	G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+	if field.Type == "File" {
+		return ""
+	}
+	if isEmpty(value) {
+		if field.Required {
+			return field.validationError(locale, G("Required."))
+		}
+		return ""
+	}
+	if _, nested := value.(FormControlField); !nested {
+		length := utf8.RuneCountInString(value.String())
+		if field.MinLength > 0 && length < field.MinLength {
+			return field.validationError(locale, fmt.Sprintf(
+				G("Please enter at least %v characters."), field.MinLength))
+		}
+		if field.MaxLength > 0 && length > field.MaxLength {
+			return field.validationError(locale, fmt.Sprintf(
+				G("Please enter at most %v characters."), field.MaxLength))
+		}
+		if len(field.Regexp) > 0 {
+			matched, err := regexp.MatchString(field.Regexp, value.String())
+			if err != nil {
+				return fmt.Sprintf(G("Invalid regular expression: %v"), err)
+			}
+			if !matched {
+				return field.validationError(locale, G("Invalid value."))
+			}
+		}
+	}
+	if value, ok := value.(ValidatingField); ok {
+		if msg := value.Validate(field, locale); msg != "" {
+			return field.validationError(locale, msg)
+		}
+	}
+	return ""
+}
+
+// matchMimeType checks if the MIME type matches one of the given
+// patterns like "image/png" or "image/*".
+func matchMimeType(mimeType string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if pattern == mimeType || strings.HasSuffix(pattern, "/*") &&
+			strings.HasPrefix(mimeType, pattern[:len(pattern)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateFile checks the content of a file to be stored for the given
+// field against the allowed MIME types and maximum size.
+//
+// Returns an error message in the given locale or the empty string if
+// the file is valid.
+func ValidateFile(field *NodeField, content []byte, locale string) string {
+	return ValidateFileHead(field, content, int64(len(content)), locale)
+}
+
+// ValidateFileHead is like ValidateFile, but only needs the beginning
+// of the file and its total size.
+//
+// The MIME type is detected using the first 512 bytes of head.
+func ValidateFileHead(field *NodeField, head []byte, size int64,
+	locale string) string {
+	G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+	if field.MaxSize > 0 && size > field.MaxSize {
+		return field.validationError(locale, fmt.Sprintf(
+			G("The file must not be larger than %v bytes."), field.MaxSize))
+	}
+	if len(field.MimeTypes) > 0 {
+		mimeType := http.DetectContentType(head)
+		if i := strings.Index(mimeType, ";"); i >= 0 {
+			mimeType = mimeType[:i]
+		}
+		if !matchMimeType(mimeType, field.MimeTypes) {
+			return field.validationError(locale, fmt.Sprintf(
+				G("Files of type %v are not allowed."), mimeType))
+		}
+	}
+	return ""
+}
+
+// Validate checks the fields and translated fields of the node.
+//
+// Returns a *ValidationError with messages in the given locale if
+// some fields are not valid.
+func (n *Node) Validate(locale string) error {
+	errors := make(map[string]string)
+	for _, field := range append(n.Type.Fields, n.LocalFields...) {
+		if value, ok := n.Fields[field.Id]; ok {
+			if msg := ValidateField(field, value, locale); msg != "" {
+				errors[field.Id] = msg
+			}
+		}
+		for translation, fields := range n.Translations {
+			if value, ok := fields[field.Id]; ok {
+				if msg := ValidateField(field, value, locale); msg != "" {
+					errors[field.Id] = fmt.Sprintf("%v (%v)", msg, translation)
+				}
+			}
+		}
+	}
+	if len(errors) > 0 {
+		return &ValidationError{errors}
+	}
+	return nil
+}
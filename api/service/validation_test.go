@@ -0,0 +1,121 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestValidateField(t *testing.T) {
+	text := func(v string) Field { f := TextField(v); return &f }
+	integer := func(v int) Field { f := IntegerField(v); return &f }
+	boolean := func(v bool) Field { f := BooleanField(v); return &f }
+	email := func(v string) Field { f := EmailField(v); return &f }
+	tests := []struct {
+		Field NodeField
+		Value Field
+		Msg   string
+	}{
+		{NodeField{}, text(""), ""},
+		{NodeField{Required: true}, text(""), "Required."},
+		{NodeField{Type: "HTMLArea", Required: true}, new(HTMLField), "Required."},
+		{NodeField{Type: "File", Required: true}, new(FileField), ""},
+		{NodeField{Required: true}, boolean(false), "Required."},
+		{NodeField{Required: true}, boolean(true), ""},
+		{NodeField{MinLength: 3}, text(""), ""},
+		{NodeField{MinLength: 3}, text("äö"), "Please enter at least 3 characters."},
+		{NodeField{MinLength: 3}, text("äöü"), ""},
+		{NodeField{MaxLength: 3}, text("abcd"), "Please enter at most 3 characters."},
+		{NodeField{Regexp: `^[a-z]+$`}, text("abc"), ""},
+		{NodeField{Regexp: `^[a-z]+$`}, text("aBc"), "Invalid value."},
+		{NodeField{Regexp: `^[a-z]+$`, ValidationError: map[string]string{
+			"en": "Lower case only.", "de": "Nur Kleinbuchstaben."}},
+			text("aBc"), "Lower case only."},
+		{NodeField{Min: 1, Max: 10}, integer(11),
+			"Please enter a value between 1 and 10."},
+		{NodeField{Min: 1, Max: 10, ValidationError: map[string]string{
+			"en": "Out of range."}}, integer(11), "Out of range."},
+		{NodeField{}, email("foo"), "Please enter a valid email address."},
+	}
+	for i, test := range tests {
+		ret := ValidateField(&test.Field, test.Value, "en")
+		if ret != test.Msg {
+			t.Errorf("%v: ValidateField(%v, %v) = %q, should be %q", i,
+				test.Field, test.Value, ret, test.Msg)
+		}
+	}
+}
+
+func TestValidateFile(t *testing.T) {
+	png := []byte("\x89PNG\x0D\x0A\x1A\x0A" + "rest of the image")
+	tests := []struct {
+		Field   NodeField
+		Content []byte
+		Valid   bool
+	}{
+		{NodeField{}, png, true},
+		{NodeField{MimeTypes: []string{"image/png"}}, png, true},
+		{NodeField{MimeTypes: []string{"image/*"}}, png, true},
+		{NodeField{MimeTypes: []string{"image/*"}}, []byte("Hello"), false},
+		{NodeField{MimeTypes: []string{"text/plain"}}, []byte("Hello"), true},
+		{NodeField{MaxSize: 10}, png, false},
+		{NodeField{MaxSize: 10}, bytes.Repeat([]byte("a"), 10), true},
+	}
+	for i, test := range tests {
+		ret := ValidateFile(&test.Field, test.Content, "en")
+		if test.Valid && ret != "" {
+			t.Errorf("%v: File should be valid, got %q", i, ret)
+		}
+		if !test.Valid && ret == "" {
+			t.Errorf("%v: File should be invalid", i)
+		}
+	}
+	field := NodeField{MimeTypes: []string{"image/png"}, MaxSize: 100}
+	if ret := ValidateFileHead(&field, png, 100, "en"); ret != "" {
+		t.Errorf("File should be valid, got %q", ret)
+	}
+	if ret := ValidateFileHead(&field, png, 101, "en"); ret == "" {
+		t.Errorf("File larger than MaxSize should be invalid")
+	}
+}
+
+func TestNodeValidate(t *testing.T) {
+	node := Node{Type: &NodeType{Fields: []*NodeField{
+		{Id: "foo.Title", Type: "Text", Required: true},
+		{Id: "foo.Body", Type: "Text", MaxLength: 5},
+	}}}
+	if err := node.InitFields(nil, ""); err != nil {
+		t.Fatalf("Could not init fields: %v", err)
+	}
+	err := node.Validate("en")
+	if verr, ok := err.(*ValidationError); !ok ||
+		verr.Fields["foo.Title"] != "Required." || len(verr.Fields) != 1 {
+		t.Errorf("Validate should report missing title, got %v", err)
+	}
+	*(node.Fields["foo.Title"].(*TextField)) = "Title"
+	if err := node.Validate("en"); err != nil {
+		t.Errorf("Node should be valid, got %v", err)
+	}
+	node.InitTranslation("de")
+	*(node.Translations["de"]["foo.Body"].(*TextField)) = "Zu lang"
+	err = node.Validate("en")
+	if verr, ok := err.(*ValidationError); !ok ||
+		verr.Fields["foo.Body"] != "Please enter at most 5 characters. (de)" {
+		t.Errorf("Validate should report invalid translation, got %v", err)
+	}
+}
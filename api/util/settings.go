@@ -17,7 +17,22 @@ type SiteSettings struct {
 	// Title as used in HTML head.
 	Title string
 	// The hosts which should deliver this site.
+	//
+	// Hosts without port match requests for any port. Hosts starting
+	// with "*." match all subdomains, e.g. "*.example.com".
 	Hosts []string
+	// Aliases are further hosts of the site like Hosts. Requests for
+	// aliases are permanently redirected to the canonical host.
+	Aliases []string
+	// CanonicalHost is the host aliases get redirected to. Defaults to
+	// the first of Hosts. If set, requests for all other hosts of the
+	// site are redirected to it.
+	CanonicalHost string
+	// ForceHTTPS permanently redirects requests not using HTTPS to
+	// HTTPS. Requests forwarded by trusted proxies (see the daemon's
+	// TrustedProxies setting) are identified by their
+	// X-Forwarded-Proto header.
+	ForceHTTPS bool
 	// EmailName is used as name in the From header of outgoing site emails.
 	// BaseURL is the URL to the root of the site. Used to generate
 	// absolute URLs.
@@ -35,8 +50,116 @@ type SiteSettings struct {
 	SessionAuthKey string
 	// Key to authenticate password request tokens.
 	PasswordTokenKey string
-	// Locale used to translate monsti's web interface.
+	// PasswordTokenMaxAge is the time in hours a password request token
+	// stays valid. Defaults to 24 hours.
+	PasswordTokenMaxAge int
+	// PasswordPolicy restricts the passwords users may choose.
+	PasswordPolicy PasswordPolicy
+	// Authenticators used to log in users, tried in the given order.
+	//
+	// Defaults to the site's user database (users.json).
+	Authenticators []AuthenticatorSettings
+	// Locale used to translate monsti's web interface. It is also
+	// the default language of the site's content.
 	Locale string
+	// Locales lists the languages the site's content may be translated
+	// to, including the default Locale.
+	Locales []string
+	// TranslationFallback enables to show the content in the default
+	// locale if a node has not been translated to the requested
+	// locale. Otherwise, untranslated nodes will not be found.
+	TranslationFallback bool
+	// MemoryCacheSize is the size in MiB of the in-memory cache in front
+	// of the site's cache on disk. Defaults to 16 MiB. Negative values
+	// disable the memory cache.
+	MemoryCacheSize int
+	// Purge configures the invalidation of caching reverse proxies in
+	// front of the site.
+	Purge PurgeSettings
+}
+
+// PurgeSettings configures the invalidation of caching reverse proxies
+// (e.g. Varnish or nginx) if cached pages of the site change.
+type PurgeSettings struct {
+	// Endpoints are the URLs of the proxies, e.g.
+	// "http://127.0.0.1:6081". The path of each invalidated URL gets
+	// appended.
+	Endpoints []string
+	// Method is the request method sent to the endpoints, "PURGE"
+	// (default) or "BAN". BAN requests include the X-Ban-Url header
+	// with a regular expression matching the URL with any query.
+	Method string
+	// Webhook is a URL receiving POST requests with the invalidated
+	// URLs as JSON.
+	Webhook string
+	// Headers are added to all requests, e.g. for authentication.
+	Headers map[string]string
+}
+
+// AuthenticatorSettings configures a way to authenticate users.
+type AuthenticatorSettings struct {
+	// Name identifies the authenticator. It must not change as long as
+	// users are logged in with it.
+	Name string
+	// Type of the authenticator: "users" (the site's user database),
+	// "ldap", or "oidc".
+	Type string
+	// Title is shown to users on the login page, e.g. "Company account".
+	Title string
+	// Logins restricts the users that may log in with this
+	// authenticator. If empty, all users of the site's user database
+	// may log in, but nobody using external authenticators (LDAP or
+	// OpenID Connect).
+	Logins []string
+	// LDAP configures authenticators of type "ldap".
+	LDAP LDAPSettings
+	// OIDC configures authenticators of type "oidc".
+	OIDC OIDCSettings
+}
+
+// LDAPSettings configures authentication via LDAP simple bind.
+type LDAPSettings struct {
+	// Address of the LDAP server, e.g. "ldap.example.com:389".
+	Address string
+	// TLS enables LDAPS (i.e. TLS from the start of the connection).
+	TLS bool
+	// UserDN is the DN template of users, with %s being replaced by
+	// the login, e.g. "uid=%s,ou=people,dc=example,dc=com".
+	UserDN string
+	// BindDN and BindPassword are the credentials used to look up
+	// users of active sessions. If not set, only the login of these
+	// users will be known.
+	BindDN, BindPassword string
+	// NameAttribute and EmailAttribute are the attributes holding the
+	// user's name and email address. Default to "cn" and "mail".
+	NameAttribute, EmailAttribute string
+}
+
+// OIDCSettings configures authentication via OAuth2 / OpenID Connect
+// using the authorization code flow.
+type OIDCSettings struct {
+	// AuthURL, TokenURL, and UserInfoURL are the provider's endpoints.
+	AuthURL, TokenURL, UserInfoURL string
+	// ClientID and ClientSecret identify the site at the provider.
+	ClientID, ClientSecret string
+	// Scopes to request. Defaults to "openid", "profile", and "email".
+	Scopes []string
+	// LoginClaim is the user info claim used as the user's
+	// login. Defaults to "sub", the provider's immutable identifier of
+	// the user.
+	LoginClaim string
+}
+
+// PasswordPolicy restricts the passwords users may choose.
+type PasswordPolicy struct {
+	// MinLength is the minimum number of characters of a
+	// password. Defaults to 8.
+	MinLength int
+	// BreachedList is the path to a file containing passwords known
+	// from data breaches, one per line. These passwords will be
+	// rejected. Relative paths are relative to the site's configuration
+	// directory.
+	BreachedList string
 }
 
 // MonstiSettings holds common Monsti settings.
@@ -135,14 +258,43 @@ func loadSiteSettings(sitesDir string) (map[string]SiteSettings, error) {
 		if len(siteSettings.Locale) == 0 {
 			siteSettings.Locale = "en"
 		}
+		hasDefaultLocale := false
+		for _, locale := range siteSettings.Locales {
+			if locale == siteSettings.Locale {
+				hasDefaultLocale = true
+			}
+		}
+		if !hasDefaultLocale {
+			siteSettings.Locales = append([]string{siteSettings.Locale},
+				siteSettings.Locales...)
+		}
+		if siteSettings.PasswordTokenMaxAge == 0 {
+			siteSettings.PasswordTokenMaxAge = 24
+		}
+		if siteSettings.PasswordPolicy.MinLength == 0 {
+			siteSettings.PasswordPolicy.MinLength = 8
+		}
+		if len(siteSettings.PasswordPolicy.BreachedList) > 0 {
+			MakeAbsolute(&siteSettings.PasswordPolicy.BreachedList, sitePath)
+		}
+		if len(siteSettings.Authenticators) == 0 {
+			siteSettings.Authenticators = []AuthenticatorSettings{
+				{Name: "users", Type: "users"}}
+		}
 		sites[siteName] = siteSettings
 	}
 	return sites, nil
 }
 
+// ReadSiteSettings returns the configurated sites' settings without
+// replacing the loaded ones.
+func (s MonstiSettings) ReadSiteSettings() (map[string]SiteSettings, error) {
+	return loadSiteSettings(filepath.Join(s.Directories.Config, "sites"))
+}
+
 // LoadSiteSettings loads the configurated sites' settings.
 func (s *MonstiSettings) LoadSiteSettings() error {
-	sites, err := loadSiteSettings(filepath.Join(s.Directories.Config, "sites"))
+	sites, err := s.ReadSiteSettings()
 	if err != nil {
 		return err
 	}
@@ -60,6 +60,19 @@ title: "Linked Example Site"
 	if entry.Locale != "en" {
 		t.Errorf(`Default locale is not "en"`)
 	}
+	if len(entry.Locales) != 1 || entry.Locales[0] != "en" {
+		t.Errorf(`Default locales should be ["en"], got %v`, entry.Locales)
+	}
+	if entry.PasswordTokenMaxAge != 24 {
+		t.Errorf(`Default password token max age is not 24`)
+	}
+	if entry.PasswordPolicy.MinLength != 8 {
+		t.Errorf(`Default password min length is not 8`)
+	}
+	if len(entry.Authenticators) != 1 || entry.Authenticators[0].Type != "users" {
+		t.Errorf(`Default authenticators should be the user database, got %v`,
+			entry.Authenticators)
+	}
 	if len(entry.Hosts) != 1 || entry.Hosts[0] != "localhost:8080" {
 		entry := sites["example"]
 		if entry.Title != "Monsti CMS Example Site" {
@@ -39,6 +39,8 @@ type Context map[string]interface{}
 type Renderer struct {
 	// Root is the absolute path to the template directory.
 	Root string
+	// Funcs are additional functions available in templates.
+	Funcs template.FuncMap
 }
 
 // getIncludes searches for include and template.include files.
@@ -113,6 +115,7 @@ func (r Renderer) Render(name string, context interface{},
 		},
 	}
 	tmpl.Funcs(funcs)
+	tmpl.Funcs(r.Funcs)
 	err := parse(name, tmpl, r.Root, siteTemplates)
 	if err != nil {
 		return nil, err
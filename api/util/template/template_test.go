@@ -4,6 +4,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 
 	mtesting "pkg.monsti.org/monsti/api/util/testing"
@@ -33,3 +34,18 @@ func TestGetIncludes(t *testing.T) {
 			includes, err, expected)
 	}
 }
+
+func TestRenderFuncs(t *testing.T) {
+	root, cleanup, err := mtesting.CreateDirectoryTree(map[string]string{
+		"/foo.html": `{{shout "hello"}}`}, "TestRenderFuncs")
+	if err != nil {
+		t.Fatalf("Could not create test directory tree: %v", err)
+	}
+	defer cleanup()
+	renderer := Renderer{Root: root, Funcs: map[string]interface{}{
+		"shout": strings.ToUpper}}
+	ret, err := renderer.Render("foo", nil, "", "")
+	if err != nil || string(ret) != "HELLO" {
+		t.Errorf(`Render returned %q, %v should be "HELLO", nil`, ret, err)
+	}
+}
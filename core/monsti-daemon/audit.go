@@ -0,0 +1,194 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// auditLogPath returns the path to the audit log in the given site
+// data directory.
+//
+// The log is append-only and contains one JSON encoded entry per line.
+func auditLogPath(dataDir string) string {
+	return filepath.Join(dataDir, "audit.log")
+}
+
+// appendAuditEntry appends the given entry to the audit log in the
+// given site data directory.
+func appendAuditEntry(dataDir string, entry *service.AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("Could not encode audit entry: %v", err)
+	}
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return fmt.Errorf("Could not create data directory: %v", err)
+	}
+	file, err := os.OpenFile(auditLogPath(dataDir),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("Could not open audit log: %v", err)
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return fmt.Errorf("Could not write audit log: %v", err)
+	}
+	return file.Close()
+}
+
+// readAuditEntries returns the entries of the audit log in the given
+// site data directory selected by the filter.
+func readAuditEntries(dataDir string, filter *service.AuditFilter) (
+	[]*service.AuditEntry, error) {
+	file, err := os.Open(auditLogPath(dataDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Could not open audit log: %v", err)
+	}
+	defer file.Close()
+	var entries []*service.AuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		entry := new(service.AuditEntry)
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return nil, fmt.Errorf("Could not decode audit entry: %v", err)
+		}
+		if filter.Match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Could not read audit log: %v", err)
+	}
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[len(entries)-filter.Limit:]
+	}
+	return entries, nil
+}
+
+// clientIP returns the IP address of the request's client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// writeAudit records the given action of the user with the given
+// login in the site's audit log.
+func writeAudit(c *reqContext, action, login, details string) error {
+	err := c.Serv.Monsti().WriteAuditEntry(c.Site.Name, &service.AuditEntry{
+		AuditActor: service.AuditActor{User: login, IP: clientIP(c.Req)},
+		Action:     action, Path: c.Node.Path, Details: details})
+	if err != nil {
+		return fmt.Errorf("Could not write audit entry: %v", err)
+	}
+	return nil
+}
+
+type auditFormData struct {
+	User, Path   string
+	Since, Until string
+}
+
+// Audit shows the site's audit log.
+func (h *nodeHandler) Audit(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	data := auditFormData{}
+	form := htmlwidgets.NewForm(&data)
+	form.Action = "@@audit"
+	form.AddWidget(new(htmlwidgets.TextWidget), "User", G("User"), "")
+	form.AddWidget(new(htmlwidgets.TextWidget), "Path", G("Path"),
+		G("Show changes of this node and all nodes below."))
+	form.AddWidget(new(htmlwidgets.TextWidget), "Since", G("Since"),
+		G("Date in the format YYYY-MM-DD."))
+	form.AddWidget(new(htmlwidgets.TextWidget), "Until", G("Until"),
+		G("Date in the format YYYY-MM-DD."))
+
+	filter := service.AuditFilter{Limit: 500}
+	if c.Req.Method != "GET" {
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	if len(c.Req.Form) > 0 && form.Fill(c.Req.Form) {
+		filter.User = data.User
+		filter.Path = data.Path
+		var timezone string
+		err := c.Serv.Monsti().GetSiteConfig(c.Site.Name, "core.timezone",
+			&timezone)
+		if err != nil {
+			return fmt.Errorf("Could not get timezone: %v", err)
+		}
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			loc = time.UTC
+		}
+		if len(data.Since) > 0 {
+			since, err := time.ParseInLocation("2006-01-02", data.Since, loc)
+			if err != nil {
+				form.AddError("Since", G("Invalid date."))
+			} else {
+				filter.Since = since
+			}
+		}
+		if len(data.Until) > 0 {
+			until, err := time.ParseInLocation("2006-01-02", data.Until, loc)
+			if err != nil {
+				form.AddError("Until", G("Invalid date."))
+			} else {
+				filter.Until = until.AddDate(0, 0, 1).Add(-time.Nanosecond)
+			}
+		}
+	}
+	entries, err := c.Serv.Monsti().GetAuditEntries(c.Site.Name, &filter)
+	if err != nil {
+		return fmt.Errorf("Could not get audit entries: %v", err)
+	}
+	// Show most recent entries first.
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	body, err := h.Renderer.Render("actions/audit", template.Context{
+		"Form":    form.RenderData(),
+		"Entries": entries,
+		"Limit":   filter.Limit,
+	}, c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render audit log: %v", err)
+	}
+	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
+		Title: G("Audit log"), Flags: EDIT_VIEW}
+	rendered, _ := renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv)
+	c.Res.Write(rendered)
+	return nil
+}
@@ -0,0 +1,86 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestAuditLog(t *testing.T) {
+	root, err := ioutil.TempDir("", "_monsti_audit_log")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(root)
+	dataDir := filepath.Join(root, "data")
+
+	entries, err := readAuditEntries(dataDir, &service.AuditFilter{})
+	if err != nil || entries != nil {
+		t.Errorf("readAuditEntries on missing log = %v, %v", entries, err)
+	}
+
+	now := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	written := []*service.AuditEntry{
+		{Time: now, Site: "example", Action: service.AuditLogin,
+			AuditActor: service.AuditActor{User: "foo", IP: "127.0.0.1"},
+			Path:       "/"},
+		{Time: now.Add(time.Hour), Site: "example",
+			Action:     service.AuditWriteNode,
+			AuditActor: service.AuditActor{User: "foo", IP: "127.0.0.1"},
+			Path:       "/foo", Details: "node.json"},
+		{Time: now.Add(48 * time.Hour), Site: "example",
+			Action:     service.AuditRenameNode,
+			AuditActor: service.AuditActor{User: "bar", IP: "::1"},
+			Path:       "/foo/bar", Details: "/bar"},
+	}
+	for _, entry := range written {
+		if err := appendAuditEntry(dataDir, entry); err != nil {
+			t.Fatalf("Could not append audit entry: %v", err)
+		}
+	}
+
+	tests := []struct {
+		Filter   service.AuditFilter
+		Expected []*service.AuditEntry
+	}{
+		{service.AuditFilter{}, written},
+		{service.AuditFilter{User: "foo"}, written[:2]},
+		{service.AuditFilter{Path: "/foo"}, written[1:]},
+		{service.AuditFilter{Path: "/foo/"}, written[1:]},
+		{service.AuditFilter{Path: "/fo"}, nil},
+		{service.AuditFilter{Since: now.Add(time.Minute)}, written[1:]},
+		{service.AuditFilter{Until: now.Add(time.Hour)}, written[:2]},
+		{service.AuditFilter{Limit: 1}, written[2:]},
+	}
+	for i, v := range tests {
+		entries, err := readAuditEntries(dataDir, &v.Filter)
+		if err != nil {
+			t.Errorf("%v: readAuditEntries returned error: %v", i, err)
+		}
+		if !reflect.DeepEqual(entries, v.Expected) {
+			t.Errorf("%v: readAuditEntries(_, %v) = %v, should be %v", i,
+				v.Filter, entries, v.Expected)
+		}
+	}
+}
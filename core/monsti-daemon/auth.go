@@ -0,0 +1,142 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// authenticator looks up users of some user source.
+type authenticator interface {
+	// Settings returns the settings of the authenticator.
+	Settings() util.AuthenticatorSettings
+	// GetUser returns the user with the given login. If there is no
+	// such user, returns nil.
+	GetUser(login string) (*service.User, error)
+}
+
+// passwordAuthenticator is an authenticator that checks login and
+// password entered at the login form.
+type passwordAuthenticator interface {
+	authenticator
+	// Authenticate returns the user with the given login if the
+	// password is correct. Otherwise, it returns nil.
+	Authenticate(login, password string) (*service.User, error)
+}
+
+// redirectAuthenticator is an authenticator that redirects users to
+// an external login page, e.g. of an OAuth2 provider.
+type redirectAuthenticator interface {
+	authenticator
+	// AuthCodeURL returns the URL of the external login page. After
+	// the login, the provider redirects to redirectURL, passing the
+	// given state and an authorization code.
+	AuthCodeURL(state, redirectURL string) string
+	// Exchange returns the user authenticated by the given
+	// authorization code. If the user may not log in, returns nil.
+	Exchange(code, redirectURL string) (*service.User, error)
+}
+
+// userDatabase authenticates users of the site's user database
+// (users.json).
+type userDatabase struct {
+	settings util.AuthenticatorSettings
+	// dataDir is the site's data directory.
+	dataDir string
+}
+
+func (u *userDatabase) Settings() util.AuthenticatorSettings {
+	return u.settings
+}
+
+func (u *userDatabase) GetUser(login string) (*service.User, error) {
+	if !allowedLogin(u.settings, login) {
+		return nil, nil
+	}
+	return getUser(login, u.dataDir)
+}
+
+func (u *userDatabase) Authenticate(login, password string) (
+	*service.User, error) {
+	user, err := u.GetUser(login)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	if !passwordEqual(user.Password, password) {
+		return nil, nil
+	}
+	return user, nil
+}
+
+// allowedLogin checks if the given login may use the authenticator.
+//
+// External authenticators fail closed: Only the configured logins may
+// use them. Otherwise, every account of a company wide directory
+// could edit the site.
+func allowedLogin(settings util.AuthenticatorSettings, login string) bool {
+	if len(settings.Logins) == 0 {
+		return settings.Type == "users"
+	}
+	return inStringSlice(login, settings.Logins)
+}
+
+// getAuthenticators returns the authenticators configured for the
+// given site.
+func getAuthenticators(site util.SiteSettings, dataDir string) (
+	[]authenticator, error) {
+	auths := make([]authenticator, 0, len(site.Authenticators))
+	for _, settings := range site.Authenticators {
+		var auth authenticator
+		switch settings.Type {
+		case "users":
+			auth = &userDatabase{settings, dataDir}
+		case "ldap":
+			auth = newLDAPAuthenticator(settings)
+		case "oidc":
+			auth = newOIDCAuthenticator(settings)
+		default:
+			return nil, fmt.Errorf("Unknown authenticator type %q", settings.Type)
+		}
+		auths = append(auths, auth)
+	}
+	return auths, nil
+}
+
+// findAuthenticator returns the authenticator with the given name or
+// nil.
+func findAuthenticator(auths []authenticator, name string) authenticator {
+	for _, auth := range auths {
+		if auth.Settings().Name == name {
+			return auth
+		}
+	}
+	return nil
+}
+
+// findUserDatabase returns the first user database authenticator or
+// nil.
+func findUserDatabase(auths []authenticator) *userDatabase {
+	for _, auth := range auths {
+		if db, ok := auth.(*userDatabase); ok {
+			return db
+		}
+	}
+	return nil
+}
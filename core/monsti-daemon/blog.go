@@ -50,46 +50,57 @@ func (s *nodeSort) Less(i, j int) bool {
 	return s.Sorter(s.Nodes[i], s.Nodes[j])
 }
 
+// getBlogPosts returns the posts of the blog, newest first.
+//
+// Posts which have not been published are only returned to
+// authenticated users. The returned cache mods let the cache expire
+// when the next post gets published.
 func getBlogPosts(req *service.Request, blogPath string, s *service.Session,
-	limit int) ([]*service.Node, error) {
+	limit int) ([]*service.Node, *service.CacheMods, error) {
 	var posts []*service.Node
+	mods := new(service.CacheMods)
 	years, err := s.Monsti().GetChildren(req.Site, blogPath)
 	if err != nil {
-		return nil, fmt.Errorf("Could not fetch year children: %v", err)
+		return nil, nil, fmt.Errorf("Could not fetch year children: %v", err)
 	}
 	for _, year := range years {
 		months, err := s.Monsti().GetChildren(req.Site, year.Path)
 		if err != nil {
-			return nil, fmt.Errorf("Could not fetch month children: %v", err)
+			return nil, nil, fmt.Errorf("Could not fetch month children: %v", err)
 		}
 		for _, month := range months {
 			monthPosts, err := s.Monsti().GetChildren(req.Site, month.Path)
 			if err != nil {
-				return nil, fmt.Errorf("Could not fetch month children: %v", err)
+				return nil, nil, fmt.Errorf("Could not fetch month children: %v", err)
+			}
+			mods.ExpireOnPublish(monthPosts...)
+			for _, post := range monthPosts {
+				if req.Session.User != nil || post.Published() {
+					posts = append(posts, post)
+				}
 			}
-			posts = append(posts, monthPosts...)
 		}
 	}
 	order := func(left, right *service.Node) bool {
 		return left.PublishTime.Before(right.PublishTime)
 	}
 	sort.Sort(sort.Reverse(&nodeSort{posts, order}))
-	return posts, nil
+	return posts, mods, nil
 }
 
 func getBlogContext(reqId uint, embed *service.EmbedNode,
 	s *service.Session, settings *settings, renderer *mtemplate.Renderer) (
-	map[string][]byte, error) {
+	map[string][]byte, *service.CacheMods, error) {
 	req, err := s.Monsti().GetRequest(reqId)
 	if err != nil {
-		return nil, fmt.Errorf("Could not get request: %v", err)
+		return nil, nil, fmt.Errorf("Could not get request: %v", err)
 	}
 	query := req.Query
 	blogPath := req.NodePath
 	if embed != nil {
 		embedUrl, err := url.Parse(embed.URI)
 		if err != nil {
-			return nil, fmt.Errorf("Could not parse embed URI")
+			return nil, nil, fmt.Errorf("Could not parse embed URI")
 		}
 		query = embedUrl.Query()
 		blogPath = embedUrl.Path
@@ -103,16 +114,17 @@ func getBlogContext(reqId uint, embed *service.EmbedNode,
 	}
 	context := mtemplate.Context{}
 	context["Embedded"] = embed
-	context["Posts"], err = getBlogPosts(req, blogPath, s, limit)
+	posts, mods, err := getBlogPosts(req, blogPath, s, limit)
 	if err != nil {
-		return nil, fmt.Errorf("Could not retrieve blog posts: %v", err)
+		return nil, nil, fmt.Errorf("Could not retrieve blog posts: %v", err)
 	}
+	context["Posts"] = posts
 	rendered, err := renderer.Render("core/blogpost-list", context,
 		req.Session.Locale, settings.Monsti.GetSiteTemplatesPath(req.Site))
 	if err != nil {
-		return nil, fmt.Errorf("Could not render template: %v", err)
+		return nil, nil, fmt.Errorf("Could not render template: %v", err)
 	}
-	return map[string][]byte{"BlogPosts": rendered}, nil
+	return map[string][]byte{"BlogPosts": rendered}, mods, nil
 }
 
 func initBlog(settings *settings, session *service.Session, logger *log.Logger,
@@ -153,11 +165,12 @@ func initBlog(settings *settings, session *service.Session, logger *log.Logger,
 			map[string][]byte, *service.CacheMods, error) {
 			switch nodeType {
 			case "core.Blog":
-				ctx, err := getBlogContext(req, embedNode, session, settings, renderer)
+				ctx, mods, err := getBlogContext(req, embedNode, session, settings,
+					renderer)
 				if err != nil {
 					return nil, nil, fmt.Errorf("Could not get blog context: %v", err)
 				}
-				return ctx, nil, nil
+				return ctx, mods, nil
 			default:
 				return nil, nil, nil
 			}
@@ -0,0 +1,413 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// cacheEntryLimit is the maximum number of entries shown by the cache
+// view.
+const cacheEntryLimit = 500
+
+// walkCache calls fn for each cache file matching the filter.
+func walkCache(root string, filter service.CacheFilter,
+	fn func(node string, file os.FileInfo) error) error {
+	if len(filter.Pattern) > 0 {
+		if _, err := path.Match(filter.Pattern, ""); err != nil {
+			return fmt.Errorf("Invalid pattern %q: %v", filter.Pattern, err)
+		}
+	}
+	visit := func(node string) error {
+		files, err := ioutil.ReadDir(filepath.Join(root, node[1:], ".data"))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Could not read cache directory: %v", err)
+		}
+		for _, file := range files {
+			if len(filter.Pattern) > 0 {
+				if ok, _ := path.Match(filter.Pattern, file.Name()); !ok {
+					continue
+				}
+			}
+			if err := fn(node, file); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	node := path.Clean("/" + filter.Node)
+	if !filter.Descend {
+		return visit(node)
+	}
+	return filepath.Walk(filepath.Join(root, node[1:]),
+		func(dir string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !info.IsDir() {
+				return nil
+			}
+			if info.Name() == ".data" {
+				return filepath.SkipDir
+			}
+			rel, err := filepath.Rel(root, dir)
+			if err != nil {
+				return err
+			}
+			return visit(path.Join("/", filepath.ToSlash(rel)))
+		})
+}
+
+// cacheDeps returns the dependencies of all cache entries below the
+// given cache root.
+func cacheDeps(root string) (map[service.CacheDep][]service.CacheDep, error) {
+	deps := make(map[service.CacheDep][]service.CacheDep)
+	err := filepath.Walk(root, func(dir string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if info.Name() == ".data" {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(root, dir)
+		if err != nil {
+			return err
+		}
+		depMap, err := readRdeps(root, path.Join("/", filepath.ToSlash(rel)))
+		if err != nil {
+			return err
+		}
+		for dep, rdeps := range depMap {
+			for rdep := range rdeps {
+				deps[rdep] = appendCacheDep(deps[rdep], dep)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not read cache dependencies: %v", err)
+	}
+	return deps, nil
+}
+
+// appendCacheDep appends the dependency unless it's already included.
+func appendCacheDep(deps []service.CacheDep,
+	dep service.CacheDep) []service.CacheDep {
+	for _, existing := range deps {
+		if existing == dep {
+			return deps
+		}
+	}
+	return append(deps, dep)
+}
+
+type cacheEntries []service.CacheEntry
+
+func (e cacheEntries) Len() int {
+	return len(e)
+}
+
+func (e cacheEntries) Less(i, j int) bool {
+	if e[i].Node != e[j].Node {
+		return e[i].Node < e[j].Node
+	}
+	return e[i].Id < e[j].Id
+}
+
+func (e cacheEntries) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+}
+
+// listCache returns the cache entries matching the filter.
+func listCache(root string, filter service.CacheFilter) (
+	[]service.CacheEntry, error) {
+	deps, err := cacheDeps(root)
+	if err != nil {
+		return nil, err
+	}
+	var entries []service.CacheEntry
+	err = walkCache(root, filter, func(node string, file os.FileInfo) error {
+		entry := service.CacheEntry{
+			Node:     node,
+			Id:       file.Name(),
+			Size:     file.Size(),
+			Modified: file.ModTime(),
+			Deps:     deps[service.CacheDep{Node: node, Cache: file.Name()}],
+		}
+		raw, err := ioutil.ReadFile(filepath.Join(root, node[1:], ".data",
+			file.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Could not read cache data: %v", err)
+		}
+		var data cacheData
+		if gob.NewDecoder(bytes.NewReader(raw)).Decode(&data) == nil &&
+			data.CacheMods != nil {
+			entry.Expire = data.CacheMods.Expire
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not list cache: %v", err)
+	}
+	sort.Sort(cacheEntries(entries))
+	return entries, nil
+}
+
+// purgesSite returns true if the filter matches all entries of the
+// cache.
+func purgesSite(filter service.CacheFilter) bool {
+	return path.Clean("/"+filter.Node) == "/" && filter.Descend &&
+		len(filter.Pattern) == 0
+}
+
+// purgeCache removes the cache entries matching the filter and the
+// rdeps of the removed entries.
+//
+// Returns the removed entries.
+func purgeCache(root string, filter service.CacheFilter) (
+	[]service.CacheDep, error) {
+	lock := cacheLock(root)
+	lock.Lock()
+	defer lock.Unlock()
+	all := purgesSite(filter)
+	var removed []service.CacheDep
+	err := walkCache(root, filter, func(node string, file os.FileInfo) error {
+		if !all {
+			err := os.Remove(filepath.Join(root, node[1:], ".data", file.Name()))
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("Could not remove cache data: %v", err)
+			}
+		}
+		removed = append(removed, service.CacheDep{Node: node,
+			Cache: file.Name()})
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("Could not purge cache: %v", err)
+	}
+	// Purging the whole site also removes the dependencies.
+	if all {
+		if err := os.RemoveAll(root); err != nil {
+			return nil, fmt.Errorf("Could not purge cache: %v", err)
+		}
+		return removed, nil
+	}
+	if err := removeRdeps(root, removed); err != nil {
+		return removed, fmt.Errorf("Could not purge cache: %v", err)
+	}
+	return removed, nil
+}
+
+type CacheFilterArgs struct {
+	Site   string
+	Filter service.CacheFilter
+}
+
+func (i *MonstiService) GetCacheEntries(args *CacheFilterArgs,
+	reply *[]service.CacheEntry) error {
+	entries, err := listCache(i.Settings.Monsti.GetSiteCachePath(args.Site),
+		args.Filter)
+	*reply = entries
+	return err
+}
+
+func (i *MonstiService) PurgeCache(args *CacheFilterArgs, reply *int) error {
+	removed, err := purgeCache(i.Settings.Monsti.GetSiteCachePath(args.Site),
+		args.Filter)
+	*reply = len(removed)
+	// The memory cache does not know about the disk layout, so clear
+	// it completely.
+	i.memoryCache(args.Site).Clear()
+	if i.Purger != nil {
+		nodes := make([]string, 0, len(removed))
+		for _, entry := range removed {
+			nodes = append(nodes, entry.Node)
+		}
+		i.Purger.Emit(args.Site, nodes, purgesSite(args.Filter))
+	}
+	return err
+}
+
+func (i *MonstiService) WarmCache(site string, reply *int) error {
+	if i.Handler == nil {
+		return fmt.Errorf("HTTP handler has not been started yet")
+	}
+	var err error
+	*reply, err = i.Handler.WarmCache(site)
+	return err
+}
+
+// WarmCache fills the cache of the given site by requesting all
+// published nodes in all locales of the site.
+//
+// Returns the number of successfully requested pages.
+func (h *nodeHandler) WarmCache(site string) (int, error) {
+	settings, ok := h.Settings.Site(site)
+	if !ok || len(settings.Hosts) == 0 {
+		return 0, fmt.Errorf("Unknown site %q", site)
+	}
+	session, err := h.Sessions.New()
+	if err != nil {
+		return 0, fmt.Errorf("Could not get session: %v", err)
+	}
+	defer h.Sessions.Free(session)
+	m := session.Monsti()
+	root, err := m.GetNode(site, "/")
+	if err != nil {
+		return 0, fmt.Errorf("Could not get root node: %v", err)
+	}
+	nodes, err := walkNodes("/", func(nodePath string) ([]*service.Node, error) {
+		return m.GetChildren(site, nodePath)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Could not get nodes: %v", err)
+	}
+	if root != nil {
+		nodes = append([]*service.Node{root}, nodes...)
+	}
+	prefixes := []string{""}
+	if len(settings.Locales) > 1 {
+		prefixes = prefixes[:0]
+		for _, locale := range settings.Locales {
+			prefixes = append(prefixes, "/"+locale)
+		}
+	}
+	warmed := 0
+	for _, node := range nodes {
+		if !node.Published() {
+			continue
+		}
+		for _, prefix := range prefixes {
+			target := path.Join("/", prefix, node.Path)
+			if !strings.HasSuffix(target, "/") {
+				target += "/"
+			}
+			req, err := http.NewRequest("GET", internalURL(settings, target), nil)
+			if err != nil {
+				return warmed, fmt.Errorf("Could not create request: %v", err)
+			}
+			res := httptest.NewRecorder()
+			h.ServeHTTP(res, req)
+			if res.Code == http.StatusOK {
+				warmed++
+			}
+		}
+	}
+	return warmed, nil
+}
+
+// Cache shows the cache entries of the site and allows to purge and
+// warm the cache.
+//
+// POST requests with the parameter Action set to "purge" remove the
+// selected entries. If set to "warm", a job to warm the cache is
+// scheduled.
+func (h *nodeHandler) Cache(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	filter := service.CacheFilter{
+		Node:    c.Req.FormValue("Node"),
+		Descend: len(c.Req.FormValue("Descend")) > 0,
+		Pattern: c.Req.FormValue("Pattern"),
+	}
+	if len(filter.Node) == 0 {
+		filter.Node = c.Node.Path
+	}
+	filter.Node = path.Clean("/" + filter.Node)
+	m := c.Serv.Monsti()
+	var message string
+	switch c.Req.Method {
+	case "GET":
+	case "POST":
+		switch c.Req.FormValue("Action") {
+		case "purge":
+			removed, err := m.PurgeCache(c.Site.Name, &filter)
+			if err != nil {
+				return fmt.Errorf("Could not purge cache: %v", err)
+			}
+			message = fmt.Sprintf(G("Removed %v cache entries."), removed)
+		case "warm":
+			err := m.ScheduleJob(&service.Job{Id: "monsti.WarmCache:" + c.Site.Name,
+				Type: "monsti.WarmCache", Site: c.Site.Name, At: time.Now()})
+			if err != nil {
+				return fmt.Errorf("Could not schedule job: %v", err)
+			}
+			message = G("The cache is being warmed in the background.")
+		default:
+			return fmt.Errorf("Unknown cache action %q", c.Req.FormValue("Action"))
+		}
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	entries, err := m.GetCacheEntries(c.Site.Name, &filter)
+	if err != nil {
+		return fmt.Errorf("Could not get cache entries: %v", err)
+	}
+	var size int64
+	for _, entry := range entries {
+		size += entry.Size
+	}
+	count := len(entries)
+	if count > cacheEntryLimit {
+		entries = entries[:cacheEntryLimit]
+	}
+	body, err := h.Renderer.Render("actions/cache", template.Context{
+		"Filter":  filter,
+		"Entries": entries,
+		"Count":   count,
+		"Size":    size,
+		"Limit":   cacheEntryLimit,
+		"Message": message,
+	}, c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render cache view: %v", err)
+	}
+	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
+		Title: G("Cache"), Flags: EDIT_VIEW}
+	rendered, _ := renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv)
+	c.Res.Write(rendered)
+	return nil
+}
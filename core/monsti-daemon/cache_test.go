@@ -0,0 +1,198 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+// setupCache caches some test data and returns the cache root.
+func setupCache(t *testing.T) (string, func()) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{},
+		"TestCache")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	expire := time.Now().AddDate(1, 0, 0).Round(time.Second)
+	for _, entry := range []struct {
+		Node, Id string
+		Mods     service.CacheMods
+	}{
+		{"/", "core.page.full", service.CacheMods{
+			Deps: []service.CacheDep{{Node: "/", Descend: -1}}}},
+		{"/foo", "core.page.full", service.CacheMods{
+			Deps: []service.CacheDep{{Node: "/foo"}, {Node: "/", Descend: -1}}}},
+		{"/foo", "core.page.partial", service.CacheMods{
+			Deps: []service.CacheDep{{Node: "/foo"}}, Expire: expire}},
+		{"/foo/bar", "core.page.full", service.CacheMods{}},
+		{"/foo/bar", "core.image.small", service.CacheMods{}},
+		{"/foobar", "core.page.full", service.CacheMods{}},
+	} {
+		mods := entry.Mods
+		if err := toCache(root, entry.Node, entry.Id, []byte("data"),
+			&mods); err != nil {
+			t.Fatalf("Could not cache data: %v", err)
+		}
+	}
+	return root, cleanup
+}
+
+func TestListCache(t *testing.T) {
+	root, cleanup := setupCache(t)
+	defer cleanup()
+	tests := []struct {
+		Filter  service.CacheFilter
+		Entries []string
+	}{
+		{service.CacheFilter{}, []string{"/ core.page.full"}},
+		{service.CacheFilter{Node: "/foo"},
+			[]string{"/foo core.page.full", "/foo core.page.partial"}},
+		{service.CacheFilter{Node: "/foo", Descend: true},
+			[]string{"/foo core.page.full", "/foo core.page.partial",
+				"/foo/bar core.image.small", "/foo/bar core.page.full"}},
+		{service.CacheFilter{Descend: true, Pattern: "core.page.f*"},
+			[]string{"/ core.page.full", "/foo core.page.full",
+				"/foo/bar core.page.full", "/foobar core.page.full"}},
+		{service.CacheFilter{Node: "/unknown", Descend: true}, nil},
+	}
+	for _, test := range tests {
+		entries, err := listCache(root, test.Filter)
+		if err != nil {
+			t.Errorf("listCache(%+v) returns error: %v", test.Filter, err)
+			continue
+		}
+		var ret []string
+		for _, entry := range entries {
+			ret = append(ret, entry.Node+" "+entry.Id)
+		}
+		if !reflect.DeepEqual(ret, test.Entries) {
+			t.Errorf("listCache(%+v) returns %v, should be %v", test.Filter, ret,
+				test.Entries)
+		}
+	}
+
+	entries, err := listCache(root, service.CacheFilter{Node: "/foo"})
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("listCache returns %v, %v", entries, err)
+	}
+	deps := []service.CacheDep{{Node: "/", Descend: -1}, {Node: "/foo"}}
+	if entries[0].Size == 0 || !entries[0].Expire.IsZero() ||
+		!reflect.DeepEqual(entries[0].Deps, deps) {
+		t.Errorf("Wrong entry %+v, dependencies should be %v", entries[0], deps)
+	}
+	if entries[1].Expire.IsZero() || entries[1].Expired() {
+		t.Errorf("Entry %+v should expire next year", entries[1])
+	}
+
+	if _, err := listCache(root, service.CacheFilter{Pattern: "["}); err == nil {
+		t.Errorf("listCache should fail for invalid patterns")
+	}
+}
+
+func TestPurgeCache(t *testing.T) {
+	root, cleanup := setupCache(t)
+	defer cleanup()
+	tests := []struct {
+		Filter  service.CacheFilter
+		Removed int
+		Left    int
+	}{
+		{service.CacheFilter{Node: "/foo", Pattern: "core.page.partial"}, 1, 5},
+		{service.CacheFilter{Node: "/foo/bar", Pattern: "core.image.*"}, 1, 4},
+		{service.CacheFilter{Node: "/foo", Descend: true}, 2, 2},
+		{service.CacheFilter{Node: "/", Descend: true}, 2, 0},
+	}
+	for _, test := range tests {
+		removed, err := purgeCache(root, test.Filter)
+		if err != nil || len(removed) != test.Removed {
+			t.Errorf("purgeCache(%+v) returns %v, %v. Should remove %v entries",
+				test.Filter, removed, err, test.Removed)
+		}
+		entries, err := listCache(root, service.CacheFilter{Descend: true})
+		if err != nil || len(entries) != test.Left {
+			t.Errorf("After purgeCache(%+v), %v entries should be left, got %v, %v",
+				test.Filter, test.Left, entries, err)
+		}
+		for _, entry := range removed {
+			for _, node := range []string{"/", "/foo"} {
+				rdeps, err := readRdeps(root, node)
+				if err != nil {
+					t.Fatalf("Could not read rdeps: %v", err)
+				}
+				for dep, entries := range rdeps {
+					if _, ok := entries[entry]; ok {
+						t.Errorf("Purged entry %v should be removed from rdeps of %v",
+							entry, dep)
+					}
+				}
+			}
+		}
+	}
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Errorf("Purging the site should remove all dependencies")
+	}
+}
+
+func TestPurgeCacheEmit(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{},
+		"TestPurgeCacheEmit")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	settings := new(settings)
+	settings.Monsti.Directories.Data = root
+	site := util.SiteSettings{}
+	site.Purge.Webhook = "http://example.com/hook"
+	m := &MonstiService{Settings: settings, Purger: &purger{
+		Site: func(name string) (util.SiteSettings, bool) {
+			return site, true
+		},
+		events: make(chan purgeEvent, 1),
+	}}
+	for _, filter := range []service.CacheFilter{
+		{Node: "/foo"}, {Node: "/", Descend: true}} {
+		err = toCache(settings.Monsti.GetSiteCachePath("site"), "/foo",
+			"core.page.full", []byte("data"), &service.CacheMods{})
+		if err != nil {
+			t.Fatalf("Could not cache data: %v", err)
+		}
+		var removed int
+		if err := m.PurgeCache(&CacheFilterArgs{"site", filter},
+			&removed); err != nil {
+			t.Fatalf("Could not purge cache: %v", err)
+		}
+		if len(m.Purger.events) != 1 {
+			t.Fatalf("PurgeCache(%+v) should emit an event", filter)
+		}
+		event := <-m.Purger.events
+		if filter.Descend && !event.All {
+			t.Errorf("Purging the site should invalidate all URLs, got %v", event)
+		}
+		if !filter.Descend && !reflect.DeepEqual(event.Paths,
+			[]string{"/foo", "/foo/"}) {
+			t.Errorf("Purging /foo should invalidate its URLs, got %v", event)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// minCompressSize is the minimum size of responses to be compressed.
+// Smaller responses do not benefit from compression.
+const minCompressSize = 256
+
+// contentEncoder returns a writer compressing data written to w.
+type contentEncoder func(w io.Writer) (io.WriteCloser, error)
+
+// contentEncoders contains the available content codings of responses.
+//
+// There is no Brotli encoder in the standard library. Static files are
+// sent Brotli compressed if pre-compressed files (.br) exist. If an
+// encoder for "br" gets added (e.g. in a file using a Brotli package),
+// pages will be sent Brotli compressed, too.
+var contentEncoders = map[string]contentEncoder{
+	"gzip": func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	},
+}
+
+// contentEncodingExts contains the file extensions of pre-compressed
+// static files.
+var contentEncodingExts = map[string]string{
+	"br":   ".br",
+	"gzip": ".gz",
+}
+
+// contentEncodingPreference lists the content codings in the order of
+// preference if the client accepts several equally.
+var contentEncodingPreference = []string{"br", "gzip"}
+
+// hasEncoder returns true if there is an encoder for the given content
+// coding.
+func hasEncoder(coding string) bool {
+	_, ok := contentEncoders[coding]
+	return ok
+}
+
+// negotiateEncoding returns the content coding preferred by the client
+// according to the given Accept-Encoding header out of the codings for
+// which available returns true.
+//
+// Returns the empty string if the response should not be encoded.
+func negotiateEncoding(acceptEncoding string,
+	available func(coding string) bool) string {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if len(coding) == 0 {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					quality = q
+				}
+			}
+		}
+		accepted[coding] = quality
+	}
+	best, bestQuality := "", 0.0
+	for _, coding := range contentEncodingPreference {
+		if !available(coding) {
+			continue
+		}
+		quality, ok := accepted[coding]
+		if !ok {
+			quality = accepted["*"]
+		}
+		if quality > bestQuality {
+			best, bestQuality = coding, quality
+		}
+	}
+	return best
+}
+
+// compress encodes the data using the given content coding.
+func compress(data []byte, encoding string) ([]byte, error) {
+	encoder, ok := contentEncoders[encoding]
+	if !ok {
+		return nil, fmt.Errorf("Unknown content coding %q", encoding)
+	}
+	var out bytes.Buffer
+	w, err := encoder(&out)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create encoder: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("Could not compress data: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("Could not compress data: %v", err)
+	}
+	return out.Bytes(), nil
+}
+
+// compressible returns true if responses of the given content type
+// should be compressed.
+func compressible(contentType string) bool {
+	contentType = strings.TrimSpace(strings.Split(contentType, ";")[0])
+	switch contentType {
+	case "application/javascript", "application/x-javascript",
+		"application/json", "application/xml", "image/svg+xml":
+		return true
+	}
+	return strings.HasPrefix(contentType, "text/")
+}
+
+// writePage writes the rendered page compressed if the client accepts
+// it.
+//
+// If cacheId is not empty, the page has been cached with this id and
+// the given expiration time. The compressed page is then cached, too,
+// and gets invalidated together with the page.
+func (h *nodeHandler) writePage(c *reqContext, content []byte, node,
+	cacheId string, expire time.Time) error {
+	header := c.Res.Header()
+	header.Add("Vary", "Accept-Encoding")
+	if len(header.Get("Content-Type")) == 0 {
+		header.Set("Content-Type", "text/html; charset=utf-8")
+	}
+	encoding := negotiateEncoding(c.Req.Header.Get("Accept-Encoding"),
+		hasEncoder)
+	if len(encoding) == 0 || len(content) < minCompressSize {
+		c.Res.Write(content)
+		return nil
+	}
+	var encoded []byte
+	var err error
+	encodedId := cacheId + "." + encoding
+	if len(cacheId) > 0 {
+		encoded, _, err = h.fromCache(c, node, encodedId)
+		if err != nil {
+			return fmt.Errorf("Could not get compressed page: %v", err)
+		}
+	}
+	if encoded == nil {
+		encoded, err = compress(content, encoding)
+		if err != nil {
+			return err
+		}
+		if len(cacheId) > 0 {
+			mods := &service.CacheMods{
+				Deps:   []service.CacheDep{{Node: node, Cache: cacheId}},
+				Expire: expire}
+			if err := c.Serv.Monsti().ToCache(c.Site.Name, node, encodedId,
+				encoded, mods); err != nil {
+				return fmt.Errorf("Could not cache compressed page: %v", err)
+			}
+		}
+	}
+	header.Set("Content-Encoding", encoding)
+	c.Res.Write(encoded)
+	return nil
+}
+
+type compressedFile struct {
+	ModTime time.Time
+	Size    int64
+	Data    []byte
+}
+
+// compressedFileServer serves static files like http.FileServer, but
+// compressed if the client accepts it.
+//
+// Pre-compressed files (e.g. style.css.gz next to style.css) are used
+// if they are up to date, also for content codings without encoder
+// (e.g. Brotli). Otherwise, files get compressed once and are kept in
+// memory until they change.
+type compressedFileServer struct {
+	Root  http.FileSystem
+	files http.Handler
+	mutex sync.Mutex
+	// compressed contains compressed files by encoding and path.
+	compressed map[string]compressedFile
+}
+
+// newCompressedFileServer returns a file server for the given root.
+func newCompressedFileServer(root http.FileSystem) *compressedFileServer {
+	return &compressedFileServer{
+		Root:       root,
+		files:      http.FileServer(root),
+		compressed: make(map[string]compressedFile),
+	}
+}
+
+func (s *compressedFileServer) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+	name := path.Clean("/" + r.URL.Path)
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if !compressible(contentType) || len(r.Header.Get("Range")) > 0 {
+		s.files.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	file, err := s.Root.Open(name)
+	if err != nil {
+		s.files.ServeHTTP(w, r)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() || info.Size() < minCompressSize {
+		s.files.ServeHTTP(w, r)
+		return
+	}
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"),
+		func(coding string) bool {
+			if hasEncoder(coding) {
+				return true
+			}
+			if pre := s.preCompressed(name, coding, info.ModTime()); pre != nil {
+				pre.Close()
+				return true
+			}
+			return false
+		})
+	if len(encoding) == 0 {
+		s.files.ServeHTTP(w, r)
+		return
+	}
+	data, err := s.compress(name, file, info.ModTime(), info.Size(), encoding)
+	if err != nil {
+		http.Error(w, "Could not compress file", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Encoding", encoding)
+	http.ServeContent(w, r, name, info.ModTime(), bytes.NewReader(data))
+}
+
+// compress returns the compressed content of the given file.
+func (s *compressedFileServer) compress(name string, file io.Reader,
+	modTime time.Time, size int64, encoding string) ([]byte, error) {
+	key := encoding + ":" + name
+	s.mutex.Lock()
+	cached, ok := s.compressed[key]
+	s.mutex.Unlock()
+	if ok && cached.ModTime.Equal(modTime) && cached.Size == size {
+		return cached.Data, nil
+	}
+	var data []byte
+	if pre := s.preCompressed(name, encoding, modTime); pre != nil {
+		data, _ = ioutil.ReadAll(pre)
+		pre.Close()
+	}
+	if data == nil {
+		content, err := ioutil.ReadAll(file)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read file: %v", err)
+		}
+		if data, err = compress(content, encoding); err != nil {
+			return nil, err
+		}
+	}
+	s.mutex.Lock()
+	s.compressed[key] = compressedFile{modTime, size, data}
+	s.mutex.Unlock()
+	return data, nil
+}
+
+// preCompressed opens the pre-compressed file of the given file and
+// content coding if it's not older than the given modification time
+// of the file.
+//
+// Returns nil if there is no such file.
+func (s *compressedFileServer) preCompressed(name, encoding string,
+	modTime time.Time) http.File {
+	ext, ok := contentEncodingExts[encoding]
+	if !ok {
+		return nil
+	}
+	pre, err := s.Root.Open(name + ext)
+	if err != nil {
+		return nil
+	}
+	info, err := pre.Stat()
+	if err != nil || info.IsDir() || info.ModTime().Before(modTime) {
+		pre.Close()
+		return nil
+	}
+	return pre
+}
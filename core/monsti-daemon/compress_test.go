@@ -0,0 +1,203 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+// gunzip returns the uncompressed data.
+func gunzip(t *testing.T, data []byte) string {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Could not read gzip data: %v", err)
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Could not read gzip data: %v", err)
+	}
+	return string(content)
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	available := func(coding string) bool {
+		return coding == "gzip" || coding == "br"
+	}
+	tests := []struct {
+		AcceptEncoding, Encoding string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"deflate, gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip;q=1.0, br;q=0.5", "gzip"},
+		{"br;q=0, gzip", "gzip"},
+		{"GZIP;q=0.2", "gzip"},
+		{"*", "br"},
+		{"*;q=0.5, br;q=0", "gzip"},
+		{"gzip;q=0", ""},
+	}
+	if ret := negotiateEncoding("br", hasEncoder); ret != "" {
+		t.Errorf("negotiateEncoding(\"br\") without encoder = %q, should be \"\"",
+			ret)
+	}
+	for _, test := range tests {
+		ret := negotiateEncoding(test.AcceptEncoding, available)
+		if ret != test.Encoding {
+			t.Errorf("negotiateEncoding(%q) = %q, should be %q",
+				test.AcceptEncoding, ret, test.Encoding)
+		}
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	for contentType, expected := range map[string]bool{
+		"text/html; charset=utf-8": true,
+		"text/css":                 true,
+		"application/javascript":   true,
+		"image/svg+xml":            true,
+		"image/png":                false,
+		"application/zip":          false,
+		"":                         false,
+	} {
+		if ret := compressible(contentType); ret != expected {
+			t.Errorf("compressible(%q) = %v, should be %v", contentType, ret,
+				expected)
+		}
+	}
+}
+
+func TestWritePage(t *testing.T) {
+	page := strings.Repeat("<p>Hello World!</p>", 50)
+	for _, acceptEncoding := range []string{"", "gzip"} {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		res := httptest.NewRecorder()
+		c := &reqContext{Req: req, Res: res}
+		h := new(nodeHandler)
+		if err := h.writePage(c, []byte(page), "/", "", time.Time{}); err != nil {
+			t.Fatalf("writePage returns error: %v", err)
+		}
+		if res.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+			t.Errorf("Wrong content type: %v", res.Header().Get("Content-Type"))
+		}
+		body := res.Body.String()
+		if res.Header().Get("Content-Encoding") != acceptEncoding {
+			t.Errorf("Content-Encoding should be %q, got %q", acceptEncoding,
+				res.Header().Get("Content-Encoding"))
+		} else if acceptEncoding == "gzip" {
+			body = gunzip(t, res.Body.Bytes())
+		}
+		if body != page {
+			t.Errorf("Wrong page for %q: %q", acceptEncoding, body)
+		}
+	}
+}
+
+func TestCompressedFileServer(t *testing.T) {
+	style := strings.Repeat("body { color: red; }\n", 50)
+	script := strings.Repeat("alert('Hello');\n", 50)
+	var preCompressed bytes.Buffer
+	w := gzip.NewWriter(&preCompressed)
+	w.Write([]byte("pre-compressed"))
+	w.Close()
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/static/style.css":    style,
+		"/static/small.css":    "body {}",
+		"/static/script.js":    script,
+		"/static/image.png":    strings.Repeat("x", 1000),
+		"/static/script.js.gz": preCompressed.String(),
+		"/static/app.js":       script,
+		"/static/app.js.br":    "brotli-compressed",
+		"/static/old.js":       script,
+		"/static/old.js.br":    "outdated"},
+		"TestCompressedFileServer")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	// Pre-compressed files are only used if they are not older than the
+	// original file.
+	now := time.Now()
+	for name, modTime := range map[string]time.Time{
+		"script.js":    now,
+		"script.js.gz": now,
+		"app.js":       now,
+		"app.js.br":    now,
+		"old.js":       now,
+		"old.js.br":    now.Add(-time.Hour)} {
+		if err := os.Chtimes(filepath.Join(root, "static", name), modTime,
+			modTime); err != nil {
+			t.Fatalf("Could not set modification time: %v", err)
+		}
+	}
+	server := newCompressedFileServer(http.Dir(root))
+	tests := []struct {
+		Path, AcceptEncoding, Encoding, Body string
+	}{
+		{"/static/style.css", "", "", style},
+		{"/static/style.css", "gzip", "gzip", style},
+		{"/static/style.css", "gzip", "gzip", style},
+		{"/static/small.css", "gzip", "", "body {}"},
+		{"/static/image.png", "gzip", "", strings.Repeat("x", 1000)},
+		{"/static/script.js", "gzip", "gzip", "pre-compressed"},
+		{"/static/app.js", "br", "br", "brotli-compressed"},
+		{"/static/app.js", "gzip, br", "br", "brotli-compressed"},
+		{"/static/app.js", "gzip", "gzip", script},
+		{"/static/old.js", "br", "", script},
+		{"/static/old.js", "gzip, br", "gzip", script},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com"+test.Path, nil)
+		req.Header.Set("Accept-Encoding", test.AcceptEncoding)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Errorf("%v: Status should be 200, got %v", test.Path, res.Code)
+			continue
+		}
+		encoding := res.Header().Get("Content-Encoding")
+		if encoding != test.Encoding {
+			t.Errorf("%v: Content-Encoding should be %q, got %q", test.Path,
+				test.Encoding, encoding)
+			continue
+		}
+		body := res.Body.String()
+		if encoding == "gzip" {
+			body = gunzip(t, res.Body.Bytes())
+		}
+		if body != test.Body {
+			t.Errorf("%v: Wrong body %q", test.Path, body)
+		}
+	}
+	if len(server.compressed) != 5 {
+		t.Errorf("Compressed files should be kept in memory, got %v",
+			len(server.compressed))
+	}
+}
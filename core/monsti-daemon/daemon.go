@@ -30,8 +30,10 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	ossignal "os/signal"
 	"path/filepath"
 	"sync"
+	"syscall"
 
 	"pkg.monsti.org/monsti/api/service"
 	"pkg.monsti.org/monsti/api/util"
@@ -47,7 +49,18 @@ type settings struct {
 	Listen string
 	// List of modules to be activated.
 	Modules []string
-	Config  struct {
+	// ThumbnailWorkers is the number of workers generating the
+	// configured image sizes in the background. Defaults to 2, a
+	// negative number disables the generation.
+	ThumbnailWorkers int
+	// DefaultSite is the site serving requests for unknown hosts. If
+	// not set, these requests fail.
+	DefaultSite string
+	// TrustedProxies are the addresses or networks (e.g. "127.0.0.1"
+	// or "10.0.0.0/8") of reverse proxies whose X-Forwarded-Proto
+	// header is trusted.
+	TrustedProxies []string
+	Config         struct {
 		NodeTypes  map[string]*service.NodeType
 		NodeFields map[string]*service.NodeField
 	}
@@ -57,6 +70,10 @@ type settings struct {
 		Password string
 		Debug    bool
 	}
+	// sites contains the settings of the sites. They may be reloaded
+	// at runtime, so they are accessed using Site and SiteNames.
+	sites      map[string]util.SiteSettings
+	sitesMutex sync.RWMutex
 }
 
 // moduleLog is a Writer used to log module messages on stderr.
@@ -106,6 +123,10 @@ func main() {
 	if err := (&settings).Monsti.LoadSiteSettings(); err != nil {
 		logger.Fatal("Could not load site settings: ", err)
 	}
+	// Sites may be reloaded, so they are only accessed using
+	// settings.Site.
+	settings.setSites(settings.Monsti.Sites)
+	settings.Monsti.Sites = nil
 
 	gettext.DefaultLocales.Domain = "monsti-daemon"
 	gettext.DefaultLocales.LocaleDir = settings.Monsti.Directories.Locale
@@ -117,6 +138,33 @@ func main() {
 	monsti := new(MonstiService)
 	monsti.Settings = &settings
 	monsti.Logger = logger
+	sessions := service.NewSessionPool(1, monstiPath)
+	if settings.ThumbnailWorkers >= 0 {
+		workers := settings.ThumbnailWorkers
+		if workers == 0 {
+			workers = 2
+		}
+		monsti.Thumbnails = newThumbnailPool(workers,
+			func(job thumbnailJob) error {
+				session, err := sessions.New()
+				if err != nil {
+					return fmt.Errorf("Could not get session: %v", err)
+				}
+				defer sessions.Free(session)
+				return generateThumbnails(session.Monsti(), job)
+			}, logger)
+	}
+	monsti.Purger = newPurger(settings.Site, logger)
+	monsti.Purger.ImageSizes = monsti.imageSizes
+	jobScheduler, err := newScheduler(
+		filepath.Join(settings.Monsti.Directories.Run, "jobs.json"),
+		func(job *service.Job) error {
+			return monsti.runJob(sessions, job)
+		}, logger)
+	if err != nil {
+		logger.Fatalf("Could not start scheduler: %v", err)
+	}
+	monsti.Scheduler = jobScheduler
 	provider := service.NewProvider("Monsti", monsti)
 	provider.Logger = logger
 	if err := provider.Listen(monstiPath); err != nil {
@@ -130,8 +178,8 @@ func main() {
 		}
 	}()
 
-	sessions := service.NewSessionPool(1, monstiPath)
-	renderer := template.Renderer{Root: settings.Monsti.GetTemplatesPath()}
+	renderer := template.Renderer{Root: settings.Monsti.GetTemplatesPath(),
+		Funcs: map[string]interface{}{"srcset": srcset}}
 
 	// Init core functionality
 	session, err := sessions.New()
@@ -175,6 +223,21 @@ func main() {
 		<-monsti.moduleInit[module]
 	}
 
+	// Start scheduler
+	jobs := jobScheduler.Jobs()
+	for _, job := range defaultJobs {
+		found := false
+		for _, scheduled := range jobs {
+			found = found || scheduled.Id == job.Id
+		}
+		if !found {
+			if err := jobScheduler.Schedule(job); err != nil {
+				logger.Fatalf("Could not schedule job %q: %v", job.Id, err)
+			}
+		}
+	}
+	go jobScheduler.Run()
+
 	// Setup up httpd
 	handler := nodeHandler{
 		Renderer: renderer,
@@ -183,18 +246,33 @@ func main() {
 		Sessions: sessions,
 	}
 	monsti.Handler = &handler
+	handler.Service = monsti
+	handler.TrustedProxies, err = parseNetworks(settings.TrustedProxies)
+	if err != nil {
+		logger.Fatalf("Could not parse trusted proxies: %v", err)
+	}
 
-	http.Handle("/static/", http.FileServer(http.Dir(
+	http.Handle("/static/", newCompressedFileServer(http.Dir(
 		filepath.Dir(settings.Monsti.GetStaticsPath()))))
-	handler.Hosts = make(map[string]string)
-	for site_title, site := range settings.Monsti.Sites {
-		for _, host := range site.Hosts {
-			handler.Hosts[host] = site_title
-			http.Handle(host+"/site-static/", http.FileServer(http.Dir(
-				filepath.Dir(settings.Monsti.GetSiteStaticsPath(site_title)))))
-		}
+	settings.sitesMutex.RLock()
+	err = handler.setSites(settings.sites)
+	settings.sitesMutex.RUnlock()
+	if err != nil {
+		logger.Fatalf("Could not serve sites: %v", err)
 	}
+	http.HandleFunc("/site-static/", handler.ServeSiteStatic)
 	http.Handle("/", &handler)
+
+	// Reload site settings on SIGHUP
+	hup := make(chan os.Signal, 1)
+	ossignal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := monsti.reloadSites(); err != nil {
+				logger.Printf("Could not reload sites: %v", err)
+			}
+		}
+	}()
 	waitGroup.Add(1)
 	go func() {
 		if err := http.ListenAndServe(settings.Listen, nil); err != nil {
@@ -0,0 +1,429 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// exportLinks maps the URLs of exported resources (e.g.
+// "/about/", "/about" or "/photo.jpg?size=thumbnail") to the paths of
+// the exported files (e.g. "/about/index.html" or
+// "/photo-thumbnail.jpg").
+type exportLinks map[string]string
+
+var (
+	// exportAttrPattern matches HTML attributes containing URLs.
+	exportAttrPattern = regexp.MustCompile(
+		`(?i)(\s(?:href|src|action|poster)\s*=\s*)("[^"]*"|'[^']*')`)
+	// exportSrcsetPattern matches srcset attributes.
+	exportSrcsetPattern = regexp.MustCompile(
+		`(?i)(\ssrcset\s*=\s*)("[^"]*"|'[^']*')`)
+	// exportCSSPattern matches url() references in style sheets and
+	// style attributes.
+	exportCSSPattern = regexp.MustCompile(
+		`(url\(\s*)("[^"]*"|'[^']*'|[^'")\s]+)(\s*\))`)
+)
+
+// rewriteURL returns the given URL relative to the exported file
+// current, if the URL points into the site.
+//
+// URLs of exported resources point to the exported files. Other
+// internal URLs ending with a slash point to an index.html. External
+// URLs are returned unchanged.
+func (l exportLinks) rewriteURL(target, current, baseURL string) string {
+	baseURL = strings.TrimRight(baseURL, "/")
+	if len(baseURL) > 0 && (target == baseURL ||
+		strings.HasPrefix(target, baseURL+"/")) {
+		target = "/" + strings.TrimPrefix(target[len(baseURL):], "/")
+	}
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		return target
+	}
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+	file, ok := l[parsed.Path+"?"+parsed.RawQuery]
+	if !ok {
+		file, ok = l[parsed.Path]
+	}
+	if !ok {
+		file = parsed.Path
+		if strings.HasSuffix(file, "/") {
+			file += "index.html"
+		}
+	}
+	rel, err := filepath.Rel(path.Dir(current), file)
+	if err != nil {
+		return target
+	}
+	rewritten := (&url.URL{Path: filepath.ToSlash(rel)}).String()
+	if len(parsed.Fragment) > 0 {
+		rewritten += "#" + parsed.Fragment
+	}
+	return rewritten
+}
+
+// rewriteAttr rewrites the URL in the given quoted attribute value.
+func rewriteAttr(value string, rewrite func(string) string) string {
+	quote := value[:1]
+	if quote != `"` && quote != `'` {
+		return rewrite(value)
+	}
+	inner := html.UnescapeString(value[1 : len(value)-1])
+	return quote + html.EscapeString(rewrite(inner)) + quote
+}
+
+// rewriteCSS rewrites the url() references in the given style sheet
+// exported to current.
+func (l exportLinks) rewriteCSS(content []byte, current,
+	baseURL string) []byte {
+	return exportCSSPattern.ReplaceAllFunc(content, func(match []byte) []byte {
+		parts := exportCSSPattern.FindSubmatch(match)
+		value := string(parts[2])
+		quote := ""
+		if value[0] == '"' || value[0] == '\'' {
+			quote, value = value[:1], value[1:len(value)-1]
+		}
+		value = l.rewriteURL(value, current, baseURL)
+		return []byte(string(parts[1]) + quote + value + quote + string(parts[3]))
+	})
+}
+
+// rewriteHTML rewrites the links of the given page exported to
+// current.
+func (l exportLinks) rewriteHTML(content []byte, current,
+	baseURL string) []byte {
+	rewriteOne := func(target string) string {
+		return l.rewriteURL(target, current, baseURL)
+	}
+	content = exportAttrPattern.ReplaceAllFunc(content,
+		func(match []byte) []byte {
+			parts := exportAttrPattern.FindSubmatch(match)
+			return []byte(string(parts[1]) + rewriteAttr(string(parts[2]),
+				rewriteOne))
+		})
+	content = exportSrcsetPattern.ReplaceAllFunc(content,
+		func(match []byte) []byte {
+			parts := exportSrcsetPattern.FindSubmatch(match)
+			return []byte(string(parts[1]) + rewriteAttr(string(parts[2]),
+				func(srcset string) string {
+					candidates := strings.Split(srcset, ",")
+					for i, candidate := range candidates {
+						fields := strings.Fields(candidate)
+						if len(fields) == 0 {
+							continue
+						}
+						fields[0] = rewriteOne(fields[0])
+						candidates[i] = strings.Join(fields, " ")
+					}
+					return strings.Join(candidates, ", ")
+				}))
+		})
+	return l.rewriteCSS(content, current, baseURL)
+}
+
+// sizedImagePath returns the path of the exported image of the given
+// node in the given size.
+//
+// The file extension is replaced if the resized image has a different
+// format than the original one.
+func sizedImagePath(nodePath, size, contentType string) string {
+	ext := path.Ext(nodePath)
+	base := strings.TrimSuffix(nodePath, ext)
+	if mime.TypeByExtension(ext) != contentType {
+		if exts, err := mime.ExtensionsByType(contentType); err == nil &&
+			len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+	return base + "-" + size + ext
+}
+
+// siteExport exports a site.
+type siteExport struct {
+	Handler *nodeHandler
+	// Site contains the settings of the exported site.
+	Site    util.SiteSettings
+	BaseURL string
+	// Dir is the target directory.
+	Dir   string
+	Links exportLinks
+	// Pages contains the page contents by exported path. The links of
+	// pages get rewritten when all links are known.
+	Pages map[string][]byte
+}
+
+// get requests the given URL of the site.
+//
+// Returns nil if the response status is not OK.
+func (e *siteExport) get(target string) (*httptest.ResponseRecorder, error) {
+	req, err := http.NewRequest("GET", internalURL(e.Site, target), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create request: %v", err)
+	}
+	res := httptest.NewRecorder()
+	e.Handler.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		e.Handler.Log.Printf("Could not export %v: Status %v", target, res.Code)
+		return nil, nil
+	}
+	return res, nil
+}
+
+// write writes the exported file with the given path.
+func (e *siteExport) write(exportPath string, content []byte) error {
+	target := filepath.Join(e.Dir, filepath.FromSlash(exportPath))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("Could not create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(target, content, 0644); err != nil {
+		return fmt.Errorf("Could not write %v: %v", exportPath, err)
+	}
+	return nil
+}
+
+// exportFile exports the file or image of the given node, including
+// all sizes of images.
+func (e *siteExport) exportFile(node *service.Node, prefixes []string,
+	sizes map[string]imageSize) (int, error) {
+	link := func(target, exportPath string) {
+		for _, prefix := range prefixes {
+			e.Links[prefix+target] = exportPath
+		}
+	}
+	res, err := e.get(node.Path)
+	if err != nil || res == nil {
+		return 0, err
+	}
+	if err := e.write(node.Path, res.Body.Bytes()); err != nil {
+		return 0, err
+	}
+	link(node.Path, node.Path)
+	exported := 1
+	if node.Type.Id != "core.Image" {
+		return exported, nil
+	}
+	for name := range sizes {
+		query := "?size=" + url.QueryEscape(name)
+		res, err := e.get(node.Path + query)
+		if err != nil {
+			return exported, err
+		}
+		if res == nil {
+			continue
+		}
+		exportPath := sizedImagePath(node.Path, name,
+			res.Header().Get("Content-Type"))
+		if err := e.write(exportPath, res.Body.Bytes()); err != nil {
+			return exported, err
+		}
+		link(node.Path+query, exportPath)
+		exported++
+	}
+	return exported, nil
+}
+
+// exportPage renders the page of the given node.
+func (e *siteExport) exportPage(nodePath string) (int, error) {
+	target := nodePath
+	if !strings.HasSuffix(target, "/") {
+		target += "/"
+	}
+	res, err := e.get(target)
+	if err != nil || res == nil {
+		return 0, err
+	}
+	exportPath := target + "index.html"
+	e.Pages[exportPath] = res.Body.Bytes()
+	e.Links[target] = exportPath
+	e.Links[strings.TrimSuffix(target, "/")] = exportPath
+	return 1, nil
+}
+
+// copyStatics copies the static files in the directory src to the
+// exported directory dst, rewriting links in style sheets.
+func (e *siteExport) copyStatics(src, dst string) (int, error) {
+	copied := 0
+	err := filepath.Walk(src, func(file string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("Could not read static file: %v", err)
+		}
+		exportPath := path.Join(dst, filepath.ToSlash(rel))
+		if path.Ext(file) == ".css" {
+			content = e.Links.rewriteCSS(content, exportPath, e.BaseURL)
+		}
+		if err := e.write(exportPath, content); err != nil {
+			return err
+		}
+		copied++
+		return nil
+	})
+	if err != nil {
+		return copied, fmt.Errorf("Could not copy static files: %v", err)
+	}
+	return copied, nil
+}
+
+// ExportSite renders all published nodes of the given site into the
+// given directory, along with node files, images in all configured
+// sizes, and static files. Links get rewritten to be relative, so that
+// the exported site can be served from any location.
+//
+// Returns the number of exported files.
+func (h *nodeHandler) ExportSite(site, dir string) (int, error) {
+	settings, ok := h.Settings.Site(site)
+	if !ok || len(settings.Hosts) == 0 {
+		return 0, fmt.Errorf("Unknown site %q", site)
+	}
+	if !filepath.IsAbs(dir) {
+		return 0, fmt.Errorf("Export directory must be absolute: %q", dir)
+	}
+	session, err := h.Sessions.New()
+	if err != nil {
+		return 0, fmt.Errorf("Could not get session: %v", err)
+	}
+	defer h.Sessions.Free(session)
+	m := session.Monsti()
+	root, err := m.GetNode(site, "/")
+	if err != nil {
+		return 0, fmt.Errorf("Could not get root node: %v", err)
+	}
+	nodes, err := walkNodes("/", func(nodePath string) ([]*service.Node, error) {
+		return m.GetChildren(site, nodePath)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Could not get nodes: %v", err)
+	}
+	if root != nil {
+		nodes = append([]*service.Node{root}, nodes...)
+	}
+	sizes, err := getImageSizes(m, site)
+	if err != nil {
+		return 0, err
+	}
+	// Files are available with and without locale prefix, pages of
+	// multilingual sites only with prefix.
+	filePrefixes := []string{""}
+	pagePrefixes := []string{""}
+	if len(settings.Locales) > 1 {
+		pagePrefixes = pagePrefixes[:0]
+		for _, locale := range settings.Locales {
+			filePrefixes = append(filePrefixes, "/"+locale)
+			pagePrefixes = append(pagePrefixes, "/"+locale)
+		}
+	}
+	export := &siteExport{
+		Handler: h,
+		Site:    settings,
+		BaseURL: settings.BaseURL,
+		Dir:     dir,
+		Links:   make(exportLinks),
+		Pages:   make(map[string][]byte),
+	}
+	exported := 0
+	for _, node := range nodes {
+		if !node.Published() {
+			continue
+		}
+		if node.Type.Id == "core.File" || node.Type.Id == "core.Image" {
+			n, err := export.exportFile(node, filePrefixes, sizes)
+			exported += n
+			if err != nil {
+				return exported, err
+			}
+			continue
+		}
+		for _, prefix := range pagePrefixes {
+			n, err := export.exportPage(path.Join("/", prefix, node.Path))
+			exported += n
+			if err != nil {
+				return exported, err
+			}
+		}
+	}
+	for exportPath, content := range export.Pages {
+		content = export.Links.rewriteHTML(content, exportPath, settings.BaseURL)
+		if err := export.write(exportPath, content); err != nil {
+			return exported, err
+		}
+	}
+	// The root of multilingual sites redirects to the first locale.
+	if len(settings.Locales) > 1 {
+		target := settings.Locales[0] + "/index.html"
+		if err := export.write("/index.html", []byte(fmt.Sprintf(
+			`<!DOCTYPE html><meta http-equiv="refresh" content="0; url=%v">`+
+				`<a href="%v">%v</a>`, target, target, target))); err != nil {
+			return exported, err
+		}
+		exported++
+	}
+	for _, statics := range []struct{ Src, Dst string }{
+		{h.Settings.Monsti.GetStaticsPath(), "/static"},
+		{h.Settings.Monsti.GetSiteStaticsPath(site), "/site-static"},
+	} {
+		n, err := export.copyStatics(statics.Src, statics.Dst)
+		exported += n
+		if err != nil {
+			return exported, err
+		}
+	}
+	return exported, nil
+}
+
+type ExportSiteArgs struct {
+	Site, Dir string
+}
+
+func (i *MonstiService) ExportSite(args *ExportSiteArgs, reply *int) error {
+	if i.Handler == nil {
+		return fmt.Errorf("HTTP handler has not been started yet")
+	}
+	var err error
+	*reply, err = i.Handler.ExportSite(args.Site, args.Dir)
+	return err
+}
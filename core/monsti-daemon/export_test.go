@@ -0,0 +1,115 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import "testing"
+
+func TestExportRewriteURL(t *testing.T) {
+	links := exportLinks{
+		"/about/":                  "/about/index.html",
+		"/about":                   "/about/index.html",
+		"/photo.jpg":               "/photo.jpg",
+		"/photo.jpg?size=thumb":    "/photo-thumb.png",
+		"/de/photo.jpg?size=thumb": "/photo-thumb.png",
+	}
+	tests := []struct {
+		Target, Current, Rewritten string
+	}{
+		{"/about/", "/index.html", "about/index.html"},
+		{"/about", "/index.html", "about/index.html"},
+		{"/about/#team", "/index.html", "about/index.html#team"},
+		{"/", "/about/index.html", "../index.html"},
+		{"/photo.jpg?size=thumb", "/about/index.html", "../photo-thumb.png"},
+		{"/de/photo.jpg?size=thumb", "/de/index.html", "../photo-thumb.png"},
+		{"/photo.jpg?size=unknown", "/index.html", "photo.jpg"},
+		{"/static/css/monsti.css", "/a/b/index.html",
+			"../../static/css/monsti.css"},
+		{"/unknown/", "/about/index.html", "../unknown/index.html"},
+		{"http://example.com/about/", "/index.html", "about/index.html"},
+		{"http://example.com", "/about/index.html", "../index.html"},
+		{"http://example.org/about/", "/index.html",
+			"http://example.org/about/"},
+		{"//example.org/foo", "/index.html", "//example.org/foo"},
+		{"mailto:foo@example.com", "/index.html", "mailto:foo@example.com"},
+		{"#top", "/index.html", "#top"},
+		{"relative/", "/index.html", "relative/"},
+	}
+	for i, test := range tests {
+		rewritten := links.rewriteURL(test.Target, test.Current,
+			"http://example.com/")
+		if rewritten != test.Rewritten {
+			t.Errorf("%v: rewriteURL(%q, %q) = %q, should be %q", i, test.Target,
+				test.Current, rewritten, test.Rewritten)
+		}
+	}
+}
+
+func TestExportRewriteHTML(t *testing.T) {
+	links := exportLinks{
+		"/photo.jpg":            "/photo.jpg",
+		"/photo.jpg?size=thumb": "/photo-thumb.jpg",
+		"/photo.jpg?size=large": "/photo-large.jpg",
+		"/photo.jpg?size=a&b=c": "/photo-a.jpg",
+		"/news/":                "/news/index.html",
+	}
+	content := `<a href="/news/">News</a><a HREF='http://example.org/'>Ext</a>
+<img src="/photo.jpg?size=thumb"
+  srcset="/photo.jpg?size=thumb 100w, /photo.jpg?size=large 800w">
+<img src="/photo.jpg?size=a&amp;b=c">
+<div style="background: url(/photo.jpg)"></div>
+<form action="/news/@@search"></form>`
+	expected := `<a href="../news/index.html">News</a><a HREF='http://example.org/'>Ext</a>
+<img src="../photo-thumb.jpg"
+  srcset="../photo-thumb.jpg 100w, ../photo-large.jpg 800w">
+<img src="../photo-a.jpg">
+<div style="background: url(../photo.jpg)"></div>
+<form action="../news/@@search"></form>`
+	rewritten := string(links.rewriteHTML([]byte(content), "/about/index.html",
+		""))
+	if rewritten != expected {
+		t.Errorf("rewriteHTML returned\n%v\nshould be\n%v", rewritten, expected)
+	}
+}
+
+func TestExportRewriteCSS(t *testing.T) {
+	content := `a{background:url("/static/img/logo.png")}` +
+		`b{background:url( '/site-static/b.png' )}c{background:url(img/c.png)}`
+	expected := `a{background:url("../img/logo.png")}` +
+		`b{background:url( '../../site-static/b.png' )}c{background:url(img/c.png)}`
+	rewritten := string(exportLinks{}.rewriteCSS([]byte(content),
+		"/static/css/monsti.css", ""))
+	if rewritten != expected {
+		t.Errorf("rewriteCSS returned\n%v\nshould be\n%v", rewritten, expected)
+	}
+}
+
+func TestSizedImagePath(t *testing.T) {
+	tests := []struct {
+		Path, Size, ContentType, Expected string
+	}{
+		{"/photo.jpg", "thumb", "image/jpeg", "/photo-thumb.jpg"},
+		{"/a/photo.png", "large", "image/png", "/a/photo-large.png"},
+		{"/photo.jpg", "thumb", "image/png", "/photo-thumb.png"},
+	}
+	for _, test := range tests {
+		ret := sizedImagePath(test.Path, test.Size, test.ContentType)
+		if ret != test.Expected {
+			t.Errorf("sizedImagePath(%q, %q, %q) = %q, should be %q", test.Path,
+				test.Size, test.ContentType, ret, test.Expected)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// fileSettings configures how files and images are sent to clients.
+//
+// They are read from the site's core.files setting.
+type fileSettings struct {
+	// MaxAge is the number of seconds clients may use files without
+	// checking for changes. Defaults to zero, i.e. clients revalidate
+	// files using conditional requests.
+	MaxAge int
+	// Disposition is either "inline" (default) to show files in the
+	// browser or "attachment" to download them.
+	Disposition string
+	// MaxUploadSize is the maximum size of requests uploading files in
+	// bytes. Zero means no restriction.
+	MaxUploadSize int64
+}
+
+// getFileSettings returns the file settings of the site.
+func getFileSettings(c *reqContext) (fileSettings, error) {
+	var settings fileSettings
+	err := c.Serv.Monsti().GetSiteConfig(c.Site.Name, "core.files", &settings)
+	if err != nil {
+		return settings, fmt.Errorf("Could not get file settings: %v", err)
+	}
+	return settings, nil
+}
+
+// limitUploadSize restricts the size of the request body to the
+// site's MaxUploadSize.
+//
+// If the request is already known to be too large, an error page is
+// sent and false is returned.
+func limitUploadSize(c *reqContext) (bool, error) {
+	settings, err := getFileSettings(c)
+	if err != nil {
+		return false, err
+	}
+	if settings.MaxUploadSize <= 0 {
+		return true, nil
+	}
+	if c.Req.ContentLength > settings.MaxUploadSize {
+		G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+		http.Error(c.Res, fmt.Sprintf(
+			G("The upload must not be larger than %v bytes."),
+			settings.MaxUploadSize), http.StatusRequestEntityTooLarge)
+		return false, nil
+	}
+	c.Req.Body = http.MaxBytesReader(c.Res, c.Req.Body, settings.MaxUploadSize)
+	return true, nil
+}
+
+// contentDisposition returns the value of a Content-Disposition header
+// for the given disposition type and file name.
+//
+// Non-ASCII file names are encoded as specified by RFC 5987, with a
+// plain ASCII name as fallback.
+func contentDisposition(disposition, filename string) string {
+	ascii := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, filename)
+	ret := fmt.Sprintf(`%v; filename="%v"`, disposition, ascii)
+	if ascii != filename {
+		ret += "; filename*=UTF-8''" + strings.Replace(url.QueryEscape(filename),
+			"+", "%20", -1)
+	}
+	return ret
+}
+
+// fileETag returns a strong entity tag for the given content.
+func fileETag(content []byte) string {
+	return fmt.Sprintf(`"%x"`, sha1.Sum(content))
+}
+
+// nodeDataETag returns an entity tag for node data which has not been
+// read yet.
+func nodeDataETag(info *service.NodeDataInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.Size, info.ModTime.UnixNano())
+}
+
+// uploadHead returns the first 512 bytes and the size of an uploaded
+// file.
+func uploadHead(file multipart.File) ([]byte, int64, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, 0, fmt.Errorf("Could not read multipart file: %v", err)
+	}
+	size, err := file.Seek(0, os.SEEK_END)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not get size of multipart file: %v", err)
+	}
+	return head[:n], size, nil
+}
+
+// serveFile sends the content of the file with the given name and
+// entity tag.
+//
+// The content type is derived from the name or detected by
+// http.ServeContent unless it has already been set. Conditional and range
+// requests are handled by http.ServeContent. Files are sent as
+// attachment if configured or if the request parameter download is
+// set. public decides if shared caches may store the file.
+func serveFile(w http.ResponseWriter, r *http.Request, name string,
+	modtime time.Time, public bool, settings fileSettings,
+	content io.ReadSeeker, etag string) {
+	header := w.Header()
+	if len(header.Get("Content-Type")) == 0 {
+		if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+	}
+	header.Set("ETag", etag)
+	if public {
+		header.Set("Cache-Control", fmt.Sprintf("public, max-age=%v",
+			settings.MaxAge))
+	} else {
+		header.Set("Cache-Control", "private, no-cache")
+	}
+	disposition := "inline"
+	if settings.Disposition == "attachment" ||
+		len(r.FormValue("download")) > 0 {
+		disposition = "attachment"
+	}
+	header.Set("Content-Disposition", contentDisposition(disposition, name))
+	http.ServeContent(w, r, name, modtime, content)
+}
+
+// serveNodeFile sends the given content as file of the requested node
+// using the site's core.files settings.
+func serveNodeFile(c *reqContext, content []byte) error {
+	settings, err := getFileSettings(c)
+	if err != nil {
+		return err
+	}
+	serveFile(c.Res, c.Req, path.Base(c.Node.Path), c.Node.Changed,
+		c.Node.Public, settings, bytes.NewReader(content), fileETag(content))
+	return nil
+}
+
+// serveNodeData streams the given data file of the requested node
+// using the site's core.files settings.
+func serveNodeData(c *reqContext, file string) error {
+	settings, err := getFileSettings(c)
+	if err != nil {
+		return err
+	}
+	reader, err := c.Serv.Monsti().OpenNodeData(c.Site.Name, c.Node.Path, file)
+	if err != nil {
+		return fmt.Errorf("Could not open node data: %v", err)
+	}
+	if reader == nil {
+		http.NotFound(c.Res, c.Req)
+		return nil
+	}
+	serveFile(c.Res, c.Req, path.Base(c.Node.Path), reader.ModTime,
+		c.Node.Public, settings, reader, nodeDataETag(&reader.NodeDataInfo))
+	return nil
+}
@@ -0,0 +1,98 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct{ Disposition, Name, Expected string }{
+		{"inline", "foo.pdf", `inline; filename="foo.pdf"`},
+		{"attachment", `a"b.txt`, `attachment; filename="a_b.txt"; ` +
+			`filename*=UTF-8''a%22b.txt`},
+		{"attachment", "Übersicht 1.pdf", `attachment; filename="_bersicht 1.pdf"; ` +
+			`filename*=UTF-8''%C3%9Cbersicht%201.pdf`},
+	}
+	for i, test := range tests {
+		ret := contentDisposition(test.Disposition, test.Name)
+		if ret != test.Expected {
+			t.Errorf("%v: contentDisposition(%q, %q) = %q, should be %q", i,
+				test.Disposition, test.Name, ret, test.Expected)
+		}
+	}
+}
+
+func TestServeFile(t *testing.T) {
+	content := []byte("Hello World!")
+	modtime := time.Date(2015, 2, 1, 12, 0, 0, 0, time.UTC)
+	etag := fileETag(content)
+	tests := []struct {
+		URL     string
+		Header  map[string]string
+		Public  bool
+		Status  int
+		Body    string
+		Headers map[string]string
+	}{
+		{"/foo.txt", nil, true, http.StatusOK, "Hello World!", map[string]string{
+			"Content-Type":        "text/plain; charset=utf-8",
+			"ETag":                etag,
+			"Last-Modified":       "Sun, 01 Feb 2015 12:00:00 GMT",
+			"Cache-Control":       "public, max-age=60",
+			"Content-Disposition": `inline; filename="foo.txt"`,
+		}},
+		{"/foo.txt?download=1", nil, false, http.StatusOK, "Hello World!",
+			map[string]string{
+				"Cache-Control":       "private, no-cache",
+				"Content-Disposition": `attachment; filename="foo.txt"`,
+			}},
+		{"/foo.txt", map[string]string{"If-None-Match": etag}, true,
+			http.StatusNotModified, "", nil},
+		{"/foo.txt", map[string]string{
+			"If-Modified-Since": "Sun, 01 Feb 2015 12:00:00 GMT"}, true,
+			http.StatusNotModified, "", nil},
+		{"/foo.txt", map[string]string{"Range": "bytes=6-10"}, true,
+			http.StatusPartialContent, "World", map[string]string{
+				"Content-Range": "bytes 6-10/12"}},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", test.URL, nil)
+		if err != nil {
+			t.Fatalf("Could not create request: %v", err)
+		}
+		for key, value := range test.Header {
+			req.Header.Set(key, value)
+		}
+		res := httptest.NewRecorder()
+		serveFile(res, req, "foo.txt", modtime, test.Public,
+			fileSettings{MaxAge: 60}, bytes.NewReader(content), etag)
+		if res.Code != test.Status || res.Body.String() != test.Body {
+			t.Errorf("%v: serveFile returned %v, %q should be %v, %q", i, res.Code,
+				res.Body.String(), test.Status, test.Body)
+		}
+		for key, value := range test.Headers {
+			if ret := res.Header().Get(key); ret != value {
+				t.Errorf("%v: Header %v is %q, should be %q", i, key, ret, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,254 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// hostRoute is the site served at a host.
+type hostRoute struct {
+	Site string
+	// Alias is true if requests get redirected to the site's canonical
+	// host.
+	Alias bool
+}
+
+// hostMap maps hosts to the sites served at them.
+type hostMap struct {
+	// exact contains the routes of hosts, with and without port.
+	exact map[string]hostRoute
+	// wildcards contains the routes of the subdomains of domains, e.g.
+	// of ".example.com" for "*.example.com".
+	wildcards map[string]hostRoute
+}
+
+// newHostMap returns the map of the hosts and aliases of the given
+// sites.
+//
+// Fails if a host is used by several sites.
+func newHostMap(sites map[string]util.SiteSettings) (*hostMap, error) {
+	m := &hostMap{
+		exact:     make(map[string]hostRoute),
+		wildcards: make(map[string]hostRoute),
+	}
+	for name, site := range sites {
+		for _, host := range site.Hosts {
+			if err := m.add(host, hostRoute{Site: name}); err != nil {
+				return nil, err
+			}
+		}
+		for _, host := range site.Aliases {
+			if err := m.add(host, hostRoute{Site: name, Alias: true}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+// add adds the route of the given host.
+func (m *hostMap) add(host string, route hostRoute) error {
+	host = strings.ToLower(host)
+	routes := m.exact
+	if strings.HasPrefix(host, "*.") {
+		routes, host = m.wildcards, host[1:]
+	}
+	if other, ok := routes[host]; ok {
+		if other.Site != route.Site {
+			return fmt.Errorf("Host %q is used by sites %q and %q", host,
+				other.Site, route.Site)
+		}
+		// Hosts take precedence over aliases.
+		route.Alias = route.Alias && other.Alias
+	}
+	routes[host] = route
+	return nil
+}
+
+// lookup returns the route of the given request host.
+//
+// Hosts configured with port are preferred over ones without and
+// these over wildcards. The most specific wildcard matches.
+func (m *hostMap) lookup(host string) (hostRoute, bool) {
+	if m == nil {
+		return hostRoute{}, false
+	}
+	host = strings.ToLower(host)
+	if route, ok := m.exact[host]; ok {
+		return route, true
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+		if route, ok := m.exact[host]; ok {
+			return route, true
+		}
+	}
+	for i := 0; i < len(host); i++ {
+		if host[i] == '.' {
+			if route, ok := m.wildcards[host[i:]]; ok {
+				return route, true
+			}
+		}
+	}
+	return hostRoute{}, false
+}
+
+// route returns the site serving the given host.
+//
+// Unknown hosts are served by the default site, if configured.
+func (h *nodeHandler) route(host string) (hostRoute, bool) {
+	h.sitesMutex.RLock()
+	route, ok := h.hosts.lookup(host)
+	h.sitesMutex.RUnlock()
+	if !ok && len(h.Settings.DefaultSite) > 0 {
+		if _, ok := h.Settings.Site(h.Settings.DefaultSite); ok {
+			return hostRoute{Site: h.Settings.DefaultSite}, true
+		}
+	}
+	return route, ok
+}
+
+// canonicalHost returns the host aliases of the site get redirected
+// to.
+//
+// Returns the empty string if the site has only wildcard hosts.
+func canonicalHost(site util.SiteSettings) string {
+	if len(site.CanonicalHost) > 0 {
+		return site.CanonicalHost
+	}
+	for _, host := range site.Hosts {
+		if !strings.HasPrefix(host, "*.") {
+			return host
+		}
+	}
+	return ""
+}
+
+// internalURL returns the URL to request the given path of the site,
+// e.g. to warm the cache.
+//
+// Internal requests are recognized by their empty remote address and
+// don't get redirected.
+func internalURL(site util.SiteSettings, target string) string {
+	scheme := "http"
+	if site.ForceHTTPS {
+		scheme = "https"
+	}
+	return scheme + "://" + canonicalHost(site) + target
+}
+
+// parseNetworks parses the given addresses and networks in CIDR
+// notation.
+func parseNetworks(addresses []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, address := range addresses {
+		if !strings.Contains(address, "/") {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid address %q", address)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip,
+				Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network %q: %v", address, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// trustedProxy returns true if the request has been sent by a trusted
+// proxy.
+func (h *nodeHandler) trustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range h.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestScheme returns the scheme ("http" or "https") the client used
+// to make the request.
+func (h *nodeHandler) requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if values := r.Header["X-Forwarded-Proto"]; len(values) > 0 &&
+		h.trustedProxy(r) {
+		// Proxies append their protocol to the values sent by the
+		// client, so only the last one has been set by the trusted proxy.
+		protos := strings.Split(values[len(values)-1], ",")
+		proto := strings.TrimSpace(protos[len(protos)-1])
+		if strings.EqualFold(proto, "https") {
+			return "https"
+		}
+	}
+	return "http"
+}
+
+// redirectHost permanently redirects the request to the canonical host
+// of the site and to HTTPS, if necessary.
+//
+// Returns true if the request has been redirected.
+func (h *nodeHandler) redirectHost(w http.ResponseWriter, r *http.Request,
+	site util.SiteSettings, route hostRoute) bool {
+	// Requests created by Monsti itself (e.g. to warm the cache) have no
+	// remote address, other than requests read by the HTTP server.
+	if len(r.RemoteAddr) == 0 {
+		return false
+	}
+	host := r.Host
+	if route.Alias || (len(site.CanonicalHost) > 0 &&
+		!strings.EqualFold(host, site.CanonicalHost)) {
+		if canonical := canonicalHost(site); len(canonical) > 0 {
+			host = canonical
+		}
+	}
+	scheme := h.requestScheme(r)
+	target := scheme
+	if site.ForceHTTPS {
+		target = "https"
+	}
+	if strings.EqualFold(host, r.Host) && target == scheme {
+		return false
+	}
+	http.Redirect(w, r, target+"://"+host+r.URL.RequestURI(),
+		http.StatusMovedPermanently)
+	return true
+}
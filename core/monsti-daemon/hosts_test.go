@@ -0,0 +1,186 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestHostMap(t *testing.T) {
+	sites := map[string]util.SiteSettings{
+		"foo": {Hosts: []string{"foo.example.com", "localhost:8080"},
+			Aliases: []string{"www.foo.example.com", "*.foo.example.com",
+				"foo.example.com"}},
+		"bar": {Hosts: []string{"*.example.com", "localhost"}},
+	}
+	hosts, err := newHostMap(sites)
+	if err != nil {
+		t.Fatalf("Could not create host map: %v", err)
+	}
+	tests := []struct {
+		Host  string
+		Route hostRoute
+		Found bool
+	}{
+		{"foo.example.com", hostRoute{"foo", false}, true},
+		{"FOO.example.com:443", hostRoute{"foo", false}, true},
+		{"www.foo.example.com", hostRoute{"foo", true}, true},
+		{"a.b.foo.example.com", hostRoute{"foo", true}, true},
+		{"bar.example.com", hostRoute{"bar", false}, true},
+		{"example.com", hostRoute{}, false},
+		{"localhost:8080", hostRoute{"foo", false}, true},
+		{"localhost:8081", hostRoute{"bar", false}, true},
+		{"localhost", hostRoute{"bar", false}, true},
+		{"example.org", hostRoute{}, false},
+	}
+	for _, test := range tests {
+		route, found := hosts.lookup(test.Host)
+		if route != test.Route || found != test.Found {
+			t.Errorf("lookup(%q) = %v, %v, should be %v, %v", test.Host, route,
+				found, test.Route, test.Found)
+		}
+	}
+
+	sites["baz"] = util.SiteSettings{Aliases: []string{"*.EXAMPLE.com"}}
+	if _, err := newHostMap(sites); err == nil {
+		t.Errorf("newHostMap should fail for hosts used by several sites")
+	}
+}
+
+func TestRoute(t *testing.T) {
+	settings := new(settings)
+	settings.setSites(map[string]util.SiteSettings{
+		"foo": {Hosts: []string{"foo.example.com"}}})
+	h := &nodeHandler{Settings: settings}
+	if err := h.setSites(settings.sites); err != nil {
+		t.Fatalf("Could not set sites: %v", err)
+	}
+	if _, ok := h.route("bar.example.com"); ok {
+		t.Errorf("Unknown hosts should not be routed without default site")
+	}
+	settings.DefaultSite = "foo"
+	if route, ok := h.route("bar.example.com"); !ok || route.Site != "foo" {
+		t.Errorf("Unknown hosts should be routed to default site, got %v, %v",
+			route, ok)
+	}
+	settings.DefaultSite = "unknown"
+	if _, ok := h.route("bar.example.com"); ok {
+		t.Errorf("Unknown default sites should be ignored")
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := parseNetworks([]string{"127.0.0.1", "10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatalf("Could not parse networks: %v", err)
+	}
+	h := &nodeHandler{TrustedProxies: networks}
+	tests := []struct {
+		RemoteAddr string
+		Trusted    bool
+	}{
+		{"127.0.0.1:1234", true},
+		{"127.0.0.2:1234", false},
+		{"10.1.2.3:1234", true},
+		{"[::1]:1234", true},
+		{"[::2]:1234", false},
+		{"invalid", false},
+	}
+	for _, test := range tests {
+		r := &http.Request{RemoteAddr: test.RemoteAddr}
+		if trusted := h.trustedProxy(r); trusted != test.Trusted {
+			t.Errorf("trustedProxy(%q) = %v, should be %v", test.RemoteAddr,
+				trusted, test.Trusted)
+		}
+	}
+	for _, invalid := range []string{"localhost", "10.0.0.0/33"} {
+		if _, err := parseNetworks([]string{invalid}); err == nil {
+			t.Errorf("parseNetworks(%q) should fail", invalid)
+		}
+	}
+}
+
+func TestRedirectHost(t *testing.T) {
+	networks, _ := parseNetworks([]string{"127.0.0.1"})
+	h := &nodeHandler{TrustedProxies: networks}
+	site := util.SiteSettings{Hosts: []string{"example.com", "*.example.org"}}
+	secure := site
+	secure.ForceHTTPS = true
+	canonical := site
+	canonical.CanonicalHost = "www.example.com"
+	tests := []struct {
+		Site       util.SiteSettings
+		Alias      bool
+		URL        string
+		RemoteAddr string
+		Proto      string
+		Redirect   string
+	}{
+		{site, false, "http://example.com/foo/?bar=1", "192.0.2.1:1234", "",
+			""},
+		{site, true, "http://www.example.com/foo/?bar=1", "192.0.2.1:1234", "",
+			"http://example.com/foo/?bar=1"},
+		{site, false, "http://a.example.org/", "192.0.2.1:1234", "", ""},
+		{canonical, false, "http://example.com/foo/", "192.0.2.1:1234", "",
+			"http://www.example.com/foo/"},
+		{canonical, false, "http://WWW.example.com/foo/", "192.0.2.1:1234", "",
+			""},
+		{secure, false, "http://example.com/foo/", "192.0.2.1:1234", "",
+			"https://example.com/foo/"},
+		{secure, true, "http://www.example.com/", "192.0.2.1:1234", "",
+			"https://example.com/"},
+		{secure, false, "http://example.com/foo/", "127.0.0.1:1234", "https", ""},
+		// Only the protocol appended by the trusted proxy counts, the
+		// others have been sent by the client.
+		{secure, false, "http://example.com/foo/", "127.0.0.1:1234",
+			"http, HTTPS", ""},
+		{secure, false, "http://example.com/foo/", "127.0.0.1:1234",
+			"https, http", "https://example.com/foo/"},
+		{secure, false, "http://example.com/foo/", "127.0.0.1:1234", "http",
+			"https://example.com/foo/"},
+		{secure, false, "http://example.com/foo/", "10.0.0.1:1234", "https",
+			"https://example.com/foo/"},
+		// Clients can't skip the redirect with absolute request URLs.
+		{secure, false, "https://example.com/foo/", "192.0.2.1:1234", "",
+			"https://example.com/foo/"},
+		// Internal requests don't get redirected.
+		{secure, false, "http://example.com/foo/", "", "", ""},
+		{canonical, false, "http://example.com/foo/", "", "", ""},
+	}
+	for i, test := range tests {
+		req, _ := http.NewRequest("GET", test.URL, nil)
+		req.RemoteAddr = test.RemoteAddr
+		if len(test.Proto) > 0 {
+			req.Header.Set("X-Forwarded-Proto", test.Proto)
+		}
+		res := httptest.NewRecorder()
+		redirected := h.redirectHost(res, req, test.Site,
+			hostRoute{"example", test.Alias})
+		location := res.Header().Get("Location")
+		if redirected != (len(test.Redirect) > 0) || location != test.Redirect {
+			t.Errorf("%v: redirectHost returned %v with location %q, "+
+				"should redirect to %q", i, redirected, location, test.Redirect)
+		}
+		if redirected && res.Code != http.StatusMovedPermanently {
+			t.Errorf("%v: Status should be 301, is %v", i, res.Code)
+		}
+	}
+}
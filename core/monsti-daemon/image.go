@@ -0,0 +1,424 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nfnt/resize"
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// imageSize is an image size as configured in the site's
+// core.image.sizes setting.
+type imageSize struct {
+	Width, Height uint
+	// Mode is one of "fit" (default), "fill" and "crop".
+	//
+	// fit scales the image down to fit into the size. fill scales and
+	// crops the image to exactly fill the size. crop cuts out the size
+	// without scaling. Images are cropped around their focal point.
+	Mode string `json:",omitempty"`
+	// Quality is the JPEG quality from 1 to 100. Defaults to the site's
+	// core.image.quality setting.
+	Quality int `json:",omitempty"`
+}
+
+// String returns an identifier of the size, e.g. "200x100" or
+// "200x100-fill".
+func (s imageSize) String() string {
+	if s.Mode == "" || s.Mode == "fit" {
+		return fmt.Sprintf("%vx%v", s.Width, s.Height)
+	}
+	return fmt.Sprintf("%vx%v-%v", s.Width, s.Height, s.Mode)
+}
+
+// focalPoint is the relative position of the most important part of an
+// image, with (0, 0) being the top left and (1, 1) the bottom right
+// corner.
+type focalPoint struct{ X, Y float64 }
+
+// focalPointRegexp is used to validate the core.FocalPoint field.
+const focalPointRegexp = `^\s*(0(\.\d+)?|1(\.0+)?)\s*,\s*(0(\.\d+)?|1(\.0+)?)\s*$`
+
+// parseFocalPoint parses a focal point like "0.3,0.6".
+//
+// Returns the center of the image if the value is empty or invalid.
+func parseFocalPoint(value string) focalPoint {
+	center := focalPoint{0.5, 0.5}
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return center
+	}
+	x, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || x < 0 || x > 1 {
+		return center
+	}
+	y, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil || y < 0 || y > 1 {
+		return center
+	}
+	return focalPoint{x, y}
+}
+
+// cropRect returns the rectangle of the given size within bounds
+// which is centered around the focal point as far as possible.
+func cropRect(bounds image.Rectangle, width, height int,
+	focus focalPoint) image.Rectangle {
+	if width > bounds.Dx() {
+		width = bounds.Dx()
+	}
+	if height > bounds.Dy() {
+		height = bounds.Dy()
+	}
+	clamp := func(pos, max int) int {
+		if pos < 0 {
+			return 0
+		}
+		if pos > max {
+			return max
+		}
+		return pos
+	}
+	x := clamp(int(focus.X*float64(bounds.Dx())-float64(width)/2+0.5),
+		bounds.Dx()-width)
+	y := clamp(int(focus.Y*float64(bounds.Dy())-float64(height)/2+0.5),
+		bounds.Dy()-height)
+	min := bounds.Min.Add(image.Pt(x, y))
+	return image.Rectangle{min, min.Add(image.Pt(width, height))}
+}
+
+// cropImage returns the given part of the image.
+func cropImage(img image.Image, rect image.Rectangle) image.Image {
+	out := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(out, out.Bounds(), img, rect.Min, draw.Src)
+	return out
+}
+
+// processImage scales and crops the image to the given size.
+//
+// Images are never scaled up.
+func processImage(img image.Image, size imageSize,
+	focus focalPoint) image.Image {
+	bounds := img.Bounds()
+	switch {
+	case size.Mode == "crop" && size.Width > 0 && size.Height > 0:
+		return cropImage(img, cropRect(bounds, int(size.Width),
+			int(size.Height), focus))
+	case size.Mode == "fill" && size.Width > 0 && size.Height > 0:
+		// Cut out the largest part having the aspect ratio of the size.
+		ratio := float64(size.Width) / float64(size.Height)
+		width, height := bounds.Dx(), int(float64(bounds.Dx())/ratio+0.5)
+		if height > bounds.Dy() {
+			width, height = int(float64(bounds.Dy())*ratio+0.5), bounds.Dy()
+		}
+		img = cropImage(img, cropRect(bounds, width, height, focus))
+		if uint(width) > size.Width {
+			img = resize.Resize(size.Width, size.Height, img, resize.Lanczos3)
+		}
+		return img
+	default:
+		width, height := fitDimensions(uint(bounds.Dx()), uint(bounds.Dy()),
+			size)
+		if width == uint(bounds.Dx()) && height == uint(bounds.Dy()) {
+			return img
+		}
+		return resize.Resize(width, height, img, resize.Lanczos3)
+	}
+}
+
+// fitDimensions returns the dimensions of an image of the given
+// dimensions scaled down to fit into the size, keeping its aspect
+// ratio.
+//
+// Sizes may restrict only one dimension.
+func fitDimensions(width, height uint, size imageSize) (uint, uint) {
+	maxWidth, maxHeight := size.Width, size.Height
+	if maxWidth == 0 {
+		maxWidth = math.MaxUint32
+	}
+	if maxHeight == 0 {
+		maxHeight = math.MaxUint32
+	}
+	if width > maxWidth {
+		height = height * maxWidth / width
+		if height < 1 {
+			height = 1
+		}
+		width = maxWidth
+	}
+	if height > maxHeight {
+		width = width * maxHeight / height
+		if width < 1 {
+			width = 1
+		}
+		height = maxHeight
+	}
+	return width, height
+}
+
+// imageEncoder writes the image in some format using the given
+// quality from 1 to 100 if applicable.
+type imageEncoder func(w io.Writer, img image.Image, quality int) error
+
+// imageEncoders contains the available output formats of resized
+// images.
+var imageEncoders = map[string]imageEncoder{
+	"jpeg": func(w io.Writer, img image.Image, quality int) error {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	},
+	"png": func(w io.Writer, img image.Image, quality int) error {
+		return png.Encode(w, img)
+	},
+}
+
+// imageFormat returns the output format for resized images of the
+// given source format.
+func imageFormat(sourceFormat string) string {
+	switch sourceFormat {
+	case "png", "gif":
+		return "png"
+	}
+	return "jpeg"
+}
+
+// encodeImage encodes the image in the given format.
+func encodeImage(img image.Image, format string, quality int) ([]byte, error) {
+	encoder, ok := imageEncoders[format]
+	if !ok {
+		return nil, fmt.Errorf("Unknown image format %q", format)
+	}
+	if quality < 1 || quality > 100 {
+		quality = jpeg.DefaultQuality
+	}
+	var out bytes.Buffer
+	if err := encoder(&out, img, quality); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// imageCacheId returns the cache id of the image resized to the given
+// size.
+func imageCacheId(size imageSize) string {
+	return "core.image.thumbnail." + size.String()
+}
+
+// resizeImage resizes the image data of the given node.
+//
+// The image gets rotated according to its EXIF orientation first.
+func resizeImage(data io.Reader, node *service.Node, size imageSize) (
+	[]byte, error) {
+	header, segments, err := readJPEGHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	img, format, err := image.Decode(io.MultiReader(bytes.NewReader(header), data))
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode image data: %v", err)
+	}
+	img = orientImage(img, parseJPEGMetadata(segments).Orientation)
+	focus := parseFocalPoint("")
+	if field := node.GetField("core.FocalPoint"); field != nil {
+		focus = parseFocalPoint(field.String())
+	}
+	img = processImage(img, size, focus)
+	out, err := encodeImage(img, imageFormat(format), size.Quality)
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode resized image: %v", err)
+	}
+	return out, nil
+}
+
+// getImageSize returns the named image size of the site.
+//
+// Returns false if the size is not configured.
+func getImageSize(m *service.MonstiClient, site, name string) (
+	imageSize, bool, error) {
+	var size imageSize
+	err := m.GetSiteConfig(site, "core.image.sizes."+name, &size)
+	if err != nil {
+		return size, false, fmt.Errorf("Could not get size config: %v", err)
+	}
+	if size.Width == 0 && size.Height == 0 {
+		return size, false, nil
+	}
+	if size.Quality == 0 {
+		err := m.GetSiteConfig(site, "core.image.quality", &size.Quality)
+		if err != nil {
+			return size, false, fmt.Errorf("Could not get image quality: %v", err)
+		}
+	}
+	return size, true, nil
+}
+
+// viewImage sends a possibly resized image
+func (h *nodeHandler) viewImage(c *reqContext) error {
+	sizeName := c.Req.FormValue("size")
+	var body []byte
+	if sizeName != "" {
+		size, ok, err := getImageSize(c.Serv.Monsti(), c.Site.Name, sizeName)
+		if err != nil {
+			h.Log.Printf("Could not get image size: %v", err)
+		} else if !ok {
+			h.Log.Printf("Could not find size %q for site %q", sizeName,
+				c.Site.Name)
+		} else {
+			body, err = h.resizedImage(c, size)
+			if err != nil {
+				return err
+			}
+			// The format may differ from the original image.
+			c.Res.Header().Set("Content-Type", http.DetectContentType(body))
+		}
+	}
+	if body == nil {
+		return serveNodeData(c, "__file_core.File")
+	}
+	return serveNodeFile(c, body)
+}
+
+// resizedImage returns the requested image resized to the given size,
+// using the cache if possible.
+func (h *nodeHandler) resizedImage(c *reqContext, size imageSize) (
+	[]byte, error) {
+	return cachedImage(c.Serv.Monsti(), c.Site.Name, c.Node, size)
+}
+
+// cachedImage returns the image of the given node resized to the given
+// size.
+//
+// The resized image is taken from the cache if possible or stored in
+// the cache otherwise.
+func cachedImage(m *service.MonstiClient, site string, node *service.Node,
+	size imageSize) ([]byte, error) {
+	cacheId := imageCacheId(size)
+	body, _, err := m.FromCache(site, node.Path, cacheId)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get thumbnail from cache: %v", err)
+	}
+	if body != nil {
+		return body, nil
+	}
+	data, err := m.OpenNodeData(site, node.Path, "__file_core.File")
+	if err != nil || data == nil {
+		return nil, fmt.Errorf("Could not get image data: %v", err)
+	}
+	body, err = resizeImage(bufio.NewReader(data), node, size)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.ToCache(site, node.Path, cacheId, body,
+		&service.CacheMods{Deps: []service.CacheDep{{Node: node.Path}}}); err != nil {
+		return nil, fmt.Errorf("Could not cache resized image data: %v", err)
+	}
+	// The image may have been replaced while resizing it. The caches
+	// have been invalidated before caching the old image then.
+	info, err := m.StatNodeData(site, node.Path, "__file_core.File")
+	if err != nil {
+		return nil, fmt.Errorf("Could not get image data: %v", err)
+	}
+	if !info.Exists || info.Size != data.Size ||
+		!info.ModTime.Equal(data.ModTime) {
+		err := m.MarkDep(site, service.CacheDep{Node: node.Path, Cache: cacheId})
+		if err != nil {
+			return nil, fmt.Errorf("Could not remove outdated image: %v", err)
+		}
+	}
+	return body, nil
+}
+
+type srcsetEntry struct {
+	Name  string
+	Width uint
+}
+
+type srcsetEntries []srcsetEntry
+
+func (s srcsetEntries) Len() int {
+	return len(s)
+}
+
+func (s srcsetEntries) Less(i, j int) bool {
+	if s[i].Width == s[j].Width {
+		return s[i].Name < s[j].Name
+	}
+	return s[i].Width < s[j].Width
+}
+
+func (s srcsetEntries) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// srcset returns the value of a srcset attribute offering the given
+// image in all sizes of mode fit, i.e. in all sizes keeping the aspect
+// ratio of the image.
+//
+// The widths are computed from the dimensions of the image (core.Width
+// and core.Height fields). Sizes resulting in the same width are only
+// listed once. Returns the empty string if the dimensions are unknown.
+func srcset(node *service.Node, sizes map[string]imageSize) string {
+	width, _ := node.GetField("core.Width").(*service.IntegerField)
+	height, _ := node.GetField("core.Height").(*service.IntegerField)
+	if width == nil || height == nil || *width <= 0 || *height <= 0 {
+		return ""
+	}
+	entries := make(srcsetEntries, 0, len(sizes))
+	for name, size := range sizes {
+		if size.Mode != "" && size.Mode != "fit" {
+			continue
+		}
+		if size.Width == 0 && size.Height == 0 {
+			continue
+		}
+		fitted, _ := fitDimensions(uint(*width), uint(*height), size)
+		entries = append(entries, srcsetEntry{name, fitted})
+	}
+	sort.Sort(entries)
+	var candidates []string
+	for i, entry := range entries {
+		if i > 0 && entries[i-1].Width == entry.Width {
+			continue
+		}
+		candidates = append(candidates, fmt.Sprintf("%v?size=%v %vw", node.Path,
+			entry.Name, entry.Width))
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// getImageSizes returns all image sizes of the site.
+func getImageSizes(m *service.MonstiClient, site string) (
+	map[string]imageSize, error) {
+	var sizes map[string]imageSize
+	if err := m.GetSiteConfig(site, "core.image.sizes", &sizes); err != nil {
+		return nil, fmt.Errorf("Could not get image sizes: %v", err)
+	}
+	return sizes, nil
+}
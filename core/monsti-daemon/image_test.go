@@ -0,0 +1,162 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"regexp"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestParseFocalPoint(t *testing.T) {
+	tests := []struct {
+		Value string
+		Point focalPoint
+		Valid bool
+	}{
+		{"", focalPoint{0.5, 0.5}, false},
+		{"0.3,0.6", focalPoint{0.3, 0.6}, true},
+		{" 1, 0 ", focalPoint{1, 0}, true},
+		{"1.5,0.5", focalPoint{0.5, 0.5}, false},
+		{"foo", focalPoint{0.5, 0.5}, false},
+	}
+	for i, test := range tests {
+		if ret := parseFocalPoint(test.Value); ret != test.Point {
+			t.Errorf("%v: parseFocalPoint(%q) = %v, should be %v", i, test.Value,
+				ret, test.Point)
+		}
+		if valid := regexp.MustCompile(focalPointRegexp).MatchString(
+			test.Value); valid != test.Valid {
+			t.Errorf("%v: focalPointRegexp matches %q: %v, should be %v", i,
+				test.Value, valid, test.Valid)
+		}
+	}
+}
+
+func TestCropRect(t *testing.T) {
+	bounds := image.Rect(0, 0, 400, 200)
+	tests := []struct {
+		Width, Height int
+		Focus         focalPoint
+		Rect          image.Rectangle
+	}{
+		{100, 100, focalPoint{0.5, 0.5}, image.Rect(150, 50, 250, 150)},
+		{100, 100, focalPoint{0, 0}, image.Rect(0, 0, 100, 100)},
+		{100, 100, focalPoint{1, 0.75}, image.Rect(300, 100, 400, 200)},
+		{500, 100, focalPoint{0.5, 0.5}, image.Rect(0, 50, 400, 150)},
+	}
+	for i, test := range tests {
+		ret := cropRect(bounds, test.Width, test.Height, test.Focus)
+		if ret != test.Rect {
+			t.Errorf("%v: cropRect(%v, %v, %v) = %v, should be %v", i,
+				test.Width, test.Height, test.Focus, ret, test.Rect)
+		}
+	}
+}
+
+func TestProcessImage(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	// Mark the left half of the image.
+	for x := 0; x < 200; x++ {
+		for y := 0; y < 200; y++ {
+			img.Set(x, y, color.White)
+		}
+	}
+	tests := []struct {
+		Size          imageSize
+		Focus         focalPoint
+		Width, Height int
+		White         bool
+	}{
+		{imageSize{Width: 100, Height: 100}, focalPoint{0.5, 0.5}, 100, 50, true},
+		{imageSize{Width: 100, Height: 100, Mode: "fit"}, focalPoint{}, 100, 50,
+			true},
+		{imageSize{Width: 100, Height: 100, Mode: "fill"}, focalPoint{0, 0.5},
+			100, 100, true},
+		{imageSize{Width: 100, Height: 100, Mode: "fill"}, focalPoint{1, 0.5},
+			100, 100, false},
+		{imageSize{Width: 800, Height: 400, Mode: "fill"}, focalPoint{}, 400, 200,
+			true},
+		{imageSize{Width: 300, Height: 100, Mode: "crop"}, focalPoint{0, 0},
+			300, 100, true},
+		{imageSize{Width: 1000, Height: 100, Mode: "crop"}, focalPoint{0, 0},
+			400, 100, true},
+		{imageSize{Height: 100}, focalPoint{}, 200, 100, true},
+		{imageSize{Width: 100, Mode: "fill"}, focalPoint{}, 100, 50, true},
+	}
+	for i, test := range tests {
+		ret := processImage(img, test.Size, test.Focus)
+		bounds := ret.Bounds()
+		if bounds.Dx() != test.Width || bounds.Dy() != test.Height {
+			t.Errorf("%v: processImage(%v) returned image of size %vx%v,"+
+				" should be %vx%v", i, test.Size, bounds.Dx(), bounds.Dy(),
+				test.Width, test.Height)
+		}
+		r, _, _, _ := ret.At(bounds.Min.X, bounds.Min.Y).RGBA()
+		if white := r > 0x8000; white != test.White {
+			t.Errorf("%v: Top left pixel of processImage(%v) is white: %v,"+
+				" should be %v", i, test.Size, white, test.White)
+		}
+	}
+}
+
+func TestImageFormat(t *testing.T) {
+	if ret := imageFormat("gif"); ret != "png" {
+		t.Errorf(`imageFormat for GIF should be "png", got %q`, ret)
+	}
+	if ret := imageFormat("jpeg"); ret != "jpeg" {
+		t.Errorf(`imageFormat for JPEG should be "jpeg", got %q`, ret)
+	}
+	size := imageSize{Width: 100, Height: 50, Mode: "fill"}
+	if ret := imageCacheId(size); ret != "core.image.thumbnail.100x50-fill" {
+		t.Errorf("Wrong cache id for filled images: %q", ret)
+	}
+	if ret := imageCacheId(imageSize{Width: 100, Height: 50}); ret !=
+		"core.image.thumbnail.100x50" {
+		t.Errorf("Wrong cache id for fitted images: %q", ret)
+	}
+}
+
+func TestSrcset(t *testing.T) {
+	sizes := map[string]imageSize{
+		"huge":   {Width: 2000},
+		"large":  {Width: 800, Height: 600},
+		"small":  {Width: 200, Height: 100},
+		"square": {Width: 200, Height: 200, Mode: "fill"},
+		"tall":   {Height: 500},
+		"thumb":  {Width: 100, Height: 20},
+	}
+	width, height := service.IntegerField(1000), service.IntegerField(500)
+	node := &service.Node{Path: "/foo/img.jpeg", Fields: map[string]service.Field{
+		"core.Width": &width, "core.Height": &height}}
+	// Sizes larger than the image result in the image's width.
+	expected := "/foo/img.jpeg?size=thumb 40w, /foo/img.jpeg?size=small 200w, " +
+		"/foo/img.jpeg?size=large 800w, /foo/img.jpeg?size=huge 1000w"
+	if ret := srcset(node, sizes); ret != expected {
+		t.Errorf("srcset returned %q, should be %q", ret, expected)
+	}
+	if ret := srcset(node, nil); ret != "" {
+		t.Errorf("srcset without sizes should be empty, got %q", ret)
+	}
+	width = 0
+	if ret := srcset(node, sizes); ret != "" {
+		t.Errorf("srcset without dimensions should be empty, got %q", ret)
+	}
+}
@@ -0,0 +1,461 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// BER tags used by the LDAP protocol (RFC 4511).
+const (
+	berBoolean        = 0x01
+	berInteger        = 0x02
+	berOctetString    = 0x04
+	berEnumerated     = 0x0a
+	berSequence       = 0x30
+	berSet            = 0x31
+	ldapBindRequest   = 0x60
+	ldapBindResponse  = 0x61
+	ldapUnbindRequest = 0x42
+	ldapSearchRequest = 0x63
+	ldapSearchEntry   = 0x64
+	ldapSearchDone    = 0x65
+	ldapSimpleAuth    = 0x80
+	ldapFilterPresent = 0x87
+)
+
+// LDAP result codes.
+const (
+	ldapSuccess            = 0
+	ldapNoSuchObject       = 32
+	ldapInvalidCredentials = 49
+)
+
+// berElement is a decoded BER element.
+type berElement struct {
+	Tag     byte
+	Content []byte
+}
+
+// berLength encodes the given content length.
+func berLength(length int) []byte {
+	if length < 0x80 {
+		return []byte{byte(length)}
+	}
+	var ret []byte
+	for ; length > 0; length >>= 8 {
+		ret = append([]byte{byte(length)}, ret...)
+	}
+	return append([]byte{0x80 | byte(len(ret))}, ret...)
+}
+
+// berEncode encodes an element with the given tag and the
+// concatenated contents.
+func berEncode(tag byte, contents ...[]byte) []byte {
+	joined := bytes.Join(contents, nil)
+	ret := append([]byte{tag}, berLength(len(joined))...)
+	return append(ret, joined...)
+}
+
+// berInt encodes an integer element with the given tag.
+func berInt(tag byte, value int) []byte {
+	content := []byte{byte(value)}
+	for value >= 0x80 || value < -0x80 {
+		value >>= 8
+		content = append([]byte{byte(value)}, content...)
+	}
+	return berEncode(tag, content)
+}
+
+// berString encodes an octet string element.
+func berString(value string) []byte {
+	return berEncode(berOctetString, []byte(value))
+}
+
+// berRead reads the next element.
+func berRead(r io.Reader) (*berElement, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		size := length & 0x7f
+		if size == 0 || size > 4 {
+			return nil, fmt.Errorf("Unsupported BER length encoding")
+		}
+		raw := make([]byte, size)
+		if _, err := io.ReadFull(r, raw); err != nil {
+			return nil, err
+		}
+		length = 0
+		for _, b := range raw {
+			length = length<<8 | int(b)
+		}
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	return &berElement{header[0], content}, nil
+}
+
+// berParse decodes the elements contained in the given content of a
+// constructed element.
+func berParse(content []byte) ([]*berElement, error) {
+	r := bytes.NewReader(content)
+	var elements []*berElement
+	for r.Len() > 0 {
+		element, err := berRead(r)
+		if err != nil {
+			return nil, fmt.Errorf("Could not decode BER element: %v", err)
+		}
+		elements = append(elements, element)
+	}
+	return elements, nil
+}
+
+// berParseInt decodes the content of an integer element.
+func berParseInt(content []byte) int {
+	var value int
+	for i, b := range content {
+		if i == 0 && b&0x80 != 0 {
+			value = -1
+		}
+		value = value<<8 | int(b)
+	}
+	return value
+}
+
+// ldapEscapeDN escapes the given attribute value to be used in a
+// distinguished name (RFC 4514).
+func ldapEscapeDN(value string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == 0:
+			buf.WriteString(`\00`)
+		case strings.IndexByte(`,+"\<>;=`, c) != -1,
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(value)-1 && c == ' ':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+// ldapConn is a minimal LDAPv3 client connection supporting simple
+// binds and base object searches.
+type ldapConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	messageID int
+}
+
+func newLDAPConn(conn net.Conn) *ldapConn {
+	return &ldapConn{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// send sends a message with the given protocol operation.
+func (c *ldapConn) send(op []byte) error {
+	c.messageID += 1
+	msg := berEncode(berSequence, berInt(berInteger, c.messageID), op)
+	_, err := c.conn.Write(msg)
+	return err
+}
+
+// receive receives the next message and returns its protocol
+// operation.
+func (c *ldapConn) receive() (*berElement, error) {
+	msg, err := berRead(c.reader)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read message: %v", err)
+	}
+	parts, err := berParse(msg.Content)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Tag != berSequence || len(parts) < 2 || parts[0].Tag != berInteger {
+		return nil, fmt.Errorf("Invalid message")
+	}
+	if id := berParseInt(parts[0].Content); id != c.messageID {
+		return nil, fmt.Errorf("Unexpected message id %v", id)
+	}
+	return parts[1], nil
+}
+
+// parseResult returns the result code and diagnostic message of the
+// given result operation.
+func parseResult(op *berElement) (int, string, error) {
+	parts, err := berParse(op.Content)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(parts) < 3 || parts[0].Tag != berEnumerated {
+		return 0, "", fmt.Errorf("Invalid result")
+	}
+	return berParseInt(parts[0].Content), string(parts[2].Content), nil
+}
+
+// Bind performs a simple bind. Returns false if the credentials are
+// invalid.
+func (c *ldapConn) Bind(dn, password string) (bool, error) {
+	err := c.send(berEncode(ldapBindRequest, berInt(berInteger, 3),
+		berString(dn), berEncode(ldapSimpleAuth, []byte(password))))
+	if err != nil {
+		return false, fmt.Errorf("Could not send bind request: %v", err)
+	}
+	op, err := c.receive()
+	if err != nil {
+		return false, fmt.Errorf("Could not receive bind response: %v", err)
+	}
+	if op.Tag != ldapBindResponse {
+		return false, fmt.Errorf("Unexpected response to bind request")
+	}
+	code, msg, err := parseResult(op)
+	if err != nil {
+		return false, fmt.Errorf("Could not parse bind response: %v", err)
+	}
+	switch code {
+	case ldapSuccess:
+		return true, nil
+	case ldapInvalidCredentials:
+		return false, nil
+	}
+	return false, fmt.Errorf("Bind failed with result code %v: %v", code, msg)
+}
+
+// Lookup returns the given attributes of the entry with the given
+// DN. If there is no such entry, returns nil.
+func (c *ldapConn) Lookup(dn string, attributes []string) (
+	map[string][]string, error) {
+	encodedAttrs := make([][]byte, 0, len(attributes))
+	for _, attr := range attributes {
+		encodedAttrs = append(encodedAttrs, berString(attr))
+	}
+	err := c.send(berEncode(ldapSearchRequest,
+		berString(dn),
+		berInt(berEnumerated, 0), // scope: base object
+		berInt(berEnumerated, 0), // never deref aliases
+		berInt(berInteger, 0),    // size limit
+		berInt(berInteger, 0),    // time limit
+		berEncode(berBoolean, []byte{0}),
+		berEncode(ldapFilterPresent, []byte("objectClass")),
+		berEncode(berSequence, encodedAttrs...)))
+	if err != nil {
+		return nil, fmt.Errorf("Could not send search request: %v", err)
+	}
+	var entry map[string][]string
+	for {
+		op, err := c.receive()
+		if err != nil {
+			return nil, fmt.Errorf("Could not receive search response: %v", err)
+		}
+		switch op.Tag {
+		case ldapSearchEntry:
+			entry, err = parseSearchEntry(op)
+			if err != nil {
+				return nil, fmt.Errorf("Could not parse search entry: %v", err)
+			}
+		case ldapSearchDone:
+			code, msg, err := parseResult(op)
+			if err != nil {
+				return nil, fmt.Errorf("Could not parse search result: %v", err)
+			}
+			switch code {
+			case ldapSuccess:
+				return entry, nil
+			case ldapNoSuchObject:
+				return nil, nil
+			}
+			return nil, fmt.Errorf("Search failed with result code %v: %v",
+				code, msg)
+		}
+	}
+}
+
+// parseSearchEntry returns the attributes of the given search result
+// entry.
+func parseSearchEntry(op *berElement) (map[string][]string, error) {
+	parts, err := berParse(op.Content)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("Invalid search entry")
+	}
+	attributes, err := berParse(parts[1].Content)
+	if err != nil {
+		return nil, err
+	}
+	entry := make(map[string][]string)
+	for _, attribute := range attributes {
+		attrParts, err := berParse(attribute.Content)
+		if err != nil {
+			return nil, err
+		}
+		if len(attrParts) < 2 {
+			return nil, fmt.Errorf("Invalid attribute")
+		}
+		values, err := berParse(attrParts[1].Content)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.ToLower(string(attrParts[0].Content))
+		for _, value := range values {
+			entry[name] = append(entry[name], string(value.Content))
+		}
+	}
+	return entry, nil
+}
+
+// Close unbinds and closes the connection.
+func (c *ldapConn) Close() error {
+	c.send(berEncode(ldapUnbindRequest))
+	return c.conn.Close()
+}
+
+// ldapAuthenticator authenticates users with a simple bind to a LDAP
+// server.
+type ldapAuthenticator struct {
+	settings util.AuthenticatorSettings
+	// dial opens a new connection to the LDAP server.
+	dial func() (net.Conn, error)
+}
+
+func newLDAPAuthenticator(
+	settings util.AuthenticatorSettings) *ldapAuthenticator {
+	if len(settings.LDAP.NameAttribute) == 0 {
+		settings.LDAP.NameAttribute = "cn"
+	}
+	if len(settings.LDAP.EmailAttribute) == 0 {
+		settings.LDAP.EmailAttribute = "mail"
+	}
+	auth := &ldapAuthenticator{settings: settings}
+	auth.dial = func() (net.Conn, error) {
+		dialer := &net.Dialer{Timeout: 10 * time.Second}
+		address := settings.LDAP.Address
+		if settings.LDAP.TLS {
+			host, _, _ := net.SplitHostPort(address)
+			return tls.DialWithDialer(dialer, "tcp", address,
+				&tls.Config{ServerName: host})
+		}
+		return dialer.Dial("tcp", address)
+	}
+	return auth
+}
+
+func (a *ldapAuthenticator) Settings() util.AuthenticatorSettings {
+	return a.settings
+}
+
+// connect opens a new connection to the LDAP server.
+func (a *ldapAuthenticator) connect() (*ldapConn, error) {
+	conn, err := a.dial()
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to LDAP server: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	return newLDAPConn(conn), nil
+}
+
+// userDN returns the DN of the user with the given login.
+func (a *ldapAuthenticator) userDN(login string) string {
+	return fmt.Sprintf(a.settings.LDAP.UserDN, ldapEscapeDN(login))
+}
+
+// lookupUser returns the user with the given login using an already
+// bound connection.
+func (a *ldapAuthenticator) lookupUser(conn *ldapConn, login string) (
+	*service.User, error) {
+	nameAttr := strings.ToLower(a.settings.LDAP.NameAttribute)
+	emailAttr := strings.ToLower(a.settings.LDAP.EmailAttribute)
+	entry, err := conn.Lookup(a.userDN(login), []string{nameAttr, emailAttr})
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	user := &service.User{Login: login, Name: login}
+	if values := entry[nameAttr]; len(values) > 0 {
+		user.Name = values[0]
+	}
+	if values := entry[emailAttr]; len(values) > 0 {
+		user.Email = values[0]
+	}
+	return user, nil
+}
+
+func (a *ldapAuthenticator) GetUser(login string) (*service.User, error) {
+	if !allowedLogin(a.settings, login) {
+		return nil, nil
+	}
+	if len(a.settings.LDAP.BindDN) == 0 {
+		return &service.User{Login: login, Name: login}, nil
+	}
+	conn, err := a.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ok, err := conn.Bind(a.settings.LDAP.BindDN, a.settings.LDAP.BindPassword)
+	if err != nil {
+		return nil, fmt.Errorf("Could not bind: %v", err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("Invalid bind credentials")
+	}
+	return a.lookupUser(conn, login)
+}
+
+func (a *ldapAuthenticator) Authenticate(login, password string) (
+	*service.User, error) {
+	// An empty password would result in an unauthenticated bind.
+	if len(password) == 0 || !allowedLogin(a.settings, login) {
+		return nil, nil
+	}
+	conn, err := a.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ok, err := conn.Bind(a.userDN(login), password)
+	if err != nil {
+		return nil, fmt.Errorf("Could not bind: %v", err)
+	}
+	if !ok {
+		return nil, nil
+	}
+	user, err := a.lookupUser(conn, login)
+	if err == nil && user == nil {
+		// The user may not be allowed to read its own entry.
+		user = &service.User{Login: login, Name: login}
+	}
+	return user, err
+}
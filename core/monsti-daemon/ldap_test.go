@@ -0,0 +1,205 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestBerInt(t *testing.T) {
+	for _, v := range []int{0, 1, 127, 128, 255, 256, 65535, 1 << 20, -1, -128,
+		-129} {
+		element, err := berRead(bytes.NewReader(berInt(berInteger, v)))
+		if err != nil {
+			t.Fatalf("Could not read encoded %v: %v", v, err)
+		}
+		if ret := berParseInt(element.Content); ret != v {
+			t.Errorf("berParseInt(berInt(%v)) = %v", v, ret)
+		}
+	}
+}
+
+func TestLdapEscapeDN(t *testing.T) {
+	tests := []struct{ Value, Expected string }{
+		{"foo", "foo"},
+		{"foo,bar", `foo\,bar`},
+		{" foo ", `\ foo\ `},
+		{"#foo=bar+baz", `\#foo\=bar\+baz`},
+		{`a"b\c<d>e;`, `a\"b\\c\<d\>e\;`},
+	}
+	for _, v := range tests {
+		if ret := ldapEscapeDN(v.Value); ret != v.Expected {
+			t.Errorf("ldapEscapeDN(%q) = %q, should be %q", v.Value, ret,
+				v.Expected)
+		}
+	}
+}
+
+// ldapTestEntry is an entry of the directory served by
+// serveLDAPTest.
+type ldapTestEntry struct {
+	Password   string
+	Attributes map[string]string
+}
+
+// serveLDAPTest serves a minimal LDAP server for the given directory
+// on the given listener.
+func serveLDAPTest(t *testing.T, listener net.Listener,
+	directory map[string]ldapTestEntry) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			for {
+				msg, err := berRead(reader)
+				if err != nil {
+					return
+				}
+				parts, err := berParse(msg.Content)
+				if err != nil || len(parts) < 2 {
+					t.Errorf("Invalid LDAP message")
+					return
+				}
+				id := berParseInt(parts[0].Content)
+				op := parts[1]
+				args, _ := berParse(op.Content)
+				reply := func(op []byte) {
+					conn.Write(berEncode(berSequence, berInt(berInteger, id), op))
+				}
+				result := func(tag byte, code int) []byte {
+					return berEncode(tag, berInt(berEnumerated, code),
+						berString(""), berString(""))
+				}
+				switch op.Tag {
+				case ldapBindRequest:
+					entry, ok := directory[string(args[1].Content)]
+					if ok && entry.Password == string(args[2].Content) {
+						reply(result(ldapBindResponse, ldapSuccess))
+					} else {
+						reply(result(ldapBindResponse, ldapInvalidCredentials))
+					}
+				case ldapSearchRequest:
+					dn := string(args[0].Content)
+					entry, ok := directory[dn]
+					if !ok {
+						reply(result(ldapSearchDone, ldapNoSuchObject))
+						continue
+					}
+					var attributes [][]byte
+					for name, value := range entry.Attributes {
+						attributes = append(attributes, berEncode(berSequence,
+							berString(name), berEncode(berSet, berString(value))))
+					}
+					reply(berEncode(ldapSearchEntry, berString(dn),
+						berEncode(berSequence, attributes...)))
+					reply(result(ldapSearchDone, ldapSuccess))
+				case ldapUnbindRequest:
+					return
+				}
+			}
+		}(conn)
+	}
+}
+
+func TestLDAPAuthenticator(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer listener.Close()
+	go serveLDAPTest(t, listener, map[string]ldapTestEntry{
+		"cn=admin,dc=example": {"secret", nil},
+		"uid=alice,ou=people,dc=example": {"foo", map[string]string{
+			"cn": "Alice", "mail": "alice@example.com"}},
+		`uid=b\,ob,ou=people,dc=example`: {"bar", nil},
+	})
+	settings := util.AuthenticatorSettings{
+		Name: "ldap", Type: "ldap",
+		LDAP: util.LDAPSettings{
+			Address: listener.Addr().String(),
+			UserDN:  "uid=%s,ou=people,dc=example",
+		}}
+	alice := &service.User{Login: "alice", Name: "Alice",
+		Email: "alice@example.com"}
+
+	auth := newLDAPAuthenticator(settings)
+	if user, err := auth.Authenticate("alice", "foo"); err != nil ||
+		user != nil {
+		t.Errorf("Authenticate without allowed logins = %v, %v", user, err)
+	}
+	settings.Logins = []string{"alice", "b,ob", "unknown"}
+	auth = newLDAPAuthenticator(settings)
+	tests := []struct {
+		Login, Password string
+		User            *service.User
+	}{
+		{"alice", "foo", alice},
+		{"alice", "bar", nil},
+		{"alice", "", nil},
+		{"b,ob", "bar", &service.User{Login: "b,ob", Name: "b,ob"}},
+		{"unknown", "foo", nil},
+	}
+	for i, v := range tests {
+		user, err := auth.Authenticate(v.Login, v.Password)
+		if err != nil {
+			t.Errorf("%v: Authenticate returned error: %v", i, err)
+		}
+		if !reflect.DeepEqual(user, v.User) {
+			t.Errorf("%v: Authenticate(%q, %q) = %v, should be %v", i, v.Login,
+				v.Password, user, v.User)
+		}
+	}
+
+	user, err := auth.GetUser("unknown")
+	if err != nil || user == nil || user.Login != "unknown" {
+		t.Errorf(`GetUser("unknown") without BindDN = %v, %v`, user, err)
+	}
+
+	settings.LDAP.BindDN = "cn=admin,dc=example"
+	settings.LDAP.BindPassword = "secret"
+	settings.Logins = []string{"alice", "unknown"}
+	auth = newLDAPAuthenticator(settings)
+	getUserTests := []struct {
+		Login string
+		User  *service.User
+	}{
+		{"alice", alice},
+		{"unknown", nil},
+		{"b,ob", nil},
+	}
+	for i, v := range getUserTests {
+		user, err := auth.GetUser(v.Login)
+		if err != nil {
+			t.Errorf("%v: GetUser returned error: %v", i, err)
+		}
+		if !reflect.DeepEqual(user, v.User) {
+			t.Errorf("%v: GetUser(%q) = %v, should be %v", i, v.Login, user,
+				v.User)
+		}
+	}
+}
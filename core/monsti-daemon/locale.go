@@ -0,0 +1,154 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// splitLocalePrefix splits off the locale prefix of the given path if
+// its first directory is one of the given locales.
+//
+// Returns the locale and the remaining path. If there is no locale
+// prefix, the locale is empty.
+func splitLocalePrefix(nodePath string, locales []string) (string, string) {
+	first := splitFirstDir(nodePath)
+	if len(first) == 0 || !inStringSlice(first, locales) {
+		return "", nodePath
+	}
+	rest := strings.TrimPrefix(strings.TrimLeft(nodePath, "/"), first)
+	if len(rest) == 0 {
+		rest = "/"
+	}
+	return first, rest
+}
+
+// negotiateLocale returns the one of the given locales which best
+// matches the given Accept-Language header value.
+//
+// Language ranges like "de-AT" match the locale "de". If no locale
+// matches, returns the empty string.
+func negotiateLocale(header string, locales []string) string {
+	var best string
+	bestQuality := 0.0
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(params[0]))
+		if len(tag) == 0 {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				value, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					quality = value
+				}
+			}
+		}
+		if quality <= bestQuality {
+			continue
+		}
+		for _, locale := range locales {
+			localeTag := strings.ToLower(strings.Replace(locale, "_", "-", -1))
+			if tag == localeTag || strings.HasPrefix(tag, localeTag+"-") ||
+				tag == "*" {
+				best, bestQuality = locale, quality
+				break
+			}
+		}
+	}
+	return best
+}
+
+// requestLocale returns the content locale for the given request and
+// node path.
+//
+// A locale prefix of the path takes precedence over the
+// Accept-Language header. Returns the locale, the locale prefix (if
+// any) and the node path without prefix.
+func requestLocale(r *http.Request, site util.SiteSettings, nodePath string) (
+	locale, prefix, rest string) {
+	if len(site.Locales) < 2 {
+		return site.Locale, "", nodePath
+	}
+	locale, rest = splitLocalePrefix(nodePath, site.Locales)
+	if len(locale) > 0 {
+		return locale, "/" + locale, rest
+	}
+	locale = negotiateLocale(r.Header.Get("Accept-Language"), site.Locales)
+	if len(locale) == 0 {
+		locale = site.Locale
+	}
+	return locale, "", nodePath
+}
+
+// translateNode returns the node translated to the given locale.
+//
+// If the node has not been translated and the site does not fall
+// back to the default locale, returns nil.
+func translateNode(node *service.Node, site util.SiteSettings,
+	locale string) *service.Node {
+	if locale == site.Locale {
+		return node
+	}
+	return node.Translated(locale, site.TranslationFallback)
+}
+
+// localeCacheID returns the cache id to be used for content in the
+// given locale.
+func localeCacheID(id string, site util.SiteSettings, locale string) string {
+	if locale == site.Locale {
+		return id
+	}
+	return id + "." + locale
+}
+
+// languageLink is an entry of the language switcher.
+type languageLink struct {
+	Locale, Target string
+	Active         bool
+}
+
+// getLanguageLinks returns the language switcher entries for the
+// given node.
+func getLanguageLinks(site util.SiteSettings, node *service.Node,
+	active string) []languageLink {
+	if len(site.Locales) < 2 {
+		return nil
+	}
+	links := make([]languageLink, 0, len(site.Locales))
+	for _, locale := range site.Locales {
+		if locale != site.Locale && !site.TranslationFallback &&
+			node.Translations[locale] == nil {
+			continue
+		}
+		target := path.Join("/", locale, node.Path)
+		if !strings.HasSuffix(target, "/") {
+			target += "/"
+		}
+		links = append(links, languageLink{locale, target, locale == active})
+	}
+	return links
+}
@@ -0,0 +1,91 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestSplitLocalePrefix(t *testing.T) {
+	locales := []string{"en", "de"}
+	tests := []struct {
+		Path, Locale, Rest string
+	}{
+		{"/", "", "/"},
+		{"/foo/", "", "/foo/"},
+		{"/de", "de", "/"},
+		{"/de/", "de", "/"},
+		{"/de/foo/bar/", "de", "/foo/bar/"},
+		{"/dev/foo/", "", "/dev/foo/"},
+		{"/fr/foo/", "", "/fr/foo/"},
+	}
+	for _, v := range tests {
+		locale, rest := splitLocalePrefix(v.Path, locales)
+		if locale != v.Locale || rest != v.Rest {
+			t.Errorf("splitLocalePrefix(%q, _) = %q, %q, should be %q, %q",
+				v.Path, locale, rest, v.Locale, v.Rest)
+		}
+	}
+}
+
+func TestNegotiateLocale(t *testing.T) {
+	locales := []string{"en", "de", "pt_BR"}
+	tests := []struct {
+		Header, Locale string
+	}{
+		{"", ""},
+		{"fr", ""},
+		{"de", "de"},
+		{"de-AT, en;q=0.8", "de"},
+		{"fr, en;q=0.5, de;q=0.8", "de"},
+		{"en;q=0.1, de;q=0", "en"},
+		{"pt-BR", "pt_BR"},
+		{"fr, *;q=0.1", "en"},
+	}
+	for _, v := range tests {
+		if ret := negotiateLocale(v.Header, locales); ret != v.Locale {
+			t.Errorf("negotiateLocale(%q, _) = %q, should be %q", v.Header, ret,
+				v.Locale)
+		}
+	}
+}
+
+func TestRequestLocale(t *testing.T) {
+	site := util.SiteSettings{Locale: "en", Locales: []string{"en", "de"}}
+	tests := []struct {
+		Path, AcceptLanguage     string
+		Locale, Prefix, NodePath string
+	}{
+		{"/foo/", "", "en", "", "/foo/"},
+		{"/foo/", "de-DE", "de", "", "/foo/"},
+		{"/en/foo/", "de-DE", "en", "/en", "/foo/"},
+		{"/de/foo/", "", "de", "/de", "/foo/"},
+	}
+	for _, v := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com"+v.Path, nil)
+		req.Header.Set("Accept-Language", v.AcceptLanguage)
+		locale, prefix, nodePath := requestLocale(req, site, v.Path)
+		if locale != v.Locale || prefix != v.Prefix || nodePath != v.NodePath {
+			t.Errorf("requestLocale(%q, %q) = %q, %q, %q, should be %q, %q, %q",
+				v.Path, v.AcceptLanguage, locale, prefix, nodePath, v.Locale,
+				v.Prefix, v.NodePath)
+		}
+	}
+}
@@ -0,0 +1,436 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html"
+	"image"
+	"io"
+	"mime/multipart"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/template"
+)
+
+// mediaAsset is an image or file node shown in the media library.
+type mediaAsset struct {
+	Node  *service.Node
+	Title string
+	Image bool
+}
+
+type mediaAssets []*mediaAsset
+
+func (a mediaAssets) Len() int {
+	return len(a)
+}
+
+func (a mediaAssets) Less(i, j int) bool {
+	return a[i].Node.Path < a[j].Node.Path
+}
+
+func (a mediaAssets) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+// isMediaNode checks if the node is an image or file.
+func isMediaNode(node *service.Node) bool {
+	return node.Type.Id == "core.Image" || node.Type.Id == "core.File"
+}
+
+// walkNodes returns all nodes below the node with the given path.
+func walkNodes(nodePath string, getChildrenFn getChildrenFunc) (
+	[]*service.Node, error) {
+	children, err := getChildrenFn(nodePath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get children of %q: %v", nodePath, err)
+	}
+	var nodes []*service.Node
+	for _, child := range children {
+		if child.Type.Id != "core.Path" {
+			nodes = append(nodes, child)
+		}
+		descendants, err := walkNodes(child.Path, getChildrenFn)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, descendants...)
+	}
+	return nodes, nil
+}
+
+// dumpFields returns the marshaled fields of the node in all
+// languages.
+func dumpFields(node *service.Node) [][]byte {
+	fieldSets := []map[string]service.Field{node.Fields}
+	for _, fields := range node.Translations {
+		fieldSets = append(fieldSets, fields)
+	}
+	var dumps [][]byte
+	for _, fields := range fieldSets {
+		for _, field := range fields {
+			if field == nil {
+				continue
+			}
+			dump, err := json.Marshal(field.Dump())
+			if err != nil {
+				continue
+			}
+			dumps = append(dumps, dump)
+		}
+	}
+	return dumps
+}
+
+// maxNodeReferences is the maximum number of paths returned by
+// nodeReferences.
+const maxNodeReferences = 100
+
+// nodeReferencePattern matches absolute paths in marshaled fields.
+// Paths of absolute URLs (e.g. http://example.com/foo) are not matched.
+var nodeReferencePattern = regexp.MustCompile(`(?:^|[^-\w./:])(/[-\w.~/]*)`)
+
+// nodeReferences returns the paths of the nodes referenced by the
+// given node.
+//
+// Nodes reference other nodes if some field contains a link to their
+// absolute path, e.g. in a href or src attribute or a reference field.
+// Relative links are not detected.
+func nodeReferences(node *service.Node) []string {
+	unique := make(map[string]bool)
+	for _, dump := range dumpFields(node) {
+		for _, match := range nodeReferencePattern.FindAllSubmatch(dump, -1) {
+			target := path.Clean(string(match[1]))
+			if target != node.Path {
+				unique[target] = true
+			}
+		}
+	}
+	targets := make([]string, 0, len(unique))
+	for target := range unique {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	if len(targets) > maxNodeReferences {
+		targets = targets[:maxNodeReferences]
+	}
+	return targets
+}
+
+// getMediaAssets returns the image and file nodes of the given nodes
+// matching the given query and type ("image", "file" or "" for all).
+//
+// The query is matched case insensitive against the name and the
+// title of the nodes.
+func getMediaAssets(nodes []*service.Node, query, assetType string) []*mediaAsset {
+	query = strings.ToLower(query)
+	assets := make(mediaAssets, 0)
+	for _, node := range nodes {
+		if !isMediaNode(node) {
+			continue
+		}
+		asset := &mediaAsset{
+			Node:  node,
+			Title: getNodeTitle(node),
+			Image: node.Type.Id == "core.Image",
+		}
+		switch {
+		case assetType == "image" && !asset.Image,
+			assetType == "file" && asset.Image:
+			continue
+		}
+		if len(query) > 0 &&
+			!strings.Contains(strings.ToLower(node.Name()), query) &&
+			!strings.Contains(strings.ToLower(asset.Title), query) {
+			continue
+		}
+		assets = append(assets, asset)
+	}
+	sort.Sort(assets)
+	return assets
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^-\w.]+`)
+
+// mediaNodeName returns a node name for the uploaded file with the
+// given file name.
+func mediaNodeName(filename string) string {
+	name := path.Base(strings.Replace(filename, `\`, "/", -1))
+	name = unsafeNameChars.ReplaceAllString(name, "-")
+	name = strings.Trim(name, "-.")
+	if len(name) == 0 {
+		return "file"
+	}
+	return name
+}
+
+// uniqueNodePath returns a path for a new node named name below parent
+// which does not exist yet.
+func uniqueNodePath(parent, name string, getNodeFn getNodeFunc) (
+	string, error) {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		candidate := path.Join(parent, name)
+		if i > 1 {
+			candidate = path.Join(parent, fmt.Sprintf("%v-%v%v", base, i, ext))
+		}
+		node, err := getNodeFn(candidate)
+		if err != nil {
+			return "", fmt.Errorf("Could not get node: %v", err)
+		}
+		if node == nil {
+			return candidate, nil
+		}
+	}
+}
+
+// storeMedia creates an image or file node below the requested node
+// for the uploaded file.
+//
+// Returns the path of the new node or an error message if the file is
+// not valid.
+func storeMedia(c *reqContext, header *multipart.FileHeader) (
+	string, string, error) {
+	m := c.Serv.Monsti()
+	file, err := header.Open()
+	if err != nil {
+		return "", "", fmt.Errorf("Could not open multipart file: %v", err)
+	}
+	defer file.Close()
+	head, size, err := uploadHead(file)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := file.Seek(0, os.SEEK_SET); err != nil {
+		return "", "", fmt.Errorf("Could not rewind multipart file: %v", err)
+	}
+	typeId := "core.File"
+	if _, _, err := image.DecodeConfig(bufio.NewReader(file)); err == nil {
+		typeId = "core.Image"
+	}
+	nodeType, err := m.GetNodeType(typeId)
+	if err != nil {
+		return "", "", fmt.Errorf("Could not get node type: %v", err)
+	}
+	for _, field := range nodeType.Fields {
+		if field.Id == "core.File" {
+			msg := service.ValidateFileHead(field, head, size, c.UserSession.Locale)
+			if len(msg) > 0 {
+				return "", msg, nil
+			}
+		}
+	}
+	nodePath, err := uniqueNodePath(c.Node.Path, mediaNodeName(header.Filename),
+		func(nodePath string) (*service.Node, error) {
+			return m.GetNode(c.Site.Name, nodePath)
+		})
+	if err != nil {
+		return "", "", err
+	}
+	node := service.Node{Type: nodeType, Path: nodePath, Public: true,
+		PublishTime: time.Now().UTC()}
+	if err := node.InitFields(m, c.Site.Name); err != nil {
+		return "", "", fmt.Errorf("Could not init node fields: %v", err)
+	}
+	*node.Fields["core.Title"].(*service.TextField) =
+		service.TextField(header.Filename)
+	if body, ok := node.Fields["core.Body"].(*service.HTMLField); ok {
+		*body = service.HTMLField(fmt.Sprintf(`<p><a href="%v">%v</a></p>`,
+			html.EscapeString(nodePath), html.EscapeString(header.Filename)))
+	}
+	if typeId == "core.Image" {
+		var timezone string
+		err := m.GetSiteConfig(c.Site.Name, "core.timezone", &timezone)
+		if err != nil {
+			return "", "", fmt.Errorf("Could not get timezone: %v", err)
+		}
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			location = time.UTC
+		}
+		if _, err := file.Seek(0, os.SEEK_SET); err != nil {
+			return "", "", fmt.Errorf("Could not rewind multipart file: %v", err)
+		}
+		if err := setImageMetadata(&node, file, location); err != nil {
+			return "", "", fmt.Errorf("Could not read image metadata: %v", err)
+		}
+	}
+	if err := m.WriteNode(c.Site.Name, nodePath, &node); err != nil {
+		return "", "", fmt.Errorf("Could not write node: %v", err)
+	}
+	if _, err := file.Seek(0, os.SEEK_SET); err != nil {
+		return "", "", fmt.Errorf("Could not rewind multipart file: %v", err)
+	}
+	var data io.Reader = file
+	if typeId == "core.Image" {
+		if data, err = imageUploadData(c, file); err != nil {
+			return "", "", err
+		}
+	}
+	err = m.WriteNodeDataFrom(c.Site.Name, nodePath, "__file_core.File", data)
+	if err != nil {
+		return "", "", fmt.Errorf("Could not save file: %v", err)
+	}
+	if err := m.MarkDep(c.Site.Name, service.CacheDep{Node: nodePath}); err != nil {
+		return "", "", fmt.Errorf("Could not mark node: %v", err)
+	}
+	return nodePath, "", nil
+}
+
+// uploadMedia creates an image or file node below the requested node
+// for each file of the multipart form field "Files".
+//
+// Returns the paths of the created nodes and error messages for files
+// which could not be stored.
+func (h *nodeHandler) uploadMedia(c *reqContext) ([]string, []string, error) {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if err := c.Req.ParseMultipartForm(1024 * 1024); err != nil {
+		return nil, nil, fmt.Errorf("Could not parse form: %v", err)
+	}
+	var uploaded, errors []string
+	for _, header := range c.Req.MultipartForm.File["Files"] {
+		nodePath, msg, err := storeMedia(c, header)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(msg) > 0 {
+			errors = append(errors, fmt.Sprintf("%v: %v", header.Filename, msg))
+			continue
+		}
+		uploaded = append(uploaded, nodePath)
+	}
+	if len(uploaded) == 0 && len(errors) == 0 {
+		errors = append(errors, G("Please select at least one file."))
+	}
+	return uploaded, errors, nil
+}
+
+// Media shows the site's media library, i.e. all images and files.
+//
+// POST requests upload files below the requested node. If the request
+// parameter picker is set, a minimal page to select an asset from
+// within the editor is shown.
+func (h *nodeHandler) Media(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	var uploaded, uploadErrors []string
+	switch c.Req.Method {
+	case "GET":
+	case "POST":
+		if ok, err := limitUploadSize(c); !ok || err != nil {
+			return err
+		}
+		var err error
+		uploaded, uploadErrors, err = h.uploadMedia(c)
+		if err != nil {
+			return err
+		}
+		if c.Req.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+			c.Res.Header().Set("Content-Type", "application/json")
+			return json.NewEncoder(c.Res).Encode(struct {
+				Uploaded, Errors []string
+			}{uploaded, uploadErrors})
+		}
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	m := c.Serv.Monsti()
+	nodes, err := walkNodes(c.Node.Path,
+		func(nodePath string) ([]*service.Node, error) {
+			return m.GetChildren(c.Site.Name, nodePath)
+		})
+	if err != nil {
+		return fmt.Errorf("Could not get nodes: %v", err)
+	}
+	query := c.Req.FormValue("q")
+	assetType := c.Req.FormValue("type")
+	picker := len(c.Req.FormValue("picker")) > 0
+	context := template.Context{
+		"Assets":   getMediaAssets(nodes, query, assetType),
+		"Query":    query,
+		"Type":     assetType,
+		"Picker":   picker,
+		"Node":     c.Node,
+		"Uploaded": uploaded,
+		"Errors":   uploadErrors,
+	}
+	sitePath := h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name)
+	if picker {
+		body, err := h.Renderer.Render("actions/media-picker", context,
+			c.UserSession.Locale, sitePath)
+		if err != nil {
+			return fmt.Errorf("Can't render media picker: %v", err)
+		}
+		c.Res.Write(body)
+		return nil
+	}
+	body, err := h.Renderer.Render("actions/media", context,
+		c.UserSession.Locale, sitePath)
+	if err != nil {
+		return fmt.Errorf("Can't render media library: %v", err)
+	}
+	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
+		Title: G("Media library"), Flags: EDIT_VIEW}
+	rendered, _ := renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv)
+	c.Res.Write(rendered)
+	return nil
+}
+
+// mediaUsages returns the paths of the nodes referencing the given
+// image or file node.
+//
+// The rendered pages of nodes depend on the nodes they reference, so
+// the usages are read from the reverse dependencies of the given
+// node's cache. Nodes which have not been rendered since their last
+// change are not found.
+func mediaUsages(cacheRoot, nodePath string) ([]string, error) {
+	lock := cacheLock(cacheRoot)
+	lock.Lock()
+	rdeps, err := readRdeps(cacheRoot, nodePath)
+	lock.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("Could not read cache dependencies: %v", err)
+	}
+	unique := make(map[string]bool)
+	for dep, entries := range rdeps {
+		if dep.Node != nodePath || len(dep.Cache) > 0 {
+			continue
+		}
+		for rdep := range entries {
+			if rdep.Node != nodePath {
+				unique[rdep.Node] = true
+			}
+		}
+	}
+	var usages []string
+	for usage := range unique {
+		usages = append(usages, usage)
+	}
+	sort.Strings(usages)
+	return usages, nil
+}
@@ -0,0 +1,179 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"path"
+	"reflect"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestMediaNodeName(t *testing.T) {
+	tests := []struct{ Filename, Name string }{
+		{"foo.png", "foo.png"},
+		{"My Photo (1).JPG", "My-Photo-1-.JPG"},
+		{`C:\Users\foo\bar.pdf`, "bar.pdf"},
+		{"../../etc/passwd", "passwd"},
+		{".hidden", "hidden"},
+		{"äöü", "file"},
+		{"", "file"},
+	}
+	for i, test := range tests {
+		if ret := mediaNodeName(test.Filename); ret != test.Name {
+			t.Errorf("%v: mediaNodeName(%q) = %q, should be %q", i,
+				test.Filename, ret, test.Name)
+		}
+	}
+}
+
+func TestUniqueNodePath(t *testing.T) {
+	existing := map[string]bool{"/foo/bar.png": true, "/foo/bar-2.png": true}
+	getNodeFn := func(nodePath string) (*service.Node, error) {
+		if existing[nodePath] {
+			return &service.Node{Path: nodePath}, nil
+		}
+		return nil, nil
+	}
+	tests := []struct{ Name, Path string }{
+		{"baz.png", "/foo/baz.png"},
+		{"bar.png", "/foo/bar-3.png"},
+	}
+	for i, test := range tests {
+		ret, err := uniqueNodePath("/foo", test.Name, getNodeFn)
+		if err != nil || ret != test.Path {
+			t.Errorf("%v: uniqueNodePath(%q) = %q, %v should be %q", i,
+				test.Name, ret, err, test.Path)
+		}
+	}
+}
+
+func TestMediaAssets(t *testing.T) {
+	image := &service.NodeType{Id: "core.Image"}
+	file := &service.NodeType{Id: "core.File"}
+	document := &service.NodeType{Id: "core.Document"}
+	html := func(v string) service.Field { f := service.HTMLField(v); return &f }
+	text := func(v string) service.Field { f := service.TextField(v); return &f }
+	nodes := map[string]*service.Node{
+		"/logo.png": {Type: image, Fields: map[string]service.Field{
+			"core.Title": text("Our Logo")}},
+		"/docs": {Type: &service.NodeType{Id: "core.Path"}},
+		"/docs/manual.pdf": {Type: file, Fields: map[string]service.Field{
+			"core.Title": text("Manual")}},
+		"/docs/logo.png.txt": {Type: file, Fields: map[string]service.Field{
+			"core.Title": text("Notes")}},
+		"/about": {Type: document, Fields: map[string]service.Field{
+			"core.Body": html(`<img src="/logo.png?size=small">`)},
+			Translations: map[string]map[string]service.Field{
+				"de": {"core.Body": html(`<a href="/docs/manual.pdf">PDF</a>`)}}},
+		"/news": {Type: document, Fields: map[string]service.Field{
+			"core.Body": html(`<a href="/docs/logo.png.txt">Notes</a>`)}},
+	}
+	children := map[string][]string{
+		"/":     {"logo.png", "docs", "about", "news"},
+		"/docs": {"manual.pdf", "logo.png.txt"},
+	}
+	getChildrenFn := func(nodePath string) ([]*service.Node, error) {
+		var ret []*service.Node
+		for _, name := range children[nodePath] {
+			node := nodes[path.Join(nodePath, name)]
+			node.Path = path.Join(nodePath, name)
+			ret = append(ret, node)
+		}
+		return ret, nil
+	}
+	all, err := walkNodes("/", getChildrenFn)
+	if err != nil {
+		t.Fatalf("walkNodes returned error: %v", err)
+	}
+	if len(all) != len(nodes)-1 {
+		t.Errorf("walkNodes should return all nodes except paths, got %v",
+			len(all))
+	}
+	tests := []struct {
+		Query, Type string
+		Paths       []string
+	}{
+		{"", "", []string{"/docs/logo.png.txt", "/docs/manual.pdf", "/logo.png"}},
+		{"", "image", []string{"/logo.png"}},
+		{"", "file", []string{"/docs/logo.png.txt", "/docs/manual.pdf"}},
+		{"MANUAL", "", []string{"/docs/manual.pdf"}},
+		{"logo", "", []string{"/docs/logo.png.txt", "/logo.png"}},
+		{"missing", "", nil},
+	}
+	for i, test := range tests {
+		var paths []string
+		for _, asset := range getMediaAssets(all, test.Query, test.Type) {
+			paths = append(paths, asset.Node.Path)
+		}
+		if !reflect.DeepEqual(paths, test.Paths) {
+			t.Errorf("%v: getMediaAssets(%q, %q) returned %v, should be %v", i,
+				test.Query, test.Type, paths, test.Paths)
+		}
+	}
+	docs, err := walkNodes("/docs", getChildrenFn)
+	if err != nil || len(docs) != 2 {
+		t.Errorf("walkNodes should return the nodes below /docs, got %v, %v",
+			docs, err)
+	}
+}
+
+func TestNodeReferences(t *testing.T) {
+	html := func(v string) service.Field { f := service.HTMLField(v); return &f }
+	node := &service.Node{Path: "/about", Fields: map[string]service.Field{
+		"core.Body": html(`<img src="/logo.png?size=small">
+<a href="/about/">Self</a> <a href="http://example.com/external">Ext</a>
+<a href="relative">Rel</a> and/or <a href='/docs/'>Docs</a>`)},
+		Translations: map[string]map[string]service.Field{
+			"de": {"core.Body": html(`<a href="/docs/manual.pdf">PDF</a>`)}}}
+	expected := []string{"/docs", "/docs/manual.pdf", "/logo.png"}
+	if refs := nodeReferences(node); !reflect.DeepEqual(refs, expected) {
+		t.Errorf("nodeReferences returned %v, should be %v", refs, expected)
+	}
+}
+
+func TestMediaUsages(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{},
+		"TestMediaUsages")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	for node, deps := range map[string][]service.CacheDep{
+		"/about":    {{Node: "/about"}, {Node: "/logo.png"}},
+		"/news":     {{Node: "/news"}, {Node: "/logo.png"}},
+		"/logo.png": {{Node: "/logo.png"}, {Node: "/", Descend: -1}},
+	} {
+		err := toCache(root, node, "core.page.full", []byte("page"),
+			&service.CacheMods{Deps: deps})
+		if err != nil {
+			t.Fatalf("Could not cache data: %v", err)
+		}
+	}
+	usages, err := mediaUsages(root, "/logo.png")
+	expected := []string{"/about", "/news"}
+	if err != nil || !reflect.DeepEqual(usages, expected) {
+		t.Errorf("mediaUsages returned %v, %v, should be %v", usages, err,
+			expected)
+	}
+	if usages, err := mediaUsages(root, "/unused.png"); err != nil ||
+		len(usages) != 0 {
+		t.Errorf("mediaUsages should not find usages, got %v, %v", usages, err)
+	}
+}
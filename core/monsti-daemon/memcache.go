@@ -0,0 +1,205 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"container/list"
+	"path"
+	"sync"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// defaultMemoryCacheSize is the size of a site's memory cache in MiB
+// if not configured.
+const defaultMemoryCacheSize = 16
+
+// memoryEntryOverhead approximates the memory used by an entry besides
+// its data.
+const memoryEntryOverhead = 128
+
+type memoryKey struct {
+	Node, Id string
+}
+
+type memoryEntry struct {
+	Key  memoryKey
+	Data []byte
+	Mods service.CacheMods
+	Size int64
+}
+
+// memoryCache is a size bounded in-memory cache in front of a site's
+// cache on disk. If full, the least recently used entries are evicted.
+//
+// A nil memoryCache is a valid, always empty cache.
+type memoryCache struct {
+	mutex sync.Mutex
+	// max is the maximum size in bytes and size the current size.
+	max, size int64
+	// entries contains the entries, most recently used first.
+	entries *list.List
+	index   map[memoryKey]*list.Element
+	// generation is incremented whenever entries get invalidated.
+	generation uint64
+}
+
+// newMemoryCache returns a cache with the given maximum size in bytes.
+func newMemoryCache(max int64) *memoryCache {
+	return &memoryCache{
+		max:     max,
+		entries: list.New(),
+		index:   make(map[memoryKey]*list.Element),
+	}
+}
+
+// Get returns the data and the cache mods of the given entry.
+//
+// Returns false if the entry is not cached or has expired.
+func (c *memoryCache) Get(node, id string) ([]byte, *service.CacheMods, bool) {
+	if c == nil {
+		return nil, nil, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, ok := c.index[memoryKey{path.Clean(node), id}]
+	if !ok {
+		return nil, nil, false
+	}
+	entry := elem.Value.(*memoryEntry)
+	if !entry.Mods.Expire.IsZero() && entry.Mods.Expire.Before(time.Now()) {
+		c.remove(elem)
+		return nil, nil, false
+	}
+	c.entries.MoveToFront(elem)
+	mods := entry.Mods
+	return entry.Data, &mods, true
+}
+
+// Generation returns the current generation of the cache. It changes
+// whenever entries get removed or the cache gets cleared.
+func (c *memoryCache) Generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.generation
+}
+
+// Put adds or replaces the given entry if no entries have been
+// invalidated since the given generation, i.e. while the data has
+// been read from or written to disk. Otherwise, the data could be
+// stale.
+//
+// The data must not be modified afterwards. Entries larger than the
+// cache are not stored.
+func (c *memoryCache) Put(generation uint64, node, id string, data []byte,
+	mods *service.CacheMods) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if generation != c.generation {
+		return
+	}
+	key := memoryKey{path.Clean(node), id}
+	if elem, ok := c.index[key]; ok {
+		c.remove(elem)
+	}
+	entry := &memoryEntry{Key: key, Data: data,
+		Size: int64(len(data)+len(key.Node)+len(key.Id)) + memoryEntryOverhead}
+	if entry.Size > c.max {
+		return
+	}
+	if mods != nil {
+		entry.Mods = *mods
+		entry.Mods.Deps = nil
+	}
+	for c.size+entry.Size > c.max {
+		c.remove(c.entries.Back())
+	}
+	c.index[key] = c.entries.PushFront(entry)
+	c.size += entry.Size
+}
+
+// Remove removes the given entry.
+func (c *memoryCache) Remove(node, id string) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.generation++
+	if elem, ok := c.index[memoryKey{path.Clean(node), id}]; ok {
+		c.remove(elem)
+	}
+}
+
+// Clear removes all entries.
+func (c *memoryCache) Clear() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.generation++
+	c.entries.Init()
+	c.index = make(map[memoryKey]*list.Element)
+	c.size = 0
+}
+
+// remove removes the given element. The mutex must be held.
+func (c *memoryCache) remove(elem *list.Element) {
+	entry := c.entries.Remove(elem).(*memoryEntry)
+	delete(c.index, entry.Key)
+	c.size -= entry.Size
+}
+
+// memoryCache returns the memory cache of the given site or nil if the
+// site's memory cache has been disabled.
+func (i *MonstiService) memoryCache(site string) *memoryCache {
+	i.memCachesMutex.Lock()
+	defer i.memCachesMutex.Unlock()
+	if cache, ok := i.memCaches[site]; ok {
+		return cache
+	}
+	settings, _ := i.Settings.Site(site)
+	size := int64(settings.MemoryCacheSize)
+	if size == 0 {
+		size = defaultMemoryCacheSize
+	}
+	var cache *memoryCache
+	if size > 0 {
+		cache = newMemoryCache(size << 20)
+	}
+	if i.memCaches == nil {
+		i.memCaches = make(map[string]*memoryCache)
+	}
+	i.memCaches[site] = cache
+	return cache
+}
+
+// forget removes the given cache entries from the site's memory cache.
+func (i *MonstiService) forget(site string, entries []service.CacheDep) {
+	memory := i.memoryCache(site)
+	for _, entry := range entries {
+		memory.Remove(entry.Node, entry.Cache)
+	}
+}
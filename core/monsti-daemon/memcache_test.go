@@ -0,0 +1,117 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestMemoryCache(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 100)
+	size := int64(len(data)+len("/a")+len("id")) + memoryEntryOverhead
+	c := newMemoryCache(2 * size)
+	c.Put(c.Generation(), "/a", "id", data, nil)
+	c.Put(c.Generation(), "/b/", "id", data, &service.CacheMods{
+		Deps: []service.CacheDep{{Node: "/"}}})
+	if _, mods, ok := c.Get("/b", "id"); !ok || mods.Deps != nil {
+		t.Errorf("/b should be cached without deps, got %v, %v", mods, ok)
+	}
+	// /a is least recently used and gets evicted.
+	c.Put(c.Generation(), "/c", "id", data, nil)
+	if _, _, ok := c.Get("/a", "id"); ok {
+		t.Errorf("/a should have been evicted")
+	}
+	for _, node := range []string{"/b", "/c"} {
+		if ret, _, ok := c.Get(node, "id"); !ok || !bytes.Equal(ret, data) {
+			t.Errorf("%v should be cached", node)
+		}
+	}
+	c.Put(c.Generation(), "/big", "id", bytes.Repeat(data, 5), nil)
+	if _, _, ok := c.Get("/big", "id"); ok || c.size != 2*size {
+		t.Errorf("Entries larger than the cache should not be stored")
+	}
+	c.Remove("/b", "id")
+	if _, _, ok := c.Get("/b", "id"); ok || c.size != size {
+		t.Errorf("/b should have been removed")
+	}
+	c.Put(c.Generation(), "/d", "id", data, &service.CacheMods{
+		Expire: time.Now().Add(-time.Second)})
+	if _, _, ok := c.Get("/d", "id"); ok {
+		t.Errorf("Expired entries should not be returned")
+	}
+	// Entries read before an invalidation are not stored.
+	generation := c.Generation()
+	c.Remove("/e", "id")
+	c.Put(generation, "/e", "id", data, nil)
+	if _, _, ok := c.Get("/e", "id"); ok {
+		t.Errorf("Stale entries should not be stored")
+	}
+	c.Clear()
+	if _, _, ok := c.Get("/c", "id"); ok || c.size != 0 {
+		t.Errorf("Cache should be empty")
+	}
+	var disabled *memoryCache
+	disabled.Put(disabled.Generation(), "/a", "id", data, nil)
+	if _, _, ok := disabled.Get("/a", "id"); ok {
+		t.Errorf("Disabled cache should be empty")
+	}
+}
+
+func TestMemoryCacheCoherence(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{},
+		"TestMemoryCacheCoherence")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	settings := new(settings)
+	settings.Monsti.Directories.Data = root
+	m := &MonstiService{Settings: settings}
+	err = m.ToCache(&ToCacheArgs{Site: "site", Node: "/foo",
+		Id: "core.page.full", Content: []byte("page"),
+		Mods: &service.CacheMods{Deps: []service.CacheDep{{Node: "/foo"}}}},
+		new(int))
+	if err != nil {
+		t.Fatalf("Could not cache data: %v", err)
+	}
+	// Hits are served from memory.
+	cacheFile := filepath.Join(root, "site/cache/foo/.data/core.page.full")
+	if err := os.Remove(cacheFile); err != nil {
+		t.Fatalf("Could not remove cache file: %v", err)
+	}
+	var ret FromCacheRet
+	err = m.FromCache(&FromCacheArgs{Site: "site", Node: "/foo",
+		Id: "core.page.full"}, &ret)
+	if err != nil || string(ret.Data) != "page" {
+		t.Errorf("Page should be served from memory, got %q, %v", ret.Data, err)
+	}
+	err = m.MarkDep(&MarkDepArgs{"site", service.CacheDep{Node: "/foo"}},
+		new(int))
+	if err != nil {
+		t.Fatalf("Could not mark dep: %v", err)
+	}
+	if _, _, ok := m.memoryCache("site").Get("/foo", "core.page.full"); ok {
+		t.Errorf("Marked entry should have been removed from memory")
+	}
+}
@@ -0,0 +1,498 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// maxJPEGHeader limits the number of bytes read by readJPEGHeader.
+const maxJPEGHeader = 1024 * 1024
+
+// jpegSegment is a marker segment of a JPEG file.
+type jpegSegment struct {
+	Marker byte
+	// Start is the position of the segment within the header.
+	Start int
+	// Data is the payload of the segment. It refers to the header,
+	// i.e. changing it changes the header.
+	Data []byte
+}
+
+// readJPEGHeader reads the marker segments preceding the image data of
+// a JPEG file.
+//
+// The returned header contains all bytes read from r and has to be
+// prepended to the rest of r to get the complete file. If r is not a
+// JPEG file, no segments are returned.
+func readJPEGHeader(r io.Reader) ([]byte, []jpegSegment, error) {
+	var header []byte
+	// read appends the next n bytes of r to the header.
+	read := func(n int) ([]byte, error) {
+		start := len(header)
+		header = append(header, make([]byte, n)...)
+		m, err := io.ReadFull(r, header[start:])
+		header = header[:start+m]
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return header[start:], err
+	}
+	var positions [][3]int
+	done := func(err error) ([]byte, []jpegSegment, error) {
+		if err == io.ErrUnexpectedEOF {
+			// Leave truncated files to the image decoder.
+			err = nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not read JPEG header: %v", err)
+		}
+		segments := make([]jpegSegment, 0, len(positions))
+		for _, pos := range positions {
+			segments = append(segments, jpegSegment{
+				Marker: header[pos[0]+1],
+				Start:  pos[0],
+				Data:   header[pos[1]:pos[2]]})
+		}
+		return header, segments, nil
+	}
+	soi, err := read(2)
+	if err != nil || soi[0] != 0xff || soi[1] != 0xd8 {
+		return done(err)
+	}
+	for {
+		start := len(header)
+		marker, err := read(4)
+		if err != nil || marker[0] != 0xff || marker[1] == 0xda ||
+			marker[1] == 0xd9 {
+			return done(err)
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:]))
+		if length < 2 || len(header)+length-2 > maxJPEGHeader {
+			return done(nil)
+		}
+		if _, err := read(length - 2); err != nil {
+			return done(err)
+		}
+		positions = append(positions, [3]int{start, start + 4, len(header)})
+	}
+}
+
+// imageMetadata contains metadata of a photo as stored in EXIF and
+// IPTC records.
+type imageMetadata struct {
+	// Orientation is the EXIF orientation from 1 to 8, or zero if
+	// unknown.
+	Orientation int
+	// DateTaken is the date and time in EXIF format, e.g. "2015:06:30
+	// 18:04:00".
+	DateTaken   string
+	Make, Model string
+	Caption     string
+}
+
+// exifDateLayout is the format of EXIF dates.
+const exifDateLayout = "2006:01:02 15:04:05"
+
+// Camera returns the make and model of the camera.
+func (m imageMetadata) Camera() string {
+	if strings.HasPrefix(strings.ToLower(m.Model), strings.ToLower(m.Make)) {
+		return m.Model
+	}
+	return strings.TrimSpace(m.Make + " " + m.Model)
+}
+
+var (
+	exifPrefix      = []byte("Exif\x00\x00")
+	photoshopPrefix = []byte("Photoshop 3.0\x00")
+	xmpPrefix       = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+// EXIF tags
+const (
+	exifTagImageDescription = 0x010e
+	exifTagMake             = 0x010f
+	exifTagModel            = 0x0110
+	exifTagOrientation      = 0x0112
+	exifTagDateTime         = 0x0132
+	exifTagExifIFD          = 0x8769
+	exifTagGPSIFD           = 0x8825
+	exifTagDateTimeOriginal = 0x9003
+)
+
+// tiffTypeSizes maps TIFF field types to the size of their values.
+var tiffTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1,
+	8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// tiffData is a TIFF structure as used by EXIF.
+type tiffData struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// ifdEntry is an entry of a TIFF image file directory.
+type ifdEntry struct {
+	Tag, Type uint16
+	Count     uint32
+	// Pos is the position of the entry within the TIFF data.
+	Pos int
+}
+
+// newTIFF returns the TIFF structure of the given data and the offset
+// of its first IFD.
+func newTIFF(data []byte) (*tiffData, uint32, bool) {
+	if len(data) < 8 {
+		return nil, 0, false
+	}
+	t := &tiffData{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, 0, false
+	}
+	if t.order.Uint16(data[2:]) != 42 {
+		return nil, 0, false
+	}
+	return t, t.order.Uint32(data[4:]), true
+}
+
+// ifd returns the entries of the IFD at the given offset.
+func (t *tiffData) ifd(offset uint32) []ifdEntry {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return nil
+	}
+	count := int(t.order.Uint16(t.data[offset:]))
+	entries := make([]ifdEntry, 0, count)
+	for i := 0; i < count; i++ {
+		pos := int(offset) + 2 + 12*i
+		if pos+12 > len(t.data) {
+			break
+		}
+		entries = append(entries, ifdEntry{
+			Tag:   t.order.Uint16(t.data[pos:]),
+			Type:  t.order.Uint16(t.data[pos+2:]),
+			Count: t.order.Uint32(t.data[pos+4:]),
+			Pos:   pos})
+	}
+	return entries
+}
+
+// value returns the raw value of the entry or nil if it's invalid.
+func (t *tiffData) value(entry ifdEntry) []byte {
+	size := uint64(tiffTypeSizes[entry.Type]) * uint64(entry.Count)
+	if size <= 4 {
+		return t.data[entry.Pos+8 : entry.Pos+8+int(size)]
+	}
+	offset := uint64(t.order.Uint32(t.data[entry.Pos+8:]))
+	if offset+size > uint64(len(t.data)) {
+		return nil
+	}
+	return t.data[offset : offset+size]
+}
+
+// uint returns the first value of a SHORT or LONG entry.
+func (t *tiffData) uint(entry ifdEntry) (uint32, bool) {
+	value := t.value(entry)
+	switch {
+	case entry.Type == 3 && len(value) >= 2:
+		return uint32(t.order.Uint16(value)), true
+	case entry.Type == 4 && len(value) >= 4:
+		return t.order.Uint32(value), true
+	}
+	return 0, false
+}
+
+// string returns the value of an ASCII entry.
+func (t *tiffData) string(entry ifdEntry) string {
+	if entry.Type != 2 {
+		return ""
+	}
+	value := t.value(entry)
+	if i := bytes.IndexByte(value, 0); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(string(value))
+}
+
+// parseExif reads the metadata of an EXIF segment.
+func parseExif(data []byte, meta *imageMetadata) {
+	t, offset, ok := newTIFF(data)
+	if !ok {
+		return
+	}
+	var dateTime string
+	for _, entry := range t.ifd(offset) {
+		switch entry.Tag {
+		case exifTagImageDescription:
+			meta.Caption = t.string(entry)
+		case exifTagMake:
+			meta.Make = t.string(entry)
+		case exifTagModel:
+			meta.Model = t.string(entry)
+		case exifTagOrientation:
+			if value, ok := t.uint(entry); ok && value <= 8 {
+				meta.Orientation = int(value)
+			}
+		case exifTagDateTime:
+			dateTime = t.string(entry)
+		case exifTagExifIFD:
+			if offset, ok := t.uint(entry); ok {
+				for _, entry := range t.ifd(offset) {
+					if entry.Tag == exifTagDateTimeOriginal {
+						meta.DateTaken = t.string(entry)
+					}
+				}
+			}
+		}
+	}
+	if meta.DateTaken == "" {
+		meta.DateTaken = dateTime
+	}
+}
+
+// parseIPTCCaption returns the caption of the IPTC record in a
+// Photoshop segment.
+func parseIPTCCaption(data []byte) string {
+	// Find the IPTC-NAA resource (0x0404) among the image resources.
+	for len(data) >= 12 && string(data[:4]) == "8BIM" {
+		id := binary.BigEndian.Uint16(data[4:])
+		// The name is a padded pascal string.
+		nameLength := (int(data[6]) + 2) &^ 1
+		if 6+nameLength+4 > len(data) {
+			return ""
+		}
+		data = data[6+nameLength:]
+		size := int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if size < 0 || size > len(data) {
+			return ""
+		}
+		if id != 0x0404 {
+			if (size+1)&^1 > len(data) {
+				return ""
+			}
+			data = data[(size+1)&^1:]
+			continue
+		}
+		// Find the Caption/Abstract dataset (2:120).
+		record := data[:size]
+		for len(record) >= 5 && record[0] == 0x1c {
+			length := int(binary.BigEndian.Uint16(record[3:]))
+			if length&0x8000 != 0 || 5+length > len(record) {
+				return ""
+			}
+			if record[1] == 2 && record[2] == 120 {
+				return strings.TrimSpace(string(record[5 : 5+length]))
+			}
+			record = record[5+length:]
+		}
+		return ""
+	}
+	return ""
+}
+
+// parseJPEGMetadata reads the metadata of the given JPEG segments.
+//
+// The IPTC caption takes precedence over the EXIF image description.
+func parseJPEGMetadata(segments []jpegSegment) imageMetadata {
+	var meta imageMetadata
+	var caption string
+	for _, segment := range segments {
+		switch {
+		case segment.Marker == 0xe1 && bytes.HasPrefix(segment.Data, exifPrefix):
+			parseExif(segment.Data[len(exifPrefix):], &meta)
+		case segment.Marker == 0xed &&
+			bytes.HasPrefix(segment.Data, photoshopPrefix):
+			caption = parseIPTCCaption(segment.Data[len(photoshopPrefix):])
+		}
+	}
+	if caption != "" {
+		meta.Caption = caption
+	}
+	return meta
+}
+
+// stripGPS removes GPS data from the given JPEG header and returns the
+// new header.
+//
+// The GPS IFD of EXIF segments gets cleared in place, XMP segments
+// containing GPS data are removed.
+func stripGPS(header []byte, segments []jpegSegment) []byte {
+	out := make([]byte, 0, len(header))
+	last := 0
+	for _, segment := range segments {
+		if segment.Marker != 0xe1 {
+			continue
+		}
+		switch {
+		case bytes.HasPrefix(segment.Data, exifPrefix):
+			t, offset, ok := newTIFF(segment.Data[len(exifPrefix):])
+			if !ok {
+				continue
+			}
+			for _, entry := range t.ifd(offset) {
+				if entry.Tag != exifTagGPSIFD {
+					continue
+				}
+				gpsOffset, ok := t.uint(entry)
+				if !ok {
+					continue
+				}
+				gpsEntries := t.ifd(gpsOffset)
+				for _, gpsEntry := range gpsEntries {
+					value := t.value(gpsEntry)
+					for i := range value {
+						value[i] = 0
+					}
+					for i := gpsEntry.Pos; i < gpsEntry.Pos+12; i++ {
+						t.data[i] = 0
+					}
+				}
+				if len(gpsEntries) > 0 {
+					t.order.PutUint16(t.data[gpsOffset:], 0)
+				}
+			}
+		case bytes.HasPrefix(segment.Data, xmpPrefix) &&
+			bytes.Contains(segment.Data, []byte("GPS")):
+			out = append(out, header[last:segment.Start]...)
+			last = segment.Start + 4 + len(segment.Data)
+		}
+	}
+	return append(out, header[last:]...)
+}
+
+// orientImage transforms the image as specified by the given EXIF
+// orientation.
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	outWidth, outHeight := width, height
+	if orientation >= 5 {
+		outWidth, outHeight = height, width
+	}
+	src := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	out := image.NewRGBA(image.Rect(0, 0, outWidth, outHeight))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var outX, outY int
+			switch orientation {
+			case 2: // flip horizontally
+				outX, outY = width-1-x, y
+			case 3: // rotate by 180°
+				outX, outY = width-1-x, height-1-y
+			case 4: // flip vertically
+				outX, outY = x, height-1-y
+			case 5: // transpose
+				outX, outY = y, x
+			case 6: // rotate by 90° clockwise
+				outX, outY = height-1-y, x
+			case 7: // transverse
+				outX, outY = height-1-y, width-1-x
+			case 8: // rotate by 90° counterclockwise
+				outX, outY = y, width-1-x
+			}
+			copy(out.Pix[out.PixOffset(outX, outY):][:4],
+				src.Pix[src.PixOffset(x, y):][:4])
+		}
+	}
+	return out
+}
+
+// setImageMetadata sets the metadata fields of the image node from
+// the given image file.
+//
+// Dimensions, date taken and camera always describe the file, the
+// caption is only set if empty. Dates are assumed to be in the given
+// location.
+func setImageMetadata(node *service.Node, file io.ReadSeeker,
+	location *time.Location) error {
+	config, _, err := image.DecodeConfig(bufio.NewReader(file))
+	if err != nil {
+		return fmt.Errorf("Could not decode image config: %v", err)
+	}
+	if _, err := file.Seek(0, os.SEEK_SET); err != nil {
+		return fmt.Errorf("Could not rewind image file: %v", err)
+	}
+	_, segments, err := readJPEGHeader(bufio.NewReader(file))
+	if err != nil {
+		return err
+	}
+	meta := parseJPEGMetadata(segments)
+	if meta.Orientation >= 5 {
+		config.Width, config.Height = config.Height, config.Width
+	}
+	if field, ok := node.GetField("core.Width").(*service.IntegerField); ok {
+		*field = service.IntegerField(config.Width)
+	}
+	if field, ok := node.GetField("core.Height").(*service.IntegerField); ok {
+		*field = service.IntegerField(config.Height)
+	}
+	if field, ok := node.GetField("core.DateTaken").(*service.DateTimeField); ok {
+		field.Time = time.Time{}
+		date, err := time.ParseInLocation(exifDateLayout, meta.DateTaken, location)
+		if err == nil {
+			field.Time = date
+		}
+	}
+	if field, ok := node.GetField("core.Camera").(*service.TextField); ok {
+		*field = service.TextField(meta.Camera())
+	}
+	if field, ok := node.GetField("core.Caption").(*service.TextField); ok &&
+		*field == "" {
+		*field = service.TextField(meta.Caption)
+	}
+	return nil
+}
+
+// imageUploadData returns the data of an uploaded image to be stored.
+//
+// GPS data is removed if the site's core.image.stripgps setting is
+// enabled.
+func imageUploadData(c *reqContext, file io.Reader) (io.Reader, error) {
+	var strip bool
+	err := c.Serv.Monsti().GetSiteConfig(c.Site.Name, "core.image.stripgps",
+		&strip)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get stripgps setting: %v", err)
+	}
+	if !strip {
+		return file, nil
+	}
+	header, segments, err := readJPEGHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	return io.MultiReader(bytes.NewReader(stripGPS(header, segments)), file), nil
+}
@@ -0,0 +1,211 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// testExif returns an EXIF segment payload with camera, orientation,
+// date, and GPS latitude.
+func testExif() []byte {
+	le := binary.LittleEndian
+	var buf bytes.Buffer
+	write := func(values ...interface{}) {
+		for _, value := range values {
+			binary.Write(&buf, le, value)
+		}
+	}
+	buf.WriteString("Exif\x00\x00II")
+	write(uint16(42), uint32(8))
+	// IFD0 at 8 with 5 entries, data area at 8+2+5*12+4 = 74.
+	write(uint16(5))
+	write(uint16(exifTagMake), uint16(2), uint32(6), uint32(74))
+	write(uint16(exifTagModel), uint16(2), uint32(10), uint32(80))
+	write(uint16(exifTagOrientation), uint16(3), uint32(1), uint16(6), uint16(0))
+	write(uint16(exifTagExifIFD), uint16(4), uint32(1), uint32(90))
+	write(uint16(exifTagGPSIFD), uint16(4), uint32(1), uint32(128))
+	write(uint32(0))
+	buf.WriteString("Canon\x00")     // 74
+	buf.WriteString("Canon EOS\x00") // 80
+	// Exif IFD at 90.
+	write(uint16(1))
+	write(uint16(exifTagDateTimeOriginal), uint16(2), uint32(20), uint32(108))
+	write(uint32(0))
+	buf.WriteString("2015:06:30 18:04:00\x00") // 108
+	// GPS IFD at 128 with the latitude at 128+2+12+4 = 146.
+	write(uint16(1))
+	write(uint16(2), uint16(5), uint32(3), uint32(146))
+	write(uint32(0))
+	write(uint32(52), uint32(1), uint32(31), uint32(1), uint32(7), uint32(1))
+	return buf.Bytes()
+}
+
+// testIPTC returns a Photoshop segment payload with the given caption.
+func testIPTC(caption string) []byte {
+	var record bytes.Buffer
+	record.Write([]byte{0x1c, 2, 0, 0, 2, 0, 4})
+	record.Write([]byte{0x1c, 2, 120, 0, byte(len(caption))})
+	record.WriteString(caption)
+	var buf bytes.Buffer
+	buf.WriteString("Photoshop 3.0\x00")
+	buf.WriteString("8BIM")
+	binary.Write(&buf, binary.BigEndian, uint16(0x0404))
+	buf.Write([]byte{0, 0})
+	binary.Write(&buf, binary.BigEndian, uint32(record.Len()))
+	buf.Write(record.Bytes())
+	return buf.Bytes()
+}
+
+// testJPEG returns a JPEG image of the given size with the given
+// segments inserted after the start of image marker.
+func testJPEG(t *testing.T, width, height int, segments map[byte][]byte) []byte {
+	var img bytes.Buffer
+	err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, width, height)), nil)
+	if err != nil {
+		t.Fatalf("Could not encode test image: %v", err)
+	}
+	var out bytes.Buffer
+	out.Write(img.Bytes()[:2])
+	for _, marker := range []byte{0xe1, 0xed} {
+		if data, ok := segments[marker]; ok {
+			out.Write([]byte{0xff, marker})
+			binary.Write(&out, binary.BigEndian, uint16(len(data)+2))
+			out.Write(data)
+		}
+	}
+	out.Write(img.Bytes()[2:])
+	return out.Bytes()
+}
+
+func TestReadJPEGMetadata(t *testing.T) {
+	data := testJPEG(t, 4, 2, map[byte][]byte{
+		0xe1: testExif(), 0xed: testIPTC("A caption")})
+	reader := bytes.NewReader(data)
+	header, segments, err := readJPEGHeader(reader)
+	if err != nil {
+		t.Fatalf("readJPEGHeader returns error: %v", err)
+	}
+	rest, _ := ioutil.ReadAll(reader)
+	if !bytes.Equal(append(header, rest...), data) {
+		t.Errorf("header and rest should make up the original data")
+	}
+	meta := parseJPEGMetadata(segments)
+	expected := imageMetadata{Orientation: 6, DateTaken: "2015:06:30 18:04:00",
+		Make: "Canon", Model: "Canon EOS", Caption: "A caption"}
+	if meta != expected {
+		t.Errorf("parseJPEGMetadata = %+v, should be %+v", meta, expected)
+	}
+	if meta.Camera() != "Canon EOS" {
+		t.Errorf("Camera() = %q, should be %q", meta.Camera(), "Canon EOS")
+	}
+
+	// Other formats have no segments.
+	png := []byte("\x89PNG\r\n\x1a\n")
+	header, segments, err = readJPEGHeader(bytes.NewReader(png))
+	if err != nil || len(segments) != 0 || len(header) != 2 {
+		t.Errorf("readJPEGHeader(png) = %v, %v, %v", header, segments, err)
+	}
+}
+
+func TestStripGPS(t *testing.T) {
+	xmp := append(append([]byte(nil), xmpPrefix...),
+		[]byte(`<x:xmpmeta exif:GPSLatitude="52,31.7N"/>`)...)
+	data := testJPEG(t, 4, 2, map[byte][]byte{0xe1: testExif()})
+	// Add an XMP segment after the EXIF segment.
+	xmpSegment := append([]byte{0xff, 0xe1, 0, byte(len(xmp) + 2)}, xmp...)
+	exifEnd := 2 + 4 + len(testExif())
+	data = append(append(append([]byte(nil), data[:exifEnd]...),
+		xmpSegment...), data[exifEnd:]...)
+
+	reader := bytes.NewReader(data)
+	header, segments, err := readJPEGHeader(reader)
+	if err != nil {
+		t.Fatalf("readJPEGHeader returns error: %v", err)
+	}
+	stripped, err := ioutil.ReadAll(io.MultiReader(
+		bytes.NewReader(stripGPS(header, segments)), reader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stripped) != len(data)-len(xmpSegment) {
+		t.Errorf("Stripped image should only lack the XMP segment")
+	}
+	if bytes.Contains(stripped, []byte("GPSLatitude")) {
+		t.Errorf("XMP GPS data should have been removed")
+	}
+	var latitude bytes.Buffer
+	binary.Write(&latitude, binary.LittleEndian, []uint32{52, 1, 31, 1})
+	if bytes.Contains(stripped, latitude.Bytes()) {
+		t.Errorf("EXIF GPS data should have been removed")
+	}
+	_, segments, err = readJPEGHeader(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatalf("readJPEGHeader returns error: %v", err)
+	}
+	if meta := parseJPEGMetadata(segments); meta.Orientation != 6 ||
+		meta.Make != "Canon" {
+		t.Errorf("Other metadata should be kept, got %+v", meta)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("Could not decode stripped image: %v", err)
+	}
+}
+
+func TestOrientImage(t *testing.T) {
+	// A 2x1 image with a red left and a blue right pixel.
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, red)
+	img.Set(1, 0, blue)
+	tests := []struct {
+		Orientation   int
+		Width, Height int
+		// Red is the position of the red pixel.
+		Red image.Point
+	}{
+		{1, 2, 1, image.Pt(0, 0)},
+		{2, 2, 1, image.Pt(1, 0)},
+		{3, 2, 1, image.Pt(1, 0)},
+		{4, 2, 1, image.Pt(0, 0)},
+		{5, 1, 2, image.Pt(0, 0)},
+		{6, 1, 2, image.Pt(0, 0)},
+		{7, 1, 2, image.Pt(0, 1)},
+		{8, 1, 2, image.Pt(0, 1)},
+	}
+	for _, test := range tests {
+		ret := orientImage(img, test.Orientation)
+		bounds := ret.Bounds()
+		if bounds.Dx() != test.Width || bounds.Dy() != test.Height {
+			t.Errorf("orientImage(%v) has size %vx%v, should be %vx%v",
+				test.Orientation, bounds.Dx(), bounds.Dy(), test.Width, test.Height)
+			continue
+		}
+		if c := color.RGBAModel.Convert(ret.At(test.Red.X, test.Red.Y)); c != red {
+			t.Errorf("orientImage(%v) should have red pixel at %v",
+				test.Orientation, test.Red)
+		}
+	}
+}
@@ -17,23 +17,20 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"fmt"
 	"html/template"
 	"image"
-	_ "image/gif"
-	"image/jpeg"
-	"image/png"
-	"io/ioutil"
+	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/chrneumann/htmlwidgets"
-	"github.com/nfnt/resize"
 	"pkg.monsti.org/gettext"
 	"pkg.monsti.org/monsti/api/service"
 	"pkg.monsti.org/monsti/api/util"
@@ -80,7 +77,7 @@ type getChildrenFunc func(path string) ([]*service.Node, error)
 
 // getNav returns the navigation for the given node.
 //
-// If public is true, show only public pages.
+// If public is true, show only published pages.
 // nodePath is the absolute path of the node for which to get the navigation.
 // active is the absolute path to the currently active node.
 func getNav(nodePath, active string, public bool,
@@ -94,7 +91,7 @@ func getNav(nodePath, active string, public bool,
 	}
 	childrenNavLinks := navLinks[:]
 	for _, child := range children {
-		if child.Hide || child.Type.Hide || public && !child.Public {
+		if child.Hide || child.Type.Hide || public && !child.Published() {
 			continue
 		}
 		childrenNavLinks = append(childrenNavLinks, navLink{
@@ -126,7 +123,7 @@ func getNav(nodePath, active string, public bool,
 			return nil, fmt.Errorf("Could not get siblings: %v", err)
 		}
 		for _, sibling := range siblings {
-			if sibling.Hide || sibling.Type.Hide || public && !sibling.Public {
+			if sibling.Hide || sibling.Type.Hide || public && !sibling.Published() {
 				continue
 			}
 			siblingsNavLinks = append(siblingsNavLinks, navLink{
@@ -172,6 +169,16 @@ func (nav *navigation) MakeAbsolute(root string) {
 	}
 }
 
+// AddPrefix prepends the given path prefix to all targets.
+func (nav navigation) AddPrefix(prefix string) {
+	if len(prefix) == 0 {
+		return
+	}
+	for i := range nav {
+		nav[i].Target = prefix + nav[i].Target
+	}
+}
+
 type addFormData struct {
 	NodeType string
 	New      string
@@ -239,8 +246,17 @@ func (h *nodeHandler) Remove(c *reqContext) error {
 	default:
 		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
 	}
+	var usages []string
+	if isMediaNode(c.Node) {
+		var err error
+		usages, err = mediaUsages(
+			h.Settings.Monsti.GetSiteCachePath(c.Site.Name), c.Node.Path)
+		if err != nil {
+			return err
+		}
+	}
 	body, err := h.Renderer.Render("actions/removeform", mtemplate.Context{
-		"Form": form.RenderData(), "Node": c.Node},
+		"Form": form.RenderData(), "Node": c.Node, "Usages": usages},
 		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
 	if err != nil {
 		panic("Can't render node remove formular: " + err.Error())
@@ -253,95 +269,17 @@ func (h *nodeHandler) Remove(c *reqContext) error {
 	return nil
 }
 
-type imageSize struct{ Width, Height uint }
-
-func (s imageSize) String() string {
-	return fmt.Sprintf("%vx%v", s.Width, s.Height)
-}
-
-// viewImage sends a possibly resized image
-func (h *nodeHandler) viewImage(c *reqContext) error {
-	sizeName := c.Req.FormValue("size")
-	var size imageSize
-	var body []byte
-	var err error
-	if sizeName != "" {
-		err = c.Serv.Monsti().GetSiteConfig(c.Site.Name,
-			"core.image.sizes."+sizeName, &size)
-		if err != nil || size.Width == 0 {
-			if err != nil {
-				h.Log.Printf("Could not get size config: %v", err)
-			} else {
-				h.Log.Printf("Could not find size %q for site %q: %v", sizeName,
-					c.Site.Name, err)
-			}
-		} else {
-			cacheId := "core.image.thumbnail." + size.String()
-			body, _, err = c.Serv.Monsti().FromCache(c.Site.Name, c.Node.Path, cacheId)
-			if err != nil {
-				return fmt.Errorf("Could not get thumbnail from cache: %v", err)
-			}
-			if body == nil {
-				body, err = c.Serv.Monsti().GetNodeData(c.Site.Name, c.Node.Path,
-					"__file_core.File")
-				if err != nil {
-					return fmt.Errorf("Could not get image data: %v", err)
-				}
-				image, format, err := image.Decode(bytes.NewBuffer(body))
-				if err != nil {
-					return fmt.Errorf("Could not decode image data: %v", err)
-				}
-				image = resize.Thumbnail(size.Width, size.Height, image,
-					resize.Lanczos3)
-				var out bytes.Buffer
-				switch format {
-				case "png", "gif":
-					err = png.Encode(&out, image)
-				default:
-					err = jpeg.Encode(&out, image, nil)
-				}
-				body = out.Bytes()
-				if err != nil {
-					return fmt.Errorf("Could not encode resized image: %v", err)
-				}
-				if err := c.Serv.Monsti().ToCache(c.Site.Name, c.Node.Path,
-					cacheId, body,
-					&service.CacheMods{Deps: []service.CacheDep{{Node: c.Node.Path}}}); err != nil {
-					return fmt.Errorf("Could not cache resized image data: %v", err)
-				}
-			}
-		}
-	}
-	if body == nil {
-		body, err = c.Serv.Monsti().GetNodeData(c.Site.Name, c.Node.Path,
-			"__file_core.File")
-		if err != nil {
-			return fmt.Errorf("Could not read image: %v", err)
-		}
-	}
-	c.Res.Write(body)
-	return nil
-}
-
 // ViewNode handles node views.
 func (h *nodeHandler) View(c *reqContext) error {
 	// Redirect if trailing slash is missing and if this is not a file
 	// node (in which case we write out the file's content).
 	if c.Node.Path[len(c.Node.Path)-1] != '/' {
-		if c.Node.Type.Id == "core.Image" || c.Node.Type.Id == "core.File" {
-			c.Res.Header().Add("Last-Modified", c.Node.Changed.Format(time.RFC1123))
-		}
 		if c.Node.Type.Id == "core.Image" {
 			return h.viewImage(c)
 		} else if c.Node.Type.Id == "core.File" {
-			content, err := c.Serv.Monsti().GetNodeData(c.Site.Name, c.Node.Path,
-				"__file_core.File")
-			if err != nil {
-				return fmt.Errorf("Could not read file: %v", err)
-			}
-			c.Res.Write(content)
+			return serveNodeData(c, "__file_core.File")
 		} else {
-			newPath, err := url.Parse(c.Node.Path + "/")
+			newPath, err := url.Parse(c.LocalePrefix + c.Node.Path + "/")
 			if err != nil {
 				serveError("Could not parse request URL: %v", err)
 			}
@@ -356,7 +294,7 @@ func (h *nodeHandler) View(c *reqContext) error {
 	mods := new(service.CacheMods)
 	if c.UserSession.User == nil && len(c.Req.Form) == 0 {
 		rendered, mods, err = c.Serv.Monsti().FromCache(c.Site.Name, c.Node.Path,
-			"core.page.partial")
+			localeCacheID("core.page.partial", *c.Site, c.Locale))
 		if err != nil {
 			return fmt.Errorf("Could not get partial cache: %v", err)
 		}
@@ -368,23 +306,26 @@ func (h *nodeHandler) View(c *reqContext) error {
 		}
 		if c.UserSession.User == nil && len(c.Req.Form) == 0 {
 			if err := c.Serv.Monsti().ToCache(c.Site.Name, c.Node.Path,
-				"core.page.partial", rendered, mods); err != nil {
+				localeCacheID("core.page.partial", *c.Site, c.Locale), rendered,
+				mods); err != nil {
 				return fmt.Errorf("Could not cache page: %v", err)
 			}
 		}
 	}
-	env := masterTmplEnv{Node: c.Node, Session: c.UserSession}
+	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
+		LocalePrefix: c.LocalePrefix}
 	content, renderMods := renderInMaster(h.Renderer, rendered, env, h.Settings,
 		*c.Site, c.UserSession.Locale, c.Serv)
 	mods.Join(renderMods)
-	if c.UserSession.User == nil && len(c.Req.Form) == 0 {
-		if err := c.Serv.Monsti().ToCache(c.Site.Name, c.Node.Path,
-			"core.page.full", content, mods); err != nil {
+	var cacheId string
+	if c.UserSession.User == nil && len(c.Req.Form) == 0 && !mods.Skip {
+		cacheId = localeCacheID("core.page.full", *c.Site, c.Locale)
+		if err := c.Serv.Monsti().ToCache(c.Site.Name, c.Node.Path, cacheId,
+			content, mods); err != nil {
 			return fmt.Errorf("Could not cache page: %v", err)
 		}
 	}
-	c.Res.Write(content)
-	return nil
+	return h.writePage(c, content, c.Node.Path, cacheId, mods.Expire)
 }
 
 // calcEmbedPath calculates the embed path for the given node path and
@@ -418,6 +359,14 @@ func (h *nodeHandler) RenderNode(c *reqContext, embedNode *service.EmbedNode) (
 			return nil, nil, fmt.Errorf("Could not find node %q to embed: %v",
 				embedPath, err)
 		}
+		if translated := translateNode(reqNode, *c.Site, c.Locale); translated != nil {
+			reqNode = translated
+		}
+	}
+	// Pages change if nodes they link to change, e.g. images. This also
+	// tracks the usages of media assets.
+	for _, target := range nodeReferences(reqNode) {
+		mods.Deps = append(mods.Deps, service.CacheDep{Node: target})
 	}
 	context := make(mtemplate.Context)
 	context["Embed"] = make(map[string]template.HTML)
@@ -460,6 +409,10 @@ func (h *nodeHandler) RenderNode(c *reqContext, embedNode *service.EmbedNode) (
 	}
 
 	context["Site"] = c.Site
+	context["ImageSizes"], err = getImageSizes(c.Serv.Monsti(), c.Site.Name)
+	if err != nil {
+		return nil, nil, err
+	}
 	rendered, err := h.Renderer.Render(template, context,
 		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
 	if err != nil {
@@ -479,6 +432,9 @@ type editFormData struct {
 func (h *nodeHandler) Edit(c *reqContext) error {
 	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
 
+	if ok, err := limitUploadSize(c); !ok || err != nil {
+		return err
+	}
 	if err := c.Req.ParseMultipartForm(1024 * 1024); err != nil {
 		if err != http.ErrNotMultipart {
 			return fmt.Errorf("Could not parse form: %v", err)
@@ -497,12 +453,18 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 		// TODO Check if node type may be added to this node
 	}
 
+	// Edit the translation if the locale has been requested explicitly.
+	translate := !newNode && len(c.LocalePrefix) > 0 &&
+		c.Locale != c.Site.Locale
+
 	env := masterTmplEnv{Node: c.Node, Session: c.UserSession}
 
 	if c.Action == service.EditAction {
 		if newNode {
 			env.Title = fmt.Sprintf(G("Add %v to \"%s\""),
 				nodeType.GetLocalName(c.UserSession.Locale), c.Node.Path)
+		} else if translate {
+			env.Title = fmt.Sprintf(G("Edit \"%s\" (%s)"), c.Node.Path, c.Locale)
 		} else {
 			env.Title = fmt.Sprintf(G("Edit \"%s\""), c.Node.Path)
 		}
@@ -522,14 +484,17 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 		formData.Node.Public = true
 	} else {
 		formData.Node = *c.Node
+		if translate {
+			formData.Node.InitTranslation(c.Locale)
+		}
 	}
-	form := htmlwidgets.NewForm(&formData)
-	form.AddWidget(new(htmlwidgets.HiddenWidget), "NodeType", "", "")
-	if !nodeType.Hide {
-		form.AddWidget(new(htmlwidgets.BoolWidget), "Node.Hide", G("Hide"), G("Don't show node in navigation."))
+	// getField returns the field to be edited.
+	getField := func(node *service.Node, field *service.NodeField) service.Field {
+		if translate && field.Translatable() {
+			return node.Translations[c.Locale][field.Id]
+		}
+		return node.GetField(field.Id)
 	}
-	form.AddWidget(new(htmlwidgets.IntegerWidget), "Node.Order", G("Order"), G("Order in navigation or listings (lower numbered entries appear first)."))
-	form.AddWidget(new(htmlwidgets.BoolWidget), "Node.Public", G("Public"), G("Is the node accessible by every visitor?"))
 	var timezone string
 	err := c.Serv.Monsti().GetSiteConfig(c.Site.Name, "core.timezone", &timezone)
 	if err != nil {
@@ -539,15 +504,6 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 	if err != nil {
 		location = time.UTC
 	}
-	form.AddWidget(&htmlwidgets.TimeWidget{
-		Location: location}, "Node.PublishTime", G("Publish time"),
-		G("The node won't be accessible to the public until it is published."))
-	if newNode || c.Node.Name() != "" {
-		form.AddWidget(&htmlwidgets.TextWidget{
-			Regexp:          `^[-\w]+$`,
-			ValidationError: G("Please enter a name consisting only of the characters A-Z, a-z, 0-9 and '-'")},
-			"Name", G("Name"), G("The name as it should appear in the URL."))
-	}
 	if !newNode {
 		formData.Name = c.Node.Name()
 	}
@@ -558,12 +514,48 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 		nodeFields = append(nodeFields, c.Node.LocalFields...)
 	}
 	for _, field := range nodeFields {
-		formData.Node.GetField(field.Id).ToFormField(form, formData.Fields,
-			field, c.UserSession.Locale)
 		if field.Type == "File" {
 			fileFields = append(fileFields, field.Id)
 		}
 	}
+	// prepareForm lets the fields adapt to the submitted form, e.g. to
+	// list items which have been added but not yet saved.
+	prepareForm := func(node *service.Node) {
+		if c.Req.Method != "POST" {
+			return
+		}
+		for _, field := range nodeFields {
+			if value, ok := getField(node, field).(service.FormControlField); ok {
+				value.PrepareForm(c.Req.Form, field)
+			}
+		}
+	}
+	prepareForm(&formData.Node)
+	// buildForm returns the edit form for the node in formData.
+	buildForm := func() *htmlwidgets.Form {
+		form := htmlwidgets.NewForm(&formData)
+		form.AddWidget(new(htmlwidgets.HiddenWidget), "NodeType", "", "")
+		if !nodeType.Hide {
+			form.AddWidget(new(htmlwidgets.BoolWidget), "Node.Hide", G("Hide"), G("Don't show node in navigation."))
+		}
+		form.AddWidget(new(htmlwidgets.IntegerWidget), "Node.Order", G("Order"), G("Order in navigation or listings (lower numbered entries appear first)."))
+		form.AddWidget(new(htmlwidgets.BoolWidget), "Node.Public", G("Public"), G("Is the node accessible by every visitor?"))
+		form.AddWidget(&htmlwidgets.TimeWidget{
+			Location: location}, "Node.PublishTime", G("Publish time"),
+			G("The node won't be accessible to the public until it is published."))
+		if newNode || c.Node.Name() != "" {
+			form.AddWidget(&htmlwidgets.TextWidget{
+				Regexp:          `^[-\w]+$`,
+				ValidationError: G("Please enter a name consisting only of the characters A-Z, a-z, 0-9 and '-'")},
+				"Name", G("Name"), G("The name as it should appear in the URL."))
+		}
+		for _, field := range nodeFields {
+			getField(&formData.Node, field).ToFormField(form, formData.Fields,
+				field, c.UserSession.Locale)
+		}
+		return form
+	}
+	form := buildForm()
 
 	switch c.Req.Method {
 	case "GET":
@@ -589,8 +581,74 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 					form.AddError("Name", G("A node with this name does already exist"))
 					writeNode = false
 				}
-				if err = node.InitFields(c.Serv.Monsti(), c.Site.Name); err != nil {
-					return fmt.Errorf("Could not init node fields: %v", err)
+				if !translate {
+					err = node.InitFields(c.Serv.Monsti(), c.Site.Name)
+					if err != nil {
+						return fmt.Errorf("Could not init node fields: %v", err)
+					}
+					prepareForm(&node)
+				}
+			}
+
+			for _, field := range nodeFields {
+				value := getField(&node, field)
+				value.FromFormField(formData.Fields, field)
+				msg := service.ValidateField(field, value, c.UserSession.Locale)
+				if msg != "" {
+					switch field.Type {
+					case "MultiSelect":
+						// Multiple selections are shown as a group of
+						// checkboxes without a widget of their own.
+						form.AddError("", field.Name[c.UserSession.Locale]+": "+msg)
+					case "List", "Compound":
+						// Messages of nested fields include the field names.
+						form.AddError("", msg)
+					default:
+						form.AddError("Fields."+field.Id, msg)
+					}
+					writeNode = false
+				}
+			}
+
+			// Show the form again if fields have been changed using their
+			// form controls, e.g. a list item has been added.
+			redisplay := false
+			for _, field := range nodeFields {
+				value, ok := getField(&node, field).(service.FormControlField)
+				if ok && value.FormChanged() {
+					redisplay = true
+				}
+			}
+			if redisplay && writeNode {
+				writeNode = false
+				formData.Node = node
+				formData.Fields = make(util.NestedMap)
+				form = buildForm()
+			}
+
+			// Check uploaded files.
+			for _, field := range nodeFields {
+				if field.Type != "File" {
+					continue
+				}
+				file, _, err := c.Req.FormFile("Fields." + field.Id)
+				if err != nil {
+					if newNode && field.Required {
+						form.AddError("Fields."+field.Id, G("Required."))
+						writeNode = false
+					}
+					continue
+				}
+				head, size, err := uploadHead(file)
+				file.Close()
+				if err != nil {
+					return err
+				}
+				msg := service.ValidateFileHead(field, head, size,
+					c.UserSession.Locale)
+				if msg != "" {
+					form.AddError("Fields."+field.Id, msg)
+					writeNode = false
 				}
 			}
 
@@ -598,15 +656,19 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 			if nodeType.Id == "core.Image" {
 				file, _, err := c.Req.FormFile("Fields.core.File")
 				if err == nil {
-					content, err := ioutil.ReadAll(file)
+					_, _, err := image.Decode(bufio.NewReader(file))
 					if err != nil {
-						return fmt.Errorf("Could not read multipart file: %v", err)
-					}
-					if _, _, err := image.Decode(bytes.NewBuffer(content)); err != nil {
 						form.AddError("Fields.core.File",
 							G("Unsupported image format. Try GIF, JPEG, or PNG."))
 						writeNode = false
+					} else if _, err := file.Seek(0, os.SEEK_SET); err != nil {
+						file.Close()
+						return fmt.Errorf("Could not rewind multipart file: %v", err)
+					} else if err := setImageMetadata(&node, file, location); err != nil {
+						file.Close()
+						return fmt.Errorf("Could not read image metadata: %v", err)
 					}
+					file.Close()
 				}
 
 			}
@@ -618,9 +680,6 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 						return fmt.Errorf("Could not move node: ", err)
 					}
 				}
-				for _, field := range nodeFields {
-					node.GetField(field.Id).FromFormField(formData.Fields, field)
-				}
 				err := c.Serv.Monsti().WriteNode(c.Site.Name, node.Path, &node)
 				if err != nil {
 					return fmt.Errorf("Could not update node: ", err)
@@ -631,18 +690,25 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 					for _, name := range fileFields {
 						file, _, err := c.Req.FormFile("Fields." + name)
 						if err == nil {
-							content, err := ioutil.ReadAll(file)
-							if err != nil {
-								return fmt.Errorf("Could not read multipart file: %v", err)
+							var data io.Reader = file
+							if nodeType.Id == "core.Image" && name == "core.File" {
+								data, err = imageUploadData(c, file)
+								if err != nil {
+									file.Close()
+									return err
+								}
 							}
-							if err = c.Serv.Monsti().WriteNodeData(c.Site.Name, node.Path,
-								"__file_"+name, content); err != nil {
+							err := c.Serv.Monsti().WriteNodeDataFrom(c.Site.Name, node.Path,
+								"__file_"+name, data)
+							file.Close()
+							if err != nil {
 								return fmt.Errorf("Could not save file: %v", err)
 							}
 						}
 					}
 				}
-				http.Redirect(c.Res, c.Req, node.Path+"/", http.StatusSeeOther)
+				http.Redirect(c.Res, c.Req, c.LocalePrefix+node.Path+"/",
+					http.StatusSeeOther)
 				err = c.Serv.Monsti().MarkDep(
 					c.Site.Name, service.CacheDep{Node: path.Clean(node.Path)})
 				if err != nil {
@@ -20,6 +20,7 @@ import (
 	"path"
 	"reflect"
 	"testing"
+	"time"
 
 	"pkg.monsti.org/monsti/api/service"
 )
@@ -30,7 +31,7 @@ func TestGetNav(t *testing.T) {
 		Children []string
 	}{
 		"/": {
-			Children: []string{"foo", "bar", "hideme", "cruz"}},
+			Children: []string{"foo", "bar", "hideme", "cruz", "later"}},
 		"/foo": {
 			Children: []string{"child1", "child2"}},
 		"/foo/child1": {
@@ -49,6 +50,9 @@ func TestGetNav(t *testing.T) {
 			Node:     service.Node{Order: -2},
 			Children: []string{"child1"}},
 		"/cruz/child1": {
+			Children: []string{}},
+		"/later": {
+			Node:     service.Node{PublishTime: time.Now().Add(time.Hour)},
 			Children: []string{}}}
 	getNodeFn := func(nodePath string) (*service.Node, error) {
 		if val, ok := nodes[nodePath]; ok {
@@ -93,6 +93,40 @@ func initNodeTypes(settings *settings, session *service.Session, logger *log.Log
 		Fields: []*service.NodeField{
 			{Id: "core.Title"},
 			{Id: "core.File"},
+			{
+				Id:     "core.FocalPoint",
+				Name:   util.GenLanguageMap(G("Focal point"), availableLocales),
+				Type:   "Text",
+				Regexp: focalPointRegexp,
+				ValidationError: util.GenLanguageMap(
+					G("Please enter the relative position of the most important part of the image, e.g. 0.5,0.3."),
+					availableLocales),
+			},
+			{
+				Id:   "core.Caption",
+				Name: util.GenLanguageMap(G("Caption"), availableLocales),
+				Type: "Text",
+			},
+			{
+				Id:   "core.DateTaken",
+				Name: util.GenLanguageMap(G("Date taken"), availableLocales),
+				Type: "DateTime",
+			},
+			{
+				Id:   "core.Camera",
+				Name: util.GenLanguageMap(G("Camera"), availableLocales),
+				Type: "Text",
+			},
+			{
+				Id:   "core.Width",
+				Name: util.GenLanguageMap(G("Width"), availableLocales),
+				Type: "Integer",
+			},
+			{
+				Id:   "core.Height",
+				Name: util.GenLanguageMap(G("Height"), availableLocales),
+				Type: "Integer",
+			},
 		},
 	}
 	if err := session.Monsti().RegisterNodeType(&imageType); err != nil {
@@ -140,7 +174,7 @@ func renderContactForm(c *reqContext, context template.Context,
 	case "POST":
 		if form.Fill(formValues) {
 			mail := gomail.NewMessage()
-			site := h.Settings.Monsti.Sites[c.Site.Name]
+			site, _ := h.Settings.Site(c.Site.Name)
 			mail.SetAddressHeader("From", site.EmailAddress, site.EmailName)
 			mail.SetAddressHeader("To", site.Owner.Email, site.Owner.Name)
 			mail.SetAddressHeader("Reply-To", data.Email, data.Name)
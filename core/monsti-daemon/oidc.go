@@ -0,0 +1,146 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// oidcAuthenticator authenticates users at an OAuth2 / OpenID Connect
+// provider using the authorization code flow.
+//
+// The user's identity is fetched from the provider's user info
+// endpoint using the access token. The token is received directly
+// from the provider, so the ID token does not have to be validated.
+type oidcAuthenticator struct {
+	settings util.AuthenticatorSettings
+	client   *http.Client
+}
+
+func newOIDCAuthenticator(
+	settings util.AuthenticatorSettings) *oidcAuthenticator {
+	if len(settings.OIDC.Scopes) == 0 {
+		settings.OIDC.Scopes = []string{"openid", "profile", "email"}
+	}
+	if len(settings.OIDC.LoginClaim) == 0 {
+		settings.OIDC.LoginClaim = "sub"
+	}
+	return &oidcAuthenticator{settings, &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (a *oidcAuthenticator) Settings() util.AuthenticatorSettings {
+	return a.settings
+}
+
+// GetUser returns a user with the given login.
+//
+// The provider can't be asked about users without an access token,
+// so the user will be incomplete.
+func (a *oidcAuthenticator) GetUser(login string) (*service.User, error) {
+	if !allowedLogin(a.settings, login) {
+		return nil, nil
+	}
+	return &service.User{Login: login, Name: login}, nil
+}
+
+func (a *oidcAuthenticator) AuthCodeURL(state, redirectURL string) string {
+	values := url.Values{
+		"response_type": {"code"},
+		"client_id":     {a.settings.OIDC.ClientID},
+		"redirect_uri":  {redirectURL},
+		"scope":         {strings.Join(a.settings.OIDC.Scopes, " ")},
+		"state":         {state},
+	}
+	separator := "?"
+	if strings.Contains(a.settings.OIDC.AuthURL, "?") {
+		separator = "&"
+	}
+	return a.settings.OIDC.AuthURL + separator + values.Encode()
+}
+
+// decodeJSONResponse decodes the JSON body of the given response into
+// out.
+func decodeJSONResponse(res *http.Response, out interface{}) error {
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status: %v", res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("Could not decode response: %v", err)
+	}
+	return nil
+}
+
+func (a *oidcAuthenticator) Exchange(code, redirectURL string) (
+	*service.User, error) {
+	res, err := a.client.PostForm(a.settings.OIDC.TokenURL, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"client_id":     {a.settings.OIDC.ClientID},
+		"client_secret": {a.settings.OIDC.ClientSecret},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not request token: %v", err)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := decodeJSONResponse(res, &token); err != nil {
+		return nil, fmt.Errorf("Could not get token: %v", err)
+	}
+	if len(token.AccessToken) == 0 {
+		return nil, fmt.Errorf("Missing access token")
+	}
+	req, err := http.NewRequest("GET", a.settings.OIDC.UserInfoURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create user info request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	res, err = a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Could not request user info: %v", err)
+	}
+	var claims map[string]interface{}
+	if err := decodeJSONResponse(res, &claims); err != nil {
+		return nil, fmt.Errorf("Could not get user info: %v", err)
+	}
+	login, _ := claims[a.settings.OIDC.LoginClaim].(string)
+	if len(login) == 0 {
+		return nil, fmt.Errorf("User info misses login claim %q",
+			a.settings.OIDC.LoginClaim)
+	}
+	if !allowedLogin(a.settings, login) {
+		return nil, nil
+	}
+	user := &service.User{Login: login, Name: login}
+	if name, ok := claims["name"].(string); ok && len(name) > 0 {
+		user.Name = name
+	}
+	if email, ok := claims["email"].(string); ok {
+		user.Email = email
+	}
+	return user, nil
+}
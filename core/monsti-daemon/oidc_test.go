@@ -0,0 +1,130 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func TestOIDCAuthenticator(t *testing.T) {
+	const redirectURL = "http://example.com/@@login?auth=sso"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "authorization_code" ||
+			r.FormValue("client_id") != "monsti" ||
+			r.FormValue("client_secret") != "secret" ||
+			r.FormValue("redirect_uri") != redirectURL {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if r.FormValue("code") == "invalid" {
+			http.Error(w, "invalid grant", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":"token-%v","token_type":"Bearer"}`,
+			r.FormValue("code"))
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer token-alice":
+			fmt.Fprint(w, `{"sub":"1","preferred_username":"alice",
+"name":"Alice","email":"alice@example.com"}`)
+		case "Bearer token-bob":
+			fmt.Fprint(w, `{"sub":"bob"}`)
+		default:
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	settings := util.AuthenticatorSettings{
+		Name: "sso", Type: "oidc",
+		OIDC: util.OIDCSettings{
+			AuthURL:      server.URL + "/authorize",
+			TokenURL:     server.URL + "/token",
+			UserInfoURL:  server.URL + "/userinfo",
+			ClientID:     "monsti",
+			ClientSecret: "secret",
+		}}
+	auth := newOIDCAuthenticator(settings)
+
+	authURL, err := url.Parse(auth.AuthCodeURL("foo", redirectURL))
+	if err != nil {
+		t.Fatalf("Could not parse auth code URL: %v", err)
+	}
+	expected := url.Values{
+		"response_type": {"code"},
+		"client_id":     {"monsti"},
+		"redirect_uri":  {redirectURL},
+		"scope":         {"openid profile email"},
+		"state":         {"foo"},
+	}
+	if authURL.Path != "/authorize" ||
+		!reflect.DeepEqual(authURL.Query(), expected) {
+		t.Errorf("AuthCodeURL returned unexpected URL %v", authURL)
+	}
+
+	tests := []struct {
+		Code  string
+		User  *service.User
+		Error bool
+	}{
+		{"alice", &service.User{Login: "1", Name: "Alice",
+			Email: "alice@example.com"}, false},
+		{"bob", &service.User{Login: "bob", Name: "bob"}, false},
+		{"invalid", nil, true},
+		{"unknown", nil, true},
+	}
+	if user, err := auth.Exchange("alice", redirectURL); err != nil ||
+		user != nil {
+		t.Errorf(`Exchange("alice") without allowed logins = %v, %v`, user,
+			err)
+	}
+	settings.Logins = []string{"1", "bob"}
+	auth = newOIDCAuthenticator(settings)
+	for i, v := range tests {
+		user, err := auth.Exchange(v.Code, redirectURL)
+		if (err != nil) != v.Error {
+			t.Errorf("%v: Exchange(%q) returned error %v", i, v.Code, err)
+		}
+		if !reflect.DeepEqual(user, v.User) {
+			t.Errorf("%v: Exchange(%q) = %v, should be %v", i, v.Code, user,
+				v.User)
+		}
+	}
+
+	settings.Logins = []string{"alice"}
+	settings.OIDC.LoginClaim = "preferred_username"
+	auth = newOIDCAuthenticator(settings)
+	if user, err := auth.Exchange("alice", redirectURL); err != nil ||
+		user == nil || user.Login != "alice" {
+		t.Errorf(`Exchange("alice") with login claim = %v, %v`, user, err)
+	}
+	if user, err := auth.Exchange("bob", redirectURL); err == nil ||
+		user != nil {
+		t.Errorf(`Exchange("bob") without login claim = %v, %v`, user, err)
+	}
+}
@@ -0,0 +1,369 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// purgeQueueSize is the maximum number of invalidation events waiting
+// to be sent to the reverse proxies.
+const purgeQueueSize = 256
+
+// purgeTimeout is the timeout of requests to reverse proxies and
+// webhooks.
+const purgeTimeout = 10 * time.Second
+
+// maxBanPaths is the maximum number of paths banned by a single
+// regular expression. The whole site gets banned for more paths.
+const maxBanPaths = 100
+
+// purgeEvent requests the invalidation of URLs of a site.
+type purgeEvent struct {
+	Site string
+	// Paths are the paths of the invalidated URLs.
+	Paths []string
+	// All is true if all URLs of the site are invalidated.
+	All bool
+}
+
+// merge adds the paths of the other event of the same site.
+func (e *purgeEvent) merge(other purgeEvent) {
+	unique := make(map[string]bool)
+	for _, paths := range [][]string{e.Paths, other.Paths} {
+		for _, target := range paths {
+			unique[target] = true
+		}
+	}
+	e.Paths = e.Paths[:0]
+	for target := range unique {
+		e.Paths = append(e.Paths, target)
+	}
+	sort.Strings(e.Paths)
+	e.All = e.All || other.All
+}
+
+// banPattern returns the regular expression of BAN requests matching
+// the event's URLs including any query. Paths with a query are covered
+// by the path without query.
+func (e purgeEvent) banPattern() string {
+	var quoted []string
+	for _, target := range e.Paths {
+		if !strings.Contains(target, "?") {
+			quoted = append(quoted, regexp.QuoteMeta(target))
+		}
+	}
+	if e.All || len(quoted) > maxBanPaths {
+		return "^/"
+	}
+	return "^(" + strings.Join(quoted, "|") + `)(\?|$)`
+}
+
+// purgeWebhookPayload is posted to webhooks.
+type purgeWebhookPayload struct {
+	Site string
+	// URLs are the invalidated absolute URLs.
+	URLs []string
+	// All is true if all URLs of the site are invalidated.
+	All bool `json:",omitempty"`
+}
+
+// purger invalidates caching reverse proxies in front of the sites in
+// the background.
+type purger struct {
+	// Log is used to log failed requests.
+	Log *log.Logger
+	// Site returns the settings of the given site.
+	Site func(name string) (util.SiteSettings, bool)
+	// ImageSizes returns the names of the image sizes of the given node
+	// if it's an image. May be nil.
+	ImageSizes func(site, node string) []string
+	Client     *http.Client
+	events     chan purgeEvent
+}
+
+// newPurger starts a purger sending the events to the proxies
+// configured in the site settings.
+func newPurger(site func(string) (util.SiteSettings, bool),
+	logger *log.Logger) *purger {
+	p := &purger{
+		Log:    logger,
+		Site:   site,
+		Client: &http.Client{Timeout: purgeTimeout},
+		events: make(chan purgeEvent, purgeQueueSize),
+	}
+	go p.work()
+	return p
+}
+
+// purgePaths returns the URL paths of the given nodes, i.e. the pages
+// of the nodes, the files of file nodes and the resized versions of
+// images, in all locales of the site.
+//
+// sizes returns the names of the image sizes of the given node if it's
+// an image. It may be nil.
+func purgePaths(settings util.SiteSettings, nodes []string,
+	sizes func(node string) []string) []string {
+	prefixes := []string{""}
+	if len(settings.Locales) > 1 {
+		for _, locale := range settings.Locales {
+			prefixes = append(prefixes, "/"+locale)
+		}
+	}
+	unique := make(map[string]bool)
+	for _, node := range nodes {
+		node = path.Clean("/" + node)
+		for _, prefix := range prefixes {
+			if node == "/" {
+				unique[prefix+"/"] = true
+				continue
+			}
+			unique[prefix+node] = true
+			unique[prefix+node+"/"] = true
+		}
+		if sizes == nil {
+			continue
+		}
+		for _, size := range sizes(node) {
+			for _, prefix := range prefixes {
+				unique[prefix+node+"?size="+url.QueryEscape(size)] = true
+			}
+		}
+	}
+	var paths []string
+	for nodePath := range unique {
+		paths = append(paths, nodePath)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Emit queues the invalidation of the URLs of the given nodes, or of
+// all URLs of the site if all is true, if the site has configured
+// reverse proxies.
+//
+// Events are dropped if the queue is full.
+func (p *purger) Emit(site string, nodes []string, all bool) {
+	settings, ok := p.Site(site)
+	if !ok || len(nodes) == 0 || (len(settings.Purge.Endpoints) == 0 &&
+		len(settings.Purge.Webhook) == 0) {
+		return
+	}
+	var sizes func(string) []string
+	if p.ImageSizes != nil {
+		sizes = func(node string) []string { return p.ImageSizes(site, node) }
+	}
+	event := purgeEvent{site, purgePaths(settings, nodes, sizes), all}
+	select {
+	case p.events <- event:
+	default:
+		p.Log.Printf("Purge queue is full, dropping invalidation of %v URLs "+
+			"of site %v", len(event.Paths), site)
+	}
+}
+
+// work sends queued events. Events queued while sending get merged
+// per site.
+func (p *purger) work() {
+	for event := range p.events {
+		events := map[string]*purgeEvent{event.Site: &event}
+		sites := []string{event.Site}
+	queued:
+		for {
+			select {
+			case next := <-p.events:
+				if merged, ok := events[next.Site]; ok {
+					merged.merge(next)
+				} else {
+					events[next.Site] = &next
+					sites = append(sites, next.Site)
+				}
+			default:
+				break queued
+			}
+		}
+		for _, site := range sites {
+			if err := p.purge(*events[site]); err != nil {
+				p.Log.Printf("Could not purge URLs of site %v: %v", site, err)
+			}
+		}
+	}
+}
+
+// send sends the request with the configured headers.
+func (p *purger) send(req *http.Request, settings util.PurgeSettings) error {
+	for key, value := range settings.Headers {
+		req.Header.Set(key, value)
+	}
+	res, err := p.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Could not send %v request to %v: %v", req.Method,
+			req.URL, err)
+	}
+	res.Body.Close()
+	// Proxies may respond with Not Found if the URL is not cached.
+	if res.StatusCode >= 300 && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("%v request to %v failed: %v", req.Method, req.URL,
+			res.Status)
+	}
+	return nil
+}
+
+// purgeEndpoint sends the event to the proxy at the given endpoint.
+//
+// BAN requests cover all URLs of the event. Otherwise, a request is
+// sent for each URL.
+func (p *purger) purgeEndpoint(event purgeEvent, settings util.SiteSettings,
+	method, endpoint string) []string {
+	endpoint = strings.TrimRight(endpoint, "/")
+	targets, pattern := event.Paths, ""
+	if method == "BAN" {
+		targets, pattern = []string{"/"}, event.banPattern()
+	}
+	var errs []string
+	for _, host := range settings.Hosts {
+		if strings.HasPrefix(host, "*.") {
+			continue
+		}
+		for _, target := range targets {
+			req, err := http.NewRequest(method, endpoint+target, nil)
+			if err != nil {
+				return append(errs, fmt.Sprintf("Could not create request: %v",
+					err))
+			}
+			req.Host = host
+			if method == "BAN" {
+				req.Header.Set("X-Ban-Url", pattern)
+			}
+			if err := p.send(req, settings.Purge); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	return errs
+}
+
+// purge sends the event to the proxies and the webhook of the site.
+// The proxies get invalidated concurrently.
+//
+// All requests are sent even if some of them fail.
+func (p *purger) purge(event purgeEvent) error {
+	settings, ok := p.Site(event.Site)
+	if !ok {
+		return fmt.Errorf("Unknown site %q", event.Site)
+	}
+	var errs []string
+	method := strings.ToUpper(settings.Purge.Method)
+	if len(method) == 0 {
+		method = "PURGE"
+	}
+	var wg sync.WaitGroup
+	var errsMutex sync.Mutex
+	for _, endpoint := range settings.Purge.Endpoints {
+		wg.Add(1)
+		go func(endpoint string) {
+			defer wg.Done()
+			endpointErrs := p.purgeEndpoint(event, settings, method, endpoint)
+			errsMutex.Lock()
+			errs = append(errs, endpointErrs...)
+			errsMutex.Unlock()
+		}(endpoint)
+	}
+	wg.Wait()
+	if len(settings.Purge.Webhook) > 0 {
+		payload := purgeWebhookPayload{Site: event.Site, All: event.All}
+		baseURL := strings.TrimRight(settings.BaseURL, "/")
+		for _, target := range event.Paths {
+			payload.URLs = append(payload.URLs, baseURL+target)
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("Could not encode webhook payload: %v", err)
+		}
+		req, err := http.NewRequest("POST", settings.Purge.Webhook,
+			bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("Could not create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if err := p.send(req, settings.Purge); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// invalidate emits the invalidation of the URLs affected by marking
+// the given dependency, i.e. the nodes of the removed cache entries
+// and the marked node itself. Marking the whole site invalidates all
+// URLs.
+func (i *MonstiService) invalidate(site string, dep service.CacheDep,
+	removed []service.CacheDep) {
+	if i.Purger == nil {
+		return
+	}
+	var nodes []string
+	if len(dep.Cache) == 0 {
+		nodes = append(nodes, dep.Node)
+	}
+	for _, entry := range removed {
+		nodes = append(nodes, entry.Node)
+	}
+	all := path.Clean("/"+dep.Node) == "/" && dep.Descend != 0
+	i.Purger.Emit(site, nodes, all)
+}
+
+// imageSizes returns the names of the configured image sizes if the
+// given node is an image.
+func (i *MonstiService) imageSizes(site, node string) []string {
+	typeId, err := getNodeType(i.Settings.Monsti.GetSiteNodesPath(site), node)
+	if err != nil || typeId != "core.Image" {
+		return nil
+	}
+	config, err := getConfig(filepath.Join(
+		i.Settings.Monsti.GetSiteConfigPath(site), "core.json"), "image.sizes")
+	if err != nil || config == nil {
+		return nil
+	}
+	var sizes struct{ Value map[string]imageSize }
+	if err := json.Unmarshal(config, &sizes); err != nil {
+		return nil
+	}
+	var names []string
+	for name := range sizes.Value {
+		names = append(names, name)
+	}
+	return names
+}
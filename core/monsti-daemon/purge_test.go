@@ -0,0 +1,230 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/util"
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestPurgePaths(t *testing.T) {
+	tests := []struct {
+		Locales []string
+		Nodes   []string
+		Paths   []string
+	}{
+		{nil, []string{"/"}, []string{"/"}},
+		{nil, []string{"/foo", "/foo/", "/"},
+			[]string{"/", "/foo", "/foo/"}},
+		{[]string{"de", "en"}, []string{"/foo"},
+			[]string{"/de/foo", "/de/foo/", "/en/foo", "/en/foo/", "/foo",
+				"/foo/"}},
+		{nil, []string{"/foo", "/img.png"},
+			[]string{"/foo", "/foo/", "/img.png", "/img.png/",
+				"/img.png?size=large", "/img.png?size=small"}},
+	}
+	sizes := func(node string) []string {
+		if node == "/img.png" {
+			return []string{"small", "large"}
+		}
+		return nil
+	}
+	for i, test := range tests {
+		paths := purgePaths(util.SiteSettings{Locales: test.Locales},
+			test.Nodes, sizes)
+		if !reflect.DeepEqual(paths, test.Paths) {
+			t.Errorf("%v: purgePaths(%v) = %v, should be %v", i, test.Nodes, paths,
+				test.Paths)
+		}
+	}
+}
+
+func TestPurge(t *testing.T) {
+	var mutex sync.Mutex
+	var requests []string
+	var payload purgeWebhookPayload
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if r.Header.Get("Authorization") != "secret" {
+				t.Errorf("Missing header in %v request", r.Method)
+			}
+			switch r.Method {
+			case "POST":
+				body, _ := ioutil.ReadAll(r.Body)
+				if err := json.Unmarshal(body, &payload); err != nil {
+					t.Errorf("Could not decode webhook payload: %v", err)
+				}
+			case "BAN":
+				requests = append(requests, r.Method+" "+r.Host+" "+r.URL.Path+
+					" "+r.Header.Get("X-Ban-Url"))
+			default:
+				requests = append(requests, r.Method+" "+r.Host+" "+
+					r.URL.RequestURI())
+			}
+			if r.URL.Path == "/missing/" {
+				http.NotFound(w, r)
+			}
+		}))
+	defer server.Close()
+	site := util.SiteSettings{
+		Hosts:   []string{"example.com", "www.example.com"},
+		BaseURL: "http://example.com/",
+	}
+	site.Purge.Endpoints = []string{server.URL + "/"}
+	site.Purge.Headers = map[string]string{"Authorization": "secret"}
+	p := &purger{
+		Log: log.New(ioutil.Discard, "", 0),
+		Site: func(name string) (util.SiteSettings, bool) {
+			return site, name == "example"
+		},
+		Client: http.DefaultClient,
+	}
+	if err := p.purge(purgeEvent{"example",
+		[]string{"/", "/img.png?size=small", "/missing/"}, false}); err != nil {
+		t.Fatalf("Could not purge: %v", err)
+	}
+	expected := []string{
+		"PURGE example.com /", "PURGE example.com /img.png?size=small",
+		"PURGE example.com /missing/", "PURGE www.example.com /",
+		"PURGE www.example.com /img.png?size=small",
+		"PURGE www.example.com /missing/"}
+	sort.Strings(requests)
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("Purge requests are %v, should be %v", requests, expected)
+	}
+
+	requests = nil
+	site.Purge.Method = "ban"
+	site.Purge.Webhook = server.URL + "/hook"
+	site.Hosts = site.Hosts[:1]
+	if err := p.purge(purgeEvent{"example",
+		[]string{"/foo.png", "/foo.png?size=small", "/foo/"},
+		false}); err != nil {
+		t.Fatalf("Could not purge: %v", err)
+	}
+	expected = []string{`BAN example.com / ^(/foo\.png|/foo/)(\?|$)`}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("Ban requests are %v, should be %v", requests, expected)
+	}
+	expectedPayload := purgeWebhookPayload{"example",
+		[]string{"http://example.com/foo.png",
+			"http://example.com/foo.png?size=small", "http://example.com/foo/"},
+		false}
+	if !reflect.DeepEqual(payload, expectedPayload) {
+		t.Errorf("Webhook payload is %v, should be %v", payload, expectedPayload)
+	}
+
+	requests = nil
+	if err := p.purge(purgeEvent{"example", []string{"/"}, true}); err != nil {
+		t.Fatalf("Could not purge: %v", err)
+	}
+	expected = []string{`BAN example.com / ^/`}
+	if !reflect.DeepEqual(requests, expected) || !payload.All {
+		t.Errorf("Ban requests for whole site are %v, should be %v", requests,
+			expected)
+	}
+
+	site.Purge.Endpoints = []string{server.URL + "/fail"}
+	site.Purge.Webhook = ""
+	server.Config.Handler = http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		})
+	if err := p.purge(purgeEvent{"example", []string{"/"}, false}); err == nil {
+		t.Errorf("purge should fail if proxy denies request")
+	}
+	if err := p.purge(purgeEvent{"unknown", []string{"/"}, false}); err == nil {
+		t.Errorf("purge should fail for unknown sites")
+	}
+}
+
+func TestImageSizes(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/site/nodes/img/node.json": `{"Type":"core.Image"}`,
+		"/data/site/nodes/doc/node.json": `{"Type":"core.Document"}`,
+		"/config/sites/site/core.json": `{"image":{"sizes":{
+			"small":{"Width":100}}}}`},
+		"TestImageSizes")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	settings := new(settings)
+	settings.Monsti.Directories.Data = filepath.Join(root, "data")
+	settings.Monsti.Directories.Config = filepath.Join(root, "config")
+	m := &MonstiService{Settings: settings}
+	for node, expected := range map[string][]string{
+		"/img":     {"small"},
+		"/doc":     nil,
+		"/missing": nil,
+	} {
+		if sizes := m.imageSizes("site", node); !reflect.DeepEqual(sizes,
+			expected) {
+			t.Errorf("imageSizes(%q) = %v, should be %v", node, sizes, expected)
+		}
+	}
+}
+
+func TestPurgerEmit(t *testing.T) {
+	site := util.SiteSettings{}
+	p := &purger{
+		Site: func(name string) (util.SiteSettings, bool) {
+			return site, true
+		},
+		events: make(chan purgeEvent, 1),
+	}
+	p.Emit("example", []string{"/foo"}, false)
+	if len(p.events) != 0 {
+		t.Fatalf("Emit should ignore sites without reverse proxies")
+	}
+	site.Purge.Webhook = "http://example.com/hook"
+	p.Emit("example", []string{"/foo"}, false)
+	if len(p.events) != 1 {
+		t.Fatalf("Emit should queue event")
+	}
+	event := <-p.events
+	expected := purgeEvent{"example", []string{"/foo", "/foo/"}, false}
+	if !reflect.DeepEqual(event, expected) {
+		t.Errorf("Emitted event is %v, should be %v", event, expected)
+	}
+}
+
+func TestPurgeEventMerge(t *testing.T) {
+	event := purgeEvent{"example", []string{"/foo", "/foo/"}, false}
+	event.merge(purgeEvent{"example", []string{"/bar", "/foo"}, false})
+	expected := purgeEvent{"example", []string{"/bar", "/foo", "/foo/"}, false}
+	if !reflect.DeepEqual(event, expected) {
+		t.Errorf("Merged event is %v, should be %v", event, expected)
+	}
+	event.merge(purgeEvent{"example", nil, true})
+	if !event.All || event.banPattern() != "^/" {
+		t.Errorf("Merged event should invalidate whole site, got %v", event)
+	}
+}
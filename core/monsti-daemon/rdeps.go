@@ -0,0 +1,398 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// The reverse dependencies (rdeps) of a cache are stored per node in
+// .rdeps.log files below the cache root. Each line maps a dependency
+// on the node to a cache entry to be removed when the dependency gets
+// marked. Adding rdeps appends lines without reading the file. Marking
+// a dependency reads the file of each affected node once and replaces
+// it once, without the marked and duplicate entries.
+//
+// Older versions of Monsti stored the rdeps of a node in a single
+// .rdeps.json file, which gets replaced on the next change.
+
+// rdepEntry is a line of a node's rdeps file.
+type rdepEntry struct {
+	Dep, RDep service.CacheDep
+}
+
+// rdepsPath returns the path to the rdeps file of the given node.
+func rdepsPath(root, node string) string {
+	return filepath.Join(root, node[1:], ".rdeps.log")
+}
+
+// legacyRdepsPath returns the path to the rdeps file of the given node
+// as written by older versions of Monsti.
+func legacyRdepsPath(root, node string) string {
+	return filepath.Join(root, node[1:], ".rdeps.json")
+}
+
+// CacheDepPair maps a dependency to the cache entries depending on it.
+//
+// It's the format of legacy rdeps files.
+type CacheDepPair struct {
+	Dep   service.CacheDep
+	RDeps []service.CacheDep
+}
+
+// CacheDepMap maps dependencies to the set of cache entries depending
+// on them.
+type CacheDepMap map[service.CacheDep]map[service.CacheDep]struct{}
+
+// add adds the cache entry to the entries depending on dep.
+//
+// Returns false if the entry has been added before.
+func (m CacheDepMap) add(dep, rdep service.CacheDep) bool {
+	rdeps, ok := m[dep]
+	if !ok {
+		rdeps = make(map[service.CacheDep]struct{})
+		m[dep] = rdeps
+	}
+	if _, ok := rdeps[rdep]; ok {
+		return false
+	}
+	rdeps[rdep] = struct{}{}
+	return true
+}
+
+// cacheLocks contains a mutex for each cache root. They synchronize
+// access to the rdeps of the cache.
+var cacheLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: make(map[string]*sync.Mutex)}
+
+// cacheLock returns the mutex synchronizing access to the rdeps of the
+// given cache root.
+func cacheLock(root string) *sync.Mutex {
+	cacheLocks.Lock()
+	defer cacheLocks.Unlock()
+	lock, ok := cacheLocks.locks[root]
+	if !ok {
+		lock = new(sync.Mutex)
+		cacheLocks.locks[root] = lock
+	}
+	return lock
+}
+
+// cleanCacheDep returns the dependency with a cleaned node path.
+func cleanCacheDep(dep service.CacheDep) service.CacheDep {
+	dep.Node = path.Clean("/" + dep.Node)
+	return dep
+}
+
+// readRdeps reads the rdeps of the given node.
+func readRdeps(root, node string) (CacheDepMap, error) {
+	depMap, _, err := loadRdeps(root, node)
+	return depMap, err
+}
+
+// loadRdeps reads the rdeps of the given node.
+//
+// Returns true if the rdeps should be rewritten, i.e. if there are
+// duplicates or a legacy file.
+func loadRdeps(root, node string) (CacheDepMap, bool, error) {
+	depMap := make(CacheDepMap)
+	compact := false
+	content, err := ioutil.ReadFile(legacyRdepsPath(root, node))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, false, fmt.Errorf("Could not read rdeps: %v", err)
+	}
+	if content != nil {
+		var raw []CacheDepPair
+		if err = json.Unmarshal(content, &raw); err != nil {
+			return nil, false, fmt.Errorf("Could not unmarshal rdeps: %v", err)
+		}
+		for _, pair := range raw {
+			for _, rdep := range pair.RDeps {
+				depMap.add(cleanCacheDep(pair.Dep), cleanCacheDep(rdep))
+			}
+		}
+		compact = true
+	}
+	content, err = ioutil.ReadFile(rdepsPath(root, node))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, false, fmt.Errorf("Could not read rdeps: %v", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(content))
+	for {
+		var entry rdepEntry
+		if err := dec.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, false, fmt.Errorf("Could not unmarshal rdeps: %v", err)
+		}
+		if !depMap.add(cleanCacheDep(entry.Dep), cleanCacheDep(entry.RDep)) {
+			compact = true
+		}
+	}
+	return depMap, compact, nil
+}
+
+// writeRdeps replaces the rdeps of the given node.
+//
+// If there are no rdeps left, the rdeps file is removed. Readers never
+// see partially written files.
+func writeRdeps(root, node string, rdeps CacheDepMap) error {
+	if err := os.Remove(legacyRdepsPath(root, node)); err != nil &&
+		!os.IsNotExist(err) {
+		return fmt.Errorf("Could not remove rdeps: %v", err)
+	}
+	filePath := rdepsPath(root, node)
+	var content bytes.Buffer
+	enc := json.NewEncoder(&content)
+	for dep, entries := range rdeps {
+		for rdep := range entries {
+			if err := enc.Encode(rdepEntry{dep, rdep}); err != nil {
+				return fmt.Errorf("Could not marshal rdeps: %v", err)
+			}
+		}
+	}
+	if content.Len() == 0 {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Could not remove rdeps: %v", err)
+		}
+		return nil
+	}
+	tmpPath := filePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content.Bytes(), 0600); err != nil {
+		return fmt.Errorf("Could not write rdeps: %v", err)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("Could not write rdeps: %v", err)
+	}
+	return nil
+}
+
+// appendRdeps adds the cache entry rdep to the entries depending on
+// the given dependencies. The lines are appended to the rdeps file of
+// each node with a single write.
+//
+// The cache lock of the root must be held.
+func appendRdeps(root string, deps []service.CacheDep,
+	rdep service.CacheDep) error {
+	rdep = cleanCacheDep(rdep)
+	lines := make(map[string]*bytes.Buffer)
+	var nodes []string
+	for _, dep := range deps {
+		dep = cleanCacheDep(dep)
+		buf, ok := lines[dep.Node]
+		if !ok {
+			buf = new(bytes.Buffer)
+			lines[dep.Node] = buf
+			nodes = append(nodes, dep.Node)
+		}
+		if err := json.NewEncoder(buf).Encode(rdepEntry{dep, rdep}); err != nil {
+			return fmt.Errorf("Could not marshal rdeps: %v", err)
+		}
+	}
+	for _, node := range nodes {
+		filePath := rdepsPath(root, node)
+		if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+			return fmt.Errorf("Could not create rdeps directory: %v", err)
+		}
+		file, err := os.OpenFile(filePath,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return fmt.Errorf("Could not open rdeps: %v", err)
+		}
+		_, err = file.Write(lines[node].Bytes())
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("Could not write rdeps: %v", err)
+		}
+	}
+	return nil
+}
+
+// removeRdeps removes the given cache entries from the rdeps of all
+// nodes below the cache root.
+//
+// The cache lock of the root must be held.
+func removeRdeps(root string, entries []service.CacheDep) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	remove := make(map[service.CacheDep]bool, len(entries))
+	for _, entry := range entries {
+		remove[cleanCacheDep(entry)] = true
+	}
+	err := filepath.Walk(root, func(dir string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if info.Name() == ".data" {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(root, dir)
+		if err != nil {
+			return err
+		}
+		node := path.Join("/", filepath.ToSlash(rel))
+		depMap, changed, err := loadRdeps(root, node)
+		if err != nil {
+			return err
+		}
+		for dep, rdeps := range depMap {
+			for rdep := range rdeps {
+				if remove[rdep] {
+					delete(rdeps, rdep)
+					changed = true
+				}
+			}
+			if len(rdeps) == 0 {
+				delete(depMap, dep)
+			}
+		}
+		if !changed {
+			return nil
+		}
+		return writeRdeps(root, node, depMap)
+	})
+	if err != nil {
+		return fmt.Errorf("Could not remove rdeps: %v", err)
+	}
+	return nil
+}
+
+// depMarker marks dependencies of a cache. The rdeps of each node are
+// read and written at most once.
+type depMarker struct {
+	root string
+	// rdeps contains the read rdeps by node. Changed ones are listed in
+	// dirty.
+	rdeps map[string]CacheDepMap
+	dirty map[string]bool
+	// marked contains the marked cache entries.
+	marked  map[service.CacheDep]bool
+	removed []service.CacheDep
+}
+
+// get returns the rdeps of the given node.
+func (m *depMarker) get(node string) (CacheDepMap, error) {
+	if rdeps, ok := m.rdeps[node]; ok {
+		return rdeps, nil
+	}
+	rdeps, compact, err := loadRdeps(m.root, node)
+	if err != nil {
+		return nil, err
+	}
+	m.rdeps[node] = rdeps
+	if compact {
+		m.dirty[node] = true
+	}
+	return rdeps, nil
+}
+
+// mark marks the given dependency of the given level, i.e. the number
+// of nodes between the originally marked node and dep.Node.
+func (m *depMarker) mark(dep service.CacheDep, level int) error {
+	dep = cleanCacheDep(dep)
+	dep.Descend = 0
+	if dep.Cache != "" {
+		if m.marked[dep] {
+			return nil
+		}
+		m.marked[dep] = true
+		dataPath := filepath.Join(m.root, dep.Node[1:], ".data", dep.Cache)
+		if err := os.Remove(dataPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Could not remove cached data: %v", err)
+		}
+		m.removed = append(m.removed, dep)
+	}
+	rdeps, err := m.get(dep.Node)
+	if err != nil {
+		return err
+	}
+	var toBeMarked []service.CacheDep
+	for rdepsDep, entries := range rdeps {
+		descend := rdepsDep.Descend
+		plainDep := rdepsDep
+		plainDep.Descend = 0
+		if (descend == -1 || descend >= level) && plainDep == dep {
+			for rdep := range entries {
+				toBeMarked = append(toBeMarked, rdep)
+			}
+			delete(rdeps, rdepsDep)
+			m.dirty[dep.Node] = true
+		}
+	}
+	for _, rdep := range toBeMarked {
+		if err := m.mark(rdep, 0); err != nil {
+			return err
+		}
+	}
+	// Changes of nodes affect caches depending on their ancestors.
+	// Cache entries are only depended on directly.
+	if dep.Cache == "" && dep.Node != "/" {
+		dep.Node = path.Dir(dep.Node)
+		if err := m.mark(dep, level+1); err != nil {
+			return fmt.Errorf("Could not mark parent: %v", err)
+		}
+	}
+	return nil
+}
+
+// markDep removes the cached data depending on the given dependency.
+//
+// Returns the removed cache entries.
+func markDep(root string, dep service.CacheDep, level int) (
+	[]service.CacheDep, error) {
+	lock := cacheLock(root)
+	lock.Lock()
+	defer lock.Unlock()
+	m := depMarker{
+		root:   root,
+		rdeps:  make(map[string]CacheDepMap),
+		dirty:  make(map[string]bool),
+		marked: make(map[service.CacheDep]bool),
+	}
+	err := m.mark(dep, level)
+	for node := range m.dirty {
+		if err := writeRdeps(root, node, m.rdeps[node]); err != nil {
+			return m.removed, fmt.Errorf("Could not write new rdeps: %v", err)
+		}
+	}
+	if err != nil {
+		return m.removed, fmt.Errorf("Could not mark dependency: %v", err)
+	}
+	return m.removed, nil
+}
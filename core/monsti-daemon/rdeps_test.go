@@ -0,0 +1,186 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestRdepsConcurrent(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/.rdeps.json": `[
+  {"Dep": {"Node": "/", "Descend": -1},
+   "RDeps": [{"Node": "/old", "Cache": "core.page.full"}]},
+  {"Dep": {"Node": "/", "Descend": -1},
+   "RDeps": [{"Node": "/old", "Cache": "core.page.full"}]}]`},
+		"TestRdepsConcurrent")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	var wg sync.WaitGroup
+	errors := make(chan error, 100)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Each page gets cached twice.
+			node := fmt.Sprintf("/node%d", i/2)
+			errors <- toCache(root, node, "core.page.full", []byte("test"),
+				&service.CacheMods{Deps: []service.CacheDep{
+					{Node: node}, {Node: "/", Descend: -1}}})
+		}(i)
+	}
+	wg.Wait()
+	close(errors)
+	for err := range errors {
+		if err != nil {
+			t.Fatalf("Could not cache data: %v", err)
+		}
+	}
+	rdeps, err := readRdeps(root, "/")
+	if err != nil {
+		t.Fatalf("Could not read rdeps: %v", err)
+	}
+	rootDep := service.CacheDep{Node: "/", Descend: -1}
+	if len(rdeps) != 1 || len(rdeps[rootDep]) != 26 {
+		t.Fatalf("Rdeps should contain one dependency with 26 unique entries, got %v",
+			rdeps)
+	}
+
+	// Removing a single cache entry does not affect the pages depending
+	// on the root.
+	removed, err := markDep(root, service.CacheDep{Node: "/node1",
+		Cache: "core.page.full"}, 0)
+	if err != nil || len(removed) != 1 {
+		t.Fatalf("markDep should remove one entry, got %v, %v", removed, err)
+	}
+	if rdeps, _ := readRdeps(root, "/"); len(rdeps) != 1 {
+		t.Errorf("Root dependency should be left, got %v", rdeps)
+	}
+
+	removed, err = markDep(root, service.CacheDep{Node: "/node2"}, 0)
+	if err != nil || len(removed) != 26 {
+		t.Errorf("markDep should mark all 26 pages, got %v, %v",
+			removed, err)
+	}
+	for _, file := range []string{"/.rdeps.json", "/.rdeps.log",
+		"/node2/.rdeps.log"} {
+		_, err := os.Stat(filepath.Join(root, file))
+		if !os.IsNotExist(err) {
+			t.Errorf("Rdeps %v should have been removed: %v", file, err)
+		}
+	}
+}
+
+func TestRdepsCompaction(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{},
+		"TestRdepsCompaction")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	deps := []service.CacheDep{{Node: "/foo"}, {Node: "/", Descend: -1}}
+	for i := 0; i < 3; i++ {
+		err := appendRdeps(root, deps, service.CacheDep{Node: "/foo",
+			Cache: "core.page.full"})
+		if err != nil {
+			t.Fatalf("Could not append rdeps: %v", err)
+		}
+	}
+	err = appendRdeps(root, deps[:1], service.CacheDep{Node: "/bar",
+		Cache: "core.page.full"})
+	if err != nil {
+		t.Fatalf("Could not append rdeps: %v", err)
+	}
+	depMap, compact, err := loadRdeps(root, "/foo")
+	if err != nil || !compact || len(depMap[deps[0]]) != 2 {
+		t.Fatalf("loadRdeps should return two entries with duplicates, got %v, %v, %v",
+			depMap, compact, err)
+	}
+	// Marking a child reads and rewrites the rdeps of /foo without
+	// duplicates. Only the page depending on the whole site is removed.
+	removed, err := markDep(root, service.CacheDep{Node: "/foo/child"}, 0)
+	if err != nil || len(removed) != 1 {
+		t.Fatalf("markDep should remove one entry, got %v, %v", removed, err)
+	}
+	depMap, compact, err = loadRdeps(root, "/foo")
+	if err != nil || compact || len(depMap) != 1 || len(depMap[deps[0]]) != 2 {
+		t.Errorf("Rdeps of /foo should have been compacted, got %v, %v, %v",
+			depMap, compact, err)
+	}
+}
+
+// benchmarkPages is the number of pages cached by the benchmarks.
+const benchmarkPages = 5000
+
+// cachePages caches pages depending on themselves and the whole site.
+func cachePages(b *testing.B, root string) {
+	for i := 0; i < benchmarkPages; i++ {
+		node := fmt.Sprintf("/node%d", i)
+		err := toCache(root, node, "core.page.full", []byte("test"),
+			&service.CacheMods{Deps: []service.CacheDep{
+				{Node: node}, {Node: "/", Descend: -1}}})
+		if err != nil {
+			b.Fatalf("Could not cache data: %v", err)
+		}
+	}
+}
+
+func BenchmarkToCache(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		root, cleanup, err := utesting.CreateDirectoryTree(
+			map[string]string{}, "BenchmarkToCache")
+		if err != nil {
+			b.Fatalf("Could not create directory tree: %v", err)
+		}
+		b.StartTimer()
+		cachePages(b, root)
+		b.StopTimer()
+		cleanup()
+		b.StartTimer()
+	}
+}
+
+func BenchmarkMarkDepRoot(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		root, cleanup, err := utesting.CreateDirectoryTree(
+			map[string]string{}, "BenchmarkMarkDepRoot")
+		if err != nil {
+			b.Fatalf("Could not create directory tree: %v", err)
+		}
+		cachePages(b, root)
+		b.StartTimer()
+		removed, err := markDep(root, service.CacheDep{Node: "/"}, 0)
+		if err != nil || len(removed) != benchmarkPages {
+			b.Fatalf("markDep should remove all pages, got %v, %v", len(removed),
+				err)
+		}
+		b.StopTimer()
+		cleanup()
+		b.StartTimer()
+	}
+}
@@ -40,6 +40,8 @@ type masterTmplEnv struct {
 	Session            *service.UserSession
 	Title, Description string
 	Flags              masterTmplFlags
+	// LocalePrefix is prepended to links to other nodes.
+	LocalePrefix string
 }
 
 // splitFirstDir returns the first directory in the given path.
@@ -59,10 +61,11 @@ func renderInMaster(r template.Renderer, content []byte, env masterTmplEnv,
 		ret, err := r.Render("admin/master", template.Context{
 			"Site": site,
 			"Page": template.Context{
-				"Title":    env.Title,
-				"Node":     env.Node,
-				"EditView": env.Flags&EDIT_VIEW != 0,
-				"Content":  htmlT.HTML(content),
+				"Title":        env.Title,
+				"Node":         env.Node,
+				"EditView":     env.Flags&EDIT_VIEW != 0,
+				"Content":      htmlT.HTML(content),
+				"LocalePrefix": env.LocalePrefix,
 			},
 			"Session": env.Session}, locale,
 			settings.Monsti.GetSiteTemplatesPath(site.Name))
@@ -74,10 +77,28 @@ func renderInMaster(r template.Renderer, content []byte, env masterTmplEnv,
 	firstDir := splitFirstDir(env.Node.Path)
 	getNodeFn := func(path string) (*service.Node, error) {
 		node, err := s.Monsti().GetNode(site.Name, path)
-		return node, err
+		if err != nil || node == nil {
+			return node, err
+		}
+		if translated := translateNode(node, site, locale); translated != nil {
+			node = translated
+		}
+		return node, nil
 	}
 	getChildrenFn := func(path string) ([]*service.Node, error) {
-		return s.Monsti().GetChildren(site.Name, path)
+		children, err := s.Monsti().GetChildren(site.Name, path)
+		if err != nil {
+			return nil, err
+		}
+		// Update the navigation when unpublished nodes get published.
+		mods.ExpireOnPublish(children...)
+		translated := children[:0]
+		for _, child := range children {
+			if child = translateNode(child, site, locale); child != nil {
+				translated = append(translated, child)
+			}
+		}
+		return translated, nil
 	}
 	prinav, err := getNav("/", path.Join("/", firstDir), env.Session.User == nil,
 		getNodeFn, getChildrenFn)
@@ -85,6 +106,7 @@ func renderInMaster(r template.Renderer, content []byte, env masterTmplEnv,
 		panic(fmt.Sprint("Could not get primary navigation: ", err))
 	}
 	prinav.MakeAbsolute("/")
+	prinav.AddPrefix(env.LocalePrefix)
 	var secnav navigation = nil
 	if env.Node.Path != "/" {
 		secnav, err = getNav(env.Node.Path, env.Node.Path, env.Session.User == nil,
@@ -93,6 +115,7 @@ func renderInMaster(r template.Renderer, content []byte, env masterTmplEnv,
 			panic(fmt.Sprint("Could not get secondary navigation: ", err))
 		}
 		secnav.MakeAbsolute(env.Node.Path)
+		secnav.AddPrefix(env.LocalePrefix)
 	}
 
 	title := getNodeTitle(env.Node)
@@ -105,7 +128,9 @@ func renderInMaster(r template.Renderer, content []byte, env masterTmplEnv,
 			"EditView":         env.Flags&EDIT_VIEW != 0,
 			"Title":            title,
 			"Content":          htmlT.HTML(content),
-			"ShowSecondaryNav": len(secnav) > 0},
+			"ShowSecondaryNav": len(secnav) > 0,
+			"LocalePrefix":     env.LocalePrefix,
+			"Languages":        getLanguageLinks(site, env.Node, locale)},
 		"Session": env.Session}, locale,
 		settings.Monsti.GetSiteTemplatesPath(site.Name))
 	if err != nil {
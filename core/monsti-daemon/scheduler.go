@@ -0,0 +1,477 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// cronSchedule is a parsed schedule of a job.
+type cronSchedule struct {
+	// The fields are bit sets of the allowed values.
+	minute, hour, dom, month, dow uint64
+	// domAll and dowAll are true if the day of month respectively the
+	// day of week is not restricted.
+	domAll, dowAll bool
+	// every is the interval of "@every" schedules.
+	every time.Duration
+}
+
+// cronShortcuts maps the predefined schedules to cron expressions.
+var cronShortcuts = map[string]string{
+	"@yearly":  "0 0 1 1 *",
+	"@monthly": "0 0 1 * *",
+	"@weekly":  "0 0 * * 0",
+	"@daily":   "0 0 * * *",
+	"@hourly":  "0 * * * *",
+}
+
+// parseCronField parses a comma separated list of values, ranges
+// (e.g. 1-5), and steps (e.g. */15 or 0-30/10).
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		stepped := false
+		if i := strings.Index(part, "/"); i >= 0 {
+			stepped = true
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("Invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("Invalid value %q", part)
+			}
+			to = from
+			if stepped {
+				// A single value with a step starts a range, e.g. 5/10.
+				to = max
+			}
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("Invalid range %q", part)
+				}
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("%q is out of range %v-%v", part, min, max)
+		}
+		for value := from; value <= to; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+// parseCronSchedule parses a schedule as described for service.Job.
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		every, err := time.ParseDuration(strings.TrimSpace(spec[7:]))
+		if err != nil || every < time.Second {
+			return nil, fmt.Errorf("Invalid interval in %q", spec)
+		}
+		return &cronSchedule{every: every}, nil
+	}
+	if expr, ok := cronShortcuts[spec]; ok {
+		spec = expr
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Schedule %q does not have five fields", spec)
+	}
+	var s cronSchedule
+	var err error
+	for i, field := range []struct {
+		bits     *uint64
+		min, max int
+	}{{&s.minute, 0, 59}, {&s.hour, 0, 23}, {&s.dom, 1, 31},
+		{&s.month, 1, 12}, {&s.dow, 0, 7}} {
+		if *field.bits, err = parseCronField(fields[i], field.min,
+			field.max); err != nil {
+			return nil, fmt.Errorf("Invalid schedule %q: %v", spec, err)
+		}
+	}
+	// Both 0 and 7 are Sunday.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAll = fields[2] == "*"
+	s.dowAll = fields[4] == "*"
+	return &s, nil
+}
+
+// dayMatches returns true if the job runs on the day of the given time.
+//
+// If both day of month and day of week are restricted, either has to
+// match.
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAll || s.dowAll {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the time of the first run after the given time.
+//
+// Returns the zero time if the schedule never matches, e.g. on
+// February 30.
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Add(s.every)
+	}
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0,
+		loc)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// jobs sorts jobs by the time of their next run.
+type jobs []service.Job
+
+func (j jobs) Len() int {
+	return len(j)
+}
+
+func (j jobs) Less(i, k int) bool {
+	if j[i].Next.Equal(j[k].Next) {
+		return j[i].Id < j[k].Id
+	}
+	return j[i].Next.Before(j[k].Next)
+}
+
+func (j jobs) Swap(i, k int) {
+	j[i], j[k] = j[k], j[i]
+}
+
+// scheduler runs jobs at their scheduled times.
+type scheduler struct {
+	// Path is the file storing the jobs.
+	Path string
+	// Log is used to log failed jobs.
+	Log *log.Logger
+	// run runs a job.
+	run     func(*service.Job) error
+	mutex   sync.Mutex
+	jobs    map[string]*service.Job
+	running map[string]bool
+	// wake interrupts waiting for the next job.
+	wake chan bool
+	// active counts the running jobs.
+	active sync.WaitGroup
+}
+
+// newScheduler returns a scheduler for the jobs stored in the given
+// file.
+func newScheduler(path string, run func(*service.Job) error,
+	logger *log.Logger) (*scheduler, error) {
+	s := &scheduler{
+		Path:    path,
+		Log:     logger,
+		run:     run,
+		jobs:    make(map[string]*service.Job),
+		running: make(map[string]bool),
+		wake:    make(chan bool, 1),
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Could not read jobs: %v", err)
+	}
+	if len(content) > 0 {
+		var stored []*service.Job
+		if err := json.Unmarshal(content, &stored); err != nil {
+			return nil, fmt.Errorf("Could not unmarshal jobs: %v", err)
+		}
+		for _, job := range stored {
+			s.jobs[job.Id] = job
+		}
+	}
+	return s, nil
+}
+
+// save writes the jobs to the scheduler's file.
+func (s *scheduler) save() error {
+	stored := make(jobs, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		stored = append(stored, *job)
+	}
+	sort.Sort(stored)
+	content, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not marshal jobs: %v", err)
+	}
+	if err := ioutil.WriteFile(s.Path+".tmp", content, 0600); err != nil {
+		return fmt.Errorf("Could not write jobs: %v", err)
+	}
+	if err := os.Rename(s.Path+".tmp", s.Path); err != nil {
+		return fmt.Errorf("Could not write jobs: %v", err)
+	}
+	return nil
+}
+
+// Schedule adds the job or replaces the job with the same id.
+func (s *scheduler) Schedule(job service.Job) error {
+	if job.Id == "" || job.Type == "" {
+		return fmt.Errorf("Jobs need an id and a type")
+	}
+	job.Next = job.At
+	if job.Schedule != "" {
+		schedule, err := parseCronSchedule(job.Schedule)
+		if err != nil {
+			return err
+		}
+		job.Next = schedule.Next(time.Now())
+		if job.Next.IsZero() {
+			return fmt.Errorf("Schedule %q never matches", job.Schedule)
+		}
+	} else if job.At.IsZero() {
+		return fmt.Errorf("Jobs need either a schedule or a time")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if old, ok := s.jobs[job.Id]; ok {
+		job.LastRun, job.LastError = old.LastRun, old.LastError
+	}
+	s.jobs[job.Id] = &job
+	if err := s.save(); err != nil {
+		return err
+	}
+	s.notify()
+	return nil
+}
+
+// Unschedule removes the job with the given id.
+func (s *scheduler) Unschedule(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.jobs[id]; !ok {
+		return nil
+	}
+	delete(s.jobs, id)
+	if err := s.save(); err != nil {
+		return err
+	}
+	s.notify()
+	return nil
+}
+
+// Jobs returns all jobs ordered by their next run.
+func (s *scheduler) Jobs() []service.Job {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ret := make(jobs, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		ret = append(ret, *job)
+	}
+	sort.Sort(ret)
+	return ret
+}
+
+// notify wakes up the scheduler to recalculate the time of the next
+// run.
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- true:
+	default:
+	}
+}
+
+// Run runs the jobs when they are due. It never returns.
+//
+// Jobs which have been missed, e.g. while Monsti was not running, are
+// run once immediately.
+func (s *scheduler) Run() {
+	for {
+		var next time.Time
+		s.mutex.Lock()
+		for _, job := range s.jobs {
+			if next.IsZero() || job.Next.Before(next) {
+				next = job.Next
+			}
+		}
+		s.mutex.Unlock()
+		var timer *time.Timer
+		var due <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(next.Sub(time.Now()))
+			due = timer.C
+		}
+		select {
+		case <-due:
+			s.runDue(time.Now())
+		case <-s.wake:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+// runDue starts all jobs due at the given time.
+//
+// Repeated jobs are skipped if their previous run has not finished
+// yet.
+func (s *scheduler) runDue(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var started []*service.Job
+	for id, job := range s.jobs {
+		if job.Next.After(now) {
+			continue
+		}
+		if job.Schedule == "" {
+			delete(s.jobs, id)
+		} else {
+			schedule, err := parseCronSchedule(job.Schedule)
+			if err != nil {
+				s.Log.Printf("Removing job %q: %v", id, err)
+				delete(s.jobs, id)
+				continue
+			}
+			job.Next = schedule.Next(now)
+			if s.running[id] {
+				s.Log.Printf("Skipping job %q, it's still running", id)
+				continue
+			}
+		}
+		s.running[id] = true
+		job := *job
+		started = append(started, &job)
+	}
+	if err := s.save(); err != nil {
+		s.Log.Printf("Could not save jobs: %v", err)
+	}
+	for _, job := range started {
+		s.active.Add(1)
+		go s.runJob(job, now)
+	}
+}
+
+// runJob runs the job and records the result.
+func (s *scheduler) runJob(job *service.Job, now time.Time) {
+	defer s.active.Done()
+	err := s.run(job)
+	if err != nil {
+		s.Log.Printf("Job %q failed: %v", job.Id, err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.running, job.Id)
+	if stored, ok := s.jobs[job.Id]; ok {
+		stored.LastRun = now
+		stored.LastError = ""
+		if err != nil {
+			stored.LastError = err.Error()
+		}
+		if err := s.save(); err != nil {
+			s.Log.Printf("Could not save jobs: %v", err)
+		}
+	}
+}
+
+// coreJobs contains the jobs run by Monsti itself.
+var coreJobs = map[string]func(*MonstiService, *service.Job) error{
+	"monsti.CleanCache": func(m *MonstiService, job *service.Job) error {
+		sites := []string{job.Site}
+		if job.Site == "" {
+			sites = m.Settings.SiteNames()
+		}
+		for _, site := range sites {
+			_, err := cleanCache(m.Settings.Monsti.GetSiteCachePath(site),
+				m.Settings.Monsti.GetSiteNodesPath(site))
+			if err != nil {
+				return fmt.Errorf("Could not clean cache of site %q: %v", site, err)
+			}
+			_, err = cleanUploads(m.Settings.Monsti.GetSiteNodesPath(site),
+				staleUploadAge)
+			if err != nil {
+				return fmt.Errorf("Could not clean uploads of site %q: %v", site,
+					err)
+			}
+		}
+		return nil
+	},
+	// monsti.WarmCache fills the cache of the job's site.
+	"monsti.WarmCache": func(m *MonstiService, job *service.Job) error {
+		var warmed int
+		return m.WarmCache(job.Site, &warmed)
+	},
+	// monsti.MarkDep invalidates the caches of the node given as data,
+	// e.g. when the node gets published.
+	"monsti.MarkDep": func(m *MonstiService, job *service.Job) error {
+		return m.MarkDep(&MarkDepArgs{job.Site,
+			service.CacheDep{Node: string(job.Data)}}, new(int))
+	},
+}
+
+// defaultJobs are scheduled if they have not been scheduled before.
+var defaultJobs = []service.Job{
+	{Id: "monsti.CleanCache", Type: "monsti.CleanCache", Schedule: "@daily"},
+}
+
+// runJob runs jobs of the scheduler, either by Monsti itself or by
+// some module.
+func (m *MonstiService) runJob(sessions *service.SessionPool,
+	job *service.Job) error {
+	if run, ok := coreJobs[job.Type]; ok {
+		return run(m, job)
+	}
+	if strings.HasPrefix(job.Type, "monsti.") {
+		return fmt.Errorf("Unknown job type %q", job.Type)
+	}
+	session, err := sessions.New()
+	if err != nil {
+		return fmt.Errorf("Could not get session: %v", err)
+	}
+	defer sessions.Free(session)
+	return session.Monsti().RunJob(job)
+}
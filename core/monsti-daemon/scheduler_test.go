@@ -0,0 +1,136 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestCronScheduleNext(t *testing.T) {
+	// 2015-06-30 is a Tuesday.
+	now := time.Date(2015, 6, 30, 18, 4, 30, 0, time.UTC)
+	tests := []struct {
+		Schedule string
+		Next     time.Time
+	}{
+		{"* * * * *", time.Date(2015, 6, 30, 18, 5, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2015, 6, 30, 18, 15, 0, 0, time.UTC)},
+		{"10/20 * * * *", time.Date(2015, 6, 30, 18, 10, 0, 0, time.UTC)},
+		{"0 0/6 * * *", time.Date(2015, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 4 * * *", time.Date(2015, 7, 1, 4, 30, 0, 0, time.UTC)},
+		{"@daily", time.Date(2015, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2015, 7, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2015, 7, 5, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2015, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2015, 7, 1, 9, 0, 0, 0, time.UTC)},
+		{"0 12 29 2 *", time.Date(2016, 2, 29, 12, 0, 0, 0, time.UTC)},
+		// Either day of month or day of week has to match.
+		{"0 0 15 * 4", time.Date(2015, 7, 2, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+		{"@every 90m", now.Add(90 * time.Minute)},
+	}
+	for _, test := range tests {
+		schedule, err := parseCronSchedule(test.Schedule)
+		if err != nil {
+			t.Errorf("parseCronSchedule(%q) returns error: %v", test.Schedule, err)
+			continue
+		}
+		if next := schedule.Next(now); !next.Equal(test.Next) {
+			t.Errorf("Next of %q is %v, should be %v", test.Schedule, next,
+				test.Next)
+		}
+	}
+	for _, invalid := range []string{"", "* * * *", "60 * * * *", "* * 0 * *",
+		"5-1 * * * *", "*/0 * * * *", "a * * * *", "@every 1ns", "@sometimes"} {
+		if _, err := parseCronSchedule(invalid); err == nil {
+			t.Errorf("parseCronSchedule(%q) should fail", invalid)
+		}
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monsti-scheduler")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jobs.json")
+	logger := log.New(ioutil.Discard, "", 0)
+	var mutex sync.Mutex
+	var ran []string
+	run := func(job *service.Job) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		ran = append(ran, job.Id)
+		if job.Type == "test.Fail" {
+			return errors.New("failed")
+		}
+		return nil
+	}
+	s, err := newScheduler(path, run, logger)
+	if err != nil {
+		t.Fatalf("Could not create scheduler: %v", err)
+	}
+	now := time.Now()
+	for _, job := range []service.Job{
+		{Id: "once", Type: "test.Job", At: now.Add(-time.Minute)},
+		{Id: "later", Type: "test.Job", At: now.Add(time.Hour)},
+		{Id: "hourly", Type: "test.Fail", Schedule: "@hourly"},
+	} {
+		if err := s.Schedule(job); err != nil {
+			t.Fatalf("Could not schedule %q: %v", job.Id, err)
+		}
+	}
+	if err := s.Schedule(service.Job{Id: "invalid", Type: "test.Job"}); err == nil {
+		t.Errorf("Jobs without schedule and time should be refused")
+	}
+
+	s.runDue(now.Add(2 * time.Hour))
+	s.active.Wait()
+	if len(ran) != 3 {
+		t.Errorf("All jobs should have been run, got %v", ran)
+	}
+
+	// One-shot jobs are removed, repeated jobs remember their last run.
+	s, err = newScheduler(path, run, logger)
+	if err != nil {
+		t.Fatalf("Could not reload scheduler: %v", err)
+	}
+	jobs := s.Jobs()
+	if len(jobs) != 1 || jobs[0].Id != "hourly" {
+		t.Fatalf("Only the hourly job should be left, got %v", jobs)
+	}
+	if jobs[0].LastError != "failed" || !jobs[0].Next.After(now.Add(2*time.Hour)) {
+		t.Errorf("Hourly job has not been updated: %+v", jobs[0])
+	}
+	if err := s.Unschedule("hourly"); err != nil {
+		t.Errorf("Could not unschedule job: %v", err)
+	}
+	if jobs := s.Jobs(); len(jobs) != 0 {
+		t.Errorf("No jobs should be left, got %v", jobs)
+	}
+}
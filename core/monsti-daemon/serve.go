@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"runtime/debug"
 	"strings"
@@ -42,21 +43,36 @@ type reqContext struct {
 	Action      service.Action
 	Session     *sessions.Session
 	UserSession *service.UserSession
+	Auths       []authenticator
 	Site        *util.SiteSettings
 	Serv        *service.Session
+	// Locale of the requested content.
+	Locale string
+	// LocalePrefix is the locale prefix of the request's path, if any.
+	LocalePrefix string
 }
 
 // nodeHandler is a net/http handler to process incoming HTTP requests.
 type nodeHandler struct {
 	Renderer template.Renderer
 	Settings *settings
-	// Hosts is a map from hosts to site names.
-	Hosts map[string]string
+	// hosts is a map from hosts to site names and statics contains
+	// the file servers of the sites' site-static directories. They get
+	// replaced if the sites are reloaded.
+	hosts      *hostMap
+	statics    map[string]http.Handler
+	sitesMutex sync.RWMutex
 	// Log is the logger used by the node handler.
 	Log *log.Logger
 	// Info is a connection to an INFO service.
-	Monsti        *service.MonstiClient
-	Sessions      *service.SessionPool
+	Monsti   *service.MonstiClient
+	Sessions *service.SessionPool
+	// TrustedProxies are the networks of proxies whose
+	// X-Forwarded-Proto header is trusted.
+	TrustedProxies []*net.IPNet
+	// Service is the Monsti service of this process. If set, cached
+	// pages are served from its memory cache without RPC calls.
+	Service       *MonstiService
 	requests      map[uint]*reqContext
 	lastRequestID uint
 	mutex         sync.RWMutex
@@ -102,6 +118,21 @@ func splitAction(path string) (string, string) {
 	return nodePath, action
 }
 
+// fromCache returns the given cached data of the request's site or nil
+// if it's not cached.
+//
+// The memory cache of the service is tried first to save an RPC call.
+func (h *nodeHandler) fromCache(c *reqContext, node, id string) ([]byte,
+	*service.CacheMods, error) {
+	if h.Service != nil {
+		memory := h.Service.memoryCache(c.Site.Name)
+		if content, mods, ok := memory.Get(node, id); ok {
+			return content, mods, nil
+		}
+	}
+	return c.Serv.Monsti().FromCache(c.Site.Name, node, id)
+}
+
 type ServeError string
 
 func (err ServeError) Error() string {
@@ -155,12 +186,22 @@ func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"remove":                 service.RemoveAction,
 		"request-password-token": service.RequestPasswordTokenAction,
 		"change-password":        service.ChangePasswordAction,
+		"audit":                  service.AuditAction,
+		"profile":                service.ProfileAction,
+		"media":                  service.MediaAction,
+		"cache":                  service.CacheAction,
 	}[action]
-	site_name, ok := h.Hosts[c.Req.Host]
-	if !ok {
-		serveError("No site found for host %v", c.Req.Host)
+	route, ok := h.route(c.Req.Host)
+	site, siteOk := h.Settings.Site(route.Site)
+	if !ok || !siteOk {
+		h.Log.Printf("No site found for host %v", c.Req.Host)
+		http.Error(c.Res, "Unknown host.", http.StatusNotFound)
+		return
 	}
-	site := h.Settings.Monsti.Sites[site_name]
+	if h.redirectHost(c.Res, c.Req, site, route) {
+		return
+	}
+	site_name := route.Site
 	c.Site = &site
 	c.Site.Name = site_name
 	c.Session, err = getSession(c.Req, *c.Site)
@@ -168,12 +209,31 @@ func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		serveError("Could not get session: %v", err)
 	}
 	defer context.Clear(c.Req)
-	c.UserSession, err = getClientSession(c.Session,
+	c.Auths, err = getAuthenticators(*c.Site,
 		h.Settings.Monsti.GetSiteDataPath(c.Site.Name))
+	if err != nil {
+		serveError("Could not get authenticators: %v", err)
+	}
+	c.UserSession, err = getClientSession(c.Session, c.Auths)
 	if err != nil {
 		serveError("Could not get client session: %v", err)
 	}
-	c.UserSession.Locale = c.Site.Locale
+	c.Locale, c.LocalePrefix, nodePath = requestLocale(c.Req, *c.Site,
+		nodePath)
+	if len(c.Site.Locales) > 1 {
+		c.Res.Header().Add("Vary", "Accept-Language")
+	}
+	c.UserSession.Locale = c.Locale
+	// Use the user's preferred language for the web interface. Views
+	// show the content in the requested locale.
+	if c.Action != service.ViewAction && c.UserSession.User != nil &&
+		len(c.UserSession.User.Locale) > 0 {
+		c.UserSession.Locale = c.UserSession.User.Locale
+	}
+	c.Serv.Monsti().Actor = service.AuditActor{IP: clientIP(c.Req)}
+	if c.UserSession.User != nil {
+		c.Serv.Monsti().Actor.User = c.UserSession.User.Login
+	}
 
 	h.Log.Printf("(%v) %v %v", c.Site.Name, c.Req.Method, c.Req.URL.Path)
 
@@ -185,10 +245,17 @@ func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if c.UserSession.User == nil && c.Action == service.ViewAction &&
 		nodePath[len(nodePath)-1] == '/' &&
 		len(c.Req.Form) == 0 {
-		content, _, err := c.Serv.Monsti().FromCache(c.Site.Name, nodePath,
-			"core.page.full")
+		cacheId := localeCacheID("core.page.full", *c.Site, c.Locale)
+		content, mods, err := h.fromCache(&c, nodePath, cacheId)
 		if err == nil && content != nil {
-			c.Res.Write(content)
+			var expire time.Time
+			if mods != nil {
+				expire = mods.Expire
+			}
+			if err := h.writePage(&c, content, nodePath, cacheId,
+				expire); err != nil {
+				serveError("Could not write page: %v", err)
+			}
 			return
 		}
 	}
@@ -198,14 +265,22 @@ func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		serveError("Error getting node %v of site %v: %v",
 			nodePath, c.Site.Name, err)
 	}
-	if c.Node == nil ||
-		(c.UserSession.User == nil &&
-			(c.Node.Public == false || c.Node.PublishTime.After(time.Now()))) {
+	if c.Node == nil || (c.UserSession.User == nil && !c.Node.Published()) {
 		h.Log.Printf("Node not found: %v @ %v", nodePath, c.Site.Name)
 		c.Node = &service.Node{Path: nodePath}
 		http.Error(c.Res, "Document not found", http.StatusNotFound)
 		return
 	}
+	if c.Action == service.ViewAction {
+		translated := translateNode(c.Node, *c.Site, c.Locale)
+		if translated == nil {
+			h.Log.Printf("Node not translated to %v: %v @ %v", c.Locale,
+				nodePath, c.Site.Name)
+			http.Error(c.Res, "Document not found", http.StatusNotFound)
+			return
+		}
+		c.Node = translated
+	}
 	if !checkPermission(c.Action, c.UserSession) {
 		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
 		return
@@ -225,6 +300,14 @@ func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		err = h.RequestPasswordToken(&c)
 	case service.ChangePasswordAction:
 		err = h.ChangePassword(&c)
+	case service.AuditAction:
+		err = h.Audit(&c)
+	case service.ProfileAction:
+		err = h.Profile(&c)
+	case service.MediaAction:
+		err = h.Media(&c)
+	case service.CacheAction:
+		err = h.Cache(&c)
 	default:
 		err = h.View(&c)
 	}
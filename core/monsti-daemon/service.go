@@ -21,6 +21,7 @@ import (
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/smtp"
@@ -28,6 +29,7 @@ import (
 	"path"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -61,6 +63,20 @@ type MonstiService struct {
 	subscriptions map[string][]string
 	subscriber    map[string]chan *signal
 	subscriberRet map[string]chan emitRet
+	// auditMutex syncronizes writes to the audit logs.
+	auditMutex sync.Mutex
+	// Thumbnails generates image sizes of changed images. May be nil.
+	Thumbnails *thumbnailPool
+	// Scheduler runs scheduled jobs.
+	Scheduler *scheduler
+	// Purger invalidates reverse proxies in front of the sites. May be
+	// nil.
+	Purger *purger
+	// memCaches contains the memory caches of the sites.
+	memCaches      map[string]*memoryCache
+	memCachesMutex sync.Mutex
+	// sitesMutex synchronizes reloading and creating sites.
+	sitesMutex sync.Mutex
 }
 
 type PublishServiceArgs struct {
@@ -210,6 +226,21 @@ func getNode(root, path string) (node []byte, err error) {
 	return
 }
 
+// getNodeType returns the type id of the given node.
+//
+// Returns the empty string if there is no such node.
+func getNodeType(root, path string) (string, error) {
+	data, err := getNode(root, path)
+	if err != nil || data == nil {
+		return "", err
+	}
+	var node struct{ Type string }
+	if err := json.Unmarshal(data, &node); err != nil {
+		return "", fmt.Errorf("Could not decode node: %v", err)
+	}
+	return node.Type, nil
+}
+
 // getChildren looks up child nodes of the given node.
 func getChildren(root, path string) (nodes [][]byte, err error) {
 	files, err := ioutil.ReadDir(filepath.Join(root, path))
@@ -272,6 +303,7 @@ func (i *MonstiService) GetNodeData(args *GetNodeDataArgs,
 type WriteNodeDataArgs struct {
 	Site, Path, File string
 	Content          []byte
+	Actor            service.AuditActor
 }
 
 func (i *MonstiService) WriteNodeData(args *WriteNodeDataArgs,
@@ -286,11 +318,311 @@ func (i *MonstiService) WriteNodeData(args *WriteNodeDataArgs,
 	if err != nil {
 		return fmt.Errorf("Could not write node data: %v", err)
 	}
+	return i.nodeDataWritten(args.Site, args.Path, args.File, args.Content,
+		args.Actor)
+}
+
+// nodeDataWritten audits writing the given data file of a node and
+// runs the hooks for node and image files. The content of node.json
+// files is read from disk if it's nil.
+func (i *MonstiService) nodeDataWritten(site, nodePath, file string,
+	content []byte, actor service.AuditActor) error {
+	i.auditNodeData(site, nodePath, file, actor)
+	if file == "node.json" {
+		if content == nil {
+			var err error
+			content, err = ioutil.ReadFile(i.nodeDataPath(site, nodePath, file))
+			if err != nil {
+				return fmt.Errorf("Could not read node: %v", err)
+			}
+		}
+		if err := i.schedulePublish(site, nodePath, content); err != nil {
+			return err
+		}
+	}
+	return i.imageDataWritten(site, nodePath, file)
+}
+
+// fileField returns the File field of the node with the given id or
+// nil if there is no such field.
+func (i *MonstiService) fileField(site, nodePath, fieldId string) (
+	*service.NodeField, error) {
+	data, err := getNode(i.Settings.Monsti.GetSiteNodesPath(site), nodePath)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var node struct {
+		Type        string
+		LocalFields []*service.NodeField
+	}
+	if err := json.Unmarshal(data, &node); err != nil {
+		return nil, fmt.Errorf("Could not decode node: %v", err)
+	}
+	fields := node.LocalFields
+	if nodeType, ok := i.Settings.Config.NodeTypes[node.Type]; ok {
+		fields = append(nodeType.Fields, fields...)
+	}
+	for _, field := range fields {
+		if field.Id == fieldId {
+			return field, nil
+		}
+	}
+	return nil, nil
+}
+
+// imageDataWritten handles writing the given data file of a node. If
+// it's the file of an image, the caches of the image get invalidated
+// and its thumbnails are generated in the background.
+func (i *MonstiService) imageDataWritten(site, nodePath, file string) error {
+	if file != "__file_core.File" {
+		return nil
+	}
+	typeId, err := getNodeType(i.Settings.Monsti.GetSiteNodesPath(site),
+		nodePath)
+	if err != nil {
+		return fmt.Errorf("Could not get node type: %v", err)
+	}
+	if typeId != "core.Image" {
+		return nil
+	}
+	err = i.MarkDep(&MarkDepArgs{site, service.CacheDep{Node: nodePath}},
+		new(int))
+	if err != nil {
+		return err
+	}
+	if i.Thumbnails != nil {
+		i.Thumbnails.Add(thumbnailJob{site, path.Clean(nodePath)})
+	}
+	return nil
+}
+
+// publishJobId returns the id of the job invalidating the caches when
+// the given node gets published.
+func publishJobId(site, nodePath string) string {
+	return "monsti.Publish:" + site + ":" + path.Clean(nodePath)
+}
+
+// schedulePublish schedules invalidating the caches of the given node
+// at its publish time if it's in the future.
+func (i *MonstiService) schedulePublish(site, nodePath string,
+	content []byte) error {
+	if i.Scheduler == nil {
+		return nil
+	}
+	var node struct{ PublishTime time.Time }
+	if err := json.Unmarshal(content, &node); err != nil {
+		return fmt.Errorf("Could not decode node: %v", err)
+	}
+	id := publishJobId(site, nodePath)
+	if !node.PublishTime.After(time.Now()) {
+		return i.Scheduler.Unschedule(id)
+	}
+	err := i.Scheduler.Schedule(service.Job{Id: id, Type: "monsti.MarkDep",
+		Site: site, At: node.PublishTime, Data: []byte(path.Clean(nodePath))})
+	if err != nil {
+		return fmt.Errorf("Could not schedule publishing: %v", err)
+	}
+	return nil
+}
+
+// auditNodeData records writing the given node data file.
+func (i *MonstiService) auditNodeData(site, nodePath, file string,
+	actor service.AuditActor) {
+	action := service.AuditWriteNodeData
+	if file == "node.json" {
+		action = service.AuditWriteNode
+	}
+	i.audit(&service.AuditEntry{Site: site, AuditActor: actor,
+		Action: action, Path: nodePath, Details: file})
+}
+
+// nodeDataPath returns the path to the given data file of a node.
+func (i *MonstiService) nodeDataPath(site, nodePath, file string) string {
+	return filepath.Join(i.Settings.Monsti.GetSiteNodesPath(site),
+		nodePath[1:], filepath.Base(file))
+}
+
+type StatNodeDataArgs struct{ Site, Path, File string }
+
+func (i *MonstiService) StatNodeData(args *StatNodeDataArgs,
+	reply *service.NodeDataInfo) error {
+	info, err := os.Stat(i.nodeDataPath(args.Site, args.Path, args.File))
+	if os.IsNotExist(err) {
+		*reply = service.NodeDataInfo{}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Could not stat node data: %v", err)
+	}
+	*reply = service.NodeDataInfo{Exists: true, Size: info.Size(),
+		ModTime: info.ModTime()}
+	return nil
+}
+
+type ReadNodeDataArgs struct {
+	Site, Path, File string
+	Offset           int64
+	Length           int
+}
+
+// maxNodeDataChunk is the maximum number of bytes read by ReadNodeData.
+const maxNodeDataChunk = 1024 * 1024
+
+func (i *MonstiService) ReadNodeData(args *ReadNodeDataArgs,
+	reply *[]byte) error {
+	file, err := os.Open(i.nodeDataPath(args.Site, args.Path, args.File))
+	if err != nil {
+		return fmt.Errorf("Could not open node data: %v", err)
+	}
+	defer file.Close()
+	length := args.Length
+	if length > maxNodeDataChunk {
+		length = maxNodeDataChunk
+	}
+	buf := make([]byte, length)
+	n, err := file.ReadAt(buf, args.Offset)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("Could not read node data: %v", err)
+	}
+	*reply = buf[:n]
+	return nil
+}
+
+type WriteNodeDataChunkArgs struct {
+	Site, Path, File string
+	// Upload identifies the transfer the chunk belongs to.
+	Upload  string
+	Content []byte
+	// Done stores the transferred data, Abort discards it.
+	Done, Abort bool
+	Actor       service.AuditActor
+}
+
+var uploadIdRegexp = regexp.MustCompile(`^[0-9a-f]{1,64}$`)
+
+// staleUploadAge is the age of temporary upload files after which
+// they are considered abandoned.
+const staleUploadAge = 24 * time.Hour
+
+// WriteNodeDataChunk appends a chunk to a temporary file which replaces
+// the node data when the transfer is done.
+//
+// Files of File fields (i.e. "__file_<field id>") are validated, see
+// service.ValidateFileHead. The head is checked on the first chunk, the
+// size on every chunk. The temporary file is removed if the transfer
+// fails. Files of abandoned transfers get removed by cleanUploads.
+func (i *MonstiService) WriteNodeDataChunk(args *WriteNodeDataChunkArgs,
+	reply *int) error {
+	if !uploadIdRegexp.MatchString(args.Upload) {
+		return fmt.Errorf("Invalid upload id %q", args.Upload)
+	}
+	path := i.nodeDataPath(args.Site, args.Path, args.File)
+	tmpPath := filepath.Join(filepath.Dir(path), ".upload-"+args.Upload)
+	if args.Abort {
+		if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Could not remove upload: %v", err)
+		}
+		return nil
+	}
+	if err := i.validateUploadChunk(args, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("Could not create node directory: %v", err)
+	}
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600)
+	if err != nil {
+		return fmt.Errorf("Could not open upload: %v", err)
+	}
+	if _, err := file.Write(args.Content); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("Could not write upload: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Could not write upload: %v", err)
+	}
+	if args.Done {
+		if err := os.Rename(tmpPath, path); err != nil {
+			os.Remove(tmpPath)
+			return fmt.Errorf("Could not write node data: %v", err)
+		}
+		return i.nodeDataWritten(args.Site, args.Path, args.File, nil,
+			args.Actor)
+	}
 	return nil
 }
 
+// validateUploadChunk validates the chunk of a File field's file to be
+// appended to the given temporary file.
+func (i *MonstiService) validateUploadChunk(args *WriteNodeDataChunkArgs,
+	tmpPath string) error {
+	fieldId := strings.TrimPrefix(args.File, "__file_")
+	if fieldId == args.File {
+		return nil
+	}
+	field, err := i.fileField(args.Site, args.Path, fieldId)
+	if err != nil || field == nil {
+		return err
+	}
+	var size int64
+	info, err := os.Stat(tmpPath)
+	switch {
+	case err == nil:
+		size = info.Size()
+	case !os.IsNotExist(err):
+		return fmt.Errorf("Could not stat upload: %v", err)
+	}
+	var msg string
+	if size == 0 {
+		msg = service.ValidateFileHead(field, args.Content,
+			int64(len(args.Content)), "")
+	} else {
+		// The head has been checked on the first chunk.
+		sizeOnly := *field
+		sizeOnly.MimeTypes = nil
+		msg = service.ValidateFileHead(&sizeOnly, nil,
+			size+int64(len(args.Content)), "")
+	}
+	if msg != "" {
+		return fmt.Errorf("Invalid file for field %v: %v", fieldId, msg)
+	}
+	return nil
+}
+
+// cleanUploads removes temporary files of uploads below the given
+// nodes root which have not been written to for the given duration.
+//
+// Returns the number of removed files.
+func cleanUploads(nodesRoot string, maxAge time.Duration) (int, error) {
+	removed := 0
+	err := filepath.Walk(nodesRoot, func(path string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || !strings.HasPrefix(info.Name(), ".upload-") ||
+			time.Since(info.ModTime()) < maxAge {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Could not remove upload: %v", err)
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
 type RemoveNodeDataArgs struct {
 	Site, Path, File string
+	Actor            service.AuditActor
 }
 
 func (i *MonstiService) RemoveNodeData(args *RemoveNodeDataArgs,
@@ -300,11 +632,15 @@ func (i *MonstiService) RemoveNodeData(args *RemoveNodeDataArgs,
 	if err := os.Remove(path); err != nil {
 		return fmt.Errorf("Could not remove node data: %v", err)
 	}
+	i.audit(&service.AuditEntry{Site: args.Site, AuditActor: args.Actor,
+		Action: service.AuditRemoveNodeData, Path: args.Path,
+		Details: args.File})
 	return nil
 }
 
 type RemoveNodeArgs struct {
 	Site, Node string
+	Actor      service.AuditActor
 }
 
 func (i *MonstiService) RemoveNode(args *RemoveNodeArgs, reply *int) error {
@@ -325,9 +661,11 @@ func (i *MonstiService) RemoveNode(args *RemoveNodeArgs, reply *int) error {
 			if err != nil {
 				return err
 			}
-			for _, rdep := range rdeps {
-				log.Println("check", rdep)
-				err := markDep(cacheRoot, rdep.Dep, 0)
+			for dep := range rdeps {
+				log.Println("check", dep)
+				removed, err := markDep(cacheRoot, dep, 0)
+				i.forget(args.Site, removed)
+				i.invalidate(args.Site, dep, removed)
 				if err != nil {
 					return err
 				}
@@ -341,11 +679,14 @@ func (i *MonstiService) RemoveNode(args *RemoveNodeArgs, reply *int) error {
 	if err := os.RemoveAll(nodePath); err != nil {
 		return fmt.Errorf("Can't remove node: %v", err)
 	}
+	i.audit(&service.AuditEntry{Site: args.Site, AuditActor: args.Actor,
+		Action: service.AuditRemoveNode, Path: args.Node})
 	return nil
 }
 
 type RenameNodeArgs struct {
 	Site, Source, Target string
+	Actor                service.AuditActor
 }
 
 func (i *MonstiService) RenameNode(args *RenameNodeArgs, reply *int) error {
@@ -359,6 +700,47 @@ func (i *MonstiService) RenameNode(args *RenameNodeArgs, reply *int) error {
 		filepath.Join(root, args.Target)); err != nil {
 		return fmt.Errorf("Can't move node: %v", err)
 	}
+	i.audit(&service.AuditEntry{Site: args.Site, AuditActor: args.Actor,
+		Action: service.AuditRenameNode, Path: args.Source,
+		Details: args.Target})
+	return nil
+}
+
+// audit appends the given entry to the site's audit log.
+//
+// Failures are logged, the audited change has already been done.
+func (i *MonstiService) audit(entry *service.AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	i.auditMutex.Lock()
+	defer i.auditMutex.Unlock()
+	err := appendAuditEntry(i.Settings.Monsti.GetSiteDataPath(entry.Site), entry)
+	if err != nil {
+		i.Logger.Printf("Could not write audit entry %v: %v", entry, err)
+	}
+}
+
+func (i *MonstiService) WriteAuditEntry(args *service.AuditEntry,
+	reply *int) error {
+	i.auditMutex.Lock()
+	defer i.auditMutex.Unlock()
+	return appendAuditEntry(i.Settings.Monsti.GetSiteDataPath(args.Site), args)
+}
+
+type GetAuditEntriesArgs struct {
+	Site   string
+	Filter service.AuditFilter
+}
+
+func (i *MonstiService) GetAuditEntries(args *GetAuditEntriesArgs,
+	reply *[]*service.AuditEntry) error {
+	entries, err := readAuditEntries(
+		i.Settings.Monsti.GetSiteDataPath(args.Site), &args.Filter)
+	if err != nil {
+		return err
+	}
+	*reply = entries
 	return nil
 }
 
@@ -466,6 +848,13 @@ func (m *MonstiService) RegisterNodeType(nodeType *service.NodeType,
 		m.Settings.Config.NodeTypes = make(map[string]*service.NodeType)
 		m.Settings.Config.NodeFields = make(map[string]*service.NodeField)
 	}
+	for _, field := range nodeType.Fields {
+		if _, ok := m.Settings.Config.NodeFields[field.Id]; !ok &&
+			service.NewField(field.Type) == nil {
+			return fmt.Errorf("Unknown field type %q of field %v", field.Type,
+				field.Id)
+		}
+	}
 	m.Settings.Config.NodeTypes[nodeType.Id] = nodeType
 	for i, field := range nodeType.Fields {
 		if existing, ok := m.Settings.Config.NodeFields[field.Id]; ok {
@@ -477,6 +866,21 @@ func (m *MonstiService) RegisterNodeType(nodeType *service.NodeType,
 	return nil
 }
 
+// RegisterFieldType registers a field type provided by a module.
+//
+// Rendering and editing of such fields is delegated to the module
+// using the monsti.FieldType signal. Modules may register their field
+// types again, e.g. after being restarted.
+func (m *MonstiService) RegisterFieldType(name string, reply *int) error {
+	return service.RegisterRemoteFieldType(name)
+}
+
+// GetRemoteFieldTypes returns the field types provided by modules.
+func (m *MonstiService) GetRemoteFieldTypes(args int, reply *[]string) error {
+	*reply = service.RemoteFieldTypes()
+	return nil
+}
+
 func (i *MonstiService) GetRequest(id uint, req *service.Request) error {
 	if r := i.Handler.GetRequest(id); r != nil {
 		*req = *r
@@ -519,75 +923,37 @@ type FromCacheRet struct {
 
 func (i *MonstiService) FromCache(args *FromCacheArgs,
 	reply *FromCacheRet) error {
+	memory := i.memoryCache(args.Site)
+	if content, mods, ok := memory.Get(args.Node, args.Id); ok {
+		*reply = FromCacheRet{mods, content}
+		return nil
+	}
+	generation := memory.Generation()
 	cacheRoot := i.Settings.Monsti.GetSiteCachePath(args.Site)
 	var err error
 	content, mods, err := fromCache(cacheRoot, args.Node, args.Id)
+	if err == nil && content != nil {
+		memory.Put(generation, args.Node, args.Id, content, mods)
+	}
 	*reply = FromCacheRet{mods, content}
 	return err
 }
 
-type CacheDepPair struct {
-	Dep   service.CacheDep
-	RDeps []service.CacheDep
-}
-
-type CacheDepMap []CacheDepPair
-
-func readRdeps(root, node string) (CacheDepMap, error) {
-	rdepsPath := filepath.Join(root, node[1:], ".rdeps.json")
-	content, err := ioutil.ReadFile(rdepsPath)
-	if err != nil && !os.IsNotExist(err) {
-		return nil, fmt.Errorf("Could not read rdeps: %v", err)
-	}
-	if content == nil {
-		return nil, nil
-	}
-	var depMap CacheDepMap
-	err = json.Unmarshal(content, &depMap)
-	if err != nil {
-		return nil, fmt.Errorf("Could not unmarshal rdeps: %v", err)
-	}
-	return depMap, nil
-}
-
-func writeRdeps(root, node string, rdeps CacheDepMap) error {
-	content, err := json.MarshalIndent(rdeps, "", "  ")
-	if err != nil {
-		return fmt.Errorf("Could not marshal rdeps: %v", err)
-	}
-	rdepsPath := filepath.Join(root, node[1:], ".rdeps.json")
-	if err := os.MkdirAll(filepath.Dir(rdepsPath), 0700); err != nil {
-		return fmt.Errorf("Could not create node cache directory: %v", err)
-	}
-	if err := ioutil.WriteFile(rdepsPath, content, 0600); err != nil {
-		return fmt.Errorf("Could not write rdeps: %v", err)
-	}
-	return nil
-}
-
-func appendRdeps(root string, dep service.CacheDep,
-	rdeps []service.CacheDep) error {
-	depMap, err := readRdeps(root, dep.Node)
-	if err != nil {
-		return fmt.Errorf("Could not read rdeps: %v", err)
-	}
-	depMap = append(depMap, CacheDepPair{dep, rdeps})
-	if err := writeRdeps(root, dep.Node, depMap); err != nil {
-		return fmt.Errorf("Could not write rdeps: %v", err)
-	}
-	return nil
-}
-
+// toCache writes the data and the rdeps of the given cache entry.
+//
+// The cache lock is held until the data has been written. Otherwise,
+// the dependencies could be marked before the data exists, leaving
+// data behind which would never be removed.
 func toCache(root, node, id string, content []byte,
 	mods *service.CacheMods) error {
+	lock := cacheLock(root)
+	lock.Lock()
+	defer lock.Unlock()
 	// Write deps to filesystem.
 	thisDep := service.CacheDep{Node: node, Cache: id}
 	if mods != nil {
-		for _, dep := range mods.Deps {
-			err := appendRdeps(root, dep, []service.CacheDep{thisDep})
-			if err != nil {
-				return fmt.Errorf("Could not write rdeps: %v", err)
-			}
+		if err := appendRdeps(root, mods.Deps, thisDep); err != nil {
+			return fmt.Errorf("Could not write rdeps: %v", err)
 		}
 	}
 
@@ -620,54 +986,14 @@ type ToCacheArgs struct {
 }
 
 func (i *MonstiService) ToCache(args *ToCacheArgs, reply *int) error {
+	memory := i.memoryCache(args.Site)
+	generation := memory.Generation()
 	cacheRoot := i.Settings.Monsti.GetSiteCachePath(args.Site)
-	return toCache(cacheRoot, args.Node, args.Id, args.Content, args.Mods)
-}
-
-func markDep(root string, dep service.CacheDep, level int) error {
-	//	log.Println("markdep", dep, level)
-	rdeps, err := readRdeps(root, dep.Node)
+	err := toCache(cacheRoot, args.Node, args.Id, args.Content, args.Mods)
 	if err != nil {
-		return fmt.Errorf("Could not read rdeps: %v", err)
-	}
-	if dep.Cache != "" {
-		//		log.Println("Removing cache", dep.Cache)
-		path := filepath.Join(root, dep.Node[1:], ".data", dep.Cache)
-		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
-			return fmt.Errorf("Could not remove cached data: %v", err)
-		}
-	}
-	toBeMarked := make([]service.CacheDep, 0)
-	var newDeps CacheDepMap
-	dep.Node = filepath.Clean(dep.Node)
-	for _, rdep := range rdeps {
-		//log.Println(rdep)
-		descend := rdep.Dep.Descend
-		rdep.Dep.Descend = 0
-		//log.Println(descend, level, rdep.Dep, "==", dep, "?")
-		rdep.Dep.Node = filepath.Clean(rdep.Dep.Node)
-		if descend == -1 || descend >= level && rdep.Dep == dep {
-			//log.Println("Match!")
-			toBeMarked = append(toBeMarked, rdep.RDeps...)
-		} else {
-			rdep.Dep.Descend = descend
-			newDeps = append(newDeps, rdep)
-		}
-	}
-	if err := writeRdeps(root, dep.Node, newDeps); err != nil {
-		return fmt.Errorf("Could not write new rdeps: %v", err)
-	}
-	for _, dep := range toBeMarked {
-		markDep(root, dep, 0)
-	}
-
-	if dep.Node != "/" {
-		//log.Printf("Marking parent. Old dep: %+v", dep)
-		dep.Node = path.Dir(dep.Node)
-		if err := markDep(root, dep, level+1); err != nil {
-			return fmt.Errorf("Could not mark parent: %v", err)
-		}
+		return err
 	}
+	memory.Put(generation, args.Node, args.Id, args.Content, args.Mods)
 	return nil
 }
 
@@ -676,7 +1002,80 @@ type MarkDepArgs struct {
 	Dep  service.CacheDep
 }
 
+// MarkDep invalidates the caches depending on the given dependency.
+//
+// The URLs of the affected nodes get purged from the site's reverse
+// proxies, if configured.
 func (i *MonstiService) MarkDep(args *MarkDepArgs, reply *int) error {
 	cacheRoot := i.Settings.Monsti.GetSiteCachePath(args.Site)
-	return markDep(cacheRoot, args.Dep, 0)
+	removed, err := markDep(cacheRoot, args.Dep, 0)
+	i.forget(args.Site, removed)
+	i.invalidate(args.Site, args.Dep, removed)
+	return err
+}
+
+func (i *MonstiService) ScheduleJob(args *service.Job, reply *int) error {
+	return i.Scheduler.Schedule(*args)
+}
+
+func (i *MonstiService) UnscheduleJob(id string, reply *int) error {
+	return i.Scheduler.Unschedule(id)
+}
+
+func (i *MonstiService) GetJobs(args int, reply *[]service.Job) error {
+	*reply = i.Scheduler.Jobs()
+	return nil
+}
+
+// cleanCache removes expired cache data and the caches of nodes which
+// do not exist anymore.
+//
+// Returns the number of removed cache entries.
+func cleanCache(cacheRoot, nodesRoot string) (int, error) {
+	removed := 0
+	err := filepath.Walk(cacheRoot, func(path string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() || info.Name() != ".data" {
+			return nil
+		}
+		nodeDir, err := filepath.Rel(cacheRoot, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		_, err = os.Stat(filepath.Join(nodesRoot, nodeDir, "node.json"))
+		if os.IsNotExist(err) {
+			entries, _ := ioutil.ReadDir(path)
+			removed += len(entries)
+			if err := os.RemoveAll(path); err != nil {
+				return fmt.Errorf("Could not remove cache: %v", err)
+			}
+			return filepath.SkipDir
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return fmt.Errorf("Could not read cache directory: %v", err)
+		}
+		for _, entry := range entries {
+			_, mods, err := fromCache(cacheRoot, "/"+filepath.ToSlash(nodeDir),
+				entry.Name())
+			if err == nil && mods != nil {
+				continue
+			}
+			if err := os.Remove(filepath.Join(path, entry.Name())); err != nil {
+				return fmt.Errorf("Could not remove cache: %v", err)
+			}
+			removed++
+		}
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return removed, fmt.Errorf("Could not clean cache: %v", err)
+	}
+	return removed, nil
 }
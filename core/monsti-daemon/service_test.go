@@ -17,7 +17,13 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/rpc"
 	"os"
 	"reflect"
 	"strings"
@@ -207,7 +213,7 @@ func TestCache(t *testing.T) {
 	if !reflect.DeepEqual(ret, []byte("test3")) {
 		t.Fatalf("test3 should be in cache, got %v", string(ret))
 	}
-	err = markDep(root, service.CacheDep{Node: "/foo/bar/cruz"}, 0)
+	_, err = markDep(root, service.CacheDep{Node: "/foo/bar/cruz"}, 0)
 	if err != nil {
 		t.Fatalf("Could not mark dep: %v", err)
 	}
@@ -242,7 +248,7 @@ func TestCacheMarkDescend(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Could not cache data: %v", err)
 	}
-	err = markDep(root, service.CacheDep{Node: "/foo/bar/cruz"}, 0)
+	_, err = markDep(root, service.CacheDep{Node: "/foo/bar/cruz"}, 0)
 	if err != nil {
 		t.Fatalf("Could not mark dep: %v", err)
 	}
@@ -253,7 +259,7 @@ func TestCacheMarkDescend(t *testing.T) {
 	if ret == nil {
 		t.Errorf("Cache should not be nil")
 	}
-	err = markDep(root, service.CacheDep{Node: "/foo/bar"}, 0)
+	_, err = markDep(root, service.CacheDep{Node: "/foo/bar"}, 0)
 	if err != nil {
 		t.Fatalf("Could not mark dep: %v", err)
 	}
@@ -271,7 +277,7 @@ func TestCacheMarkDescend(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Could not cache data: %v", err)
 	}
-	err = markDep(root, service.CacheDep{Node: "/foo/bar/cruz"}, 0)
+	_, err = markDep(root, service.CacheDep{Node: "/foo/bar/cruz"}, 0)
 	if err != nil {
 		t.Fatalf("Could not mark dep: %v", err)
 	}
@@ -326,3 +332,263 @@ func TestCacheExpire(t *testing.T) {
 		t.Errorf("Cache should have been expired.")
 	}
 }
+
+func TestCleanCache(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/nodes/node.json":     `{"Type":"core.Document"}`,
+		"/nodes/foo/node.json": `{"Type":"core.Document"}`},
+		"TestCleanCache")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	cacheRoot := filepath.Join(root, "cache")
+	for _, entry := range []struct {
+		Node, Id string
+		Expire   time.Time
+	}{
+		{"/", "foo.valid", time.Time{}},
+		{"/foo", "foo.valid", time.Now().AddDate(1, 0, 0)},
+		{"/foo", "foo.expired", time.Now().AddDate(-1, 0, 0)},
+		{"/removed", "foo.valid", time.Time{}},
+	} {
+		err := toCache(cacheRoot, entry.Node, entry.Id, []byte("test"),
+			&service.CacheMods{Expire: entry.Expire})
+		if err != nil {
+			t.Fatalf("Could not cache data: %v", err)
+		}
+	}
+	removed, err := cleanCache(cacheRoot, filepath.Join(root, "nodes"))
+	if err != nil {
+		t.Fatalf("cleanCache returns error: %v", err)
+	}
+	if removed != 2 {
+		t.Errorf("cleanCache should remove 2 entries, removed %v", removed)
+	}
+	for _, entry := range []struct {
+		Node, Id string
+		Exists   bool
+	}{
+		{"/", "foo.valid", true},
+		{"/foo", "foo.valid", true},
+		{"/foo", "foo.expired", false},
+		{"/removed", "foo.valid", false},
+	} {
+		_, err := os.Stat(filepath.Join(cacheRoot, entry.Node, ".data", entry.Id))
+		if exists := err == nil; exists != entry.Exists {
+			t.Errorf("Cache %v of %v should exist: %v, exists: %v", entry.Id,
+				entry.Node, entry.Exists, exists)
+		}
+	}
+}
+
+func TestSchedulePublish(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{},
+		"TestSchedulePublish")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	settings := new(settings)
+	settings.Monsti.Directories.Data = root
+	logger := log.New(ioutil.Discard, "", 0)
+	m := &MonstiService{Settings: settings, Logger: logger}
+	m.Scheduler, err = newScheduler(filepath.Join(root, "jobs.json"),
+		func(job *service.Job) error { return coreJobs[job.Type](m, job) }, logger)
+	if err != nil {
+		t.Fatalf("Could not create scheduler: %v", err)
+	}
+	cacheRoot := settings.Monsti.GetSiteCachePath("site")
+	if err := toCache(cacheRoot, "/", "foo.nav", []byte("test"),
+		&service.CacheMods{Deps: []service.CacheDep{
+			{Node: "/", Descend: -1}}}); err != nil {
+		t.Fatalf("Could not cache data: %v", err)
+	}
+	publish := time.Now().Add(time.Hour).Round(time.Second)
+	write := func(publishTime time.Time) {
+		content, _ := json.Marshal(map[string]interface{}{
+			"Type": "core.Document", "PublishTime": publishTime})
+		err := m.WriteNodeData(&WriteNodeDataArgs{Site: "site", Path: "/foo",
+			File: "node.json", Content: content}, new(int))
+		if err != nil {
+			t.Fatalf("Could not write node: %v", err)
+		}
+	}
+	write(publish)
+	jobs := m.Scheduler.Jobs()
+	if len(jobs) != 1 || jobs[0].Type != "monsti.MarkDep" ||
+		!jobs[0].Next.Equal(publish) || string(jobs[0].Data) != "/foo" {
+		t.Fatalf("Publishing should have been scheduled, got %v", jobs)
+	}
+	m.Scheduler.runDue(publish)
+	m.Scheduler.active.Wait()
+	if ret, _, _ := fromCache(cacheRoot, "/", "foo.nav"); ret != nil {
+		t.Errorf("Cache should have been invalidated on publishing")
+	}
+
+	write(publish)
+	write(time.Now().Add(-time.Hour))
+	if jobs := m.Scheduler.Jobs(); len(jobs) != 0 {
+		t.Errorf("Published nodes should not be scheduled, got %v", jobs)
+	}
+}
+
+func TestCleanUploads(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.json":        `{"Type":"core.File"}`,
+		"/foo/.upload-1":        "old",
+		"/foo/bar/.upload-2":    "new",
+		"/foo/__file_core.File": "data"},
+		"TestCleanUploads")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	old := time.Now().Add(-2 * staleUploadAge)
+	err = os.Chtimes(filepath.Join(root, "foo/.upload-1"), old, old)
+	if err != nil {
+		t.Fatalf("Could not set modification time: %v", err)
+	}
+	removed, err := cleanUploads(root, staleUploadAge)
+	if err != nil || removed != 1 {
+		t.Errorf("cleanUploads returned %v, %v, should remove one file",
+			removed, err)
+	}
+	for file, exists := range map[string]bool{"foo/.upload-1": false,
+		"foo/bar/.upload-2": true, "foo/__file_core.File": true} {
+		if _, err := os.Stat(filepath.Join(root, file)); (err == nil) != exists {
+			t.Errorf("%v should exist: %v, got %v", file, exists, err)
+		}
+	}
+}
+
+func TestNodeDataStreaming(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/site/nodes/foo/node.json": `{"Type":"core.File"}`},
+		"TestNodeDataStreaming")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	settings := new(settings)
+	settings.Monsti.Directories.Data = root
+	server := rpc.NewServer()
+	if err := server.RegisterName("Monsti", &MonstiService{
+		Settings: settings, Logger: log.New(ioutil.Discard, "", 0)}); err != nil {
+		t.Fatalf("Could not register service: %v", err)
+	}
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	client := new(service.MonstiClient)
+	client.RPCClient = rpc.NewClient(clientConn)
+	defer client.RPCClient.Close()
+
+	content := bytes.Repeat([]byte("0123456789"), 60000)
+	err = client.WriteNodeDataFrom("site", "/foo", "data.bin",
+		bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("Could not write node data: %v", err)
+	}
+	reader, err := client.OpenNodeData("site", "/foo", "data.bin")
+	if err != nil || reader == nil {
+		t.Fatalf("Could not open node data: %v", err)
+	}
+	if reader.Size != int64(len(content)) {
+		t.Errorf("Size should be %v, got %v", len(content), reader.Size)
+	}
+	if _, err := reader.Seek(5, os.SEEK_SET); err != nil {
+		t.Fatalf("Could not seek: %v", err)
+	}
+	ret, err := ioutil.ReadAll(reader)
+	if err != nil || !bytes.Equal(ret, content[5:]) {
+		t.Errorf("Read wrong data (%v bytes): %v", len(ret), err)
+	}
+	// Small reads are served from the buffered chunk.
+	if _, err := reader.Seek(0, os.SEEK_SET); err != nil {
+		t.Fatalf("Could not seek: %v", err)
+	}
+	var small bytes.Buffer
+	buf := make([]byte, 1000)
+	for {
+		n, err := reader.Read(buf)
+		small.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Could not read: %v", err)
+		}
+	}
+	if !bytes.Equal(small.Bytes(), content) {
+		t.Errorf("Small reads returned wrong data (%v bytes)", small.Len())
+	}
+	files, _ := filepath.Glob(filepath.Join(root, "site/nodes/foo/.upload-*"))
+	if len(files) > 0 {
+		t.Errorf("Temporary files should be removed, got %v", files)
+	}
+	reader, err = client.OpenNodeData("site", "/foo", "missing")
+	if err != nil || reader != nil {
+		t.Errorf("OpenNodeData of missing data should return nil, nil,"+
+			" got %v, %v", reader, err)
+	}
+}
+
+func TestWriteNodeDataChunk(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/site/nodes/foo/node.json": `{"Type":"test.Upload"}`},
+		"TestWriteNodeDataChunk")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	settings := new(settings)
+	settings.Monsti.Directories.Data = root
+	settings.Config.NodeTypes = map[string]*service.NodeType{
+		"test.Upload": {Id: "test.Upload", Fields: []*service.NodeField{
+			{Id: "test.Image", Type: "File", MimeTypes: []string{"image/*"},
+				MaxSize: 20}}}}
+	logger := log.New(ioutil.Discard, "", 0)
+	m := &MonstiService{Settings: settings, Logger: logger}
+	m.Scheduler, err = newScheduler(filepath.Join(root, "jobs.json"),
+		func(job *service.Job) error { return nil }, logger)
+	if err != nil {
+		t.Fatalf("Could not create scheduler: %v", err)
+	}
+	png := []byte("\x89PNG\x0D\x0A\x1A\x0A")
+	tmpPath := filepath.Join(root, "site/nodes/foo/.upload-1")
+	write := func(file string, content []byte, done bool) error {
+		return m.WriteNodeDataChunk(&WriteNodeDataChunkArgs{Site: "site",
+			Path: "/foo", File: file, Upload: "1", Content: content,
+			Done: done}, new(int))
+	}
+	checkRemoved := func(test string) {
+		if _, err := os.Stat(tmpPath); !os.IsNotExist(err) {
+			t.Errorf("Upload should have been removed (%v), got %v", test, err)
+		}
+	}
+
+	if err := write("__file_test.Image", []byte("text"), false); err == nil {
+		t.Errorf("Uploading text to an image field should fail")
+	}
+	checkRemoved("invalid type")
+	if err := write("__file_test.Image", png, false); err != nil {
+		t.Fatalf("Could not write first chunk: %v", err)
+	}
+	if err := write("__file_test.Image", png, false); err != nil {
+		t.Fatalf("Could not write second chunk: %v", err)
+	}
+	if err := write("__file_test.Image", png, false); err == nil {
+		t.Errorf("Uploading more than MaxSize bytes should fail")
+	}
+	checkRemoved("too large")
+
+	publish := time.Now().Add(time.Hour).Round(time.Second)
+	content, _ := json.Marshal(map[string]interface{}{
+		"Type": "test.Upload", "PublishTime": publish})
+	if err := write("node.json", content, true); err != nil {
+		t.Fatalf("Could not write node: %v", err)
+	}
+	if jobs := m.Scheduler.Jobs(); len(jobs) != 1 || !jobs[0].Next.Equal(publish) {
+		t.Errorf("Publishing should have been scheduled, got %v", jobs)
+	}
+}
@@ -17,15 +17,20 @@
 package main
 
 import (
+	"bufio"
+	"crypto/rand"
 	"encoding/base32"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"crypto/sha256"
 	"code.google.com/p/go.crypto/bcrypt"
@@ -45,26 +50,61 @@ type loginFormData struct {
 // Login handles login requests.
 func (h *nodeHandler) Login(c *reqContext) error {
 	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	if name := c.Req.FormValue("auth"); len(name) > 0 {
+		return h.redirectLogin(c, name)
+	}
 	data := loginFormData{}
 
 	form := htmlwidgets.NewForm(&data)
 	form.AddWidget(new(htmlwidgets.TextWidget), "Login", G("Login"), "")
 	form.AddWidget(new(htmlwidgets.PasswordWidget), "Password", G("Password"), "")
 
+	type provider struct{ Name, Title string }
+	var providers []provider
+	passwordLogin, userDatabaseLogin := false, false
+	for _, auth := range c.Auths {
+		switch auth.(type) {
+		case passwordAuthenticator:
+			passwordLogin = true
+			if _, ok := auth.(*userDatabase); ok {
+				userDatabaseLogin = true
+			}
+		case redirectAuthenticator:
+			settings := auth.Settings()
+			title := settings.Title
+			if len(title) == 0 {
+				title = settings.Name
+			}
+			providers = append(providers, provider{settings.Name, title})
+		}
+	}
+
 	switch c.Req.Method {
 	case "GET":
 	case "POST":
-		if form.Fill(c.Req.Form) {
-			user, err := getUser(data.Login,
-				h.Settings.Monsti.GetSiteDataPath(c.Site.Name))
-			if err != nil {
-				return fmt.Errorf("Could not get user: %v", err)
-			}
-			if user != nil && passwordEqual(user.Password, data.Password) {
-				c.Session.Values["login"] = user.Login
-				c.Session.Save(c.Req, c.Res)
-				http.Redirect(c.Res, c.Req, c.Node.Path+"/", http.StatusSeeOther)
-				return nil
+		if passwordLogin && form.Fill(c.Req.Form) {
+			for _, auth := range c.Auths {
+				pwAuth, ok := auth.(passwordAuthenticator)
+				if !ok {
+					continue
+				}
+				user, err := pwAuth.Authenticate(data.Login, data.Password)
+				if err != nil {
+					h.Log.Printf("Could not authenticate with %q: %v",
+						auth.Settings().Name, err)
+					continue
+				}
+				if user != nil {
+					err := writeAudit(c, service.AuditLogin, user.Login,
+						auth.Settings().Name)
+					if err != nil {
+						return err
+					}
+					setSessionUser(c.Session, auth.Settings().Name, user)
+					c.Session.Save(c.Req, c.Res)
+					http.Redirect(c.Res, c.Req, c.Node.Path+"/", http.StatusSeeOther)
+					return nil
+				}
 			}
 			form.AddError("", G("Wrong login or password."))
 		}
@@ -73,7 +113,10 @@ func (h *nodeHandler) Login(c *reqContext) error {
 	}
 	data.Password = ""
 	body, err := h.Renderer.Render("actions/loginform", template.Context{
-		"Form": form.RenderData()}, c.UserSession.Locale,
+		"Form":              form.RenderData(),
+		"PasswordLogin":     passwordLogin,
+		"UserDatabaseLogin": userDatabaseLogin,
+		"Providers":         providers}, c.UserSession.Locale,
 		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
 	if err != nil {
 		return fmt.Errorf("Can't render login form: %v", err)
@@ -87,9 +130,66 @@ func (h *nodeHandler) Login(c *reqContext) error {
 	return nil
 }
 
+// redirectLogin handles logins using the redirect authenticator with
+// the given name.
+//
+// The user is redirected to the provider's login page. The provider
+// redirects back to this action passing the state stored in the
+// session and an authorization code.
+func (h *nodeHandler) redirectLogin(c *reqContext, name string) error {
+	auth, ok := findAuthenticator(c.Auths, name).(redirectAuthenticator)
+	if !ok {
+		http.Error(c.Res, "Document not found", http.StatusNotFound)
+		return nil
+	}
+	redirectURL := c.Site.BaseURL + c.Node.Path + "/@@login?auth=" +
+		url.QueryEscape(name)
+	state := c.Req.FormValue("state")
+	if len(state) == 0 {
+		raw := make([]byte, 16)
+		if _, err := rand.Read(raw); err != nil {
+			return fmt.Errorf("Could not generate state: %v", err)
+		}
+		state = base32.StdEncoding.EncodeToString(raw)
+		c.Session.Values["auth_state"] = state
+		c.Session.Save(c.Req, c.Res)
+		http.Redirect(c.Res, c.Req, auth.AuthCodeURL(state, redirectURL),
+			http.StatusSeeOther)
+		return nil
+	}
+	expected, _ := c.Session.Values["auth_state"].(string)
+	delete(c.Session.Values, "auth_state")
+	code := c.Req.FormValue("code")
+	if len(expected) == 0 || state != expected || len(code) == 0 {
+		c.Session.Save(c.Req, c.Res)
+		http.Error(c.Res, "Unauthorized.", http.StatusUnauthorized)
+		return nil
+	}
+	user, err := auth.Exchange(code, redirectURL)
+	if err != nil {
+		return fmt.Errorf("Could not authenticate with %q: %v", name, err)
+	}
+	if user == nil {
+		c.Session.Save(c.Req, c.Res)
+		http.Error(c.Res, "Unauthorized.", http.StatusUnauthorized)
+		return nil
+	}
+	if err := writeAudit(c, service.AuditLogin, user.Login, name); err != nil {
+		return err
+	}
+	setSessionUser(c.Session, name, user)
+	c.Session.Save(c.Req, c.Res)
+	http.Redirect(c.Res, c.Req, c.Node.Path+"/", http.StatusSeeOther)
+	return nil
+}
+
 // Logout handles logout requests.
 func (h *nodeHandler) Logout(c *reqContext) error {
-	delete(c.Session.Values, "login")
+	err := writeAudit(c, service.AuditLogout, c.UserSession.User.Login, "")
+	if err != nil {
+		return err
+	}
+	clearSessionUser(c.Session)
 	c.Session.Save(c.Req, c.Res)
 	http.Redirect(c.Res, c.Req, c.Node.Path, http.StatusSeeOther)
 	return nil
@@ -103,6 +203,11 @@ type requestPasswordTokenFormData struct {
 // the login password.
 func (h *nodeHandler) RequestPasswordToken(c *reqContext) error {
 	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	db := findUserDatabase(c.Auths)
+	if db == nil {
+		http.Error(c.Res, "Document not found", http.StatusNotFound)
+		return nil
+	}
 	data := requestPasswordTokenFormData{}
 	form := htmlwidgets.NewForm(&data)
 	form.AddWidget(new(htmlwidgets.TextWidget), "User", G("Login"), "")
@@ -115,15 +220,14 @@ func (h *nodeHandler) RequestPasswordToken(c *reqContext) error {
 		}
 	case "POST":
 		if form.Fill(c.Req.Form) {
-			user, err := getUser(data.User,
-				h.Settings.Monsti.GetSiteDataPath(c.Site.Name))
+			user, err := db.GetUser(data.User)
 			if err != nil {
 				return fmt.Errorf("Could not get user: %v", err)
 			}
 			if user != nil {
-				site := h.Settings.Monsti.Sites[c.Site.Name]
+				site, _ := h.Settings.Site(c.Site.Name)
 				link := getRequestPasswordToken(c.Site.Name, data.User,
-					site.PasswordTokenKey)
+					user.Password, site.PasswordTokenKey)
 
 				// Send email to user
 				mail := gomail.NewMessage()
@@ -135,12 +239,14 @@ func (h *nodeHandler) RequestPasswordToken(c *reqContext) error {
 someone, possibly you, requested a new password for your account %v at
 "%v".
 
-To change your password, visit the following link within 24 hours.
-If you did not request a new password, you may ignore this email.
+To change your password, visit the following link within %v hours.
+The link can only be used once. If you did not request a new
+password, you may ignore this email.
 %v
 
 This is an automatically generated email. Please don't reply to it.
-`, data.User, site.Title, site.BaseURL+"/@@change-password?token="+link))
+`, data.User, site.Title, site.PasswordTokenMaxAge,
+					site.BaseURL+"/@@change-password?token="+link))
 				mailer := gomail.NewCustomMailer("", nil, gomail.SetSendMail(
 					c.Serv.Monsti().SendMailFunc()))
 				err := mailer.Send(mail)
@@ -186,6 +292,12 @@ type changePasswordFormData struct {
 func (h *nodeHandler) ChangePassword(c *reqContext) error {
 	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
 	authenticated := c.UserSession.User != nil
+	db := findUserDatabase(c.Auths)
+	external := db == nil
+	if authenticated {
+		_, ok := sessionAuthenticator(c.Session, c.Auths).(*userDatabase)
+		external = !ok
+	}
 	data := changePasswordFormData{}
 	form := htmlwidgets.NewForm(&data)
 	if authenticated {
@@ -199,7 +311,7 @@ func (h *nodeHandler) ChangePassword(c *reqContext) error {
 	var token string
 	tokenInvalid := false
 	var user *service.User
-	if !authenticated {
+	if !authenticated && !external {
 		if tokens, ok := c.Req.Form["token"]; ok {
 			token = tokens[0]
 		}
@@ -207,12 +319,10 @@ func (h *nodeHandler) ChangePassword(c *reqContext) error {
 			http.Redirect(c.Res, c.Req, "@@login", http.StatusSeeOther)
 			return nil
 		}
-		getUserFn := func(login string) (*service.User, error) {
-			return getUser(login, h.Settings.Monsti.GetSiteDataPath(c.Site.Name))
-		}
 		var err error
+		maxAge := time.Duration(c.Site.PasswordTokenMaxAge) * time.Hour
 		user, err = verifyRequestPasswordToken(
-			c.Site.Name, getUserFn, c.Site.PasswordTokenKey, token)
+			c.Site.Name, db.GetUser, c.Site.PasswordTokenKey, token, maxAge)
 		if err != nil {
 			return fmt.Errorf("Could not verify request password token: %v", err)
 		}
@@ -229,7 +339,7 @@ func (h *nodeHandler) ChangePassword(c *reqContext) error {
 			changed = true
 		}
 	case "POST":
-		if authenticated || !tokenInvalid {
+		if !external && (authenticated || !tokenInvalid) {
 			if form.Fill(c.Req.Form) {
 				changePassword := true
 				if authenticated {
@@ -239,6 +349,17 @@ func (h *nodeHandler) ChangePassword(c *reqContext) error {
 						form.AddError("Password", G("Wrong password."))
 					}
 				}
+				if changePassword {
+					msg, err := checkPasswordPolicy(data.Password,
+						c.Site.PasswordPolicy, G)
+					if err != nil {
+						return fmt.Errorf("Could not check password policy: %v", err)
+					}
+					if len(msg) > 0 {
+						form.AddError("Password", msg)
+						changePassword = false
+					}
+				}
 				if changePassword {
 					hashed, err := bcrypt.GenerateFromPassword([]byte(data.Password), 0)
 					if err != nil {
@@ -246,10 +367,19 @@ func (h *nodeHandler) ChangePassword(c *reqContext) error {
 					}
 					user.PasswordChanged = time.Now().UTC()
 					user.Password = string(hashed)
-					err = writeUser(user, h.Settings.Monsti.GetSiteDataPath(c.Site.Name))
+					err = writeUser(user, db.dataDir)
 					if err != nil {
 						return fmt.Errorf("Could not change user password: %v", err)
 					}
+					var details string
+					if !authenticated {
+						details = "token"
+					}
+					err = writeAudit(c, service.AuditChangePassword, user.Login,
+						details)
+					if err != nil {
+						return err
+					}
 					http.Redirect(c.Res, c.Req, "@@change-password?changed",
 						http.StatusSeeOther)
 					return nil
@@ -262,6 +392,7 @@ func (h *nodeHandler) ChangePassword(c *reqContext) error {
 
 	body, err := h.Renderer.Render("actions/change_password",
 		template.Context{
+			"External":     external,
 			"TokenInvalid": tokenInvalid,
 			"Changed":      changed,
 			"Form":         form.RenderData()}, c.UserSession.Locale,
@@ -280,6 +411,85 @@ func (h *nodeHandler) ChangePassword(c *reqContext) error {
 	return nil
 }
 
+type profileFormData struct {
+	Name, Email, Locale string
+}
+
+// Profile allows users to change their name, email address, and
+// preferred language.
+func (h *nodeHandler) Profile(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	_, ok := sessionAuthenticator(c.Session, c.Auths).(*userDatabase)
+	external := !ok
+	user := c.UserSession.User
+	data := profileFormData{user.Name, user.Email, user.Locale}
+	form := htmlwidgets.NewForm(&data)
+	form.AddWidget(&htmlwidgets.TextWidget{
+		MinLength: 1, ValidationError: G("Required.")}, "Name", G("Name"), "")
+	form.AddWidget(&htmlwidgets.TextWidget{
+		Regexp:          `^[^@\s]+@[^@\s]+$`,
+		ValidationError: G("Please enter a valid email address.")},
+		"Email", G("Email"), "")
+	localeOptions := []htmlwidgets.SelectOption{
+		{Value: "", Text: G("Site default")}}
+	for _, locale := range availableLocales {
+		localeOptions = append(localeOptions,
+			htmlwidgets.SelectOption{Value: locale, Text: locale})
+	}
+	form.AddWidget(&htmlwidgets.SelectWidget{Options: localeOptions},
+		"Locale", G("Language"), G("Language of the web interface."))
+
+	changed := false
+	switch c.Req.Method {
+	case "GET":
+		if _, ok := c.Req.Form["changed"]; ok {
+			changed = true
+		}
+	case "POST":
+		if !external && form.Fill(c.Req.Form) {
+			if len(data.Locale) > 0 && !inStringSlice(data.Locale,
+				availableLocales) {
+				form.AddError("Locale", G("Unknown language."))
+				break
+			}
+			user.Name = data.Name
+			user.Email = data.Email
+			user.Locale = data.Locale
+			err := writeUser(user, findUserDatabase(c.Auths).dataDir)
+			if err != nil {
+				return fmt.Errorf("Could not write user: %v", err)
+			}
+			if err := writeAudit(c, service.AuditWriteUser, user.Login,
+				"profile"); err != nil {
+				return err
+			}
+			http.Redirect(c.Res, c.Req, "@@profile?changed", http.StatusSeeOther)
+			return nil
+		}
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+
+	body, err := h.Renderer.Render("actions/profile",
+		template.Context{
+			"External": external,
+			"Changed":  changed,
+			"Form":     form.RenderData()}, c.UserSession.Locale,
+		h.Settings.Monsti.GetSiteTemplatesPath(c.Site.Name))
+	if err != nil {
+		return fmt.Errorf("Can't render profile form: %v", err)
+	}
+	env := masterTmplEnv{
+		Node:    c.Node,
+		Session: c.UserSession,
+		Title:   G("Profile"),
+		Flags:   EDIT_VIEW}
+	rendered, _ := renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+		*c.Site, c.UserSession.Locale, c.Serv)
+	c.Res.Write(rendered)
+	return nil
+}
+
 // getSession returns a currently active or new session.
 func getSession(r *http.Request, site util.SiteSettings) (
 	*sessions.Session, error) {
@@ -291,28 +501,73 @@ func getSession(r *http.Request, site util.SiteSettings) (
 	return session, nil
 }
 
+// sessionAuthenticator returns the authenticator which authenticated
+// the user of the given session or nil.
+//
+// Sessions created before authenticators were configurable belong to
+// the "users" authenticator.
+func sessionAuthenticator(session *sessions.Session,
+	auths []authenticator) authenticator {
+	name, ok := session.Values["auth"].(string)
+	if !ok {
+		name = "users"
+	}
+	return findAuthenticator(auths, name)
+}
+
+// setSessionUser stores the user authenticated by the authenticator
+// with the given name in the session.
+func setSessionUser(session *sessions.Session, auth string,
+	user *service.User) {
+	session.Values["login"] = user.Login
+	session.Values["auth"] = auth
+	session.Values["name"] = user.Name
+	session.Values["email"] = user.Email
+}
+
+// clearSessionUser removes the user from the session.
+func clearSessionUser(session *sessions.Session) {
+	for _, key := range []string{"login", "auth", "name", "email"} {
+		delete(session.Values, key)
+	}
+}
+
 // getClientSession returns the client session for the given session.
 //
-// configDir is the site's configuration directory.
+// auths are the site's authenticators. Users of the site's user
+// database are read on every request. External users (LDAP or OpenID
+// Connect) are restored from the session to avoid asking the external
+// source on every request. They only get checked against the allowed
+// logins.
 func getClientSession(session *sessions.Session,
-	dataDir string) (uSession *service.UserSession, err error) {
+	auths []authenticator) (uSession *service.UserSession, err error) {
 	uSession = new(service.UserSession)
 	loginData, ok := session.Values["login"]
 	if !ok {
 		return
 	}
 	login_, ok := loginData.(string)
-	if !ok {
-		delete(session.Values, "login")
+	auth := sessionAuthenticator(session, auths)
+	if !ok || auth == nil {
+		clearSessionUser(session)
 		return
 	}
-	user, err := getUser(login_, dataDir)
-	if err != nil {
-		err = fmt.Errorf("Could not get user: %v", err)
-		return
+	var user *service.User
+	if _, ok := auth.(*userDatabase); ok {
+		user, err = auth.GetUser(login_)
+		if err != nil {
+			err = fmt.Errorf("Could not get user: %v", err)
+			return
+		}
+	} else if allowedLogin(auth.Settings(), login_) {
+		user = &service.User{Login: login_, Name: login_}
+		if name, _ := session.Values["name"].(string); len(name) > 0 {
+			user.Name = name
+		}
+		user.Email, _ = session.Values["email"].(string)
 	}
 	if user == nil {
-		delete(session.Values, "login")
+		clearSessionUser(session)
 		return
 	}
 	*uSession = service.UserSession{User: user}
@@ -381,7 +636,8 @@ func checkPermission(action service.Action, session *service.UserSession) bool {
 	auth := session.User != nil
 	switch action {
 	case service.RemoveAction, service.EditAction, service.AddAction,
-		service.LogoutAction:
+		service.LogoutAction, service.AuditAction, service.ProfileAction,
+		service.MediaAction, service.CacheAction:
 		if auth {
 			return true
 		}
@@ -405,22 +661,57 @@ func generateToken(args ...string) string {
 	return base32.StdEncoding.EncodeToString(hash[:])
 }
 
-// genPasswordToken generates a password token
-func getRequestPasswordToken(site, login, secret string) string {
+// checkPasswordPolicy checks if the password complies with the given
+// policy.
+//
+// Returns a message describing the violation, translated with G, or
+// an empty string if the password is acceptable.
+func checkPasswordPolicy(password string, policy util.PasswordPolicy,
+	G func(string) string) (string, error) {
+	if utf8.RuneCountInString(password) < policy.MinLength {
+		return fmt.Sprintf(G("The password must have at least %v characters."),
+			policy.MinLength), nil
+	}
+	if len(policy.BreachedList) == 0 {
+		return "", nil
+	}
+	file, err := os.Open(policy.BreachedList)
+	if err != nil {
+		return "", fmt.Errorf("Could not open breached password list: %v", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == password {
+			return G("This password is known from data breaches. Please choose another one."), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("Could not read breached password list: %v", err)
+	}
+	return "", nil
+}
+
+// getRequestPasswordToken generates a password token.
+//
+// password is the user's current password hash. Changing the password
+// invalidates the token, so it may only be used once.
+func getRequestPasswordToken(site, login, password, secret string) string {
 	if len(secret) == 0 {
 		panic("Secret passed to getRequestPasswordToken must not be empty")
 	}
 	generated := time.Now().Unix()
 	return fmt.Sprintf("%v-%v-%v", login, generated, generateToken(
-		site, login, fmt.Sprint(generated), secret))
+		site, login, fmt.Sprint(generated), password, secret))
 }
 
 // verifyRequestPasswordToken verifies the password token for the
 // given site and returns the user who requested the password
-// change. If the token is invalid, returns nil.
+// change. If the token is invalid, older than maxAge, or has already
+// been used, returns nil.
 func verifyRequestPasswordToken(site string,
 	getUserFn func(login string) (*service.User, error),
-	secret string, token string) (*service.User, error) {
+	secret string, token string, maxAge time.Duration) (*service.User, error) {
 	if len(secret) == 0 {
 		panic("Secret passed to verifyRequestPasswordToken must not be empty")
 	}
@@ -434,13 +725,18 @@ func verifyRequestPasswordToken(site string,
 	if err != nil {
 		return nil, fmt.Errorf("Could not get user: %v", err)
 	}
+	if user == nil {
+		return nil, nil
+	}
 	timeSubstring := parts[userPartsCount]
-	generated, err := strconv.Atoi(timeSubstring)
-	if err != nil || int64(generated) < user.PasswordChanged.Unix() {
+	generated, err := strconv.ParseInt(timeSubstring, 10, 64)
+	if err != nil || generated < user.PasswordChanged.Unix() ||
+		time.Since(time.Unix(generated, 0)) > maxAge {
 		return nil, nil
 	}
 	hashSubstring := parts[userPartsCount+1]
-	calculated := generateToken(site, user.Login, timeSubstring, secret)
+	calculated := generateToken(site, user.Login, timeSubstring, user.Password,
+		secret)
 	if calculated == hashSubstring {
 		return user, nil
 	}
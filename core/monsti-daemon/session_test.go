@@ -24,7 +24,9 @@ import (
 	"time"
 
 	"code.google.com/p/go.crypto/bcrypt"
+	"github.com/gorilla/sessions"
 	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
 	utesting "pkg.monsti.org/monsti/api/util/testing"
 )
 
@@ -63,7 +65,8 @@ func TestGetUser(t *testing.T) {
 	}
 	db := []byte(`{
 "foo":{"name":"Mr. Foo","password":"the pass","email":"foo@example.com"},
-"bar":{"name":"Mrs. Bar","email":"bar@example.com","password":"other pass"}}
+"bar":{"name":"Mrs. Bar","email":"bar@example.com","password":"other pass",
+"locale":"de"}}
 `)
 	if err = ioutil.WriteFile(filepath.Join(root, "users.json"),
 		db, 0600); err != nil {
@@ -77,7 +80,7 @@ func TestGetUser(t *testing.T) {
 		{Login: "foo", User: &service.User{Login: "foo", Password: "the pass",
 			Name: "Mr. Foo", Email: "foo@example.com"}},
 		{Login: "bar", User: &service.User{Login: "bar", Password: "other pass",
-			Name: "Mrs. Bar", Email: "bar@example.com"}}}
+			Name: "Mrs. Bar", Email: "bar@example.com", Locale: "de"}}}
 	for _, v := range tests {
 		user, err := getUser(v.Login, root)
 		if !reflect.DeepEqual(user, v.User) || err != nil {
@@ -109,6 +112,34 @@ func WriteUser(t *testing.T) {
 	}
 }
 
+func TestGetClientSession(t *testing.T) {
+	settings := util.AuthenticatorSettings{Name: "directory", Type: "ldap",
+		Logins: []string{"alice"}}
+	// External users must not be looked up on each request.
+	settings.LDAP.Address = "127.0.0.1:1"
+	settings.LDAP.BindDN = "cn=monsti"
+	auths := []authenticator{newLDAPAuthenticator(settings)}
+	session := sessions.NewSession(nil, "monsti-session")
+	setSessionUser(session, "directory", &service.User{Login: "alice",
+		Name: "Alice", Email: "alice@example.com"})
+	uSession, err := getClientSession(session, auths)
+	expected := &service.User{Login: "alice", Name: "Alice",
+		Email: "alice@example.com"}
+	if err != nil || !reflect.DeepEqual(uSession.User, expected) {
+		t.Errorf("getClientSession returned %v, %v, should be %v",
+			uSession.User, err, expected)
+	}
+	setSessionUser(session, "directory", &service.User{Login: "bob"})
+	uSession, err = getClientSession(session, auths)
+	if err != nil || uSession.User != nil {
+		t.Errorf("getClientSession should deny bob, got %v, %v",
+			uSession.User, err)
+	}
+	if _, ok := session.Values["login"]; ok {
+		t.Errorf("Denied user should be removed from session")
+	}
+}
+
 func TestPasswordEqual(t *testing.T) {
 	if !passwordEqual(
 		"$2a$10$1x90nccptYh/OtXQiFaom.xCisdPD7qCMoEcJa41XEnewk3NdMfGq",
@@ -142,7 +173,7 @@ func TestRequestPasswordToken(t *testing.T) {
 				t.Errorf("getRequestPasswordToken should panic if empty secret is passed")
 			}
 		}()
-		getRequestPasswordToken("foo", "bar", "")
+		getRequestPasswordToken("foo", "bar", "hash", "")
 	}()
 
 	past := time.Now().Add(-time.Hour * 10000)
@@ -150,24 +181,78 @@ func TestRequestPasswordToken(t *testing.T) {
 	tests := []struct {
 		Site, Login, Secret string
 		Changed             time.Time
-		Valid               bool
+		// NewPassword is the password hash at verification time.
+		NewPassword string
+		MaxAge      time.Duration
+		Valid       bool
 	}{
-		{"foo", "bar", "baz", past, true},
-		{"foo", "bar", "baz", future, false},
-		{"bar", "baz", "foo", past, true},
-		{"bar", "baz", "foo", future, false},
+		{"foo", "bar", "baz", past, "hash", time.Hour, true},
+		{"foo", "bar", "baz", future, "hash", time.Hour, false},
+		{"bar", "baz", "foo", past, "hash", time.Hour, true},
+		{"bar", "baz", "foo", future, "hash", time.Hour, false},
+		{"foo", "bar", "baz", past, "changed", time.Hour, false},
+		{"foo", "bar", "baz", past, "hash", -time.Hour, false},
 	}
 
 	for i, test := range tests {
-		token := getRequestPasswordToken(test.Site, test.Login, test.Secret)
+		token := getRequestPasswordToken(test.Site, test.Login, "hash",
+			test.Secret)
 		getUserFn := func(login string) (*service.User, error) {
 			return &service.User{
 				Login:           test.Login,
+				Password:        test.NewPassword,
 				PasswordChanged: test.Changed}, nil
 		}
-		user, err := verifyRequestPasswordToken(test.Site, getUserFn, test.Secret, token)
-		if err != nil || (test.Valid && user == nil) {
+		user, err := verifyRequestPasswordToken(test.Site, getUserFn,
+			test.Secret, token, test.MaxAge)
+		if err != nil || test.Valid != (user != nil) {
 			t.Errorf("RequestPasswordToken test[%v] failed", i)
 		}
 	}
+
+	getUserFn := func(login string) (*service.User, error) { return nil, nil }
+	token := getRequestPasswordToken("foo", "unknown", "hash", "baz")
+	user, err := verifyRequestPasswordToken("foo", getUserFn, "baz", token,
+		time.Hour)
+	if err != nil || user != nil {
+		t.Errorf("Token of unknown user should be invalid")
+	}
+}
+
+func TestCheckPasswordPolicy(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/breached.txt": "123456\npassword1\n  letmein99  \n"},
+		"TestCheckPasswordPolicy")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	G := func(in string) string { return in }
+	tests := []struct {
+		Password string
+		Policy   util.PasswordPolicy
+		Valid    bool
+	}{
+		{"", util.PasswordPolicy{}, true},
+		{"short", util.PasswordPolicy{MinLength: 8}, false},
+		{"äöüäöüäö", util.PasswordPolicy{MinLength: 8}, true},
+		{"long enough", util.PasswordPolicy{MinLength: 8}, true},
+		{"password1", util.PasswordPolicy{MinLength: 8,
+			BreachedList: filepath.Join(root, "breached.txt")}, false},
+		{"letmein99", util.PasswordPolicy{MinLength: 8,
+			BreachedList: filepath.Join(root, "breached.txt")}, false},
+		{"not breached", util.PasswordPolicy{MinLength: 8,
+			BreachedList: filepath.Join(root, "breached.txt")}, true},
+	}
+	for i, test := range tests {
+		msg, err := checkPasswordPolicy(test.Password, test.Policy, G)
+		if err != nil || test.Valid != (len(msg) == 0) {
+			t.Errorf("checkPasswordPolicy test[%v] returned %q, %v", i, msg, err)
+		}
+	}
+	_, err = checkPasswordPolicy("long enough", util.PasswordPolicy{
+		BreachedList: filepath.Join(root, "missing.txt")}, G)
+	if err == nil {
+		t.Errorf("checkPasswordPolicy should fail for missing breached list")
+	}
 }
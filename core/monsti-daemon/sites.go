@@ -0,0 +1,367 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+// Site returns the settings of the given site.
+func (s *settings) Site(name string) (util.SiteSettings, bool) {
+	s.sitesMutex.RLock()
+	defer s.sitesMutex.RUnlock()
+	site, ok := s.sites[name]
+	return site, ok
+}
+
+// SiteNames returns the sorted names of all sites.
+func (s *settings) SiteNames() []string {
+	s.sitesMutex.RLock()
+	defer s.sitesMutex.RUnlock()
+	var names []string
+	for name := range s.sites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setSites replaces the settings of all sites.
+func (s *settings) setSites(sites map[string]util.SiteSettings) {
+	s.sitesMutex.Lock()
+	defer s.sitesMutex.Unlock()
+	s.sites = sites
+}
+
+// siteOf returns the name of the site configured for the given host,
+// including aliases and wildcards.
+func (h *nodeHandler) siteOf(host string) (string, bool) {
+	h.sitesMutex.RLock()
+	defer h.sitesMutex.RUnlock()
+	route, ok := h.hosts.lookup(host)
+	return route.Site, ok
+}
+
+// setSites updates the hosts and the site-static file servers to serve
+// the given sites.
+//
+// Requests being served are not affected.
+func (h *nodeHandler) setSites(sites map[string]util.SiteSettings) error {
+	hosts, err := newHostMap(sites)
+	if err != nil {
+		return err
+	}
+	h.sitesMutex.Lock()
+	defer h.sitesMutex.Unlock()
+	statics := make(map[string]http.Handler)
+	for name := range sites {
+		// Keep the file servers of existing sites and their compressed
+		// files.
+		if handler, ok := h.statics[name]; ok {
+			statics[name] = handler
+			continue
+		}
+		statics[name] = newCompressedFileServer(http.Dir(
+			filepath.Dir(h.Settings.Monsti.GetSiteStaticsPath(name))))
+	}
+	h.hosts = hosts
+	h.statics = statics
+	return nil
+}
+
+// ServeSiteStatic serves the files below /site-static/ of the site
+// served at the request's host.
+func (h *nodeHandler) ServeSiteStatic(w http.ResponseWriter, r *http.Request) {
+	route, ok := h.route(r.Host)
+	h.sitesMutex.RLock()
+	handler := h.statics[route.Site]
+	h.sitesMutex.RUnlock()
+	if !ok || handler == nil {
+		http.NotFound(w, r)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// reloadSites reads the site settings and starts to serve the changed
+// sites.
+func (i *MonstiService) reloadSites() error {
+	i.sitesMutex.Lock()
+	defer i.sitesMutex.Unlock()
+	sites, err := i.Settings.Monsti.ReadSiteSettings()
+	if err != nil {
+		return fmt.Errorf("Could not read site settings: %v", err)
+	}
+	if i.Handler != nil {
+		if err := i.Handler.setSites(sites); err != nil {
+			return fmt.Errorf("Could not serve sites: %v", err)
+		}
+	} else if _, err := newHostMap(sites); err != nil {
+		return err
+	}
+	// Memory caches get recreated on demand with the new size.
+	i.memCachesMutex.Lock()
+	for name := range i.memCaches {
+		old, _ := i.Settings.Site(name)
+		if site, ok := sites[name]; !ok ||
+			site.MemoryCacheSize != old.MemoryCacheSize {
+			delete(i.memCaches, name)
+		}
+	}
+	i.memCachesMutex.Unlock()
+	i.Settings.setSites(sites)
+	i.Logger.Printf("Loaded settings of %v sites", len(sites))
+	return nil
+}
+
+// ReloadSites reads the site settings. New sites get served, removed
+// ones not anymore.
+func (i *MonstiService) ReloadSites(args int, reply *int) error {
+	return i.reloadSites()
+}
+
+// CreateSite creates a new site as a copy of a template site and
+// starts to serve it.
+func (i *MonstiService) CreateSite(args *service.NewSite, reply *int) error {
+	if _, ok := i.Settings.Site(args.Template); !ok {
+		return fmt.Errorf("Unknown template site %q", args.Template)
+	}
+	for _, host := range args.Hosts {
+		if i.Handler != nil {
+			if site, ok := i.Handler.siteOf(host); ok {
+				return fmt.Errorf("Host %q is used by site %q", host, site)
+			}
+		}
+	}
+	if err := createSite(i.Settings.Monsti, args); err != nil {
+		return err
+	}
+	if err := i.reloadSites(); err != nil {
+		os.RemoveAll(i.Settings.Monsti.GetSiteConfigPath(args.Name))
+		os.RemoveAll(i.Settings.Monsti.GetSiteDataPath(args.Name))
+		return fmt.Errorf("Could not load site %q: %v", args.Name, err)
+	}
+	return nil
+}
+
+// siteNamePattern matches valid site names.
+var siteNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+
+// createSite creates the configuration and data directories of a new
+// site as copies of the template's directories.
+//
+// The cache, the audit log, the user database, and unfinished uploads
+// of the template are not copied. The new site gets its own session
+// and password token keys and a user database containing only the
+// given initial user, if any. The template's aliases and canonical
+// host are removed.
+func createSite(monsti util.MonstiSettings, site *service.NewSite) error {
+	if !siteNamePattern.MatchString(site.Name) {
+		return fmt.Errorf("Invalid site name %q", site.Name)
+	}
+	if len(site.Hosts) == 0 {
+		return fmt.Errorf("No hosts given for site %q", site.Name)
+	}
+	configDir := monsti.GetSiteConfigPath(site.Name)
+	dataDir := monsti.GetSiteDataPath(site.Name)
+	for _, dir := range []string{configDir, dataDir} {
+		if _, err := os.Lstat(dir); err == nil {
+			return fmt.Errorf("Site %q already exists: %v", site.Name, dir)
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("Could not check site directory: %v", err)
+		}
+	}
+	values := [][2]string{
+		{"hosts", yamlList(site.Hosts)},
+		{"baseurl", strconv.Quote(site.BaseURL)},
+		{"aliases", "[]"},
+		{"canonicalhost", `""`},
+	}
+	if len(site.Title) > 0 {
+		values = append(values, [2]string{"title", strconv.Quote(site.Title)})
+	}
+	if len(site.BaseURL) == 0 {
+		values[1][1] = strconv.Quote("http://" + site.Hosts[0])
+	}
+	for _, key := range []string{"sessionauthkey", "passwordtokenkey"} {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return fmt.Errorf("Could not generate key: %v", err)
+		}
+		values = append(values, [2]string{key, hex.EncodeToString(raw)})
+	}
+	err := func() error {
+		templateConfig, err := filepath.EvalSymlinks(
+			monsti.GetSiteConfigPath(site.Template))
+		if err != nil {
+			return fmt.Errorf("Could not get template configuration: %v", err)
+		}
+		if err := copyTree(templateConfig, configDir, nil); err != nil {
+			return fmt.Errorf("Could not copy configuration: %v", err)
+		}
+		siteYAML := filepath.Join(configDir, "site.yaml")
+		content, err := ioutil.ReadFile(siteYAML)
+		if err != nil {
+			return fmt.Errorf("Could not read site settings: %v", err)
+		}
+		content = setYAMLValues(content, values)
+		if err := ioutil.WriteFile(siteYAML, content, 0600); err != nil {
+			return fmt.Errorf("Could not write site settings: %v", err)
+		}
+		templateData, err := filepath.EvalSymlinks(
+			monsti.GetSiteDataPath(site.Template))
+		if err != nil {
+			return fmt.Errorf("Could not get template data: %v", err)
+		}
+		err = copyTree(templateData, dataDir, func(rel string) bool {
+			return rel == "cache" || rel == "audit.log" || rel == "users.json" ||
+				strings.HasPrefix(path.Base(rel), ".upload-")
+		})
+		if err != nil {
+			return fmt.Errorf("Could not copy data: %v", err)
+		}
+		users := make(map[string]service.User)
+		if site.User != nil {
+			users[site.User.Login] = *site.User
+		}
+		return writeUserDatabase(users, dataDir)
+	}()
+	if err != nil {
+		os.RemoveAll(configDir)
+		os.RemoveAll(dataDir)
+		return fmt.Errorf("Could not create site %q: %v", site.Name, err)
+	}
+	return nil
+}
+
+// yamlList returns the given strings as YAML flow sequence.
+func yamlList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = strconv.Quote(value)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// yamlKeyPattern matches top level keys of YAML documents.
+var yamlKeyPattern = regexp.MustCompile(`^([A-Za-z0-9_-]+)\s*:`)
+
+// setYAMLValues replaces the values of the given top level keys in the
+// YAML document, keeping everything else including comments. Missing
+// keys are appended.
+func setYAMLValues(content []byte, values [][2]string) []byte {
+	set := make(map[string]bool)
+	var out bytes.Buffer
+	skipping := false
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		if skipping && (strings.HasPrefix(line, " ") ||
+			strings.HasPrefix(line, "\t") || strings.HasPrefix(line, "-")) {
+			continue
+		}
+		skipping = false
+		if match := yamlKeyPattern.FindStringSubmatch(line); match != nil {
+			for _, value := range values {
+				if strings.ToLower(match[1]) == value[0] && !set[value[0]] {
+					line = value[0] + ": " + value[1] + "\n"
+					set[value[0]] = true
+					skipping = true
+				}
+			}
+		}
+		out.WriteString(line)
+	}
+	if out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+		out.WriteString("\n")
+	}
+	for _, value := range values {
+		if !set[value[0]] {
+			out.WriteString(value[0] + ": " + value[1] + "\n")
+		}
+	}
+	return out.Bytes()
+}
+
+// copyTree copies the directory src to dst, which must not exist.
+//
+// Files and directories for which skip returns true, given their path
+// relative to src, are not copied. Symbolic links are copied as links.
+func copyTree(src, dst string, skip func(rel string) bool) error {
+	return filepath.Walk(src, func(file string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		if rel != "." && skip != nil && skip(filepath.ToSlash(rel)) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return os.Mkdir(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(file, target, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+// copyFile copies the regular file src to dst.
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,224 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestSetYAMLValues(t *testing.T) {
+	content := `# Example site
+title: "Example"
+hosts:
+  - example.com
+  - www.example.com
+baseurl: "http://example.com"
+owner:
+  name: Foo
+# Keys
+sessionauthkey: foo`
+	expected := `# Example site
+title: "Example"
+hosts: ["new.example.com"]
+baseurl: "http://new.example.com"
+owner:
+  name: Foo
+# Keys
+sessionauthkey: bar
+passwordtokenkey: baz
+`
+	ret := string(setYAMLValues([]byte(content), [][2]string{
+		{"hosts", yamlList([]string{"new.example.com"})},
+		{"baseurl", `"http://new.example.com"`},
+		{"sessionauthkey", "bar"},
+		{"passwordtokenkey", "baz"},
+	}))
+	if ret != expected {
+		t.Errorf("setYAMLValues returned\n%v\nshould be\n%v", ret, expected)
+	}
+}
+
+func TestCreateSite(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/config/sites/template/site.yaml": `title: "Template"
+hosts: ["template.example.com"]
+aliases: ["www.template.example.com"]
+canonicalhost: template.example.com
+sessionauthkey: secret
+`,
+		"/config/sites/template/core.json":      `{}`,
+		"/data/template/nodes/node.json":        `{"Type": "core.Document"}`,
+		"/data/template/users.json":             `{"admin": {"Password": "x"}}`,
+		"/data/template/nodes/.upload-1":        "",
+		"/data/template/audit.log":              "",
+		"/data/template/cache/.data/core.page":  "",
+		"/data/template/site-static/style.css":  "",
+		"/data/template/templates/master.html":  "",
+		"/data/template/nodes/foo/node.json":    `{"Type": "core.Document"}`,
+		"/data/template/nodes/foo/__file_image": "",
+	}, "TestCreateSite")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	var monsti util.MonstiSettings
+	monsti.Directories.Config = filepath.Join(root, "config")
+	monsti.Directories.Data = filepath.Join(root, "data")
+	site := &service.NewSite{Name: "new", Template: "template",
+		Hosts: []string{"new.example.com"}, Title: "New",
+		User: &service.User{Login: "alice", Password: "hash"}}
+	if err := createSite(monsti, site); err != nil {
+		t.Fatalf("Could not create site: %v", err)
+	}
+	sites, err := monsti.ReadSiteSettings()
+	if err != nil {
+		t.Fatalf("Could not read site settings: %v", err)
+	}
+	settings := sites["new"]
+	if settings.Title != "New" || len(settings.Hosts) != 1 ||
+		settings.Hosts[0] != "new.example.com" ||
+		settings.BaseURL != "http://new.example.com" ||
+		len(settings.Aliases) != 0 || len(settings.CanonicalHost) != 0 ||
+		len(settings.SessionAuthKey) != 64 ||
+		len(settings.PasswordTokenKey) != 64 {
+		t.Errorf("Wrong settings of new site: %+v", settings)
+	}
+	for _, file := range []string{"config/sites/new/core.json",
+		"data/new/nodes/node.json", "data/new/nodes/foo/__file_image",
+		"data/new/site-static/style.css",
+		"data/new/templates/master.html"} {
+		if _, err := os.Stat(filepath.Join(root, file)); err != nil {
+			t.Errorf("%v should have been copied: %v", file, err)
+		}
+	}
+	users, err := getUserDatabase(filepath.Join(root, "data/new"))
+	if err != nil || len(users) != 1 || users["alice"].Password != "hash" {
+		t.Errorf("Users of new site should only contain alice: %v, %v",
+			users, err)
+	}
+	for _, file := range []string{"data/new/cache", "data/new/audit.log",
+		"data/new/nodes/.upload-1"} {
+		if _, err := os.Stat(filepath.Join(root, file)); !os.IsNotExist(err) {
+			t.Errorf("%v should not have been copied", file)
+		}
+	}
+
+	if err := createSite(monsti, site); err == nil {
+		t.Errorf("createSite should fail for existing sites")
+	}
+	site.Name = "../evil"
+	if err := createSite(monsti, site); err == nil {
+		t.Errorf("createSite should fail for invalid names")
+	}
+	site.Name, site.Template = "other", "unknown"
+	if err := createSite(monsti, site); err == nil {
+		t.Errorf("createSite should fail for unknown templates")
+	}
+	if _, err := os.Stat(filepath.Join(root, "config/sites/other")); err == nil {
+		t.Errorf("Failed createSite should clean up")
+	}
+}
+
+func TestReloadSites(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/config/sites/foo/site.yaml":        `hosts: ["foo.example.com"]`,
+		"/data/foo/site-static/foo.txt":      "foo",
+		"/data/bar/site-static/bar.txt":      "bar",
+		"/config/sites/bar/site.yaml.unused": "",
+	}, "TestReloadSites")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	settings := new(settings)
+	settings.Monsti.Directories.Config = filepath.Join(root, "config")
+	settings.Monsti.Directories.Data = filepath.Join(root, "data")
+	handler := &nodeHandler{Settings: settings}
+	monsti := &MonstiService{Settings: settings, Handler: handler,
+		Logger: log.New(ioutil.Discard, "", 0)}
+	get := func(host, target string) (int, string) {
+		req, _ := http.NewRequest("GET", "http://"+host+target, nil)
+		res := httptest.NewRecorder()
+		handler.ServeSiteStatic(res, req)
+		return res.Code, res.Body.String()
+	}
+
+	if err := monsti.reloadSites(); err != nil {
+		t.Fatalf("Could not reload sites: %v", err)
+	}
+	if code, body := get("foo.example.com", "/site-static/foo.txt"); code != 200 ||
+		body != "foo" {
+		t.Errorf("Should serve foo.txt, got %v %q", code, body)
+	}
+	if code, _ := get("bar.example.com", "/site-static/bar.txt"); code != 404 {
+		t.Errorf("Should not serve unknown site, got %v", code)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(root, "config/sites/bar/site.yaml"),
+		[]byte(`hosts: ["bar.example.com"]`), 0600)
+	if err != nil {
+		t.Fatalf("Could not write site settings: %v", err)
+	}
+	if err := monsti.reloadSites(); err != nil {
+		t.Fatalf("Could not reload sites: %v", err)
+	}
+	if code, body := get("bar.example.com", "/site-static/bar.txt"); code != 200 ||
+		body != "bar" {
+		t.Errorf("Should serve bar.txt of new site, got %v %q", code, body)
+	}
+	if site, ok := handler.siteOf("bar.example.com"); !ok || site != "bar" {
+		t.Errorf("siteOf(bar.example.com) = %v, %v", site, ok)
+	}
+	if names := settings.SiteNames(); len(names) != 2 {
+		t.Errorf("SiteNames() = %v, should contain two sites", names)
+	}
+
+	// Conflicting hosts keep the old sites.
+	err = ioutil.WriteFile(filepath.Join(root, "config/sites/bar/site.yaml"),
+		[]byte(`hosts: ["foo.example.com"]`), 0600)
+	if err != nil {
+		t.Fatalf("Could not write site settings: %v", err)
+	}
+	if err := monsti.reloadSites(); err == nil {
+		t.Errorf("reloadSites should fail for conflicting hosts")
+	}
+	if site, ok := handler.siteOf("bar.example.com"); !ok || site != "bar" {
+		t.Errorf("Failed reload should keep sites, got %v, %v", site, ok)
+	}
+
+	// Sites that can't be loaded get removed again.
+	err = monsti.CreateSite(&service.NewSite{Name: "baz", Template: "foo",
+		Hosts: []string{"baz.example.com"}}, nil)
+	if err == nil {
+		t.Errorf("CreateSite should fail if sites can't be reloaded")
+	}
+	for _, dir := range []string{"config/sites/baz", "data/baz"} {
+		if _, err := os.Stat(filepath.Join(root, dir)); !os.IsNotExist(err) {
+			t.Errorf("Failed CreateSite should remove %v", dir)
+		}
+	}
+}
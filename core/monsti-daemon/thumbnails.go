@@ -0,0 +1,126 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// thumbnailQueueSize is the maximum number of images waiting for their
+// thumbnails.
+const thumbnailQueueSize = 256
+
+// thumbnailJob requests the thumbnails of a node.
+type thumbnailJob struct {
+	Site, Path string
+}
+
+// thumbnailPool generates thumbnails in the background using a fixed
+// number of workers.
+type thumbnailPool struct {
+	// Log is used to log failed jobs.
+	Log      *log.Logger
+	generate func(thumbnailJob) error
+	jobs     chan thumbnailJob
+	mutex    sync.Mutex
+	// pending contains the queued jobs.
+	pending map[thumbnailJob]bool
+}
+
+// newThumbnailPool starts the given number of workers calling generate
+// for added jobs.
+func newThumbnailPool(workers int, generate func(thumbnailJob) error,
+	logger *log.Logger) *thumbnailPool {
+	p := &thumbnailPool{
+		Log:      logger,
+		generate: generate,
+		jobs:     make(chan thumbnailJob, thumbnailQueueSize),
+		pending:  make(map[thumbnailJob]bool),
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Add queues the job unless it's already waiting.
+//
+// Jobs are dropped if the queue is full. The thumbnails will then be
+// generated on request.
+func (p *thumbnailPool) Add(job thumbnailJob) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.pending[job] {
+		return
+	}
+	select {
+	case p.jobs <- job:
+		p.pending[job] = true
+	default:
+		p.Log.Printf("Thumbnail queue is full, dropping %v of site %v",
+			job.Path, job.Site)
+	}
+}
+
+// work runs queued jobs.
+func (p *thumbnailPool) work() {
+	for job := range p.jobs {
+		p.mutex.Lock()
+		delete(p.pending, job)
+		p.mutex.Unlock()
+		if err := p.generate(job); err != nil {
+			p.Log.Printf("Could not generate thumbnails of %v of site %v: %v",
+				job.Path, job.Site, err)
+		}
+	}
+}
+
+// generateThumbnails generates all configured sizes of the site for the
+// given node if it's an image.
+//
+// Sizes which are already cached are skipped. Resized versions of
+// replaced images don't stay in the cache, see cachedImage.
+func generateThumbnails(m *service.MonstiClient, job thumbnailJob) error {
+	node, err := m.GetNode(job.Site, job.Path)
+	if err != nil {
+		return fmt.Errorf("Could not get node: %v", err)
+	}
+	if node == nil || node.Type.Id != "core.Image" {
+		return nil
+	}
+	sizes, err := getImageSizes(m, job.Site)
+	if err != nil {
+		return err
+	}
+	for name := range sizes {
+		size, ok, err := getImageSize(m, job.Site, name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if _, err := cachedImage(m, job.Site, node, size); err != nil {
+			return fmt.Errorf("Could not generate size %q: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/rpc"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestThumbnailPool(t *testing.T) {
+	var mutex sync.Mutex
+	var done sync.WaitGroup
+	started := make(chan bool)
+	release := make(chan bool)
+	var generated []thumbnailJob
+	pool := newThumbnailPool(1, func(job thumbnailJob) error {
+		started <- true
+		<-release
+		mutex.Lock()
+		generated = append(generated, job)
+		mutex.Unlock()
+		done.Done()
+		return nil
+	}, log.New(ioutil.Discard, "", 0))
+	first := thumbnailJob{"site", "/first"}
+	second := thumbnailJob{"site", "/second"}
+	done.Add(3)
+	pool.Add(first)
+	<-started
+	// Jobs may be queued again while running, but only once while
+	// waiting.
+	pool.Add(first)
+	pool.Add(second)
+	pool.Add(second)
+	close(release)
+	<-started
+	<-started
+	done.Wait()
+	if len(generated) != 3 || generated[0] != first || generated[1] != first ||
+		generated[2] != second {
+		t.Errorf("Generated %v, should be [first first second]", generated)
+	}
+}
+
+func TestGenerateThumbnails(t *testing.T) {
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 40, 20))); err != nil {
+		t.Fatalf("Could not encode test image: %v", err)
+	}
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/site/nodes/img/node.json":         `{"Type":"core.Image"}`,
+		"/data/site/nodes/img/__file_core.File":  img.String(),
+		"/data/site/nodes/file/node.json":        `{"Type":"core.File"}`,
+		"/data/site/nodes/file/__file_core.File": "not an image",
+		"/config/sites/site/core.json": `{"image": {"sizes": {
+  "small": {"Width": 10, "Height": 10},
+  "square": {"Width": 10, "Height": 10, "Mode": "fill"}}}}`},
+		"TestGenerateThumbnails")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	settings := new(settings)
+	settings.Monsti.Directories.Data = filepath.Join(root, "data")
+	settings.Monsti.Directories.Config = filepath.Join(root, "config")
+	fileField := &service.NodeField{Id: "core.File", Type: "File"}
+	settings.Config.NodeTypes = map[string]*service.NodeType{
+		"core.Image": {Id: "core.Image", Fields: []*service.NodeField{fileField}},
+		"core.File":  {Id: "core.File", Fields: []*service.NodeField{fileField}},
+	}
+	server := rpc.NewServer()
+	if err := server.RegisterName("Monsti", &MonstiService{
+		Settings: settings, Logger: log.New(ioutil.Discard, "", 0)}); err != nil {
+		t.Fatalf("Could not register service: %v", err)
+	}
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	client := new(service.MonstiClient)
+	client.RPCClient = rpc.NewClient(clientConn)
+	defer client.RPCClient.Close()
+
+	for _, nodePath := range []string{"/img", "/file"} {
+		if err := generateThumbnails(client, thumbnailJob{"site", nodePath}); err != nil {
+			t.Errorf("generateThumbnails(%v) returns error: %v", nodePath, err)
+		}
+	}
+	for _, size := range []imageSize{{10, 10, "", 0}, {10, 10, "fill", 0}} {
+		data, _, err := client.FromCache("site", "/img", imageCacheId(size))
+		if err != nil || data == nil {
+			t.Errorf("Size %v should have been cached, got %v", size, err)
+			continue
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil || config.Width != 10 {
+			t.Errorf("Cached size %v is wrong: %v, %v", size, config, err)
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(root, "data/site/cache/file/.data/*"))
+	if len(files) > 0 {
+		t.Errorf("Files should not get thumbnails, got %v", files)
+	}
+}
+
+func TestImageDataWritten(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/site/nodes/img/node.json":  `{"Type":"core.Image"}`,
+		"/data/site/nodes/file/node.json": `{"Type":"core.File"}`},
+		"TestImageDataWritten")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	settings := new(settings)
+	settings.Monsti.Directories.Data = filepath.Join(root, "data")
+	jobs := make(chan thumbnailJob, 10)
+	m := &MonstiService{Settings: settings,
+		Thumbnails: &thumbnailPool{jobs: jobs,
+			pending: make(map[thumbnailJob]bool)}}
+	err = m.ToCache(&ToCacheArgs{Site: "site", Node: "/img",
+		Id: "core.image.thumbnail.10x10", Content: []byte("old"),
+		Mods: &service.CacheMods{Deps: []service.CacheDep{{Node: "/img"}}}},
+		new(int))
+	if err != nil {
+		t.Fatalf("Could not cache data: %v", err)
+	}
+	// Marking nodes and writing other files does not generate thumbnails.
+	err = m.MarkDep(&MarkDepArgs{"site", service.CacheDep{Node: "/file"}},
+		new(int))
+	if err != nil {
+		t.Fatalf("Could not mark node: %v", err)
+	}
+	for _, write := range []WriteNodeDataArgs{
+		{Site: "site", Path: "/img", File: "node.json",
+			Content: []byte(`{"Type":"core.Image"}`)},
+		{Site: "site", Path: "/file", File: "__file_core.File",
+			Content: []byte("file")},
+		{Site: "site", Path: "/img", File: "__file_core.File",
+			Content: []byte("image")},
+	} {
+		if err := m.WriteNodeData(&write, new(int)); err != nil {
+			t.Fatalf("Could not write %v: %v", write.File, err)
+		}
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("Only writing the image should queue a job, got %v", len(jobs))
+	}
+	if job := <-jobs; job != (thumbnailJob{"site", "/img"}) {
+		t.Errorf("Wrong job %v", job)
+	}
+	var ret FromCacheRet
+	err = m.FromCache(&FromCacheArgs{Site: "site", Node: "/img",
+		Id: "core.image.thumbnail.10x10"}, &ret)
+	if err != nil || ret.Data != nil {
+		t.Errorf("Thumbnails of the old image should be removed, got %q, %v",
+			ret.Data, err)
+	}
+}
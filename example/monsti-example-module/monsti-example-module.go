@@ -18,6 +18,8 @@ package main
 
 import (
 	"fmt"
+	"html/template"
+	"regexp"
 
 	"pkg.monsti.org/monsti/api/service"
 	"pkg.monsti.org/monsti/api/util"
@@ -26,10 +28,69 @@ import (
 
 var availableLocales = []string{"de", "en"}
 
+// ColorField is an example field type holding a color like "#ff0000".
+type ColorField string
+
+func (t ColorField) RenderHTML() interface{} {
+	if !colorRegexp.MatchString(string(t)) {
+		return ""
+	}
+	color := template.HTMLEscapeString(string(t))
+	return template.HTML(fmt.Sprintf(
+		`<span style="background-color: %v">&nbsp;&nbsp;&nbsp;</span> %v`,
+		color, color))
+}
+
+// Load loads the stored color. Invalid values are dropped as they may
+// have been written without SetFormValue.
+func (t *ColorField) Load(f func(interface{}) error) error {
+	var value string
+	if err := f(&value); err != nil {
+		return err
+	}
+	*t = ""
+	if colorRegexp.MatchString(value) {
+		*t = ColorField(value)
+	}
+	return nil
+}
+
+func (t ColorField) Dump() interface{} {
+	return string(t)
+}
+
+func (t ColorField) FormValue(field *service.NodeField, locale string) (
+	string, bool) {
+	return string(t), false
+}
+
+var colorRegexp = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+func (t *ColorField) SetFormValue(value string, field *service.NodeField,
+	locale string) string {
+	if !colorRegexp.MatchString(value) {
+		return "Please enter a color like #ff0000."
+	}
+	*t = ColorField(value)
+	return ""
+}
+
 func setup(c *module.ModuleContext) error {
 	G := func(in string) string { return in }
 	m := c.Session.Monsti()
 
+	// Register a new field type. Rendering and editing is delegated to
+	// this module using the field type handler.
+	if err := m.RegisterFieldType("example.Color"); err != nil {
+		c.Logger.Fatalf("Could not register field type: %v", err)
+	}
+	handler := service.NewFieldTypeHandler(map[string]func() service.ModuleField{
+		"example.Color": func() service.ModuleField { return new(ColorField) },
+	})
+	if err := m.AddSignalHandler(handler); err != nil {
+		c.Logger.Fatalf("Could not add field type handler: %v", err)
+	}
+
 	// Register a new node type
 	nodeType := service.NodeType{
 		Id:        "example.ExampleType",
@@ -50,6 +111,11 @@ func setup(c *module.ModuleContext) error {
 				Name: util.GenLanguageMap(G("Bar"), availableLocales),
 				Type: "DateTime",
 			},
+			{
+				Id:   "example.Color",
+				Name: util.GenLanguageMap(G("Color"), availableLocales),
+				Type: "example.Color",
+			},
 		},
 	}
 	if err := m.RegisterNodeType(&nodeType); err != nil {
@@ -57,7 +123,7 @@ func setup(c *module.ModuleContext) error {
 	}
 
 	// Add a signal handler
-	handler := service.NewNodeContextHandler(
+	handler = service.NewNodeContextHandler(
 		func(id uint, nodeType string, embedNode *service.EmbedNode) (
 			map[string][]byte, *service.CacheMods, error) {
 			session, err := c.Sessions.New()
@@ -80,6 +146,23 @@ func setup(c *module.ModuleContext) error {
 		c.Logger.Fatalf("Could not add signal handler: %v", err)
 	}
 
+	// Run a job every hour. The scheduler sends it to this module using
+	// the job handler.
+	handler = service.NewJobHandler(map[string]func(*service.Job) error{
+		"example.Report": func(job *service.Job) error {
+			c.Logger.Printf("Running job %q, last run: %v", job.Id, job.LastRun)
+			return nil
+		},
+	})
+	if err := m.AddSignalHandler(handler); err != nil {
+		c.Logger.Fatalf("Could not add job handler: %v", err)
+	}
+	err := m.ScheduleJob(&service.Job{
+		Id: "example.Report", Type: "example.Report", Schedule: "@hourly"})
+	if err != nil {
+		c.Logger.Fatalf("Could not schedule job: %v", err)
+	}
+
 	return nil
 }
 
@@ -5,6 +5,22 @@
       plugins: "anchor autosave code hr image visualchars visualblocks table paste media link",
       tools: "inserttable",
       height: 300,
+      // Let the user pick images and files from the media library of
+      // the whole site.
+      file_browser_callback: function(fieldName, url, type, win) {
+        var assetType = type == "image" ? "image" : "";
+        tinymce.activeEditor.windowManager.open({
+          title: "Media",
+          url: "/@@media?picker=1&type=" + assetType,
+          width: 800,
+          height: 500
+        }, {
+          oninsert: function(url) {
+            win.document.getElementById(fieldName).value = url;
+          }
+        });
+        return false;
+      }
     });
   });
 })();
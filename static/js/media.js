@@ -0,0 +1,54 @@
+(function() {
+  // upload sends the given files to the media library and reloads the
+  // page to show them.
+  function upload(form, files) {
+    var data = new FormData();
+    for (var i = 0; i < files.length; i++) {
+      data.append("Files", files[i]);
+    }
+    var status = form.find(".media-upload-status");
+    $.ajax({
+      url: form.attr("action"),
+      type: "POST",
+      data: data,
+      processData: false,
+      contentType: false,
+      dataType: "json",
+      headers: {"X-Requested-With": "XMLHttpRequest"}
+    }).done(function(ret) {
+      if (ret.Errors && ret.Errors.length > 0) {
+        status.empty();
+        $.each(ret.Errors, function(i, msg) {
+          status.append($("<li class='error'>").text(msg));
+        });
+        return;
+      }
+      window.location.reload();
+    }).fail(function(xhr) {
+      status.empty().append($("<li class='error'>").text(xhr.statusText));
+    });
+  }
+
+  $(document).ready(function () {
+    $(".media-upload").each(function() {
+      var form = $(this);
+      var zone = form.find(".media-drop-zone");
+      zone.on("dragover dragenter", function(e) {
+        e.preventDefault();
+        zone.addClass("dragover");
+      }).on("dragleave drop", function(e) {
+        e.preventDefault();
+        zone.removeClass("dragover");
+      }).on("drop", function(e) {
+        upload(form, e.originalEvent.dataTransfer.files);
+      });
+    });
+
+    // Pass the selected asset to the editor which opened the picker.
+    $(".media-picker .media-insert").click(function() {
+      var editor = top.tinymce.activeEditor;
+      editor.windowManager.getParams().oninsert($(this).data("url"));
+      editor.windowManager.close();
+    });
+  });
+})();
@@ -0,0 +1,111 @@
+// Tool to inspect, purge, and warm the cache of a running Monsti
+// instance.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %v [options] <config_directory> <site> <command>
+
+Commands:
+  list   List cache entries with size, age, expiry, and dependencies.
+  purge  Remove cache entries.
+  warm   Fill the cache by requesting all published nodes.
+
+Options:
+`, filepath.Base(os.Args[0]))
+	flag.PrintDefaults()
+}
+
+func error(args ...interface{}) {
+	fmt.Fprintln(os.Stderr, args...)
+	os.Exit(1)
+}
+
+func main() {
+	var filter service.CacheFilter
+	flag.StringVar(&filter.Node, "node", "/", "select entries of this node")
+	flag.BoolVar(&filter.Descend, "r", false,
+		"select entries of all nodes below, too")
+	flag.StringVar(&filter.Pattern, "id", "",
+		"select entries whose ids match this shell pattern")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 3 {
+		usage()
+		os.Exit(2)
+	}
+	settings, err := util.LoadMonstiSettings(util.GetConfigPath(flag.Arg(0)))
+	if err != nil {
+		error("Could not load settings:", err)
+	}
+	site := flag.Arg(1)
+	sessions := service.NewSessionPool(1,
+		settings.GetServicePath(service.MonstiService.String()))
+	session, err := sessions.New()
+	if err != nil {
+		error("Could not connect to Monsti:", err)
+	}
+	defer sessions.Free(session)
+	m := session.Monsti()
+
+	switch flag.Arg(2) {
+	case "list":
+		entries, err := m.GetCacheEntries(site, &filter)
+		if err != nil {
+			error("Could not get cache entries:", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NODE\tID\tSIZE\tAGE\tEXPIRES\tDEPENDENCIES")
+		for _, entry := range entries {
+			expire := "-"
+			if !entry.Expire.IsZero() {
+				expire = entry.Expire.Format(time.RFC3339)
+				if entry.Expired() {
+					expire += " (expired)"
+				}
+			}
+			var deps string
+			for i, dep := range entry.Deps {
+				if i > 0 {
+					deps += ", "
+				}
+				deps += dep.Node
+				if len(dep.Cache) > 0 {
+					deps += "#" + dep.Cache
+				}
+				if dep.Descend != 0 {
+					deps += fmt.Sprintf("[%v]", dep.Descend)
+				}
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", entry.Node, entry.Id,
+				entry.Size, entry.Age()/time.Second*time.Second, expire, deps)
+		}
+		w.Flush()
+	case "purge":
+		removed, err := m.PurgeCache(site, &filter)
+		if err != nil {
+			error("Could not purge cache:", err)
+		}
+		fmt.Printf("Removed %v cache entries.\n", removed)
+	case "warm":
+		warmed, err := m.WarmCache(site)
+		if err != nil {
+			error("Could not warm cache:", err)
+		}
+		fmt.Printf("Requested %v pages.\n", warmed)
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,57 @@
+// Tool to export a site of a running Monsti instance as static files.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %v <config_directory> <site> <target_directory>
+
+Renders all published nodes of the site along with files, images, and
+static files into the target directory. Links get rewritten so that
+the exported site can be served by any web server.
+`, filepath.Base(os.Args[0]))
+}
+
+func error(args ...interface{}) {
+	fmt.Fprintln(os.Stderr, args...)
+	os.Exit(1)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 3 {
+		usage()
+		os.Exit(2)
+	}
+	settings, err := util.LoadMonstiSettings(util.GetConfigPath(flag.Arg(0)))
+	if err != nil {
+		error("Could not load settings:", err)
+	}
+	// The export gets written by the Monsti daemon, which probably
+	// runs in a different working directory.
+	dir, err := filepath.Abs(flag.Arg(2))
+	if err != nil {
+		error("Could not get target directory:", err)
+	}
+	sessions := service.NewSessionPool(1,
+		settings.GetServicePath(service.MonstiService.String()))
+	session, err := sessions.New()
+	if err != nil {
+		error("Could not connect to Monsti:", err)
+	}
+	defer sessions.Free(session)
+	exported, err := session.Monsti().ExportSite(flag.Arg(1), dir)
+	if err != nil {
+		error("Could not export site:", err)
+	}
+	fmt.Printf("Exported %v files to %v.\n", exported, dir)
+}
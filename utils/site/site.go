@@ -0,0 +1,96 @@
+// Tool to reload and create sites of a running Monsti instance.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.google.com/p/go.crypto/bcrypt"
+	"code.google.com/p/gopass"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %v [options] <config_directory> <command>
+
+Commands:
+  reload                              Reload the site settings.
+  create <site> <template> <host>...  Create a new site as a copy of
+                                      the template site.
+
+Options:
+`, filepath.Base(os.Args[0]))
+	flag.PrintDefaults()
+}
+
+func error(args ...interface{}) {
+	fmt.Fprintln(os.Stderr, args...)
+	os.Exit(1)
+}
+
+func main() {
+	var site service.NewSite
+	flag.StringVar(&site.Title, "title", "", "title of the new site")
+	flag.StringVar(&site.BaseURL, "baseurl", "", "base URL of the new site")
+	admin := flag.String("admin", "", "login of the new site's initial user")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 2 {
+		usage()
+		os.Exit(2)
+	}
+	settings, err := util.LoadMonstiSettings(util.GetConfigPath(flag.Arg(0)))
+	if err != nil {
+		error("Could not load settings:", err)
+	}
+	sessions := service.NewSessionPool(1,
+		settings.GetServicePath(service.MonstiService.String()))
+	session, err := sessions.New()
+	if err != nil {
+		error("Could not connect to Monsti:", err)
+	}
+	defer sessions.Free(session)
+	m := session.Monsti()
+
+	switch flag.Arg(1) {
+	case "reload":
+		if flag.NArg() != 2 {
+			usage()
+			os.Exit(2)
+		}
+		if err := m.ReloadSites(); err != nil {
+			error("Could not reload sites:", err)
+		}
+		fmt.Println("Reloaded sites.")
+	case "create":
+		if flag.NArg() < 5 {
+			usage()
+			os.Exit(2)
+		}
+		site.Name, site.Template = flag.Arg(2), flag.Arg(3)
+		site.Hosts = flag.Args()[4:]
+		if len(*admin) > 0 {
+			password, err := gopass.GetPass("Password of " + *admin + ": ")
+			if err != nil {
+				error("Could not read password:", err)
+			}
+			hash, err := bcrypt.GenerateFromPassword([]byte(password), 0)
+			if err != nil {
+				error("Could not hash password:", err)
+			}
+			site.User = &service.User{Login: *admin, Name: *admin,
+				Password: string(hash), PasswordChanged: time.Now()}
+		}
+		if err := m.CreateSite(&site); err != nil {
+			error("Could not create site:", err)
+		}
+		fmt.Printf("Created site %v.\n", site.Name)
+	default:
+		usage()
+		os.Exit(2)
+	}
+}